@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"dfs/comm"
+	s "dfs/server"
+	"dfs/server/lock"
+	"dfs/server/meta"
+	mp "dfs/server/multipart"
+	sp "dfs/server/path"
+	"dfs/server/raft"
+	"dfs/server/replication"
+	rs "dfs/server/resumable"
+	st "dfs/server/token"
+	u "dfs/util"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	APIURL          = "/api/v1/"
+	APIUploadsURL   = "/api/v1/uploads/"
+	APIDownloadsURL = "/api/v1/downloads/"
+	APIObjectsURL   = "/api/v1/objects/"
+	APIBucketsURL   = "/api/v1/buckets/"
+	APIStatusURL    = "/api/v1/status"
+)
+
+var (
+	ErrorNotFound         = errors.New("Not found.")
+	ErrorMethodNotAllowed = errors.New("Method not allowed.")
+	ErrorUnauthorized     = errors.New("Unauthorized.")
+	ErrorBadRequestBody   = errors.New("Request body is malformed.")
+)
+
+//apiErrorKind is the HTTP status and the code clients tell the error by
+type apiErrorKind struct {
+	Status int
+	Code   string
+}
+
+//apiErrors maps errors of the cluster to their kinds, errors missing here are internal ones
+var apiErrors = map[error]apiErrorKind{
+	u.ErrorBadQuery:                {400, "BadQuery"},
+	meta.ErrorBadContinuationToken: {400, "BadContinuationToken"},
+	st.ErrorTTLTooLong:             {400, "TTLTooLong"},
+	st.ErrorTooManyUses:            {400, "TooManyUses"},
+	st.ErrorMethodIsNotAllowed:     {400, "MethodIsNotAllowed"},
+	st.ErrorMaxSizeTooLarge:        {400, "MaxSizeTooLarge"},
+	ErrorTusUploadLength:           {400, "BadUploadLength"},
+	ErrorTusUploadOffset:           {400, "BadUploadOffset"},
+	ErrorTusMetadataMalformed:      {400, "BadUploadMetadata"},
+	ErrorBadRequestBody:            {400, "BadRequestBody"},
+	s.ErrorReservedFileName:        {400, "ReservedFileName"},
+	mp.ErrorInvalidPartNumber:      {400, "InvalidPartNumber"},
+	mp.ErrorInvalidPart:            {400, "InvalidPart"},
+	mp.ErrorInvalidPartOrder:       {400, "InvalidPartOrder"},
+	mp.ErrorNoPartsListed:          {400, "NoPartsListed"},
+
+	ErrorUnauthorized: {401, "Unauthorized"},
+
+	st.ErrorTokenIsMalformed:    {403, "TokenIsInvalid"},
+	st.ErrorTokenKeyIsUnknown:   {403, "TokenIsInvalid"},
+	st.ErrorTokenSignature:      {403, "TokenIsInvalid"},
+	st.ErrorTokenType:           {403, "TokenIsInvalid"},
+	st.ErrorTokenForAnotherNode: {403, "TokenForAnotherNode"},
+	st.ErrorTokenExpired:        {403, "TokenExpired"},
+	st.ErrorTokenUsedUp:         {403, "TokenUsedUp"},
+	st.ErrorTokenForAnotherIP:   {403, "TokenForAnotherIP"},
+	st.ErrorTokenMethod:         {403, "TokenMethod"},
+	st.ErrorTokenContentType:    {403, "TokenContentType"},
+	st.ErrorTokenForAnotherPath: {403, "TokenForAnotherPath"},
+
+	ErrorNotFound:                {404, "NotFound"},
+	s.ErrorFileDoesNotExist:      {404, "FileDoesNotExist"},
+	meta.ErrorBucketDoesNotExist: {404, "BucketDoesNotExist"},
+	rs.ErrorUploadDoesNotExist:   {404, "UploadDoesNotExist"},
+	mp.ErrorUploadDoesNotExist:   {404, "UploadDoesNotExist"},
+
+	ErrorMethodNotAllowed: {405, "MethodNotAllowed"},
+
+	ErrorTusVersion: {412, "TusVersionNotSupported"},
+
+	s.ErrorFileAlreadyExists:       {409, "FileAlreadyExists"},
+	s.ErrorPathConflict:            {409, "PathConflict"},
+	s.ErrorPathIsNotLocked:         {409, "PathIsNotLocked"},
+	sp.ErrorUploadIsUnknown:        {409, "UploadIsUnknown"},
+	meta.ErrorStaleFencingToken:    {409, "StaleFencingToken"},
+	meta.ErrorBucketAlreadyExists:  {409, "BucketAlreadyExists"},
+	meta.ErrorBucketIsNotEmpty:     {409, "BucketIsNotEmpty"},
+	rs.ErrorOffsetMismatch:         {409, "OffsetMismatch"},
+	mp.ErrorUploadOnAnotherNode:    {409, "UploadOnAnotherNode"},
+	mp.ErrorPartChecksumMismatch:   {409, "PartChecksumMismatch"},
+	replication.ErrorFileIsDeleted: {409, "FileIsDeleted"},
+
+	s.ErrorFileTooLarge:          {413, "FileTooLarge"},
+	rs.ErrorUploadLengthExceeded: {413, "UploadLengthExceeded"},
+	mp.ErrorPartIsTooLarge:       {413, "PartIsTooLarge"},
+
+	s.ErrorPathIsLocked:        {423, "PathIsLocked"},
+	sp.ErrorPathIsLocked:       {423, "PathIsLocked"},
+	lock.ErrorResourceIsLocked: {423, "ResourceIsLocked"},
+	lock.ErrorLeaseExpired:     {423, "LeaseExpired"},
+	rs.ErrorUploadIsBusy:       {423, "UploadIsBusy"},
+	mp.ErrorUploadIsCompleting: {423, "UploadIsCompleting"},
+
+	ErrorTusContentType: {415, "UnsupportedMediaType"},
+
+	s.ErrorNoNodeAvailable:   {503, "NoNodeAvailable"},
+	raft.ErrorNoLeader:       {503, "QuorumLost"},
+	raft.ErrorLeadershipLost: {503, "QuorumLost"},
+	raft.ErrorNoQuorum:       {503, "QuorumLost"},
+	comm.ErrorRequestTimeout: {503, "QuorumLost"},
+	comm.ErrorNodeIsDead:     {503, "NodeIsDead"},
+	//Waits for the cluster are bounded by the request context
+	context.DeadlineExceeded: {503, "Timeout"},
+	context.Canceled:         {409, "Canceled"},
+}
+
+//errorBody tells what failed, Code is one of the codes of apiErrors
+type errorBody struct {
+	Code    string
+	Message string
+}
+
+//apiError is the body of failed API responses
+type apiError struct {
+	Error errorBody
+}
+
+//errorKind returns the kind of the error or of the error it wraps
+func errorKind(err error) apiErrorKind {
+	if kind, exists := apiErrors[err]; exists {
+		return kind
+	}
+	for known, kind := range apiErrors {
+		if errors.Is(err, known) {
+			return kind
+		}
+	}
+	return apiErrorKind{500, "InternalError"}
+}
+
+//wantsJSON reports whether the client prefers JSON to HTML by the Accept header
+func wantsJSON(request *http.Request) bool {
+	jsonQuality, htmlQuality := 0.0, 0.0
+	for _, mediaRange := range strings.Split(request.Header.Get("Accept"), ",") {
+		params := strings.Split(mediaRange, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch strings.TrimSpace(params[0]) {
+		case "application/json":
+			jsonQuality = quality
+		case "text/html":
+			htmlQuality = quality
+		}
+	}
+	return jsonQuality > 0 && jsonQuality > htmlQuality
+}
+
+func writeJSON(response http.ResponseWriter, status int, value interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	enc := json.NewEncoder(response)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+}
+
+//writeJSONError responds with the status of the error and its code
+func writeJSONError(response http.ResponseWriter, err error) {
+	kind := errorKind(err)
+	writeJSON(response, kind.Status, apiError{errorBody{kind.Code, err.Error()}})
+}
+
+//writeError responds with the error as JSON or as plain text depending on what the client accepts
+func writeError(response http.ResponseWriter, request *http.Request, err error) {
+	if wantsJSON(request) {
+		writeJSONError(response, err)
+		return
+	}
+	http.Error(response, err.Error(), errorKind(err).Status)
+}
+
+//transferLink is the signed link to upload or download the file.
+//Requests must use Method, set Headers and send no more than MaxSize bytes, if it is not 0.
+type transferLink struct {
+	URL     string
+	Address string
+	Token   string
+	Method  string
+	Headers map[string]string `json:",omitempty"`
+	MaxSize int64             `json:",omitempty"`
+	Expires time.Time
+	//Resumable and Multipart are where upload with the token is created by the tus protocol
+	//or as multipart upload instead, if the token allows POST
+	Resumable string `json:",omitempty"`
+	Multipart string `json:",omitempty"`
+}
+
+//newTransferLink describes the link token is used with on the node at address.
+//Method is the preferred one, the first method of the token is taken if the token does not allow it.
+func newTransferLink(address, token, handlerURL, method string) (transferLink, error) {
+	tokenInfo, err := server.InspectToken(token)
+	if err != nil {
+		return transferLink{}, err
+	}
+
+	//Methods asked for by the query may not include the preferred one
+	allowed := len(tokenInfo.Methods) == 0
+	resumable := len(tokenInfo.Methods) == 0
+	for _, tokenMethod := range tokenInfo.Methods {
+		allowed = allowed || tokenMethod == method
+		resumable = resumable || tokenMethod == http.MethodPost
+	}
+	if !allowed {
+		method = tokenInfo.Methods[0]
+	}
+
+	link := transferLink{
+		URL:     "http://" + address + handlerURL + token,
+		Address: address,
+		Token:   token,
+		Method:  method,
+		Expires: tokenInfo.ExpireTime,
+	}
+	if tokenInfo.Type == "upload" {
+		link.MaxSize = tokenInfo.MaxSize
+		if resumable {
+			link.Resumable = tusLink(address, token)
+			link.Multipart = "http://" + address + MultipartURL + token
+		}
+		if tokenInfo.ContentType != "" {
+			link.Headers = map[string]string{"Content-Type": tokenInfo.ContentType}
+		}
+	}
+	return link, nil
+}
+
+//deleteResult lists nodes the file was deleted on and the ones that failed to delete it
+type deleteResult struct {
+	Deleted []string
+	Failed  map[string]string `json:",omitempty"`
+}
+
+//extractMaxKeys returns max-keys query parameter or 0 if it is not set
+func extractMaxKeys(request *http.Request) (int, error) {
+	value := request.URL.Query().Get("max-keys")
+	if value == "" {
+		return 0, nil
+	}
+	maxKeys, err := strconv.Atoi(value)
+	if err != nil || maxKeys <= 0 {
+		return 0, u.ErrorBadQuery
+	}
+	return maxKeys, nil
+}
+
+//apiNotFound answers requests to unknown API endpoints
+func apiNotFound(response http.ResponseWriter, request *http.Request) {
+	writeJSONError(response, ErrorNotFound)
+}
+
+//apiMethodNotAllowed answers requests with methods the endpoint does not serve
+func apiMethodNotAllowed(response http.ResponseWriter, allow string) {
+	response.Header().Set("Allow", allow)
+	writeJSONError(response, ErrorMethodNotAllowed)
+}
+
+//apiUploads reserves the file on POST and returns the link to upload it with.
+//Token options are taken from the query like for /request_upload/.
+func apiUploads(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		apiMethodNotAllowed(response, "POST")
+		return
+	}
+	bucketName, fileName, err := u.ParseBucketNameFileName(strings.TrimPrefix(request.URL.Path, APIUploadsURL))
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	options, err := extractTokenOptions(request)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	address, token, err := server.RequestUpload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	link, err := newTransferLink(address, token, UploadURL, http.MethodPut)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	writeJSON(response, 201, link)
+}
+
+//apiDownloads returns the link to download the file with on POST.
+//Token options are taken from the query like for /request_download/.
+func apiDownloads(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		apiMethodNotAllowed(response, "POST")
+		return
+	}
+	bucketName, fileName, err := u.ParseBucketNameFileName(strings.TrimPrefix(request.URL.Path, APIDownloadsURL))
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	options, err := extractTokenOptions(request)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	address, token, err := server.RequestDownload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	link, err := newTransferLink(address, token, DownloadURL, http.MethodGet)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	writeJSON(response, 200, link)
+}
+
+//apiObjects serves /api/v1/objects/{bucket}/ listing the bucket on GET
+//and /api/v1/objects/{bucket}/{file} returning the file record on GET and deleting the file on DELETE
+func apiObjects(response http.ResponseWriter, request *http.Request) {
+	objectPath := strings.TrimPrefix(request.URL.Path, APIObjectsURL)
+	if strings.HasSuffix(objectPath, "/") || !strings.Contains(objectPath, "/") {
+		apiListObjects(response, request, objectPath)
+		return
+	}
+
+	bucketName, fileName, err := u.ParseBucketNameFileName(objectPath)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		object, err := server.Object(bucketName, fileName)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 200, object)
+
+	case http.MethodDelete:
+		if err = authorizeDelete(request, bucketName, fileName); err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		deleted, err := server.Delete(request.Context(), bucketName, fileName)
+		if deleteError, ok := err.(*replication.DeleteError); ok {
+			writeJSON(response, 500, struct {
+				deleteResult
+				Error errorBody
+			}{
+				deleteResult{deleted, deleteError.Failed},
+				errorBody{"DeleteFailed", deleteError.Error()},
+			})
+			return
+		}
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 200, deleteResult{Deleted: deleted})
+
+	default:
+		apiMethodNotAllowed(response, "GET, HEAD, DELETE")
+	}
+}
+
+func apiListObjects(response http.ResponseWriter, request *http.Request, bucketPath string) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		apiMethodNotAllowed(response, "GET, HEAD")
+		return
+	}
+	bucketName, err := u.ParseBucketName(bucketPath)
+	if err != nil || bucketName == "" {
+		writeJSONError(response, u.ErrorBadQuery)
+		return
+	}
+	maxKeys, err := extractMaxKeys(request)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	query := request.URL.Query()
+	listing, err := server.ListObjects(request.Context(), bucketName, query.Get("prefix"), query.Get("continuation-token"), maxKeys)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	writeJSON(response, 200, listing)
+}
+
+//apiBuckets lists buckets starting with prefix query parameter on GET
+func apiBuckets(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		apiMethodNotAllowed(response, "GET, HEAD")
+		return
+	}
+	if request.URL.Path != APIBucketsURL {
+		apiNotFound(response, request)
+		return
+	}
+	writeJSON(response, 200, struct {
+		Buckets []string
+	}{
+		server.ListBuckets(request.URL.Query().Get("prefix")),
+	})
+}
+
+func apiStatus(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		apiMethodNotAllowed(response, "GET, HEAD")
+		return
+	}
+	writeJSON(response, 200, server.Status())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"dfs/server/lock"
+	"dfs/server/replication"
+	st "dfs/server/token"
+	u "dfs/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		json   bool
+	}{
+		{accept: "", json: false},
+		{accept: "application/json", json: true},
+		{accept: "text/html", json: false},
+		{accept: "*/*", json: false},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", json: false},
+		{accept: "application/json, text/html", json: false},
+		{accept: "application/json;q=0.9, text/html;q=0.5", json: true},
+		{accept: "text/html;q=0.1, application/json", json: true},
+		{accept: "application/json;q=0", json: false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/list/", nil)
+		request.Header.Set("Accept", test.accept)
+		if json := wantsJSON(request); json != test.json {
+			t.Fatalf("%q: got JSON %v, want %v", test.accept, json, test.json)
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind apiErrorKind
+	}{
+		{name: "bad query", err: u.ErrorBadQuery, kind: apiErrorKind{400, "BadQuery"}},
+		{name: "expired token", err: st.ErrorTokenExpired, kind: apiErrorKind{403, "TokenExpired"}},
+		{name: "locked resource", err: lock.ErrorResourceIsLocked, kind: apiErrorKind{423, "ResourceIsLocked"}},
+		{name: "wrapped error", err: fmt.Errorf("replication of bucket/file to two failed: %w", replication.ErrorFileIsDeleted), kind: apiErrorKind{409, "FileIsDeleted"}},
+		{name: "wrapped known error", err: fmt.Errorf("waiting: %w", lock.ErrorLeaseExpired), kind: apiErrorKind{423, "LeaseExpired"}},
+		{name: "deadline", err: context.DeadlineExceeded, kind: apiErrorKind{503, "Timeout"}},
+		{name: "wrapped deadline", err: fmt.Errorf("proposal: %w", context.DeadlineExceeded), kind: apiErrorKind{503, "Timeout"}},
+		{name: "canceled", err: context.Canceled, kind: apiErrorKind{409, "Canceled"}},
+		{name: "unknown", err: errors.New("Disk is full."), kind: apiErrorKind{500, "InternalError"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if kind := errorKind(test.err); kind != test.kind {
+				t.Fatalf("got %+v, want %+v", kind, test.kind)
+			}
+		})
+	}
+}
+
+//TestErrorStatuses checks that every error of the table is told apart by its status and code
+func TestErrorStatuses(t *testing.T) {
+	for err, kind := range apiErrors {
+		if kind.Status < 400 || kind.Status > 599 || kind.Code == "" {
+			t.Fatalf("error %v has kind %+v", err, kind)
+		}
+		if got := errorKind(fmt.Errorf("wrapped: %w", err)); got != kind {
+			t.Fatalf("got %+v of wrapped %v, want %+v", got, err, kind)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{name: "plain text", accept: "text/html", contentType: "text/plain", body: st.ErrorTokenExpired.Error() + "\n"},
+		{name: "JSON", accept: "application/json", contentType: "application/json", body: `"Code": "TokenExpired"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/download/token", nil)
+			request.Header.Set("Accept", test.accept)
+			response := httptest.NewRecorder()
+			writeError(response, request, st.ErrorTokenExpired)
+
+			if response.Code != 403 {
+				t.Fatalf("got status %d, want 403", response.Code)
+			}
+			if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+				t.Fatalf("got content type %s, want %s", contentType, test.contentType)
+			}
+			if !strings.Contains(response.Body.String(), test.body) {
+				t.Fatalf("got body %s, want %s", response.Body.String(), test.body)
+			}
+			if test.contentType == "application/json" {
+				var body apiError
+				if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Error.Message != st.ErrorTokenExpired.Error() {
+					t.Fatalf("got body %+v, %v", body, err)
+				}
+			}
+		})
+	}
+}
@@ -9,51 +9,86 @@ type MessageType int8
 
 const (
 	MessageTypeStatus MessageType = iota
-	MessageTypeRequestUploadToken
-	MessageTypeUploadToken
-	MessageTypeRequestDownloadToken
-	MessageTypeDownloadToken
-	MessageTypeRequestLock
-	MessageTypeGrantLockPermission
-	MessageTypeFile
-	MessageTypeFileReceived
-	MessageTypeLockPath
-	MessageTypeUnlockPath
-	MessageTypePathLocked
+	MessageTypeRequestFileOffset
+	MessageTypeFileOffset
+	MessageTypeFileChunk
+	MessageTypeFileChunkAck
+	MessageTypeCommitFile
+	MessageTypeFileCommitted
+	MessageTypeDeleteFile
+	MessageTypeFileDeleted
+	MessageTypeRequestVote
+	MessageTypeVote
+	MessageTypeAppendEntries
+	MessageTypeAppendEntriesResult
+	MessageTypeInstallSnapshot
+	MessageTypeSnapshotInstalled
+	MessageTypePropose
+	MessageTypeProposeResult
+	MessageTypeReadPart
+	MessageTypePartData
+	MessageTypeReadIndex
+	MessageTypeReadIndexResult
+	MessageTypeRemoveParts
 )
 
 func (mt MessageType) String() string {
 	switch mt {
 	case MessageTypeStatus:
 		return "MessageTypeStatus"
-	case MessageTypeRequestUploadToken:
-		return "MessageTypeRequestUploadToken"
-	case MessageTypeUploadToken:
-		return "MessageTypeUploadToken"
-	case MessageTypeRequestDownloadToken:
-		return "MessageTypeRequestDownloadToken"
-	case MessageTypeDownloadToken:
-		return "MessageTypeDownloadToken"
-	case MessageTypeRequestLock:
-		return "MessageTypeRequestLock"
-	case MessageTypeGrantLockPermission:
-		return "MessageTypeGrantLockPermission"
-	case MessageTypeFile:
-		return "MessageTypeFile"
-	case MessageTypeFileReceived:
-		return "MessageTypeFileReceived"
-	case MessageTypeLockPath:
-		return "MessageTypeLockPath"
-	case MessageTypeUnlockPath:
-		return "MessageTypeUnlockPath"
-	case MessageTypePathLocked:
-		return "MessageTypePathLocked"
+	case MessageTypeRequestFileOffset:
+		return "MessageTypeRequestFileOffset"
+	case MessageTypeFileOffset:
+		return "MessageTypeFileOffset"
+	case MessageTypeFileChunk:
+		return "MessageTypeFileChunk"
+	case MessageTypeFileChunkAck:
+		return "MessageTypeFileChunkAck"
+	case MessageTypeCommitFile:
+		return "MessageTypeCommitFile"
+	case MessageTypeFileCommitted:
+		return "MessageTypeFileCommitted"
+	case MessageTypeDeleteFile:
+		return "MessageTypeDeleteFile"
+	case MessageTypeFileDeleted:
+		return "MessageTypeFileDeleted"
+	case MessageTypeRequestVote:
+		return "MessageTypeRequestVote"
+	case MessageTypeVote:
+		return "MessageTypeVote"
+	case MessageTypeAppendEntries:
+		return "MessageTypeAppendEntries"
+	case MessageTypeAppendEntriesResult:
+		return "MessageTypeAppendEntriesResult"
+	case MessageTypeInstallSnapshot:
+		return "MessageTypeInstallSnapshot"
+	case MessageTypeSnapshotInstalled:
+		return "MessageTypeSnapshotInstalled"
+	case MessageTypePropose:
+		return "MessageTypePropose"
+	case MessageTypeProposeResult:
+		return "MessageTypeProposeResult"
+	case MessageTypeReadPart:
+		return "MessageTypeReadPart"
+	case MessageTypePartData:
+		return "MessageTypePartData"
+	case MessageTypeReadIndex:
+		return "MessageTypeReadIndex"
+	case MessageTypeReadIndexResult:
+		return "MessageTypeReadIndexResult"
+	case MessageTypeRemoveParts:
+		return "MessageTypeRemoveParts"
 	}
 	return "Unknown"
 }
 
+//Message is a single unit of communication between nodes.
+//ID is unique among messages sent by SourceNode,
+//InReplyTo holds ID of the request this message answers or zero.
 type Message struct {
 	Type       MessageType
+	ID         uint64
+	InReplyTo  uint64
 	SourceNode string
 	Data       []byte
 }
@@ -2,9 +2,23 @@
 package comm
 
 import (
+	"bufio"
+	"crypto/hmac"
+	c "dfs/config"
 	"dfs/server/node"
-	"encoding/gob"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dialTimeout      = 5 * time.Second
+	handshakeTimeout = 5 * time.Second
+	//frameTimeout bounds writing a frame and reading the rest of the frame once it started to arrive,
+	//so the node which stopped reading or writing does not block the other side
+	frameTimeout = 30 * time.Second
 )
 
 //MessageHandler is the interface that must be implemented to be able to subscribe to incoming messages
@@ -12,18 +26,61 @@ type MessageHandler interface {
 	HandleMessage(*Message)
 }
 
+//outConn is an established outgoing connection that already passed the handshake
+type outConn struct {
+	sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+//writeFrame writes the message to the connection within frameTimeout
+func (out *outConn) writeFrame(msg *Message) error {
+	out.conn.SetWriteDeadline(time.Now().Add(frameTimeout))
+	return writeFrame(out.w, msg)
+}
+
+//readFrameIn waits for the next frame as long as needed, the frame must arrive within frameTimeout once it started
+func readFrameIn(conn net.Conn, r *bufio.Reader) (*Message, error) {
+	_, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(frameTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return readFrame(r)
+}
+
 //MessageHub handles all the netwoking between nodes.
 //It provides methods to send messages, broadcast messages, subscribe to recive certain message types
 type MessageHub struct {
+	mutex           sync.Mutex
 	nodeManager     *node.NodeManager
 	messageHandlers map[MessageType][]MessageHandler
-	outConnMap      map[string]net.Conn
+	streamHandlers  map[MessageType]StreamHandler
+	peers           map[string]*peer
+	pendingRequests map[uint64]*pendingRequest
+	lastMessageID   uint64
+	config          *c.Config
+}
+
+func (msgHub *MessageHub) UseConfig(config *c.Config) {
+	msgHub.config = config
 }
 
-//Listen method starts listening for incoming connections and messages from other nodes
+//Listen method starts listening for incoming connections and messages from other nodes.
+//Only the configured nodes knowing the cluster secret are let in.
 func (msgHub *MessageHub) Listen(nodeManager *node.NodeManager, addr string) error {
-	msgHub.outConnMap = make(map[string]net.Conn, 0)
+	if msgHub.config.ClusterSecret == "" {
+		return ErrorNoClusterSecret
+	}
+	msgHub.mutex.Lock()
+	if msgHub.peers == nil {
+		msgHub.peers = make(map[string]*peer, 0)
+	}
+	msgHub.mutex.Unlock()
 	msgHub.nodeManager = nodeManager
+	msgHub.nodeManager.Watch(msgHub.nodeStateChanged)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
@@ -34,26 +91,97 @@ func (msgHub *MessageHub) Listen(nodeManager *node.NodeManager, addr string) err
 			if err != nil {
 				continue
 			}
-			go func() {
-				for {
-					msg := new(Message)
-					dec := gob.NewDecoder(conn)
-					err := dec.Decode(msg)
-					if err != nil {
-						break
-					}
-					for _, msgHandler := range msgHub.messageHandlers[msg.Type] {
-						msgHandler.HandleMessage(msg)
-					}
-				}
-			}()
+			go msgHub.serveConn(conn)
 		}
 	}()
 	return nil
 }
 
+//serveConn performs the handshake on an incoming connection and dispatches its frames
+func (msgHub *MessageHub) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	hs, err := readHandshake(r)
+	if err != nil {
+		log.Printf("comm: handshake from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if hs.Version != ProtocolVersion {
+		log.Printf("comm: rejecting %s (%s): protocol version %d, want %d",
+			hs.NodeName, conn.RemoteAddr(), hs.Version, ProtocolVersion)
+		writeHandshakeReply(w, ProtocolVersion, handshakeRejected, nil, nil)
+		return
+	}
+	if _, exists := msgHub.nodeManager.Nodes()[hs.NodeName]; !exists {
+		log.Printf("comm: rejecting %s (%s): %v", hs.NodeName, conn.RemoteAddr(), ErrorUnknownNode)
+		writeHandshakeReply(w, ProtocolVersion, handshakeRejected, nil, nil)
+		return
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return
+	}
+	proof := handshakeProof(msgHub.config.ClusterSecret, roleAccepting, hs.Nonce, hs)
+	if err = writeHandshakeReply(w, ProtocolVersion, handshakeAccepted, nonce, proof); err != nil {
+		return
+	}
+	peerProof, err := readProof(r)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(peerProof, handshakeProof(msgHub.config.ClusterSecret, roleDialing, nonce, hs)) {
+		log.Printf("comm: rejecting %s (%s): %v", hs.NodeName, conn.RemoteAddr(), ErrorHandshakeProof)
+		writeHandshakeStatus(w, handshakeRejected)
+		return
+	}
+	if err = writeHandshakeStatus(w, handshakeAccepted); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	//The node which has just connected is up, so there is no point in backing off from it
+	msgHub.mutex.Lock()
+	if p, exists := msgHub.peers[hs.NodeName]; exists {
+		p.wake()
+	}
+	msgHub.mutex.Unlock()
+	if hs.Kind == connKindStream {
+		msgHub.serveStream(conn, r, w, hs.NodeName)
+		return
+	}
+
+	for {
+		msg, err := readFrameIn(conn, r)
+		if err != nil {
+			return
+		}
+		if msg.SourceNode != hs.NodeName {
+			log.Printf("comm: %v (%s != %s)", ErrorSourceNodeMismatch, msg.SourceNode, hs.NodeName)
+			return
+		}
+		msgHub.dispatch(msg)
+	}
+}
+
+func (msgHub *MessageHub) dispatch(msg *Message) {
+	if msg.InReplyTo != 0 {
+		msgHub.deliverReply(msg)
+		return
+	}
+	msgHub.mutex.Lock()
+	handlers := msgHub.messageHandlers[msg.Type]
+	msgHub.mutex.Unlock()
+	for _, msgHandler := range handlers {
+		msgHandler.HandleMessage(msg)
+	}
+}
+
 //Subscribe method subscribes MessageHandler to receive certain message types
 func (msgHub *MessageHub) Subscribe(msgHandler MessageHandler, msgTypes ...MessageType) {
+	msgHub.mutex.Lock()
+	defer msgHub.mutex.Unlock()
 	if msgHub.messageHandlers == nil {
 		msgHub.messageHandlers = make(map[MessageType][]MessageHandler, 0)
 	}
@@ -62,50 +190,145 @@ func (msgHub *MessageHub) Subscribe(msgHandler MessageHandler, msgTypes ...Messa
 	}
 }
 
-//Send method sends message to other node
-func (msgHub *MessageHub) Send(msg Message, nodeName string) (err error) {
-	msg.SourceNode = msgHub.nodeManager.This.Name
+//dial opens a new connection to the node and performs the handshake
+func (msgHub *MessageHub) dial(nodeName string, kind byte) (*outConn, error) {
 	node := msgHub.nodeManager.Node(nodeName)
-	conn, exists := msgHub.outConnMap[node.PrivateAddress]
+	if node.PrivateAddress == "" {
+		return nil, ErrorUnknownMessageTarget
+	}
+	conn, err := net.DialTimeout("tcp", node.PrivateAddress, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	out := &outConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	err = msgHub.authenticate(out, kind)
+	if err != nil {
+		conn.Close()
+		log.Printf("comm: handshake with %s failed: %v", nodeName, err)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return out, nil
+}
+
+//authenticate performs the handshake of the dialing side, both sides prove they know the cluster secret
+func (msgHub *MessageHub) authenticate(out *outConn, kind byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	hs := handshake{
+		Version:  ProtocolVersion,
+		Kind:     kind,
+		NodeName: msgHub.nodeManager.This.Name,
+		Nonce:    nonce,
+	}
+	err = writeHandshake(out.w, hs)
+	if err != nil {
+		return err
+	}
+	peerNonce, peerProof, err := readHandshakeReply(out.r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(peerProof, handshakeProof(msgHub.config.ClusterSecret, roleAccepting, nonce, hs)) {
+		return ErrorHandshakeProof
+	}
+	err = writeProof(out.w, handshakeProof(msgHub.config.ClusterSecret, roleDialing, peerNonce, hs))
+	if err != nil {
+		return err
+	}
+	return readHandshakeStatus(out.r)
+}
+
+//stamp fills in the source node and a fresh message ID
+func (msgHub *MessageHub) stamp(msg *Message) {
+	msg.SourceNode = msgHub.nodeManager.This.Name
+	msg.ID = atomic.AddUint64(&msgHub.lastMessageID, 1)
+}
+
+//peer returns the connection supervisor for the node, creating it if needed
+func (msgHub *MessageHub) peer(nodeName string) *peer {
+	msgHub.mutex.Lock()
+	defer msgHub.mutex.Unlock()
+	if msgHub.peers == nil {
+		msgHub.peers = make(map[string]*peer, 0)
+	}
+	p, exists := msgHub.peers[nodeName]
 	if !exists {
-		conn, err = net.Dial("tcp", node.PrivateAddress)
-		if err != nil {
-			return err
-		}
-		msgHub.outConnMap[node.PrivateAddress] = conn
+		p = newPeer(msgHub, nodeName)
+		msgHub.peers[nodeName] = p
 	}
-	enc := gob.NewEncoder(conn)
-	enc.Encode(msg)
-	return nil
+	return p
+}
+
+//Send method sends message to other node.
+//If the node is unreachable the message is queued while the connection is being restored.
+func (msgHub *MessageHub) Send(msg Message, nodeName string) (err error) {
+	msgHub.stamp(&msg)
+	return msgHub.send(msg, nodeName)
+}
+
+func (msgHub *MessageHub) send(msg Message, nodeName string) error {
+	if msgHub.nodeManager.Node(nodeName).PrivateAddress == "" {
+		return ErrorUnknownMessageTarget
+	}
+	return msgHub.peer(nodeName).send(msg)
+}
+
+//PeerStates method returns state of the outgoing connection to every known node
+func (msgHub *MessageHub) PeerStates() map[string]PeerState {
+	states := make(map[string]PeerState, 0)
+	for _, node := range msgHub.nodeManager.Nodes() {
+		states[node.Name] = msgHub.peer(node.Name).snapshot()
+	}
+	return states
 }
 
 //Broadcast method broadcasts messages to all the nodes
 func (msgHub *MessageHub) Broadcast(msg Message) error {
-	msg.SourceNode = msgHub.nodeManager.This.Name
+	var firstErr error
 	for _, node := range msgHub.nodeManager.Nodes() {
-		msgHub.Send(msg, node.Name)
+		err := msgHub.Send(msg, node.Name)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
+}
+
+//Multicast method sends message to each of the listed nodes
+func (msgHub *MessageHub) Multicast(msg Message, nodeNames []string) error {
+	var firstErr error
+	for _, nodeName := range nodeNames {
+		err := msgHub.Send(msg, nodeName)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 //SendInNewConnection method creates new connection and uses it to send the message
 func (msgHub *MessageHub) SendInNewConnection(msg Message, nodeName string) (err error) {
-	msg.SourceNode = msgHub.nodeManager.This.Name
-	node := msgHub.nodeManager.Node(nodeName)
-	conn, err := net.Dial("tcp", node.PrivateAddress)
+	msgHub.stamp(&msg)
+	out, err := msgHub.dial(nodeName, connKindMessages)
 	if err != nil {
 		return err
 	}
-	enc := gob.NewEncoder(conn)
-	enc.Encode(msg)
-	return nil
+	defer out.conn.Close()
+	return out.writeFrame(&msg)
 }
 
 //BroadcastInNewConnection method creates new connections and uses them to broadcast the message
 func (msgHub *MessageHub) BroadcastInNewConnection(msg Message) error {
-	msg.SourceNode = msgHub.nodeManager.This.Name
+	var firstErr error
 	for _, node := range msgHub.nodeManager.Nodes() {
-		msgHub.SendInNewConnection(msg, node.Name)
+		err := msgHub.SendInNewConnection(msg, node.Name)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
 }
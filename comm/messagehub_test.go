@@ -0,0 +1,151 @@
+package comm
+
+import (
+	"bufio"
+	c "dfs/config"
+	"dfs/server/node"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "cluster secret"
+
+//newTestHub returns the hub of the node knowing the other nodes, it does not listen
+func newTestHub(name, secret string, nodes ...string) *MessageHub {
+	config := &c.Config{ClusterSecret: secret}
+	config.This.Name = name
+	for _, other := range nodes {
+		config.Nodes = append(config.Nodes, c.NodeInfo{Name: other})
+	}
+	nodeManager := &node.NodeManager{}
+	nodeManager.UseConfig(config)
+
+	msgHub := &MessageHub{nodeManager: nodeManager, peers: make(map[string]*peer, 0)}
+	msgHub.UseConfig(config)
+	return msgHub
+}
+
+//connect serves one end of a pipe with the accepting hub and returns the other end
+func connect(t *testing.T, accepting *MessageHub) *outConn {
+	t.Helper()
+	server, client := net.Pipe()
+	go accepting.serveConn(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return &outConn{conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+}
+
+type messageRecorder chan *Message
+
+func (mr messageRecorder) HandleMessage(msg *Message) {
+	mr <- msg
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		dialer *MessageHub
+		err    error
+	}{
+		{name: "known node", dialer: newTestHub("two", testSecret, "one")},
+		{name: "unknown node", dialer: newTestHub("four", testSecret, "one"), err: ErrorHandshakeRejected},
+		//The dialing side checks the proof first, so the one with another secret does not send its own
+		{name: "another secret", dialer: newTestHub("two", "other secret", "one"), err: ErrorHandshakeProof},
+	}
+	accepting := newTestHub("one", testSecret, "two", "three")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := connect(t, accepting)
+			if err := test.dialer.authenticate(out, connKindMessages); err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	accepting := newTestHub("one", testSecret, "two")
+	out := connect(t, accepting)
+	nonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeHandshake(out.w, handshake{Version: ProtocolVersion + 1, Kind: connKindMessages, NodeName: "two", Nonce: nonce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = readHandshakeReply(out.r)
+	if err != ErrorHandshakeRejected {
+		t.Fatalf("got error %v, want %v", err, ErrorHandshakeRejected)
+	}
+}
+
+//TestForgedProof sends the proof made without the cluster secret, the accepting side must refuse it
+func TestForgedProof(t *testing.T) {
+	accepting := newTestHub("one", testSecret, "two")
+	out := connect(t, accepting)
+	nonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := handshake{Version: ProtocolVersion, Kind: connKindMessages, NodeName: "two", Nonce: nonce}
+	if err = writeHandshake(out.w, hs); err != nil {
+		t.Fatal(err)
+	}
+	peerNonce, _, err := readHandshakeReply(out.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeProof(out.w, handshakeProof("guessed secret", roleDialing, peerNonce, hs)); err != nil {
+		t.Fatal(err)
+	}
+	if err = readHandshakeStatus(out.r); err != ErrorHandshakeRejected {
+		t.Fatalf("got error %v, want %v", err, ErrorHandshakeRejected)
+	}
+}
+
+func TestIncompatibleVersionReply(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	go func() {
+		writeHandshakeReply(bufio.NewWriter(other), ProtocolVersion+1, handshakeRejected, nil, nil)
+		other.Close()
+	}()
+	_, _, err := readHandshakeReply(bufio.NewReader(conn))
+	if err == nil || !strings.HasPrefix(err.Error(), ErrorIncompatibleVersion.Error()) {
+		t.Fatalf("got error %v, want %v", err, ErrorIncompatibleVersion)
+	}
+}
+
+//TestSourceNodeMismatch checks that the node can not send messages on behalf of another one
+func TestSourceNodeMismatch(t *testing.T) {
+	accepting := newTestHub("one", testSecret, "two", "three")
+	received := make(messageRecorder, 3)
+	accepting.Subscribe(received, MessageTypeStatus)
+	dialer := newTestHub("two", testSecret, "one")
+	out := connect(t, accepting)
+	if err := dialer.authenticate(out, connKindMessages); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{"two", "three", "two"} {
+		//The accepting side closes the connection, so the last write may fail
+		writeFrame(out.w, &Message{Type: MessageTypeStatus, ID: 1, SourceNode: source})
+	}
+	select {
+	case msg := <-received:
+		if msg.SourceNode != "two" {
+			t.Fatalf("got message from %s, want two", msg.SourceNode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message of the node is not dispatched")
+	}
+	if _, err := out.r.ReadByte(); err == nil {
+		t.Fatal("connection is kept after the message on behalf of another node")
+	}
+	if len(received) != 0 {
+		t.Fatalf("got %d messages after the mismatched one", len(received))
+	}
+}
@@ -2,56 +2,159 @@ package comm
 
 import (
 	"fmt"
+	"time"
 )
 
 type MessageNodeStatus struct {
 	RequestsPerMinute int
-	TokenCount        int
 	RequestCounter    int
+	FreeDisk          uint64
+	FreeDiskUnknown   bool
+	InFlightTransfers int
+	//IssuedTokens is the number of unexpired transfer tokens the node issued for every node
+	IssuedTokens map[string]int
 }
 
 func (msg MessageNodeStatus) String() string {
-	return fmt.Sprintf("RPM: %d\nTC: %d\nRC: %d\n",
+	return fmt.Sprintf("RPM: %d\nRC: %d\n",
 		msg.RequestsPerMinute,
-		msg.TokenCount,
 		msg.RequestCounter)
 }
 
-type MessageRequestToken struct {
-	Path string
+//MessageFileInfo identifies version of the file being replicated
+type MessageFileInfo struct {
+	Path     string
+	Size     int64
+	Checksum string
+	ModTime  time.Time
+}
+
+type MessageFileOffset struct {
+	Path   string
+	Offset int64
 }
 
-type MessageToken struct {
+type MessageFileChunk struct {
+	Path     string
+	Checksum string
+	Offset   int64
+	Data     []byte
+}
+
+type MessageFileChunkAck struct {
+	Path   string
+	Offset int64
+	Error  string
+}
+
+type MessageFileCommitted struct {
 	Path  string
-	Token string
+	Error string
 }
 
-type MessageRequestLock struct {
-	Resource  string
-	Timestamp int64
+type MessageDeleteFile struct {
+	Path      string
+	DeletedAt time.Time
 }
 
-type MessageGrantLockPermission struct {
-	Resource string
+type MessageFileDeleted struct {
+	Path  string
+	Error string
 }
 
-type MessageFile struct {
-	Path     string
-	FileData []byte
+type MessageRequestVote struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	PreVote      bool
+}
+
+type MessageVote struct {
+	Term    uint64
+	Granted bool
+	PreVote bool
+}
+
+type MessageRaftEntry struct {
+	Index  uint64
+	Term   uint64
+	Type   uint8
+	Target string
+	Data   []byte
+	Time   time.Time
+}
+
+type MessageAppendEntries struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []MessageRaftEntry
+	LeaderCommit uint64
+}
+
+//MessageAppendEntriesResult answers MessageAppendEntries.
+//On failure ConflictIndex tells the leader where to continue from.
+type MessageAppendEntriesResult struct {
+	Term          uint64
+	Success       bool
+	MatchIndex    uint64
+	ConflictIndex uint64
+}
+
+type MessageInstallSnapshot struct {
+	Term     uint64
+	Leader   string
+	Index    uint64
+	LogTerm  uint64
+	Members  []string
+	Machines map[string][]byte
+}
+
+type MessageSnapshotInstalled struct {
+	Term       uint64
+	MatchIndex uint64
+	//Refused tells the follower failed to restore the snapshot and kept its previous state
+	Refused bool
+}
+
+//MessagePropose forwards command to the leader
+type MessagePropose struct {
+	Type   uint8
+	Target string
+	Data   []byte
+}
+
+//MessageProposeResult carries result of the command and index of its entry,
+//so the proposer can wait until it applies the entry itself
+type MessageProposeResult struct {
+	Result []byte
+	Index  uint64
+	Error  string
 }
 
-type MessageFileReceived struct {
-	Path string
+//MessageReadPart asks the node that received the part of multipart upload for its data
+type MessageReadPart struct {
+	UploadID string
+	Number   int
+	Checksum string
+	Offset   int64
+	Length   int
 }
 
-type MessageLockPath struct {
-	Path string
+type MessagePartData struct {
+	Data  []byte
+	Error string
 }
 
-type MessageUnlockPath struct {
-	Path string
+//MessageReadIndexResult answers MessageTypeReadIndex with the commit index the leader confirmed it still leads at
+type MessageReadIndexResult struct {
+	Index uint64
+	Error string
 }
 
-type MessagePathLocked struct {
-	Path string
+//MessageRemoveParts asks the node to remove the parts it received for the finished multipart upload
+type MessageRemoveParts struct {
+	UploadID string
 }
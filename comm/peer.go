@@ -0,0 +1,241 @@
+package comm
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	PeerStateDisconnected = "disconnected"
+	PeerStateConnected    = "connected"
+	PeerStateBackingOff   = "backing off"
+)
+
+const (
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+	maxQueuedMessages = 1024
+	maxQueuedTime     = 5 * time.Second
+)
+
+var (
+	ErrorSendQueueFull = errors.New("Send queue is full.")
+)
+
+//PeerState describes health of the outgoing connection to a single node
+type PeerState struct {
+	State         string
+	LastError     string
+	LastErrorTime time.Time
+	Attempts      int
+	QueuedCount   int
+	//DroppedCount is the number of queued messages discarded because the connection was not restored in time
+	DroppedCount uint64
+	//Latency is the moving average of request round-trip time
+	Latency time.Duration
+}
+
+type queuedMessage struct {
+	msg      Message
+	queuedAt time.Time
+}
+
+//peer supervises the outgoing connection to one node.
+//Failed connections are evicted and redialed with exponential backoff,
+//messages sent meanwhile are queued for a short time.
+type peer struct {
+	mutex        sync.Mutex
+	name         string
+	msgHub       *MessageHub
+	out          *outConn
+	state        PeerState
+	queue        []queuedMessage
+	reconnecting bool
+	//wakeup cuts the backoff short once the node is known to be back
+	wakeup chan struct{}
+}
+
+func newPeer(msgHub *MessageHub, name string) *peer {
+	return &peer{
+		name:   name,
+		msgHub: msgHub,
+		state:  PeerState{State: PeerStateDisconnected},
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+//send writes the message to the connection or queues it while the connection is being restored.
+//Node is dialed by the reconnecting goroutine, so senders are not blocked by the node which does not answer.
+func (p *peer) send(msg Message) error {
+	p.mutex.Lock()
+	out := p.out
+	if out == nil {
+		if !p.reconnecting {
+			p.reconnecting = true
+			go p.reconnect(0)
+		}
+		err := p.enqueue(msg)
+		p.mutex.Unlock()
+		return err
+	}
+	p.mutex.Unlock()
+
+	out.Lock()
+	err := out.writeFrame(&msg)
+	out.Unlock()
+	if err != nil {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.drop(out, err)
+		return p.enqueue(msg)
+	}
+	return nil
+}
+
+func (p *peer) enqueue(msg Message) error {
+	p.expireQueue()
+	if len(p.queue) >= maxQueuedMessages {
+		p.state.DroppedCount++
+		return ErrorSendQueueFull
+	}
+	p.queue = append(p.queue, queuedMessage{msg, time.Now()})
+	p.state.QueuedCount = len(p.queue)
+	return nil
+}
+
+//expireQueue drops messages queued for longer than maxQueuedTime, they are counted in DroppedCount
+func (p *peer) expireQueue() {
+	now := time.Now()
+	i := 0
+	for i < len(p.queue) && now.Sub(p.queue[i].queuedAt) > maxQueuedTime {
+		i++
+	}
+	if i > 0 {
+		log.Printf("comm: dropped %d messages queued for %s", i, p.name)
+		p.state.DroppedCount += uint64(i)
+	}
+	p.queue = p.queue[i:]
+	p.state.QueuedCount = len(p.queue)
+}
+
+//connected installs a fresh connection and watches it for read failures
+func (p *peer) connected(out *outConn) {
+	p.out = out
+	p.state.State = PeerStateConnected
+	p.state.Attempts = 0
+	go func() {
+		io.Copy(ioutil.Discard, out.conn)
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.drop(out, io.EOF)
+	}()
+}
+
+//drop evicts a broken connection and starts reconnecting
+func (p *peer) drop(out *outConn, err error) {
+	if p.out != out {
+		return
+	}
+	out.conn.Close()
+	p.out = nil
+	p.fail(err)
+}
+
+func (p *peer) fail(err error) {
+	p.state.LastError = err.Error()
+	p.state.LastErrorTime = time.Now()
+	p.state.State = PeerStateBackingOff
+	if !p.reconnecting {
+		p.reconnecting = true
+		go p.reconnect(minReconnectDelay)
+	}
+}
+
+//reconnect dials the node after delay until the connection is restored, zero delay dials right away
+func (p *peer) reconnect(delay time.Duration) {
+	for {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-p.wakeup:
+				delay = minReconnectDelay
+			}
+		}
+
+		p.mutex.Lock()
+		p.state.Attempts++
+		p.mutex.Unlock()
+
+		out, err := p.msgHub.dial(p.name, connKindMessages)
+
+		p.mutex.Lock()
+		if err == nil {
+			p.connected(out)
+			err = p.flush()
+			if err == nil {
+				p.reconnecting = false
+				p.mutex.Unlock()
+				return
+			}
+			p.out = nil
+			out.conn.Close()
+		}
+		p.state.State = PeerStateBackingOff
+		p.state.LastError = err.Error()
+		p.state.LastErrorTime = time.Now()
+		p.mutex.Unlock()
+
+		delay *= 2
+		if delay == 0 {
+			delay = minReconnectDelay
+		}
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+//wake makes the reconnecting peer redial right away
+func (p *peer) wake() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (p *peer) flush() error {
+	p.expireQueue()
+	out := p.out
+	out.Lock()
+	defer out.Unlock()
+	for len(p.queue) > 0 {
+		if err := out.writeFrame(&p.queue[0].msg); err != nil {
+			return err
+		}
+		p.queue = p.queue[1:]
+	}
+	p.state.QueuedCount = 0
+	return nil
+}
+
+//observeLatency adds round-trip time of a request to the moving average
+func (p *peer) observeLatency(rtt time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state.Latency == 0 {
+		p.state.Latency = rtt
+		return
+	}
+	p.state.Latency = (p.state.Latency*7 + rtt) / 8
+}
+
+func (p *peer) snapshot() PeerState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireQueue()
+	return p.state
+}
@@ -0,0 +1,271 @@
+package comm
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ProtocolVersion is the version of the wire protocol spoken by this build.
+//Nodes refuse to talk to peers announcing a different version.
+const ProtocolVersion uint16 = 10
+
+const (
+	protocolMagic  = "DFSP"
+	maxNodeNameLen = 1 << 10
+	nonceLen       = 16
+)
+
+//MaxPayloadLength is the biggest message payload that fits in a single frame
+const MaxPayloadLength = 1 << 26
+
+const (
+	handshakeAccepted byte = iota
+	handshakeRejected
+)
+
+//Sides of the handshake proving they know the cluster secret
+const (
+	roleAccepting byte = iota
+	roleDialing
+)
+
+//Kinds of connections. Message connections carry messages one way and replies come back
+//in a separate connection, stream connections carry requests and replies in lockstep.
+const (
+	connKindMessages byte = iota
+	connKindStream
+)
+
+var (
+	ErrorBadMagic             = errors.New("Peer does not speak DFS protocol.")
+	ErrorIncompatibleVersion  = errors.New("Peer uses incompatible protocol version.")
+	ErrorHandshakeRejected    = errors.New("Peer rejected handshake.")
+	ErrorHandshakeProof       = errors.New("Peer does not know the cluster secret.")
+	ErrorUnknownNode          = errors.New("Node is not in the cluster.")
+	ErrorNoClusterSecret      = errors.New("Cluster secret is not configured.")
+	ErrorFrameTooLarge        = errors.New("Frame is too large.")
+	ErrorSourceNodeMismatch   = errors.New("Frame source does not match handshake.")
+	ErrorNodeNameTooLong      = errors.New("Node name is too long.")
+	ErrorUnknownMessageTarget = errors.New("Unknown message target.")
+)
+
+/*handshake is the first thing written on every connection.
+
+	magic    [4]byte "DFSP"
+	version  uint16
+	kind     byte
+	nameLen  uint16
+	name     [nameLen]byte
+	nonce    [16]byte
+
+The accepting side answers with its own version and a status byte. Accepted handshake is authenticated both ways:
+the accepting side follows with its nonce and the proof over the nonce of the dialing side,
+the dialing side answers with the proof over that nonce and the accepting side confirms it with a status byte.
+Proof is HMAC-SHA256 of the role, nonce, kind and name keyed with the cluster secret.*/
+type handshake struct {
+	Version  uint16
+	Kind     byte
+	NodeName string
+	Nonce    []byte
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+//handshakeProof shows the side of the handshake knows the secret, nonce is the one of the other side
+func handshakeProof(secret string, role byte, nonce []byte, hs handshake) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte{role})
+	mac.Write(nonce)
+	mac.Write([]byte{hs.Kind})
+	mac.Write([]byte(hs.NodeName))
+	return mac.Sum(nil)
+}
+
+func writeHandshake(w *bufio.Writer, hs handshake) error {
+	if len(hs.NodeName) > maxNodeNameLen {
+		return ErrorNodeNameTooLong
+	}
+	w.WriteString(protocolMagic)
+	binary.Write(w, binary.BigEndian, hs.Version)
+	w.WriteByte(hs.Kind)
+	binary.Write(w, binary.BigEndian, uint16(len(hs.NodeName)))
+	w.WriteString(hs.NodeName)
+	w.Write(hs.Nonce)
+	return w.Flush()
+}
+
+func readHandshake(r *bufio.Reader) (hs handshake, err error) {
+	magic := make([]byte, len(protocolMagic))
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return hs, err
+	}
+	if string(magic) != protocolMagic {
+		return hs, ErrorBadMagic
+	}
+	var nameLen uint16
+	if err = binary.Read(r, binary.BigEndian, &hs.Version); err != nil {
+		return hs, err
+	}
+	if hs.Version != ProtocolVersion {
+		//Layout of the rest depends on version, leave it to the caller to reject the peer
+		return hs, nil
+	}
+	if hs.Kind, err = r.ReadByte(); err != nil {
+		return hs, err
+	}
+	if err = binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return hs, err
+	}
+	if nameLen > maxNodeNameLen {
+		return hs, ErrorNodeNameTooLong
+	}
+	name := make([]byte, nameLen)
+	if _, err = io.ReadFull(r, name); err != nil {
+		return hs, err
+	}
+	hs.NodeName = string(name)
+	hs.Nonce = make([]byte, nonceLen)
+	if _, err = io.ReadFull(r, hs.Nonce); err != nil {
+		return hs, err
+	}
+	return hs, nil
+}
+
+//writeHandshakeReply answers the handshake, nonce and proof of the accepting side follow the accepted status only
+func writeHandshakeReply(w *bufio.Writer, version uint16, status byte, nonce, proof []byte) error {
+	binary.Write(w, binary.BigEndian, version)
+	w.WriteByte(status)
+	if status == handshakeAccepted {
+		w.Write(nonce)
+		w.Write(proof)
+	}
+	return w.Flush()
+}
+
+func readHandshakeReply(r *bufio.Reader) (nonce, proof []byte, err error) {
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, nil, err
+	}
+	status, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version != ProtocolVersion {
+		return nil, nil, fmt.Errorf("%v Local %d, remote %d.", ErrorIncompatibleVersion, ProtocolVersion, version)
+	}
+	if status != handshakeAccepted {
+		return nil, nil, ErrorHandshakeRejected
+	}
+	nonce = make([]byte, nonceLen)
+	if _, err = io.ReadFull(r, nonce); err != nil {
+		return nil, nil, err
+	}
+	proof = make([]byte, sha256.Size)
+	if _, err = io.ReadFull(r, proof); err != nil {
+		return nil, nil, err
+	}
+	return nonce, proof, nil
+}
+
+func writeProof(w *bufio.Writer, proof []byte) error {
+	w.Write(proof)
+	return w.Flush()
+}
+
+func readProof(r *bufio.Reader) ([]byte, error) {
+	proof := make([]byte, sha256.Size)
+	_, err := io.ReadFull(r, proof)
+	return proof, err
+}
+
+func writeHandshakeStatus(w *bufio.Writer, status byte) error {
+	w.WriteByte(status)
+	return w.Flush()
+}
+
+func readHandshakeStatus(r *bufio.Reader) error {
+	status, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status != handshakeAccepted {
+		return ErrorHandshakeRejected
+	}
+	return nil
+}
+
+/*writeFrame writes a single message as a length-prefixed frame.
+
+	type       int8
+	messageID  uint64
+	inReplyTo  uint64
+	sourceLen  uint16
+	source     [sourceLen]byte
+	payloadLen uint32
+	payload    [payloadLen]byte
+*/
+func writeFrame(w *bufio.Writer, msg *Message) error {
+	if len(msg.SourceNode) > maxNodeNameLen {
+		return ErrorNodeNameTooLong
+	}
+	if len(msg.Data) > MaxPayloadLength {
+		return ErrorFrameTooLarge
+	}
+	binary.Write(w, binary.BigEndian, msg.Type)
+	binary.Write(w, binary.BigEndian, msg.ID)
+	binary.Write(w, binary.BigEndian, msg.InReplyTo)
+	binary.Write(w, binary.BigEndian, uint16(len(msg.SourceNode)))
+	w.WriteString(msg.SourceNode)
+	binary.Write(w, binary.BigEndian, uint32(len(msg.Data)))
+	w.Write(msg.Data)
+	return w.Flush()
+}
+
+func readFrame(r *bufio.Reader) (*Message, error) {
+	msg := new(Message)
+	var sourceLen uint16
+	var payloadLen uint32
+
+	if err := binary.Read(r, binary.BigEndian, &msg.Type); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &msg.ID); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &msg.InReplyTo); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &sourceLen); err != nil {
+		return nil, err
+	}
+	if sourceLen > maxNodeNameLen {
+		return nil, ErrorNodeNameTooLong
+	}
+	source := make([]byte, sourceLen)
+	if _, err := io.ReadFull(r, source); err != nil {
+		return nil, err
+	}
+	msg.SourceNode = string(source)
+	if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
+		return nil, err
+	}
+	if payloadLen > MaxPayloadLength {
+		return nil, ErrorFrameTooLarge
+	}
+	msg.Data = make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,59 @@
+package comm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		err  error
+	}{
+		{name: "empty payload", msg: Message{Type: MessageTypeStatus, ID: 1, SourceNode: "one"}},
+		{name: "reply", msg: Message{Type: MessageTypeFileOffset, ID: 2, InReplyTo: 1, SourceNode: "one", Data: []byte("data")}},
+		{name: "payload too large", msg: Message{SourceNode: "one", Data: make([]byte, MaxPayloadLength+1)}, err: ErrorFrameTooLarge},
+		{name: "node name too long", msg: Message{SourceNode: strings.Repeat("n", maxNodeNameLen+1)}, err: ErrorNodeNameTooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := writeFrame(bufio.NewWriter(buf), &test.msg); err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				if buf.Len() != 0 {
+					t.Fatalf("got %d bytes written of refused frame", buf.Len())
+				}
+				return
+			}
+			msg, err := readFrame(bufio.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != test.msg.Type || msg.ID != test.msg.ID || msg.InReplyTo != test.msg.InReplyTo ||
+				msg.SourceNode != test.msg.SourceNode || !bytes.Equal(msg.Data, test.msg.Data) {
+				t.Fatalf("got message %+v, want %+v", msg, test.msg)
+			}
+		})
+	}
+}
+
+//TestReadFrameTooLarge checks that the frame claiming too large payload is refused before the payload is allocated
+func TestReadFrameTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, MessageTypeStatus)
+	binary.Write(buf, binary.BigEndian, uint64(1))
+	binary.Write(buf, binary.BigEndian, uint64(0))
+	binary.Write(buf, binary.BigEndian, uint16(3))
+	buf.WriteString("one")
+	binary.Write(buf, binary.BigEndian, uint32(MaxPayloadLength+1))
+
+	if _, err := readFrame(bufio.NewReader(buf)); err != ErrorFrameTooLarge {
+		t.Fatalf("got error %v, want %v", err, ErrorFrameTooLarge)
+	}
+}
@@ -0,0 +1,136 @@
+package comm
+
+import (
+	"context"
+	"dfs/server/node"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorRequestTimeout = errors.New("Request timed out.")
+	ErrorNodeIsDead     = errors.New("Node is dead.")
+)
+
+type pendingRequest struct {
+	nodeName  string
+	replyChan chan *Message
+	errChan   chan error
+}
+
+//Response is a reply to a request sent to a single node or the error that prevented it
+type Response struct {
+	Msg *Message
+	Err error
+}
+
+//Request method sends message to other node and waits for the reply.
+//Reply is matched by its InReplyTo field, so concurrent requests never mix their answers.
+func (msgHub *MessageHub) Request(msg Message, nodeName string, timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return msgHub.RequestContext(ctx, msg, nodeName)
+}
+
+//RequestContext method works like Request but waits for the reply until ctx is done
+func (msgHub *MessageHub) RequestContext(ctx context.Context, msg Message, nodeName string) (*Message, error) {
+	if msgHub.nodeManager.NodeState(nodeName) == node.NodeStateDead {
+		return nil, ErrorNodeIsDead
+	}
+
+	msgHub.stamp(&msg)
+	request := &pendingRequest{
+		nodeName:  nodeName,
+		replyChan: make(chan *Message, 1),
+		errChan:   make(chan error, 1),
+	}
+
+	msgHub.mutex.Lock()
+	if msgHub.pendingRequests == nil {
+		msgHub.pendingRequests = make(map[uint64]*pendingRequest, 0)
+	}
+	msgHub.pendingRequests[msg.ID] = request
+	msgHub.mutex.Unlock()
+
+	defer func() {
+		msgHub.mutex.Lock()
+		delete(msgHub.pendingRequests, msg.ID)
+		msgHub.mutex.Unlock()
+	}()
+
+	sentAt := time.Now()
+	err := msgHub.send(msg, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-request.replyChan:
+		msgHub.peer(nodeName).observeLatency(time.Since(sentAt))
+		return reply, nil
+	case err := <-request.errChan:
+		return nil, err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrorRequestTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+//RequestMulticast method sends request to each of the listed nodes in parallel and collects the replies
+func (msgHub *MessageHub) RequestMulticast(ctx context.Context, msg Message, nodeNames []string) map[string]Response {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	responses := make(map[string]Response, len(nodeNames))
+	for _, nodeName := range nodeNames {
+		wg.Add(1)
+		go func(nodeName string) {
+			defer wg.Done()
+			reply, err := msgHub.RequestContext(ctx, msg, nodeName)
+			mutex.Lock()
+			responses[nodeName] = Response{reply, err}
+			mutex.Unlock()
+		}(nodeName)
+	}
+	wg.Wait()
+	return responses
+}
+
+//Reply method sends reply to the node that sent request
+func (msgHub *MessageHub) Reply(request *Message, reply Message) error {
+	reply.InReplyTo = request.ID
+	return msgHub.Send(reply, request.SourceNode)
+}
+
+//deliverReply hands reply over to the waiting request. Replies nobody waits for are dropped.
+func (msgHub *MessageHub) deliverReply(msg *Message) {
+	msgHub.mutex.Lock()
+	request, exists := msgHub.pendingRequests[msg.InReplyTo]
+	msgHub.mutex.Unlock()
+	if !exists || request.nodeName != msg.SourceNode {
+		return
+	}
+	select {
+	case request.replyChan <- msg:
+	default:
+	}
+}
+
+//nodeStateChanged fails every request that waits for a node that is dead
+func (msgHub *MessageHub) nodeStateChanged(nodeName string, state node.NodeState) {
+	if state != node.NodeStateDead {
+		return
+	}
+	msgHub.mutex.Lock()
+	defer msgHub.mutex.Unlock()
+	for _, request := range msgHub.pendingRequests {
+		if request.nodeName == nodeName {
+			select {
+			case request.errChan <- ErrorNodeIsDead:
+			default:
+			}
+		}
+	}
+}
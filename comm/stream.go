@@ -0,0 +1,127 @@
+package comm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	defaultStreamTimeout = 30 * time.Second
+)
+
+var (
+	ErrorUnexpectedReply = errors.New("Unexpected reply in stream.")
+	ErrorNoStreamHandler = errors.New("No stream handler for message type.")
+)
+
+//StreamHandler is the interface that must be implemented to serve requests coming through streams.
+//Returned message is sent back as the reply.
+type StreamHandler interface {
+	HandleStreamMessage(*Message) Message
+}
+
+//Stream is a dedicated connection to a single node.
+//Every request written to the stream is answered before the next one is sent,
+//so bulk transfers neither block nor get interleaved with regular messages.
+type Stream struct {
+	msgHub   *MessageHub
+	nodeName string
+	out      *outConn
+}
+
+//SubscribeStream method makes handler serve requests of the given types coming through streams
+func (msgHub *MessageHub) SubscribeStream(handler StreamHandler, msgTypes ...MessageType) {
+	msgHub.mutex.Lock()
+	defer msgHub.mutex.Unlock()
+	if msgHub.streamHandlers == nil {
+		msgHub.streamHandlers = make(map[MessageType]StreamHandler, 0)
+	}
+	for _, msgType := range msgTypes {
+		msgHub.streamHandlers[msgType] = handler
+	}
+}
+
+//OpenStream method opens new stream to other node
+func (msgHub *MessageHub) OpenStream(nodeName string) (*Stream, error) {
+	out, err := msgHub.dial(nodeName, connKindStream)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{msgHub: msgHub, nodeName: nodeName, out: out}, nil
+}
+
+//Request method sends message through the stream and waits for the reply until ctx is done.
+//Stream is not usable anymore once Request failed.
+func (stream *Stream) Request(ctx context.Context, msg Message) (*Message, error) {
+	stream.msgHub.stamp(&msg)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultStreamTimeout)
+	}
+	stream.out.conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.out.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	err := writeFrame(stream.out.w, &msg)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readFrame(stream.out.r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if reply.InReplyTo != msg.ID {
+		return nil, ErrorUnexpectedReply
+	}
+	return reply, nil
+}
+
+func (stream *Stream) Close() error {
+	return stream.out.conn.Close()
+}
+
+//serveStream answers requests coming through a stream connection
+func (msgHub *MessageHub) serveStream(conn net.Conn, r *bufio.Reader, w *bufio.Writer, nodeName string) {
+	for {
+		msg, err := readFrameIn(conn, r)
+		if err != nil {
+			return
+		}
+		if msg.SourceNode != nodeName {
+			log.Printf("comm: %v (%s != %s)", ErrorSourceNodeMismatch, msg.SourceNode, nodeName)
+			return
+		}
+
+		msgHub.mutex.Lock()
+		handler, exists := msgHub.streamHandlers[msg.Type]
+		msgHub.mutex.Unlock()
+		if !exists {
+			log.Printf("comm: %v (%s from %s)", ErrorNoStreamHandler, msg.Type, nodeName)
+			return
+		}
+
+		reply := handler.HandleStreamMessage(msg)
+		msgHub.stamp(&reply)
+		reply.InReplyTo = msg.ID
+		conn.SetWriteDeadline(time.Now().Add(frameTimeout))
+		if err = writeFrame(w, &reply); err != nil {
+			return
+		}
+	}
+}
@@ -3,19 +3,167 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path"
+	"time"
 )
 
+//Duration is time.Duration that is written in config as a string like "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+//Or returns d, or fallback if d is not set
+func (d Duration) Or(fallback time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return fallback
+	}
+	return d.Duration
+}
+
 type NodeInfo struct {
 	Name           string
 	PublicAddress  string
 	PrivateAddress string
+	Weight         float64
+}
+
+//TokenKey is a secret shared by the nodes to sign transfer tokens
+type TokenKey struct {
+	ID     string
+	Secret string
+}
+
+//TokenConfig sets lifetime and scope of transfer tokens, requests may narrow it
+type TokenConfig struct {
+	//TTL is lifetime of tokens unless request asks for another one, MaxTTL caps what request may ask for
+	TTL    Duration
+	MaxTTL Duration
+	//MaxUses limits how many times a download token may be used, 0 means no limit
+	MaxUses int
+	//BindIP makes tokens valid only for the client address they were requested from
+	BindIP bool
+	//DownloadMethods and UploadMethods are HTTP methods tokens may be used with
+	DownloadMethods []string
+	UploadMethods   []string
+}
+
+//S3Credentials is the key pair S3 clients sign requests with
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+//S3Config sets up the S3 compatible gateway. Gateway is disabled while Address or Credentials are empty.
+type S3Config struct {
+	Address     string
+	Region      string
+	Credentials []S3Credentials
+}
+
+type FailureDetectorConfig struct {
+	SuspectTimeout Duration
+	DeadTimeout    Duration
+}
+
+//TimeoutsConfig holds deadlines of the operations that wait for other nodes
+type TimeoutsConfig struct {
+	Lock        Duration
+	PathLock    Duration
+	Replication Duration
+	Token       Duration
+	//Consensus is how long to wait until a command is committed by the majority
+	Consensus Duration
+}
+
+//RaftConfig tunes the consensus log keeping metadata and locks
+type RaftConfig struct {
+	//Dir keeps the log and snapshots, by default it is UploadDir + ".raft"
+	Dir               string
+	HeartbeatInterval Duration
+	//ElectionTimeout is the minimal time without leader before election starts, it is randomized up to twice as much
+	ElectionTimeout Duration
+	//SnapshotThreshold is the number of applied entries that triggers a snapshot
+	SnapshotThreshold int
 }
 
 type Config struct {
-	fileName  string
-	This      NodeInfo
-	Nodes     []NodeInfo
-	UploadDir string
+	fileName        string
+	This            NodeInfo
+	Nodes           []NodeInfo
+	UploadDir       string
+	FailureDetector FailureDetectorConfig
+	Timeouts        TimeoutsConfig
+	Raft            RaftConfig
+
+	//StagingDir keeps partially replicated files, by default it is UploadDir + ".staging"
+	StagingDir           string
+	ReplicationChunkSize int
+	//ResumableUploadTTL is how long unfinished resumable upload is kept after it received the last chunk
+	ResumableUploadTTL Duration
+	//MultipartUploadTTL is how long unfinished multipart upload is kept after it received the last part
+	MultipartUploadTTL Duration
+	//UploadLeaseTTL is how long upload keeps its path after the node receiving it stopped renewing the lease
+	UploadLeaseTTL Duration
+
+	//ReplicationFactor is the number of nodes that keep every file, 0 means all nodes.
+	//BucketReplicationFactors overrides it for single buckets.
+	ReplicationFactor        int
+	BucketReplicationFactors map[string]int
+
+	//TokenKeys sign transfer tokens. The first key signs new tokens and every key verifies them,
+	//so a key is rotated by adding the new one first and removing the old one once its tokens expire.
+	TokenKeys []TokenKey
+	//MaxUploadSize limits size of uploaded files in bytes, 0 means no limit
+	MaxUploadSize int64
+	//Tokens applies to every bucket, BucketTokens overrides its non-empty fields for single buckets
+	Tokens       TokenConfig
+	BucketTokens map[string]TokenConfig
+	//TokenReaperInterval is how often expired token uses and upload reservations are cleaned up
+	TokenReaperInterval Duration
+
+	S3 S3Config
+
+	//LockLeaseTTL is how long a lock outlives the holder that stopped renewing it
+	LockLeaseTTL Duration
+
+	//TombstoneTTL is how long deleted files are remembered to keep lagging replicas from restoring them
+	TombstoneTTL Duration
+
+	//VirtualNodes is the number of points a node of weight 1 takes on the placement ring
+	VirtualNodes int
+
+	//PlacementStrategy chooses which node serves a transfer: random, least-requests,
+	//least-tokens, power-of-two-choices or free-disk-weighted.
+	PlacementStrategy string
+	//MinFreeDisk is the number of free bytes below which node accepts no new files
+	MinFreeDisk uint64
+
+	//AdminToken authorizes requests to the admin endpoints, they are disabled while it is empty
+	AdminToken string
+	//ClusterSecret authenticates nodes to each other, every node of the cluster must have the same one
+	ClusterSecret string
+}
+
+//StagingPath returns StagingDir or its default
+func (config *Config) StagingPath() string {
+	if config.StagingDir != "" {
+		return config.StagingDir
+	}
+	return path.Clean(config.UploadDir) + ".staging"
 }
 
 func (config *Config) Load(configFileName string) error {
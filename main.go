@@ -3,13 +3,27 @@ package main
 
 import (
 	c "dfs/config"
+	"dfs/s3"
 	s "dfs/server"
+	"dfs/server/meta"
+	"dfs/server/replication"
+	st "dfs/server/token"
 	u "dfs/util"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 )
 
 const (
@@ -22,11 +36,17 @@ const (
 	RequestUploadURL   = "/request_upload/"
 	UploadURL          = "/upload/"
 	StatusURL          = "/status/"
+	DeleteURL          = "/delete/"
+	ListURL            = "/list/"
+	RaftMembersURL     = "/raft/members/"
+	AdminLocksURL      = "/admin/locks/"
+	PresignURL         = "/presign/"
 )
 
 var configFileName = flag.String("config", "config.json", "Config file name")
 
 var server s.Server
+var gateway s3.Gateway
 var uploadHtmlTemplate *template.Template
 var downloadHtmlTemplate *template.Template
 
@@ -53,12 +73,28 @@ func main() {
 	}
 
 	server.Start(config)
+	gateway.UseConfig(&config)
+	gateway.Listen(&server, UploadURL, DownloadURL, MultipartURL)
 
 	http.HandleFunc(RequestDownloadURL, requestDownload)
 	http.HandleFunc(DownloadURL, download)
 	http.HandleFunc(RequestUploadURL, requestUpload)
 	http.HandleFunc(UploadURL, upload)
 	http.HandleFunc(StatusURL, status)
+	http.HandleFunc(DeleteURL, deleteFile)
+	http.HandleFunc(ListURL, list)
+	http.HandleFunc(RaftMembersURL, raftMembers)
+	http.HandleFunc(AdminLocksURL, adminLocks)
+	http.HandleFunc(PresignURL, presign)
+	http.HandleFunc(TusURL, tus)
+	http.HandleFunc(MultipartURL, multipart)
+
+	http.HandleFunc(APIURL, apiNotFound)
+	http.HandleFunc(APIUploadsURL, apiUploads)
+	http.HandleFunc(APIDownloadsURL, apiDownloads)
+	http.HandleFunc(APIObjectsURL, apiObjects)
+	http.HandleFunc(APIBucketsURL, apiBuckets)
+	http.HandleFunc(APIStatusURL, apiStatus)
 
 	http.ListenAndServe(config.This.PublicAddress, nil)
 }
@@ -66,13 +102,29 @@ func main() {
 func requestDownload(response http.ResponseWriter, request *http.Request) {
 	bucketName, fileName, err := u.ExtractBucketNameFileName(request)
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
+		return
+	}
+
+	options, err := extractTokenOptions(request)
+	if err != nil {
+		writeError(response, request, err)
 		return
 	}
 
-	address, token, err := server.RequestDownload(bucketName, fileName)
+	address, token, err := server.RequestDownload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
+		return
+	}
+
+	if wantsJSON(request) {
+		link, err := newTransferLink(address, token, DownloadURL, http.MethodGet)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+		writeJSON(response, 200, link)
 		return
 	}
 
@@ -83,50 +135,84 @@ func requestDownload(response http.ResponseWriter, request *http.Request) {
 		"http://" + address + DownloadURL + token,
 		fileName,
 	})
-
-	enc := json.NewEncoder(response)
-	enc.Encode(struct {
-		Address string
-		Token   string
-	}{
-		address,
-		token,
-	})
 }
 
 func download(response http.ResponseWriter, request *http.Request) {
 	downloadToken, err := u.ExtractToken(request)
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
 		return
 	}
 
-	downloadPath, err := server.Download(downloadToken)
+	downloadPath, object, lease, err := server.Download(request.Context(), downloadToken, tokenAccess(request))
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
 		return
 	}
+	defer server.DownloadFinished(lease)
 
-	http.ServeFile(response, request, downloadPath)
+	file, err := os.Open(downloadPath)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	defer file.Close()
 
-	enc := json.NewEncoder(response)
-	enc.Encode(struct {
-		DownloadToken string
-	}{
-		downloadToken,
-	})
+	//Transfer is cut off if the lease is lost, the file may be replaced then,
+	//or once the token has read the file as many times as it may
+	serveObject(response, request, object, server.MeterDownload(downloadToken, lease.Guard(file)))
+}
+
+//serveObject sends the content of the file described by the catalog record.
+//ServeContent answers conditional and range requests, including multiple ranges, against the ETag.
+func serveObject(response http.ResponseWriter, request *http.Request, object meta.ObjectMeta, content io.ReadSeeker) {
+	header := response.Header()
+	header.Set("ETag", `"`+object.Checksum+`"`)
+	header.Set("Content-Disposition", contentDisposition(request, object.Path))
+	if checksum, err := hex.DecodeString(object.Checksum); err == nil {
+		header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(checksum)+":")
+	}
+	if object.ContentType != "" {
+		header.Set("Content-Type", object.ContentType)
+	}
+	http.ServeContent(response, request, "", object.Modified, content)
+}
+
+//contentDisposition saves the file under its own name, "inline" query parameter lets browsers show it instead
+func contentDisposition(request *http.Request, filePath string) string {
+	disposition := "attachment"
+	if _, inline := request.URL.Query()["inline"]; inline {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(filePath)})
 }
 
 func requestUpload(response http.ResponseWriter, request *http.Request) {
 	bucketName, fileName, err := u.ExtractBucketNameFileName(request)
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
 		return
 	}
 
-	address, token, err := server.RequestUpload(bucketName, fileName)
+	options, err := extractTokenOptions(request)
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
+		return
+	}
+
+	address, token, err := server.RequestUpload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	if wantsJSON(request) {
+		link, err := newTransferLink(address, token, UploadURL, http.MethodPost)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+		writeJSON(response, 201, link)
 		return
 	}
 
@@ -137,15 +223,53 @@ func requestUpload(response http.ResponseWriter, request *http.Request) {
 		"http://" + address + UploadURL + token,
 		UploadFileKey,
 	})
+}
 
-	enc := json.NewEncoder(response)
-	enc.Encode(struct {
-		Address string
-		Token   string
-	}{
-		address,
-		token,
-	})
+//extractTokenOptions reads what the token is asked for from ttl, max-uses, bind-ip, methods,
+//max-size, content-type and overwrite query parameters
+func extractTokenOptions(request *http.Request) (options st.TokenOptions, err error) {
+	query := request.URL.Query()
+	if query.Get("ttl") != "" {
+		options.TTL, err = time.ParseDuration(query.Get("ttl"))
+		if err != nil || options.TTL <= 0 {
+			return st.TokenOptions{}, u.ErrorBadQuery
+		}
+	}
+	if query.Get("max-uses") != "" {
+		options.MaxUses, err = strconv.Atoi(query.Get("max-uses"))
+		if err != nil || options.MaxUses <= 0 {
+			return st.TokenOptions{}, u.ErrorBadQuery
+		}
+	}
+	if query.Get("bind-ip") != "" {
+		options.BindIP, err = strconv.ParseBool(query.Get("bind-ip"))
+		if err != nil {
+			return st.TokenOptions{}, u.ErrorBadQuery
+		}
+	}
+	if query.Get("max-size") != "" {
+		options.MaxSize, err = strconv.ParseInt(query.Get("max-size"), 10, 64)
+		if err != nil || options.MaxSize <= 0 {
+			return st.TokenOptions{}, u.ErrorBadQuery
+		}
+	}
+	options.ContentType = query.Get("content-type")
+	if query.Get("overwrite") != "" {
+		options.Overwrite, err = strconv.ParseBool(query.Get("overwrite"))
+		if err != nil {
+			return st.TokenOptions{}, u.ErrorBadQuery
+		}
+	}
+	if query.Get("methods") != "" {
+		for _, method := range strings.Split(query.Get("methods"), ",") {
+			options.Methods = append(options.Methods, strings.ToUpper(strings.TrimSpace(method)))
+		}
+	}
+	return options, nil
+}
+
+func tokenAccess(request *http.Request) st.Access {
+	return st.Access{Method: request.Method, ClientIP: u.ClientIP(request)}
 }
 
 func upload(response http.ResponseWriter, request *http.Request) {
@@ -161,6 +285,19 @@ func upload(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	//Pre-signed links upload the request body as is
+	if request.Method == http.MethodPut {
+		access := tokenAccess(request)
+		access.ContentType = request.Header.Get("Content-Type")
+		object, err := server.Upload(request.Context(), uploadToken, access, request.Body)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 201, object)
+		return
+	}
+
 	file, fileHeader, err := request.FormFile(UploadFileKey)
 	if err != nil {
 		uploadHtmlTemplate.Execute(response, struct {
@@ -173,9 +310,175 @@ func upload(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	err = server.Upload(uploadToken, file, fileHeader)
+	access := tokenAccess(request)
+	access.ContentType = fileHeader.Header.Get("Content-Type")
+	object, err := server.Upload(request.Context(), uploadToken, access, file)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	if wantsJSON(request) {
+		writeJSON(response, 201, object)
+		return
+	}
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.WriteHeader(201)
+	fmt.Fprintf(response, "Uploaded %s, %d bytes.\n", object.Path, object.Size)
+}
+
+//presign returns signed link for the operation query parameter, "upload", "download" or "delete", on the file.
+//Token options are taken from the query like for /request_upload/ and /request_download/,
+//upload links are PUT links unless methods ask for another one.
+func presign(response http.ResponseWriter, request *http.Request) {
+	bucketName, fileName, err := u.ExtractBucketNameFileName(request)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	options, err := extractTokenOptions(request)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	var address, token, handlerURL, method string
+	switch request.URL.Query().Get("operation") {
+	case "upload":
+		method, handlerURL = http.MethodPut, UploadURL
+		if len(options.Methods) == 0 {
+			options.Methods = []string{method}
+		}
+		address, token, err = server.RequestUpload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
+	case "download":
+		method, handlerURL = http.MethodGet, DownloadURL
+		address, token, err = server.RequestDownload(request.Context(), bucketName, fileName, options, u.ClientIP(request))
+	case "delete":
+		//Delete URL names the file, the token goes to the query
+		method, handlerURL = http.MethodDelete, DeleteURL+bucketName+"/"+fileName+"?token="
+		address, token, err = server.RequestDelete(bucketName, fileName, options, u.ClientIP(request))
+	default:
+		err = u.ErrorBadQuery
+	}
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+
+	link, err := newTransferLink(address, token, handlerURL, method)
+	if err != nil {
+		writeJSONError(response, err)
+		return
+	}
+	writeJSON(response, 200, link)
+}
+
+//authorizeDelete lets the request delete the file if it has the admin token or the delete token of the file,
+//either as the bearer token or as token query parameter
+func authorizeDelete(request *http.Request, bucketName, fileName string) error {
+	token := u.ExtractBearerToken(request)
+	if token == "" {
+		token = request.URL.Query().Get("token")
+	}
+	if token == "" {
+		return ErrorUnauthorized
+	}
+	if server.IsAdminToken(token) {
+		return nil
+	}
+	return server.CheckDeleteToken(token, bucketName, fileName, tokenAccess(request))
+}
+
+func deleteFile(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete && request.Method != http.MethodPost {
+		response.Header().Set("Allow", "DELETE, POST")
+		writeError(response, request, ErrorMethodNotAllowed)
+		return
+	}
+
+	bucketName, fileName, err := u.ExtractBucketNameFileName(request)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	if err = authorizeDelete(request, bucketName, fileName); err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	deleted, err := server.Delete(request.Context(), bucketName, fileName)
+	result := deleteResult{Deleted: deleted}
+	if deleteError, ok := err.(*replication.DeleteError); ok {
+		result.Failed = deleteError.Failed
+		response.WriteHeader(500)
+	} else if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	enc := json.NewEncoder(response)
+	enc.Encode(result)
+}
+
+func list(response http.ResponseWriter, request *http.Request) {
+	bucketName, err := u.ExtractBucketName(request)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	query := request.URL.Query()
+	prefix := query.Get("prefix")
+	enc := json.NewEncoder(response)
+
+	if bucketName == "" {
+		enc.Encode(struct {
+			Buckets []string
+		}{
+			server.ListBuckets(prefix),
+		})
+		return
+	}
+
+	maxKeys, err := extractMaxKeys(request)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	listing, err := server.ListObjects(request.Context(), bucketName, prefix, query.Get("continuation-token"), maxKeys)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	enc.Encode(listing)
+}
+
+//raftMembers adds node to the consensus group on POST and removes it on DELETE, both need the admin token
+func raftMembers(response http.ResponseWriter, request *http.Request) {
+	if !server.IsAdminToken(u.ExtractBearerToken(request)) {
+		writeError(response, request, ErrorUnauthorized)
+		return
+	}
+
+	nodeName := strings.TrimPrefix(request.URL.Path, RaftMembersURL)
+	if nodeName == "" || !u.IsValidName(nodeName) {
+		writeError(response, request, u.ErrorBadQuery)
+		return
+	}
+
+	var err error
+	switch request.Method {
+	case http.MethodPost:
+		err = server.AddRaftMember(request.Context(), nodeName)
+	case http.MethodDelete:
+		err = server.RemoveRaftMember(request.Context(), nodeName)
+	default:
+		response.Header().Set("Allow", "POST, DELETE")
+		writeError(response, request, ErrorMethodNotAllowed)
+		return
+	}
 	if err != nil {
-		http.Error(response, err.Error(), 403)
+		writeError(response, request, err)
 		return
 	}
 }
@@ -186,3 +489,43 @@ func status(response http.ResponseWriter, request *http.Request) {
 	status := server.Status()
 	enc.Encode(status)
 }
+
+//adminLocks lists locks on GET and force-releases the lock given by resource
+//or the upload path given by path query parameter on DELETE.
+//Locks are granted by the raft log rather than by permissions of every node, so the listing tells:
+//Token of a holder orders the grants like a Lamport timestamp would, Waiting is the queue of writers
+//granted on release in order, and LocalWaiters counts callers of this node not yet asking the cluster.
+//No grant is pending on single nodes, a lock is held once the majority commits it.
+func adminLocks(response http.ResponseWriter, request *http.Request) {
+	if !server.IsAdminToken(u.ExtractBearerToken(request)) {
+		writeError(response, request, ErrorUnauthorized)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		enc := json.NewEncoder(response)
+		enc.SetIndent("", "  ")
+		enc.Encode(server.Locks())
+
+	case http.MethodDelete:
+		query := request.URL.Query()
+		var err error
+		switch {
+		case query.Get("resource") != "":
+			err = server.ForceUnlock(request.Context(), query.Get("resource"))
+		case query.Get("path") != "":
+			err = server.ForceUnlockPath(query.Get("path"))
+		default:
+			err = u.ErrorBadQuery
+		}
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+
+	default:
+		response.Header().Set("Allow", "GET, DELETE")
+		writeError(response, request, ErrorMethodNotAllowed)
+	}
+}
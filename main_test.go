@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"dfs/server/meta"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	mm "mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testContent = "0123456789"
+
+func newTestObject() meta.ObjectMeta {
+	checksum := sha256.Sum256([]byte(testContent))
+	return meta.ObjectMeta{
+		Path:        "bucket/file.txt",
+		Size:        int64(len(testContent)),
+		Checksum:    hex.EncodeToString(checksum[:]),
+		ContentType: "text/plain",
+		Modified:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestServeObject(t *testing.T) {
+	object := newTestObject()
+	etag := `"` + object.Checksum + `"`
+	modified := object.Modified.Format(http.TimeFormat)
+	earlier := object.Modified.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+		body   string
+		//contentRange is the Content-Range of the single range response
+		contentRange string
+	}{
+		{name: "whole file", status: http.StatusOK, body: testContent},
+		{name: "matching If-None-Match", header: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+		{name: "other If-None-Match", header: map[string]string{"If-None-Match": `"other"`}, status: http.StatusOK, body: testContent},
+		{name: "matching If-Match", header: map[string]string{"If-Match": etag}, status: http.StatusOK, body: testContent},
+		{name: "other If-Match", header: map[string]string{"If-Match": `"other"`}, status: http.StatusPreconditionFailed},
+		{name: "not modified since", header: map[string]string{"If-Modified-Since": modified}, status: http.StatusNotModified},
+		{name: "modified since", header: map[string]string{"If-Modified-Since": earlier}, status: http.StatusOK, body: testContent},
+		{name: "modified after If-Unmodified-Since", header: map[string]string{"If-Unmodified-Since": earlier}, status: http.StatusPreconditionFailed},
+		{name: "range", header: map[string]string{"Range": "bytes=2-5"}, status: http.StatusPartialContent, body: "2345", contentRange: "bytes 2-5/10"},
+		{name: "suffix range", header: map[string]string{"Range": "bytes=-3"}, status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+		{name: "range of the same version", header: map[string]string{"Range": "bytes=8-", "If-Range": etag}, status: http.StatusPartialContent, body: "89", contentRange: "bytes 8-9/10"},
+		{name: "range of other version", header: map[string]string{"Range": "bytes=8-", "If-Range": `"other"`}, status: http.StatusOK, body: testContent},
+		{name: "unsatisfiable range", header: map[string]string{"Range": "bytes=20-30"}, status: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, DownloadURL+"token", nil)
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+			response := httptest.NewRecorder()
+			serveObject(response, request, object, strings.NewReader(testContent))
+
+			if response.Code != test.status {
+				t.Fatalf("got status %d, want %d", response.Code, test.status)
+			}
+			if response.Header().Get("ETag") != etag {
+				t.Fatalf("got ETag %s, want %s", response.Header().Get("ETag"), etag)
+			}
+			if test.body != "" && response.Body.String() != test.body {
+				t.Fatalf("got body %q, want %q", response.Body.String(), test.body)
+			}
+			if contentRange := response.Header().Get("Content-Range"); test.contentRange != "" && contentRange != test.contentRange {
+				t.Fatalf("got Content-Range %s, want %s", contentRange, test.contentRange)
+			}
+		})
+	}
+}
+
+func TestServeObjectRanges(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, DownloadURL+"token", nil)
+	request.Header.Set("Range", "bytes=0-1,5-6")
+	response := httptest.NewRecorder()
+	serveObject(response, request, newTestObject(), strings.NewReader(testContent))
+
+	if response.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", response.Code, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got content type %s, %v", response.Header().Get("Content-Type"), err)
+	}
+	reader := mm.NewReader(response.Body, params["boundary"])
+	parts := []struct {
+		contentRange string
+		body         string
+	}{
+		{contentRange: "bytes 0-1/10", body: "01"},
+		{contentRange: "bytes 5-6/10", body: "56"},
+	}
+	for _, want := range parts {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Range") != want.contentRange || string(body) != want.body {
+			t.Fatalf("got part %s %q, want %s %q", part.Header.Get("Content-Range"), body, want.contentRange, want.body)
+		}
+		if part.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("got part content type %s, want text/plain", part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err := reader.NextPart(); err == nil {
+		t.Fatal("got more parts than ranges")
+	}
+}
+
+func TestServeObjectHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		disposition string
+	}{
+		{name: "attachment", disposition: "attachment; filename=file.txt"},
+		{name: "inline", query: "?inline", disposition: "inline; filename=file.txt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, DownloadURL+"token"+test.query, nil)
+			response := httptest.NewRecorder()
+			serveObject(response, request, newTestObject(), strings.NewReader(testContent))
+
+			header := response.Header()
+			if header.Get("Content-Disposition") != test.disposition {
+				t.Fatalf("got Content-Disposition %s, want %s", header.Get("Content-Disposition"), test.disposition)
+			}
+			if !strings.HasPrefix(header.Get("Repr-Digest"), "sha-256=:") {
+				t.Fatalf("got Repr-Digest %s", header.Get("Repr-Digest"))
+			}
+			if header.Get("Accept-Ranges") != "bytes" || header.Get("Content-Type") != "text/plain" {
+				t.Fatalf("got Accept-Ranges %s, Content-Type %s", header.Get("Accept-Ranges"), header.Get("Content-Type"))
+			}
+		})
+	}
+}
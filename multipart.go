@@ -0,0 +1,114 @@
+package main
+
+import (
+	mp "dfs/server/multipart"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Multipart uploads: POST to MultipartURL + upload token initiates the upload on the node the token is for,
+//PUT to MultipartURL + ID + "/" + part number uploads the part to any node, GET describes the upload,
+//POST to MultipartURL + ID + "/complete" assembles the file on the initiating node and DELETE aborts the upload.
+//ID of the upload authorizes requests to it.
+const (
+	MultipartURL = "/multipart/"
+	completePath = "complete"
+)
+
+//multipartUpload describes the upload to the client. Parts are sent to any of Addresses,
+//Complete is the URL of the node that assembles the file.
+type multipartUpload struct {
+	UploadID  string
+	Path      string
+	Complete  string
+	Addresses []string
+	Parts     []mp.Part
+	Expires   time.Time
+}
+
+//completeRequest lists parts to assemble the file from, like in S3 the list must not be empty
+type completeRequest struct {
+	Parts []mp.CompletedPart
+}
+
+func newMultipartUpload(upload mp.Upload) multipartUpload {
+	return multipartUpload{
+		UploadID:  upload.ID,
+		Path:      upload.Path,
+		Complete:  "http://" + server.NodeAddress(upload.Node) + MultipartURL + upload.ID + "/" + completePath,
+		Addresses: server.PartAddresses(upload),
+		Parts:     upload.SortedParts(),
+		Expires:   server.MultipartUploadExpires(upload),
+	}
+}
+
+func multipart(response http.ResponseWriter, request *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(request.URL.Path, MultipartURL), "/")
+	id := segments[0]
+
+	switch {
+	case len(segments) == 1 && request.Method == http.MethodPost:
+		access := tokenAccess(request)
+		access.ContentType = request.Header.Get("Content-Type")
+		upload, err := server.InitiateMultipartUpload(request.Context(), id, access)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 201, newMultipartUpload(upload))
+
+	case len(segments) == 1 && request.Method == http.MethodGet:
+		upload, err := server.MultipartUpload(request.Context(), id)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 200, newMultipartUpload(upload))
+
+	case len(segments) == 1 && request.Method == http.MethodDelete:
+		err := server.AbortMultipartUpload(request.Context(), id)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+
+	case len(segments) == 2 && segments[1] == completePath && request.Method == http.MethodPost:
+		var body completeRequest
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			writeJSONError(response, ErrorBadRequestBody)
+			return
+		}
+		object, err := server.CompleteMultipartUpload(request.Context(), id, body.Parts)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		writeJSON(response, 201, object)
+
+	case len(segments) == 2 && request.Method == http.MethodPut:
+		number, err := strconv.Atoi(segments[1])
+		if err != nil {
+			writeJSONError(response, mp.ErrorInvalidPartNumber)
+			return
+		}
+		part, err := server.UploadPart(request.Context(), id, number, request.Body)
+		if err != nil {
+			writeJSONError(response, err)
+			return
+		}
+		response.Header().Set("ETag", `"`+part.MD5+`"`)
+		writeJSON(response, 200, part)
+
+	case len(segments) <= 2:
+		apiMethodNotAllowed(response, "GET, POST, PUT, DELETE")
+
+	default:
+		writeJSONError(response, ErrorNotFound)
+	}
+}
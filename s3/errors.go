@@ -0,0 +1,122 @@
+package s3
+
+import (
+	"dfs/comm"
+	s "dfs/server"
+	"dfs/server/lock"
+	"dfs/server/meta"
+	mp "dfs/server/multipart"
+	sp "dfs/server/path"
+	"dfs/server/raft"
+	"errors"
+	"net/http"
+)
+
+//Error is the S3 error response, clients tell errors by Code
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+var (
+	ErrorAccessDenied              = &Error{403, "AccessDenied", "Access denied."}
+	ErrorRequestExpired            = &Error{403, "AccessDenied", "Request has expired."}
+	ErrorInvalidAccessKeyID        = &Error{403, "InvalidAccessKeyId", "The access key ID does not exist."}
+	ErrorSignatureDoesNotMatch     = &Error{403, "SignatureDoesNotMatch", "The request signature does not match."}
+	ErrorRequestTimeTooSkewed      = &Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server time is too large."}
+	ErrorAuthorizationMalformed    = &Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	ErrorAuthorizationQueryInvalid = &Error{400, "AuthorizationQueryParametersError", "The authorization query parameters are invalid."}
+	ErrorContentSHA256Mismatch     = &Error{400, "XAmzContentSHA256Mismatch", "The content SHA-256 does not match the request body."}
+	ErrorBadDigest                 = &Error{400, "BadDigest", "The Content-MD5 does not match the request body."}
+	ErrorInvalidDigest             = &Error{400, "InvalidDigest", "The Content-MD5 is not valid."}
+	ErrorIncompleteBody            = &Error{400, "IncompleteBody", "The request body is malformed or incomplete."}
+	ErrorInvalidArgument           = &Error{400, "InvalidArgument", "Invalid argument."}
+	ErrorInvalidBucketName         = &Error{400, "InvalidBucketName", "The bucket name is not valid."}
+	ErrorUnsupportedKey            = &Error{400, "InvalidArgument", "The key contains characters or segments that are not supported."}
+	ErrorEntityTooLarge            = &Error{400, "EntityTooLarge", "The object exceeds the maximum allowed size."}
+	ErrorInvalidPart               = &Error{400, "InvalidPart", "One or more of the specified parts could not be found or the ETag does not match."}
+	ErrorInvalidPartOrder          = &Error{400, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	ErrorMalformedXML              = &Error{400, "MalformedXML", "The XML is not well-formed."}
+	ErrorNoSuchBucket              = &Error{404, "NoSuchBucket", "The specified bucket does not exist."}
+	ErrorNoSuchKey                 = &Error{404, "NoSuchKey", "The specified key does not exist."}
+	ErrorNoSuchUpload              = &Error{404, "NoSuchUpload", "The specified multipart upload does not exist."}
+	ErrorMethodNotAllowed          = &Error{405, "MethodNotAllowed", "The method is not allowed against this resource."}
+	ErrorBucketAlreadyOwnedByYou   = &Error{409, "BucketAlreadyOwnedByYou", "The bucket already exists."}
+	ErrorBucketNotEmpty            = &Error{409, "BucketNotEmpty", "The bucket is not empty."}
+	ErrorOperationAborted          = &Error{409, "OperationAborted", "A conflicting operation is currently in progress against this resource."}
+	ErrorKeyConflict               = &Error{409, "KeyConflict", "The key is a prefix of another key followed by a slash or the other way round."}
+	ErrorPreconditionFailed        = &Error{412, "PreconditionFailed", "At least one of the preconditions does not hold."}
+	ErrorInternalError             = &Error{500, "InternalError", "We encountered an internal error."}
+	ErrorNotImplemented            = &Error{501, "NotImplemented", "The functionality is not implemented."}
+	ErrorServiceUnavailable        = &Error{503, "ServiceUnavailable", "The cluster is not available, try again later."}
+)
+
+//apiErrorCodes maps error codes of the JSON API the other nodes answer with to S3 errors
+var apiErrorCodes = map[string]*Error{
+	"FileTooLarge":       ErrorEntityTooLarge,
+	"PartIsTooLarge":     ErrorEntityTooLarge,
+	"FileDoesNotExist":   ErrorNoSuchKey,
+	"UploadDoesNotExist": ErrorNoSuchUpload,
+	"InvalidPart":        ErrorInvalidPart,
+	"NoPartsListed":      ErrorMalformedXML,
+	"InvalidPartOrder":   ErrorInvalidPartOrder,
+	"ReservedFileName":   ErrorUnsupportedKey,
+	"PathConflict":       ErrorKeyConflict,
+	"PathIsLocked":       ErrorOperationAborted,
+	"ResourceIsLocked":   ErrorOperationAborted,
+	"StaleFencingToken":  ErrorOperationAborted,
+	"UploadIsUnknown":    ErrorOperationAborted,
+	"LeaseExpired":       ErrorOperationAborted,
+	"UploadIsCompleting": ErrorOperationAborted,
+	"QuorumLost":         ErrorServiceUnavailable,
+	"NoNodeAvailable":    ErrorServiceUnavailable,
+	"NodeIsDead":         ErrorServiceUnavailable,
+}
+
+//toError returns S3 error that tells client about err
+func toError(err error) *Error {
+	var s3Error *Error
+	if errors.As(err, &s3Error) {
+		return s3Error
+	}
+	switch err {
+	case s.ErrorFileDoesNotExist:
+		return ErrorNoSuchKey
+	case meta.ErrorBucketDoesNotExist:
+		return ErrorNoSuchBucket
+	case meta.ErrorBucketAlreadyExists:
+		return ErrorBucketAlreadyOwnedByYou
+	case meta.ErrorBucketIsNotEmpty:
+		return ErrorBucketNotEmpty
+	case meta.ErrorBadContinuationToken:
+		return ErrorInvalidArgument
+	case s.ErrorReservedFileName:
+		return ErrorUnsupportedKey
+	case s.ErrorPathConflict:
+		return ErrorKeyConflict
+	case s.ErrorFileTooLarge, mp.ErrorPartIsTooLarge:
+		return ErrorEntityTooLarge
+	case mp.ErrorUploadDoesNotExist:
+		return ErrorNoSuchUpload
+	case mp.ErrorInvalidPart:
+		return ErrorInvalidPart
+	case mp.ErrorNoPartsListed:
+		return ErrorMalformedXML
+	case mp.ErrorInvalidPartOrder:
+		return ErrorInvalidPartOrder
+	case mp.ErrorInvalidPartNumber:
+		return ErrorInvalidArgument
+	case s.ErrorPathIsLocked, sp.ErrorPathIsLocked, lock.ErrorResourceIsLocked, meta.ErrorStaleFencingToken,
+		mp.ErrorUploadIsCompleting, sp.ErrorUploadIsUnknown, lock.ErrorLeaseExpired:
+		return ErrorOperationAborted
+	case s.ErrorNoNodeAvailable, raft.ErrorNoLeader, raft.ErrorLeadershipLost, raft.ErrorNoQuorum,
+		comm.ErrorRequestTimeout, comm.ErrorNodeIsDead:
+		return ErrorServiceUnavailable
+	}
+	return &Error{http.StatusInternalServerError, ErrorInternalError.Code, err.Error()}
+}
@@ -0,0 +1,757 @@
+//Package s3 serves the cluster to S3 clients: buckets and keys are mapped onto files of the cluster
+//and requests are authenticated by SigV4 signatures.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	c "dfs/config"
+	s "dfs/server"
+	"dfs/server/meta"
+	mp "dfs/server/multipart"
+	st "dfs/server/token"
+	u "dfs/util"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	//maxListPages limits catalog pages read to fill one listing, common prefixes may skip many files
+	maxListPages = 100
+)
+
+//Gateway translates S3 requests into requests to the server.
+//Transfers of files the other node is chosen for are proxied to that node.
+type Gateway struct {
+	config       *c.Config
+	server       *s.Server
+	uploadURL    string
+	downloadURL  string
+	multipartURL string
+	client       *http.Client
+}
+
+func (gateway *Gateway) UseConfig(config *c.Config) {
+	gateway.config = config
+}
+
+//Listen serves S3 requests on the configured address in background.
+//uploadURL, downloadURL and multipartURL are handlers of the nodes transfers are proxied to.
+//Gateway is not started unless both address and credentials are configured.
+func (gateway *Gateway) Listen(server *s.Server, uploadURL, downloadURL, multipartURL string) {
+	gateway.server = server
+	gateway.uploadURL = uploadURL
+	gateway.downloadURL = downloadURL
+	gateway.multipartURL = multipartURL
+	gateway.client = &http.Client{}
+
+	if gateway.config.S3.Address == "" || len(gateway.config.S3.Credentials) == 0 {
+		return
+	}
+	go func() {
+		log.Fatal(http.ListenAndServe(gateway.config.S3.Address, gateway))
+	}()
+}
+
+func (gateway *Gateway) region() string {
+	if gateway.config.S3.Region != "" {
+		return gateway.config.S3.Region
+	}
+	return defaultRegion
+}
+
+func (gateway *Gateway) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	requestID := newRequestID()
+	response.Header().Set("X-Amz-Request-Id", requestID)
+	response.Header().Set("Server", "DFS")
+
+	sig, err := gateway.authenticate(request)
+	if err != nil {
+		gateway.writeError(response, request, requestID, err)
+		return
+	}
+	body, err := gateway.payload(request, sig)
+	if err != nil {
+		gateway.writeError(response, request, requestID, err)
+		return
+	}
+
+	bucketName, key := splitPath(request.URL.Path)
+	if bucketName != "" && !u.IsValidName(bucketName) {
+		gateway.writeError(response, request, requestID, ErrorInvalidBucketName)
+		return
+	}
+	if key != "" && !isValidKey(key) {
+		gateway.writeError(response, request, requestID, ErrorUnsupportedKey)
+		return
+	}
+
+	query := request.URL.Query()
+	switch {
+	case bucketName == "" && request.Method == http.MethodGet:
+		err = gateway.listBuckets(response)
+	case bucketName == "":
+		err = ErrorMethodNotAllowed
+
+	case key == "" && request.Method == http.MethodPut:
+		err = gateway.createBucket(response, request, bucketName)
+	case key == "" && request.Method == http.MethodDelete:
+		err = gateway.deleteBucket(response, request, bucketName)
+	case key == "" && request.Method == http.MethodHead:
+		err = gateway.headBucket(bucketName)
+	case key == "" && request.Method == http.MethodGet && hasParam(query, "location"):
+		err = gateway.bucketLocation(response, bucketName)
+	case key == "" && request.Method == http.MethodGet:
+		err = gateway.listObjects(response, request, bucketName)
+	case key == "":
+		err = ErrorMethodNotAllowed
+
+	case request.Method == http.MethodPost && hasParam(query, "uploads"):
+		err = gateway.createMultipartUpload(response, request, bucketName, key)
+	case request.Method == http.MethodPost && hasParam(query, "uploadId"):
+		err = gateway.completeMultipartUpload(response, request, body, bucketName, key)
+	case request.Method == http.MethodPut && hasParam(query, "uploadId"):
+		err = gateway.uploadPart(response, request, body, bucketName, key)
+	case request.Method == http.MethodDelete && hasParam(query, "uploadId"):
+		err = gateway.abortMultipartUpload(response, request, bucketName, key)
+	case request.Method == http.MethodGet && hasParam(query, "uploadId"):
+		err = gateway.listParts(response, request, bucketName, key)
+
+	case request.Method == http.MethodPut:
+		err = gateway.putObject(response, request, body, bucketName, key)
+	case request.Method == http.MethodGet || request.Method == http.MethodHead:
+		err = gateway.getObject(response, request, bucketName, key)
+	case request.Method == http.MethodDelete:
+		err = gateway.deleteObject(response, request, bucketName, key)
+	default:
+		err = ErrorMethodNotAllowed
+	}
+	if err != nil {
+		gateway.writeError(response, request, requestID, err)
+	}
+}
+
+func (gateway *Gateway) writeError(response http.ResponseWriter, request *http.Request, requestID string, err error) {
+	s3Error := toError(err)
+	if s3Error.Status == http.StatusInternalServerError {
+		log.Println(err)
+	}
+	if request.Method == http.MethodHead {
+		response.WriteHeader(s3Error.Status)
+		return
+	}
+	writeXML(response, s3Error.Status, errorResponse{
+		Code:      s3Error.Code,
+		Message:   s3Error.Message,
+		Resource:  request.URL.Path,
+		RequestID: requestID,
+	})
+}
+
+func writeXML(response http.ResponseWriter, status int, value interface{}) {
+	response.Header().Set("Content-Type", "application/xml")
+	response.WriteHeader(status)
+	io.WriteString(response, xml.Header)
+	xml.NewEncoder(response).Encode(value)
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+//splitPath returns bucket and key of the path-style request "/{bucket}/{key}"
+func splitPath(path string) (bucketName, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+//isValidKey reports whether key is a path of valid names, S3 keys may hold slashes but the files can not escape the bucket
+func isValidKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if !u.IsValidName(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasParam(query url.Values, name string) bool {
+	_, exists := query[name]
+	return exists
+}
+
+func etag(object meta.ObjectMeta) string {
+	if object.CompositeMD5 != "" {
+		return `"` + object.CompositeMD5 + `"`
+	}
+	if object.MD5 != "" {
+		return `"` + object.MD5 + `"`
+	}
+	return `"` + object.Checksum + `"`
+}
+
+func (gateway *Gateway) listBuckets(response http.ResponseWriter) error {
+	result := listAllMyBucketsResult{
+		Owner:   owner{ownerID, ownerID},
+		Buckets: make([]bucketEntry, 0),
+	}
+	for _, bucket := range gateway.server.Buckets() {
+		result.Buckets = append(result.Buckets, bucketEntry{bucket.Name, formatTime(bucket.Created)})
+	}
+	writeXML(response, http.StatusOK, result)
+	return nil
+}
+
+func (gateway *Gateway) createBucket(response http.ResponseWriter, request *http.Request, bucketName string) error {
+	err := gateway.server.CreateBucket(request.Context(), bucketName)
+	if err != nil {
+		return err
+	}
+	response.Header().Set("Location", "/"+bucketName)
+	response.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (gateway *Gateway) deleteBucket(response http.ResponseWriter, request *http.Request, bucketName string) error {
+	err := gateway.server.DeleteBucket(request.Context(), bucketName)
+	if err != nil {
+		return err
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (gateway *Gateway) headBucket(bucketName string) error {
+	if !gateway.server.BucketExists(bucketName) {
+		return ErrorNoSuchBucket
+	}
+	return nil
+}
+
+func (gateway *Gateway) bucketLocation(response http.ResponseWriter, bucketName string) error {
+	if !gateway.server.BucketExists(bucketName) {
+		return ErrorNoSuchBucket
+	}
+	//Buckets of the default region have no location constraint
+	region := gateway.region()
+	if region == defaultRegion {
+		region = ""
+	}
+	writeXML(response, http.StatusOK, locationConstraint{Region: region})
+	return nil
+}
+
+//listObjects answers ListObjectsV2 if list-type is 2 and ListObjects otherwise.
+//Keys sharing the part up to the delimiter after prefix are rolled up into one common prefix.
+func (gateway *Gateway) listObjects(response http.ResponseWriter, request *http.Request, bucketName string) error {
+	if !gateway.server.BucketExists(bucketName) {
+		return ErrorNoSuchBucket
+	}
+	query := request.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		return ErrorInvalidArgument
+	}
+	maxKeys := meta.DefaultMaxKeys
+	if query.Get("max-keys") != "" {
+		var err error
+		maxKeys, err = strconv.Atoi(query.Get("max-keys"))
+		if err != nil || maxKeys < 0 {
+			return ErrorInvalidArgument
+		}
+		if maxKeys > meta.DefaultMaxKeys {
+			maxKeys = meta.DefaultMaxKeys
+		}
+	}
+
+	startAfter := query.Get("start-after")
+	if !v2 {
+		startAfter = query.Get("marker")
+	}
+	if v2 && query.Get("continuation-token") != "" {
+		var err error
+		startAfter, err = meta.ParseContinuationToken(query.Get("continuation-token"))
+		if err != nil {
+			return ErrorInvalidArgument
+		}
+	}
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+		}
+		return s
+	}
+	result := listBucketResult{
+		Name:         bucketName,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		EncodingType: encodingType,
+		MaxKeys:      maxKeys,
+	}
+
+	count := 0
+	lastPrefix := ""
+	for page := 0; count < maxKeys && page < maxListPages; page++ {
+		continuationToken := ""
+		if startAfter != "" {
+			continuationToken = meta.ContinuationToken(startAfter)
+		}
+		listing, err := gateway.server.ListObjects(request.Context(), bucketName, prefix, continuationToken, maxKeys-count)
+		if err != nil {
+			return err
+		}
+		for _, object := range listing.Objects {
+			if count == maxKeys {
+				break
+			}
+			key := strings.TrimPrefix(object.Path, bucketName+"/")
+			if lastPrefix != "" && strings.HasPrefix(key, lastPrefix) {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				lastPrefix = key[:len(prefix)+i+len(delimiter)]
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{encode(lastPrefix)})
+				//Keys are UTF-8, so none of them starts with the prefix and goes after 0xff
+				startAfter = lastPrefix + "\xff"
+			} else {
+				result.Contents = append(result.Contents, objectEntry{
+					Key:          encode(key),
+					LastModified: formatTime(object.Modified),
+					ETag:         etag(object),
+					Size:         object.Size,
+					StorageClass: "STANDARD",
+				})
+				startAfter = key
+			}
+			count++
+		}
+		if !listing.IsTruncated && count < maxKeys {
+			break
+		}
+		if count == maxKeys {
+			//Listing is truncated only if something is left after the last key
+			rest, err := gateway.server.ListObjects(request.Context(), bucketName, prefix, meta.ContinuationToken(startAfter), 1)
+			if err != nil {
+				return err
+			}
+			result.IsTruncated = len(rest.Objects) > 0
+		} else {
+			result.IsTruncated = listing.IsTruncated
+		}
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = encode(query.Get("start-after"))
+		if result.IsTruncated {
+			result.NextContinuationToken = meta.ContinuationToken(startAfter)
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = encode(strings.TrimSuffix(startAfter, "\xff"))
+		}
+	}
+	writeXML(response, http.StatusOK, result)
+	return nil
+}
+
+//putObject uploads the body replacing the existing file
+func (gateway *Gateway) putObject(response http.ResponseWriter, request *http.Request, body io.Reader, bucketName, key string) error {
+	if request.Header.Get("X-Amz-Copy-Source") != "" {
+		return ErrorNotImplemented
+	}
+	clientIP := u.ClientIP(request)
+	address, token, err := gateway.server.RequestUpload(request.Context(), bucketName, key, st.TokenOptions{Overwrite: true}, clientIP)
+	if err != nil {
+		return err
+	}
+
+	contentType := request.Header.Get("Content-Type")
+	var object meta.ObjectMeta
+	if address == gateway.config.This.PublicAddress {
+		object, err = gateway.server.Upload(request.Context(), token, st.Access{
+			Method:      http.MethodPut,
+			ClientIP:    clientIP,
+			ContentType: contentType,
+		}, body)
+	} else {
+		object, err = gateway.proxyUpload(request.Context(), address, token, contentType, body)
+	}
+	if err != nil {
+		return err
+	}
+	response.Header().Set("ETag", etag(object))
+	response.WriteHeader(http.StatusOK)
+	return nil
+}
+
+//proxyUpload sends the body to the node the upload token was issued for
+func (gateway *Gateway) proxyUpload(ctx context.Context, address, token, contentType string, body io.Reader) (meta.ObjectMeta, error) {
+	proxyRequest, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://"+address+gateway.uploadURL+token, body)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	proxyRequest.Header.Set("Content-Type", contentType)
+	proxyRequest.Header.Set("Accept", "application/json")
+	proxyResponse, err := gateway.client.Do(proxyRequest)
+	if err != nil {
+		//Errors of reading the body are passed through by the client
+		return meta.ObjectMeta{}, toError(err)
+	}
+	defer proxyResponse.Body.Close()
+
+	if proxyResponse.StatusCode != http.StatusCreated {
+		return meta.ObjectMeta{}, proxyError(proxyResponse)
+	}
+	var object meta.ObjectMeta
+	err = json.NewDecoder(proxyResponse.Body).Decode(&object)
+	return object, err
+}
+
+//proxyError returns S3 error that tells about failure of the JSON API of the other node
+func proxyError(proxyResponse *http.Response) error {
+	var body struct {
+		Error struct {
+			Code    string
+			Message string
+		}
+	}
+	json.NewDecoder(proxyResponse.Body).Decode(&body)
+	if s3Error, exists := apiErrorCodes[body.Error.Code]; exists {
+		return s3Error
+	}
+	return &Error{http.StatusInternalServerError, ErrorInternalError.Code, body.Error.Message}
+}
+
+//getObject serves GetObject and HeadObject. Preconditions are checked against the catalog record,
+//the content is served by this node or proxied from the node chosen for the download.
+func (gateway *Gateway) getObject(response http.ResponseWriter, request *http.Request, bucketName, key string) error {
+	object, err := gateway.server.Object(bucketName, key)
+	if err == s.ErrorFileDoesNotExist && !gateway.server.BucketExists(bucketName) {
+		return ErrorNoSuchBucket
+	}
+	if err != nil {
+		return err
+	}
+
+	header := response.Header()
+	header.Set("ETag", etag(object))
+	header.Set("Last-Modified", object.Modified.UTC().Format(http.TimeFormat))
+	header.Set("Content-Type", object.ContentType)
+	header.Set("Accept-Ranges", "bytes")
+
+	status := checkPreconditions(request, object)
+	if status == http.StatusPreconditionFailed {
+		return ErrorPreconditionFailed
+	}
+	if status == http.StatusNotModified {
+		response.WriteHeader(status)
+		return nil
+	}
+	if request.Method == http.MethodHead {
+		header.Set("Content-Length", strconv.FormatInt(object.Size, 10))
+		response.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	clientIP := u.ClientIP(request)
+	address, token, err := gateway.server.RequestDownload(request.Context(), bucketName, key, st.TokenOptions{}, clientIP)
+	if err != nil {
+		return err
+	}
+	if address != gateway.config.This.PublicAddress {
+		return gateway.proxyDownload(response, request, address, token)
+	}
+
+	downloadPath, _, lease, err := gateway.server.Download(request.Context(), token, st.Access{Method: http.MethodGet, ClientIP: clientIP})
+	if err != nil {
+		return err
+	}
+	defer gateway.server.DownloadFinished(lease)
+	file, err := os.Open(downloadPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	//Preconditions are checked already, ServeContent handles the range
+	request.Header.Del("If-Match")
+	request.Header.Del("If-None-Match")
+	request.Header.Del("If-Modified-Since")
+	request.Header.Del("If-Unmodified-Since")
+	http.ServeContent(response, request, "", object.Modified, gateway.server.MeterDownload(token, lease.Guard(file)))
+	return nil
+}
+
+//proxyDownload streams the file from the node the download token was issued for
+func (gateway *Gateway) proxyDownload(response http.ResponseWriter, request *http.Request, address, token string) error {
+	proxyRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, "http://"+address+gateway.downloadURL+token, nil)
+	if err != nil {
+		return err
+	}
+	proxyRequest.Header.Set("Accept", "application/json")
+	if rangeHeader := request.Header.Get("Range"); rangeHeader != "" {
+		proxyRequest.Header.Set("Range", rangeHeader)
+	}
+	proxyResponse, err := gateway.client.Do(proxyRequest)
+	if err != nil {
+		return ErrorServiceUnavailable
+	}
+	defer proxyResponse.Body.Close()
+
+	if proxyResponse.StatusCode != http.StatusOK && proxyResponse.StatusCode != http.StatusPartialContent {
+		if proxyResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return &Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+		}
+		return proxyError(proxyResponse)
+	}
+	for _, name := range []string{"Content-Length", "Content-Range"} {
+		if value := proxyResponse.Header.Get(name); value != "" {
+			response.Header().Set(name, value)
+		}
+	}
+	//Several ranges come as parts of the multipart body
+	if contentType := proxyResponse.Header.Get("Content-Type"); strings.HasPrefix(contentType, "multipart/byteranges") {
+		response.Header().Set("Content-Type", contentType)
+	}
+	response.WriteHeader(proxyResponse.StatusCode)
+	io.Copy(response, proxyResponse.Body)
+	return nil
+}
+
+//checkPreconditions evaluates conditional headers of the request against the file,
+//it returns 412 or 304 if the request must not be served and 200 otherwise
+func checkPreconditions(request *http.Request, object meta.ObjectMeta) int {
+	matches := func(header string) bool {
+		for _, value := range strings.Split(header, ",") {
+			value = strings.TrimSpace(value)
+			if value == "*" || strings.TrimPrefix(value, "W/") == etag(object) {
+				return true
+			}
+		}
+		return false
+	}
+	modified := object.Modified.Truncate(time.Second)
+
+	if header := request.Header.Get("If-Match"); header != "" && !matches(header) {
+		return http.StatusPreconditionFailed
+	}
+	if header := request.Header.Get("If-Unmodified-Since"); header != "" && request.Header.Get("If-Match") == "" {
+		if since, err := http.ParseTime(header); err == nil && modified.After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if header := request.Header.Get("If-None-Match"); header != "" {
+		if matches(header) {
+			return http.StatusNotModified
+		}
+		return http.StatusOK
+	}
+	if header := request.Header.Get("If-Modified-Since"); header != "" {
+		if since, err := http.ParseTime(header); err == nil && !modified.After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return http.StatusOK
+}
+
+//deleteObject removes the file, deleting missing files succeeds like in S3
+func (gateway *Gateway) deleteObject(response http.ResponseWriter, request *http.Request, bucketName, key string) error {
+	_, err := gateway.server.Delete(request.Context(), bucketName, key)
+	if err != nil && err != s.ErrorFileDoesNotExist {
+		return err
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+//createMultipartUpload reserves the key and initiates the upload on the node the upload token is issued for
+func (gateway *Gateway) createMultipartUpload(response http.ResponseWriter, request *http.Request, bucketName, key string) error {
+	clientIP := u.ClientIP(request)
+	address, token, err := gateway.server.RequestUpload(request.Context(), bucketName, key, st.TokenOptions{Overwrite: true}, clientIP)
+	if err != nil {
+		return err
+	}
+
+	contentType := request.Header.Get("Content-Type")
+	var uploadID string
+	if address == gateway.config.This.PublicAddress {
+		upload, err := gateway.server.InitiateMultipartUpload(request.Context(), token, st.Access{
+			Method:      http.MethodPost,
+			ClientIP:    clientIP,
+			ContentType: contentType,
+		})
+		if err != nil {
+			return err
+		}
+		uploadID = upload.ID
+	} else {
+		var upload struct {
+			UploadID string
+		}
+		err = gateway.proxyJSON(request.Context(), address+gateway.multipartURL+token, contentType, nil, &upload)
+		if err != nil {
+			return err
+		}
+		uploadID = upload.UploadID
+	}
+	writeXML(response, http.StatusOK, initiateMultipartUploadResult{
+		Bucket:   bucketName,
+		Key:      key,
+		UploadID: uploadID,
+	})
+	return nil
+}
+
+//multipartUpload returns the upload of the query if it uploads the key
+func (gateway *Gateway) multipartUpload(request *http.Request, bucketName, key string) (mp.Upload, error) {
+	upload, err := gateway.server.MultipartUpload(request.Context(), request.URL.Query().Get("uploadId"))
+	if err != nil {
+		return mp.Upload{}, err
+	}
+	if upload.Path != bucketName+"/"+key {
+		return mp.Upload{}, ErrorNoSuchUpload
+	}
+	return upload, nil
+}
+
+//uploadPart stores the part on this node, parts are accepted by every node
+func (gateway *Gateway) uploadPart(response http.ResponseWriter, request *http.Request, body io.Reader, bucketName, key string) error {
+	if request.Header.Get("X-Amz-Copy-Source") != "" {
+		return ErrorNotImplemented
+	}
+	upload, err := gateway.multipartUpload(request, bucketName, key)
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(request.URL.Query().Get("partNumber"))
+	if err != nil {
+		return ErrorInvalidArgument
+	}
+	part, err := gateway.server.UploadPart(request.Context(), upload.ID, number, body)
+	if err != nil {
+		return err
+	}
+	response.Header().Set("ETag", `"`+part.MD5+`"`)
+	response.WriteHeader(http.StatusOK)
+	return nil
+}
+
+//completeMultipartUpload assembles the listed parts on the node the upload was initiated on
+func (gateway *Gateway) completeMultipartUpload(response http.ResponseWriter, request *http.Request, body io.Reader, bucketName, key string) error {
+	upload, err := gateway.multipartUpload(request, bucketName, key)
+	if err != nil {
+		return err
+	}
+	var listed completeMultipartUpload
+	err = xml.NewDecoder(body).Decode(&listed)
+	if err != nil {
+		return ErrorMalformedXML
+	}
+	completed := make([]mp.CompletedPart, 0, len(listed.Parts))
+	for _, part := range listed.Parts {
+		completed = append(completed, mp.CompletedPart{Number: part.PartNumber, ETag: part.ETag})
+	}
+	if len(completed) == 0 {
+		return ErrorMalformedXML
+	}
+
+	var object meta.ObjectMeta
+	address := gateway.server.NodeAddress(upload.Node)
+	if address == gateway.config.This.PublicAddress {
+		object, err = gateway.server.CompleteMultipartUpload(request.Context(), upload.ID, completed)
+	} else {
+		requestBody, _ := json.Marshal(struct{ Parts []mp.CompletedPart }{completed})
+		err = gateway.proxyJSON(request.Context(), address+gateway.multipartURL+upload.ID+"/complete", "application/json", requestBody, &object)
+	}
+	if err != nil {
+		return err
+	}
+	writeXML(response, http.StatusOK, completeMultipartUploadResult{
+		Location: "http://" + request.Host + "/" + bucketName + "/" + key,
+		Bucket:   bucketName,
+		Key:      key,
+		ETag:     etag(object),
+	})
+	return nil
+}
+
+func (gateway *Gateway) abortMultipartUpload(response http.ResponseWriter, request *http.Request, bucketName, key string) error {
+	upload, err := gateway.multipartUpload(request, bucketName, key)
+	if err != nil {
+		return err
+	}
+	err = gateway.server.AbortMultipartUpload(request.Context(), upload.ID)
+	if err != nil {
+		return err
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+//listParts lists every uploaded part at once
+func (gateway *Gateway) listParts(response http.ResponseWriter, request *http.Request, bucketName, key string) error {
+	upload, err := gateway.multipartUpload(request, bucketName, key)
+	if err != nil {
+		return err
+	}
+	result := listPartsResult{
+		Bucket:       bucketName,
+		Key:          key,
+		UploadID:     upload.ID,
+		Owner:        owner{ownerID, ownerID},
+		StorageClass: "STANDARD",
+		MaxParts:     mp.MaxPartNumber,
+	}
+	for _, part := range upload.SortedParts() {
+		result.Parts = append(result.Parts, partEntry{
+			PartNumber:   part.Number,
+			LastModified: formatTime(part.Uploaded),
+			ETag:         `"` + part.MD5 + `"`,
+			Size:         part.Size,
+		})
+	}
+	writeXML(response, http.StatusOK, result)
+	return nil
+}
+
+//proxyJSON posts the body to the JSON endpoint of the other node and decodes its answer into result
+func (gateway *Gateway) proxyJSON(ctx context.Context, target, contentType string, body []byte, result interface{}) error {
+	proxyRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	proxyRequest.Header.Set("Content-Type", contentType)
+	proxyRequest.Header.Set("Accept", "application/json")
+	proxyResponse, err := gateway.client.Do(proxyRequest)
+	if err != nil {
+		return ErrorServiceUnavailable
+	}
+	defer proxyResponse.Body.Close()
+
+	if proxyResponse.StatusCode != http.StatusCreated {
+		return proxyError(proxyResponse)
+	}
+	return json.NewDecoder(proxyResponse.Body).Decode(result)
+}
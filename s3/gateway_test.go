@@ -0,0 +1,120 @@
+package s3
+
+import (
+	s "dfs/server"
+	"dfs/server/meta"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//signRequest signs the request with the example credentials at the current time
+func signRequest(t *testing.T, gateway *Gateway, request *http.Request) {
+	t.Helper()
+	amzDate := time.Now().UTC().Format(amzDateFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	credential := exampleAccessKeyID + "/" + amzDate[:8] + "/us-east-1/s3/aws4_request"
+	sig, err := gateway.newSignature(credential, amzDate, ErrorAuthorizationMalformed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signature := sig.sign(canonicalRequest(request, signedHeaders, emptyPayloadHash))
+	request.Header.Set("Authorization", signingAlgorithm+" Credential="+credential+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+//TestInvalidNames checks that buckets and keys can not refer to other directories, the requests never reach the cluster
+func TestInvalidNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		err    *Error
+	}{
+		{name: "current directory bucket", method: http.MethodPut, path: "/./", err: ErrorInvalidBucketName},
+		{name: "parent directory bucket", method: http.MethodGet, path: "/../", err: ErrorInvalidBucketName},
+		{name: "object in parent directory bucket", method: http.MethodGet, path: "/../file", err: ErrorInvalidBucketName},
+		{name: "parent directory in key", method: http.MethodPut, path: "/bucket/dir/../../file", err: ErrorUnsupportedKey},
+		{name: "current directory in key", method: http.MethodGet, path: "/bucket/./file", err: ErrorUnsupportedKey},
+		{name: "empty segment in key", method: http.MethodGet, path: "/bucket/dir//file", err: ErrorUnsupportedKey},
+		{name: "trailing slash in key", method: http.MethodPut, path: "/bucket/dir/", err: ErrorUnsupportedKey},
+	}
+	gateway := newTestGateway()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, "http://s3.local"+test.path, nil)
+			signRequest(t, gateway, request)
+			response := httptest.NewRecorder()
+			gateway.ServeHTTP(response, request)
+			if response.Code != test.err.Status || !strings.Contains(response.Body.String(), "<Code>"+test.err.Code+"</Code>") {
+				t.Fatalf("got status %d, body %s, want %s", response.Code, response.Body.String(), test.err.Code)
+			}
+		})
+	}
+}
+
+func TestKeyConflict(t *testing.T) {
+	if err := toError(s.ErrorPathConflict); err != ErrorKeyConflict {
+		t.Fatalf("got error %v, want %v", err, ErrorKeyConflict)
+	}
+	if err := apiErrorCodes["PathConflict"]; err != ErrorKeyConflict {
+		t.Fatalf("got error %v of proxied upload, want %v", err, ErrorKeyConflict)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	object := meta.ObjectMeta{MD5: "abc", Modified: time.Date(2026, 1, 1, 0, 0, 0, 500, time.UTC)}
+	modified := object.Modified.Format(http.TimeFormat)
+	earlier := object.Modified.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+	}{
+		{name: "no conditions", status: http.StatusOK},
+		{name: "matching If-Match", header: map[string]string{"If-Match": `"abc"`}, status: http.StatusOK},
+		{name: "any If-Match", header: map[string]string{"If-Match": "*"}, status: http.StatusOK},
+		{name: "one of If-Match", header: map[string]string{"If-Match": `"other", "abc"`}, status: http.StatusOK},
+		{name: "other If-Match", header: map[string]string{"If-Match": `"other"`}, status: http.StatusPreconditionFailed},
+		{name: "matching If-None-Match", header: map[string]string{"If-None-Match": `"abc"`}, status: http.StatusNotModified},
+		{name: "weak If-None-Match", header: map[string]string{"If-None-Match": `W/"abc"`}, status: http.StatusNotModified},
+		{name: "other If-None-Match", header: map[string]string{"If-None-Match": `"other"`}, status: http.StatusOK},
+		{name: "If-None-Match wins over If-Modified-Since", header: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modified}, status: http.StatusOK},
+		{name: "not modified since", header: map[string]string{"If-Modified-Since": modified}, status: http.StatusNotModified},
+		{name: "modified since", header: map[string]string{"If-Modified-Since": earlier}, status: http.StatusOK},
+		{name: "modified after If-Unmodified-Since", header: map[string]string{"If-Unmodified-Since": earlier}, status: http.StatusPreconditionFailed},
+		{name: "If-Match wins over If-Unmodified-Since", header: map[string]string{"If-Match": `"abc"`, "If-Unmodified-Since": earlier}, status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://s3.local/bucket/file", nil)
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+			if status := checkPreconditions(request, object); status != test.status {
+				t.Fatalf("got status %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	tests := []struct {
+		name   string
+		object meta.ObjectMeta
+		etag   string
+	}{
+		{name: "single part", object: meta.ObjectMeta{MD5: "abc", Checksum: "def"}, etag: `"abc"`},
+		{name: "multipart", object: meta.ObjectMeta{MD5: "abc", CompositeMD5: "abc-2"}, etag: `"abc-2"`},
+	}
+	for _, test := range tests {
+		if etag := etag(test.object); etag != test.etag {
+			t.Fatalf("%s: got ETag %s, want %s", test.name, etag, test.etag)
+		}
+	}
+}
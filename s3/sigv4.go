@@ -0,0 +1,385 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	scopeTerminator  = "aws4_request"
+	serviceName      = "s3"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptyPayloadHash         = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+	//maxChunkSize limits chunks of aws-chunked bodies, every chunk is kept in memory until its signature is checked
+	maxChunkSize = 16 << 20
+)
+
+//signature is what the request was signed with
+type signature struct {
+	amzDate       string
+	scope         string
+	signingKey    []byte
+	signedHeaders []string
+	value         string
+	payloadHash   string
+}
+
+//authenticate checks SigV4 signature of the request given either in the Authorization header or in the query
+func (gateway *Gateway) authenticate(request *http.Request) (*signature, error) {
+	query := request.URL.Query()
+	var sig *signature
+	var err error
+	switch {
+	case strings.HasPrefix(request.Header.Get("Authorization"), signingAlgorithm+" "):
+		sig, err = gateway.parseAuthorizationHeader(request)
+	case query.Get("X-Amz-Algorithm") != "":
+		sig, err = gateway.parseAuthorizationQuery(request)
+	default:
+		return nil, ErrorAccessDenied
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := canonicalRequest(request, sig.signedHeaders, sig.payloadHash)
+	if !hmac.Equal([]byte(sig.value), []byte(sig.sign(canonical))) {
+		return nil, ErrorSignatureDoesNotMatch
+	}
+	return sig, nil
+}
+
+//parseAuthorizationHeader reads signature of
+//"AWS4-HMAC-SHA256 Credential=id/date/region/s3/aws4_request, SignedHeaders=a;b, Signature=hex"
+func (gateway *Gateway) parseAuthorizationHeader(request *http.Request) (*signature, error) {
+	fields := make(map[string]string, 3)
+	authorization := strings.TrimPrefix(request.Header.Get("Authorization"), signingAlgorithm+" ")
+	for _, field := range strings.Split(authorization, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrorAuthorizationMalformed
+		}
+		fields[parts[0]] = parts[1]
+	}
+	if fields["Credential"] == "" || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, ErrorAuthorizationMalformed
+	}
+
+	amzDate := request.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		date, err := http.ParseTime(request.Header.Get("Date"))
+		if err != nil {
+			return nil, ErrorAccessDenied
+		}
+		amzDate = date.UTC().Format(amzDateFormat)
+	}
+	signedAt, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return nil, ErrorAccessDenied
+	}
+	if skew := time.Since(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, ErrorRequestTimeTooSkewed
+	}
+
+	sig, err := gateway.newSignature(fields["Credential"], amzDate, ErrorAuthorizationMalformed)
+	if err != nil {
+		return nil, err
+	}
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	sig.value = fields["Signature"]
+	sig.payloadHash = request.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		return nil, ErrorAuthorizationMalformed
+	}
+	return sig, nil
+}
+
+//parseAuthorizationQuery reads signature of the pre-signed URL
+func (gateway *Gateway) parseAuthorizationQuery(request *http.Request) (*signature, error) {
+	query := request.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signingAlgorithm {
+		return nil, ErrorAuthorizationQueryInvalid
+	}
+	amzDate := query.Get("X-Amz-Date")
+	signedAt, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return nil, ErrorAuthorizationQueryInvalid
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, ErrorAuthorizationQueryInvalid
+	}
+	if time.Now().Before(signedAt.Add(-maxClockSkew)) {
+		return nil, ErrorRequestTimeTooSkewed
+	}
+	if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+		return nil, ErrorRequestExpired
+	}
+
+	sig, err := gateway.newSignature(query.Get("X-Amz-Credential"), amzDate, ErrorAuthorizationQueryInvalid)
+	if err != nil {
+		return nil, err
+	}
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	sig.value = query.Get("X-Amz-Signature")
+	sig.payloadHash = unsignedPayload
+	if query.Get("X-Amz-Content-Sha256") != "" {
+		sig.payloadHash = query.Get("X-Amz-Content-Sha256")
+	}
+	return sig, nil
+}
+
+//newSignature checks credential "id/date/region/s3/aws4_request" and derives the signing key of its secret
+func (gateway *Gateway) newSignature(credential, amzDate string, malformed *Error) (*signature, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[1] != amzDate[:8] || parts[3] != serviceName || parts[4] != scopeTerminator {
+		return nil, malformed
+	}
+	if parts[2] != gateway.region() {
+		return nil, &Error{malformed.Status, malformed.Code, "The region is wrong, expecting " + gateway.region() + "."}
+	}
+
+	secret := ""
+	for _, credentials := range gateway.config.S3.Credentials {
+		if credentials.AccessKeyID == parts[0] {
+			secret = credentials.SecretAccessKey
+		}
+	}
+	if secret == "" {
+		return nil, ErrorInvalidAccessKeyID
+	}
+
+	signingKey := hmacSHA256([]byte("AWS4"+secret), parts[1])
+	for _, part := range parts[2:] {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	return &signature{
+		amzDate:    amzDate,
+		scope:      strings.Join(parts[1:], "/"),
+		signingKey: signingKey,
+	}, nil
+}
+
+func (sig *signature) sign(canonical string) string {
+	stringToSign := strings.Join([]string{signingAlgorithm, sig.amzDate, sig.scope, sha256Hex([]byte(canonical))}, "\n")
+	return hex.EncodeToString(hmacSHA256(sig.signingKey, stringToSign))
+}
+
+//signChunk returns signature of the chunk of aws-chunked body, chunks are chained by previous signature
+func (sig *signature) signChunk(previous string, data []byte) string {
+	stringToSign := strings.Join([]string{
+		signingAlgorithm + "-PAYLOAD", sig.amzDate, sig.scope, previous, emptyPayloadHash, sha256Hex(data),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(sig.signingKey, stringToSign))
+}
+
+//canonicalRequest builds the request the way client built it for signing
+func canonicalRequest(request *http.Request, signedHeaders []string, payloadHash string) string {
+	query := request.URL.Query()
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	headers := make([]string, 0, len(signedHeaders))
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = request.Host
+		case "content-length":
+			value = strconv.FormatInt(request.ContentLength, 10)
+		case "transfer-encoding":
+			value = strings.Join(request.TransferEncoding, ",")
+		default:
+			values := make([]string, 0, 1)
+			for _, v := range request.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		headers = append(headers, name+":"+value+"\n")
+	}
+
+	return strings.Join([]string{
+		request.Method,
+		uriEncode(request.URL.Path, false),
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+//uriEncode escapes everything but unreserved characters, slashes are kept unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hexDigits[c>>4])
+			buf.WriteByte(hexDigits[c&15])
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//payload returns body of the request that fails reading if it does not match the signed hash or Content-MD5.
+//aws-chunked bodies are decoded.
+func (gateway *Gateway) payload(request *http.Request, sig *signature) (io.Reader, error) {
+	var body io.Reader = request.Body
+	switch sig.payloadHash {
+	case unsignedPayload:
+	case streamingPayload, streamingPayloadTrailer:
+		body = &chunkedReader{reader: bufio.NewReader(request.Body), sig: sig, previous: sig.value}
+	case streamingUnsignedTrailer:
+		body = &chunkedReader{reader: bufio.NewReader(request.Body)}
+	default:
+		expected, err := hex.DecodeString(sig.payloadHash)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, ErrorContentSHA256Mismatch
+		}
+		body = &verifyingReader{reader: body, hash: sha256.New(), expected: expected, mismatch: ErrorContentSHA256Mismatch}
+	}
+
+	if contentMD5 := request.Header.Get("Content-MD5"); contentMD5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(expected) != md5.Size {
+			return nil, ErrorInvalidDigest
+		}
+		body = &verifyingReader{reader: body, hash: md5.New(), expected: expected, mismatch: ErrorBadDigest}
+	}
+	return body, nil
+}
+
+//verifyingReader hashes what is read and fails at the end if the hash is not the expected one
+type verifyingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected []byte
+	mismatch error
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.reader.Read(p)
+	vr.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(vr.hash.Sum(nil), vr.expected) {
+		return n, vr.mismatch
+	}
+	return n, err
+}
+
+//chunkedReader decodes aws-chunked body: "size;chunk-signature=sig\r\ndata\r\n" chunks ending with
+//the empty one and optional trailing headers. Chunk signatures are checked if sig is set.
+type chunkedReader struct {
+	reader   *bufio.Reader
+	sig      *signature
+	previous string
+	chunk    []byte
+	done     bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		err := cr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *chunkedReader) readChunk() error {
+	line, err := cr.reader.ReadString('\n')
+	if err != nil {
+		return ErrorIncompleteBody
+	}
+	header := strings.Split(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(header[0], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return ErrorIncompleteBody
+	}
+	chunkSignature := ""
+	for _, extension := range header[1:] {
+		if strings.HasPrefix(extension, "chunk-signature=") {
+			chunkSignature = strings.TrimPrefix(extension, "chunk-signature=")
+		}
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(cr.reader, data)
+	if err != nil {
+		return ErrorIncompleteBody
+	}
+	if cr.sig != nil {
+		expected := cr.sig.signChunk(cr.previous, data)
+		if !hmac.Equal([]byte(chunkSignature), []byte(expected)) {
+			return ErrorSignatureDoesNotMatch
+		}
+		cr.previous = expected
+	}
+
+	if size == 0 {
+		//Trailing headers end with an empty line, checksums they carry are not checked
+		cr.done = true
+		for {
+			line, err := cr.reader.ReadString('\n')
+			if err != nil || strings.TrimRight(line, "\r\n") == "" {
+				return nil
+			}
+		}
+	}
+	if line, err := cr.reader.ReadString('\n'); err != nil || line != "\r\n" {
+		return ErrorIncompleteBody
+	}
+	cr.chunk = data
+	return nil
+}
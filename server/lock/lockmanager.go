@@ -1,32 +1,188 @@
 package lock
 
 import (
-	"dfs/comm"
+	"bytes"
+	"context"
 	c "dfs/config"
 	"dfs/server/node"
+	"dfs/server/raft"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
-	"strings"
+	"fmt"
+	"io"
+	"log"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	defaultLockTimeout  = 30 * time.Second
+	defaultLockLeaseTTL = 30 * time.Second
+	stateMachineName    = "locks"
+	//minLockRetryDelay keeps waiters from flooding the log when clocks of the nodes disagree on expiry
+	minLockRetryDelay = 100 * time.Millisecond
+)
+
+const (
+	opAcquire = "acquire"
+	opRenew   = "renew"
+	opRelease = "release"
+	//opEnqueue puts the writer into the queue without granting the lock, writer waiting for local holders keeps its place this way
+	opEnqueue = "enqueue"
+	//opForceRelease drops every holder and waiter of the resource
+	opForceRelease = "force-release"
+)
+
+//LockMode tells whether the resource may be shared with other holders
+type LockMode string
+
+const (
+	//LockShared is taken by readers, any number of them may hold the resource together
+	LockShared LockMode = "shared"
+	//LockExclusive is taken by writers, nobody else may hold the resource meanwhile
+	LockExclusive LockMode = "exclusive"
 )
 
 var (
-	ErrorResourceIsLockedLocally = errors.New("Resource is locked locally.")
+	ErrorLeaseExpired     = errors.New("Lock lease expired.")
+	ErrorResourceIsLocked = errors.New("Resource is locked by another owner.")
 )
 
+//LockInfo describes a holder of the resource, or a writer waiting for it.
+//Token is the fencing token of the lease, every new lease gets a greater one.
 type LockInfo struct {
-	GrantedCount   int
-	WaitChan       chan bool
-	Timestamp      int64
-	GrantOnRelease []string
+	Owner   string
+	Node    string
+	Mode    LockMode
+	Since   time.Time
+	Expires time.Time
+	Token   uint64
+}
+
+//LockStatus is LockInfo as seen by this node at the moment of the listing
+type LockStatus struct {
+	LockInfo
+	Age     c.Duration
+	Expired bool
+}
+
+//ResourceLock describes holders of the resource and writers queued for it.
+//LocalWaiters is the number of callers on this node waiting for their turn.
+type ResourceLock struct {
+	Resource     string
+	Mode         LockMode
+	Holders      []LockStatus
+	Waiting      []LockStatus
+	LocalWaiters int
+}
+
+type lockCommand struct {
+	Op       string
+	Resource string
+	Owner    string
+	Node     string
+	Mode     LockMode
+	//Time is the leader's clock at the moment the command entered the log, leases are compared to it,
+	//so every node applies the command the same way and a node with a clock running ahead can not expire other leases.
+	//The proposer's clock is taken only for the entries that did not record the time.
+	Time time.Time
+	TTL  time.Duration
+}
+
+//resourceState is the replicated state of one resource.
+//Queue keeps writers in order they asked for the resource, while it is not empty new readers are refused,
+//so a stream of downloads can not keep deletes and overwrites out forever.
+//Writer waiting behind holders of its own node is queued too, so it keeps readers of other nodes out while it waits.
+type resourceState struct {
+	Holders map[string]LockInfo
+	Queue   []LockInfo
+}
+
+//lockTable is the replicated state of the lock manager
+type lockTable struct {
+	Resources map[string]*resourceState
+	LastToken uint64
+}
+
+//Lease is a lock held by this node. Holder must stop writing once Lost is closed
+//and must pass Token to the writers, so they can reject writes of stale holders.
+type Lease struct {
+	Resource string
+	Mode     LockMode
+	Token    uint64
+
+	owner string
+	lost  chan struct{}
+	done  chan struct{}
+}
+
+//Lost returns channel closed when the lease could not be renewed in time
+func (lease *Lease) Lost() <-chan struct{} {
+	return lease.lost
 }
 
+//Context returns copy of ctx which is also cancelled once the lease is lost
+func (lease *Lease) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-lease.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+//Guard returns reader which fails once the lease is lost, so the holder stops serving data the lease no longer guards
+func (lease *Lease) Guard(r io.ReadSeeker) io.ReadSeeker {
+	return &guardedReader{ReadSeeker: r, lost: lease.lost}
+}
+
+type guardedReader struct {
+	io.ReadSeeker
+	lost chan struct{}
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.lost:
+		return 0, ErrorLeaseExpired
+	default:
+	}
+	return r.ReadSeeker.Read(p)
+}
+
+type localWaiter struct {
+	mode  LockMode
+	ready chan struct{}
+}
+
+//localQueue lets local callers wait for the resource in order instead of competing through the log.
+//Waiters are let in first come first served, readers in a row are let in together.
+type localQueue struct {
+	readers int
+	writer  bool
+	waiters []*localWaiter
+}
+
+//LockManager keeps the cluster-wide lock table in the raft log.
+//Lock is acquired once the majority of nodes agrees on its holders,
+//it is held as a lease which expires unless the holder renews it.
 type LockManager struct {
 	mutex   sync.Mutex
-	clock   int64
-	lockMap map[string]*LockInfo
+	counter uint64
+	table   lockTable
+	//queues serialize local callers locking the same resource
+	queues map[string]*localQueue
+	//changed is closed when holders of the resource leave
+	changed map[string]chan struct{}
 
 	nodeManager *node.NodeManager
-	msgHub      *comm.MessageHub
+	raft        *raft.Raft
 	config      *c.Config
 }
 
@@ -34,107 +190,557 @@ func (lm *LockManager) UseConfig(config *c.Config) {
 	lm.config = config
 }
 
-func (lm *LockManager) Listen(nodeManager *node.NodeManager, msgHub *comm.MessageHub) {
-	lm.lockMap = make(map[string]*LockInfo, 0)
+//Listen registers lock table in the raft log, it must be called before raft starts
+func (lm *LockManager) Listen(nodeManager *node.NodeManager, r *raft.Raft) {
+	lm.table = lockTable{Resources: make(map[string]*resourceState, 0)}
+	lm.queues = make(map[string]*localQueue, 0)
+	lm.changed = make(map[string]chan struct{}, 0)
 
 	lm.nodeManager = nodeManager
-	lm.msgHub = msgHub
-	lm.msgHub.Subscribe(lm,
-		comm.MessageTypeRequestLock,
-		comm.MessageTypeGrantLockPermission)
+	lm.raft = r
+	r.Register(stateMachineName, lm)
+}
+
+func encodeToken(token uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, token)
+	return data
 }
 
-func (lm *LockManager) HandleMessage(msg *comm.Message) {
+func decodeToken(data []byte) uint64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+//prune drops holders and queued writers whose leases expired by now
+func (state *resourceState) prune(now time.Time) {
+	for owner, holder := range state.Holders {
+		if !now.Before(holder.Expires) {
+			delete(state.Holders, owner)
+		}
+	}
+	queue := state.Queue[:0]
+	for _, waiter := range state.Queue {
+		if now.Before(waiter.Expires) {
+			queue = append(queue, waiter)
+		}
+	}
+	state.Queue = queue
+}
+
+//mode returns the mode the resource is held in, or empty string if it is free
+func (state *resourceState) mode() LockMode {
+	for _, holder := range state.Holders {
+		return holder.Mode
+	}
+	return ""
+}
+
+//queuedAhead returns the number of writers queued ahead of the first writer of the node.
+//Queued writers of the node wait for its callers in the local queue, so callers of the node
+//are not kept out by them, only by writers of other nodes which came first.
+func (state *resourceState) queuedAhead(node string) int {
+	for i, waiter := range state.Queue {
+		if waiter.Node == node {
+			return i
+		}
+	}
+	return len(state.Queue)
+}
+
+//grantable reports whether a caller of the node may take the resource in the mode
+func (state *resourceState) grantable(node string, mode LockMode) bool {
+	if mode == LockShared {
+		return state.mode() != LockExclusive && state.queuedAhead(node) == 0
+	}
+	return len(state.Holders) == 0 && state.queuedAhead(node) == 0
+}
+
+//enqueue adds writer to the queue or refreshes its place in it
+func (state *resourceState) enqueue(waiter LockInfo) {
+	for i := range state.Queue {
+		if state.Queue[i].Owner == waiter.Owner {
+			state.Queue[i].Expires = waiter.Expires
+			return
+		}
+	}
+	state.Queue = append(state.Queue, waiter)
+}
+
+func (state *resourceState) dequeue(owner string) {
+	for i := range state.Queue {
+		if state.Queue[i].Owner == owner {
+			state.Queue = append(state.Queue[:i], state.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+//notifyChanged wakes the waiters of the resource. Must be called with lm.mutex held.
+func (lm *LockManager) notifyChanged(resource string) {
+	if changed, exists := lm.changed[resource]; exists {
+		close(changed)
+		delete(lm.changed, resource)
+	}
+}
+
+//Apply executes committed lock command at the time of its proposer.
+//Acquire and renew return the fencing token of the lease, or nothing if the lock is not granted.
+func (lm *LockManager) Apply(data []byte) []byte {
+	return lm.ApplyAt(data, time.Time{})
+}
+
+//ApplyAt executes committed lock command at the time the leader appended it to the log
+func (lm *LockManager) ApplyAt(data []byte, appended time.Time) []byte {
+	var command lockCommand
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&command) != nil {
+		return nil
+	}
+	if !appended.IsZero() {
+		command.Time = appended
+	}
+
 	lm.mutex.Lock()
 	defer lm.mutex.Unlock()
 
-	switch msg.Type {
-	case comm.MessageTypeRequestLock:
-		var request comm.MessageRequestLock
-		msg.DecodeData(&request)
-		res := request.Resource
-		if lm.shouldGrantPermission(request, msg.SourceNode) {
-			responseMsg := comm.Message{Type: comm.MessageTypeGrantLockPermission}
-			response := comm.MessageGrantLockPermission{
-				Resource: res,
-			}
-			responseMsg.EncodeData(response)
-			lm.msgHub.Send(responseMsg, msg.SourceNode)
+	state, exists := lm.table.Resources[command.Resource]
+	if !exists {
+		state = &resourceState{Holders: make(map[string]LockInfo, 0)}
+	}
+	state.prune(command.Time)
+	defer func() {
+		if len(state.Holders) == 0 && len(state.Queue) == 0 {
+			delete(lm.table.Resources, command.Resource)
 		} else {
-			lm.lockMap[res].GrantOnRelease = append(lm.lockMap[res].GrantOnRelease, msg.SourceNode)
+			lm.table.Resources[command.Resource] = state
+		}
+	}()
+
+	holder, holds := state.Holders[command.Owner]
+	switch command.Op {
+	case opEnqueue:
+		if !holds && command.Mode == LockExclusive {
+			state.enqueue(LockInfo{
+				Owner:   command.Owner,
+				Node:    command.Node,
+				Mode:    command.Mode,
+				Since:   command.Time,
+				Expires: command.Time.Add(command.TTL),
+			})
+		}
+		return nil
+
+	case opAcquire:
+		if !holds {
+			if !state.grantable(command.Node, command.Mode) {
+				if command.Mode == LockExclusive {
+					state.enqueue(LockInfo{
+						Owner:   command.Owner,
+						Node:    command.Node,
+						Mode:    command.Mode,
+						Since:   command.Time,
+						Expires: command.Time.Add(command.TTL),
+					})
+				}
+				return nil
+			}
+			state.dequeue(command.Owner)
+			lm.table.LastToken++
+			holder = LockInfo{
+				Owner: command.Owner,
+				Node:  command.Node,
+				Mode:  command.Mode,
+				Since: command.Time,
+				Token: lm.table.LastToken,
+			}
 		}
-		lm.clock = request.Timestamp + 1
+		holder.Expires = command.Time.Add(command.TTL)
+		state.Holders[command.Owner] = holder
+		return encodeToken(holder.Token)
 
-	case comm.MessageTypeGrantLockPermission:
-		var grant comm.MessageGrantLockPermission
-		msg.DecodeData(&grant)
-		lm.lockMap[grant.Resource].GrantedCount--
-		if lm.lockMap[grant.Resource].GrantedCount == 0 {
-			lm.lockMap[grant.Resource].WaitChan <- true
+	case opRenew:
+		if !holds {
+			return nil
 		}
+		holder.Expires = command.Time.Add(command.TTL)
+		state.Holders[command.Owner] = holder
+		return encodeToken(holder.Token)
+
+	case opRelease:
+		delete(state.Holders, command.Owner)
+		state.dequeue(command.Owner)
+		lm.notifyChanged(command.Resource)
+
+	case opForceRelease:
+		state.Holders = make(map[string]LockInfo, 0)
+		state.Queue = nil
+		lm.notifyChanged(command.Resource)
 	}
+	return nil
 }
 
-func (lm *LockManager) LockResource(resource string) error {
-	msg := comm.Message{Type: comm.MessageTypeRequestLock}
-	requestMsg := comm.MessageRequestLock{
-		Resource:  resource,
-		Timestamp: lm.clock,
+func (lm *LockManager) Snapshot() ([]byte, error) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	return json.Marshal(lm.table)
+}
+
+func (lm *LockManager) Restore(data []byte) error {
+	table := lockTable{Resources: make(map[string]*resourceState, 0)}
+	err := json.Unmarshal(data, &table)
+	if err != nil {
+		return err
+	}
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.table = table
+	for resource := range lm.changed {
+		lm.notifyChanged(resource)
+	}
+	return nil
+}
+
+func (lm *LockManager) leaseTTL() time.Duration {
+	return lm.config.LockLeaseTTL.Or(defaultLockLeaseTTL)
+}
+
+func (lm *LockManager) propose(ctx context.Context, command lockCommand) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(command)
+	if err != nil {
+		return nil, err
+	}
+	return lm.raft.Propose(ctx, stateMachineName, buf.Bytes())
+}
+
+//waitChange returns channel closed once a holder of the resource leaves and the time left until
+//the first lease of the resource expires. If the resource is free, the channel is closed right away.
+func (lm *LockManager) waitChange(resource string) (chan struct{}, time.Duration) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	state, exists := lm.table.Resources[resource]
+	if !exists {
+		changed := make(chan struct{})
+		close(changed)
+		return changed, 0
+	}
+	changed, exists := lm.changed[resource]
+	if !exists {
+		changed = make(chan struct{})
+		lm.changed[resource] = changed
 	}
 
-	if _, exists := lm.lockMap[resource]; exists {
-		return ErrorResourceIsLockedLocally
+	var expires time.Time
+	for _, holder := range state.Holders {
+		if expires.IsZero() || holder.Expires.Before(expires) {
+			expires = holder.Expires
+		}
+	}
+	for _, waiter := range state.Queue {
+		if expires.IsZero() || waiter.Expires.Before(expires) {
+			expires = waiter.Expires
+		}
 	}
+	expiresIn := time.Until(expires)
+	if expiresIn < minLockRetryDelay {
+		expiresIn = minLockRetryDelay
+	}
+	return changed, expiresIn
+}
 
-	msg.EncodeData(requestMsg)
+//admit lets in waiters from the head of the local queue that may hold the resource together.
+//Must be called with lm.mutex held.
+func (queue *localQueue) admit() {
+	for len(queue.waiters) > 0 {
+		waiter := queue.waiters[0]
+		if queue.writer || (waiter.mode == LockExclusive && queue.readers > 0) {
+			return
+		}
+		if waiter.mode == LockExclusive {
+			queue.writer = true
+		} else {
+			queue.readers++
+		}
+		close(waiter.ready)
+		queue.waiters = queue.waiters[1:]
+	}
+}
 
+//waitTurn queues the caller behind other local holders and waiters of the resource.
+//Writer which has to wait is queued on the whole cluster as well, so readers of other nodes can not keep it out meanwhile.
+func (lm *LockManager) waitTurn(ctx context.Context, resource, owner string, mode LockMode) error {
 	lm.mutex.Lock()
-	waitChan := make(chan bool, 1)
-	lm.lockMap[resource] = &LockInfo{
-		WaitChan:     waitChan,
-		Timestamp:    lm.clock,
-		GrantedCount: len(lm.nodeManager.NodeNames()),
+	queue, exists := lm.queues[resource]
+	if !exists {
+		queue = &localQueue{}
+		lm.queues[resource] = queue
 	}
+	waiter := &localWaiter{mode: mode, ready: make(chan struct{})}
+	queue.waiters = append(queue.waiters, waiter)
+	queue.admit()
 	lm.mutex.Unlock()
 
-	lm.msgHub.Broadcast(msg)
+	var enqueue <-chan time.Time
+	if mode == LockExclusive {
+		enqueue = time.After(0)
+	}
+	for waiting := true; waiting; {
+		select {
+		case <-waiter.ready:
+			return nil
+		case <-enqueue:
+			//Place in the queue expires like a lease, it is refreshed until the turn comes
+			lm.propose(ctx, lockCommand{
+				Op:       opEnqueue,
+				Resource: resource,
+				Owner:    owner,
+				Node:     lm.nodeManager.This.Name,
+				Mode:     mode,
+				Time:     time.Now(),
+				TTL:      lm.leaseTTL(),
+			})
+			enqueue = time.After(lm.leaseTTL() / 3)
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
 
-	<-waitChan
-	return nil
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	select {
+	case <-waiter.ready:
+		//Turn came together with cancellation, it is passed on
+		lm.leaveTurn(resource, mode)
+	default:
+		for i, w := range queue.waiters {
+			if w == waiter {
+				queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+				break
+			}
+		}
+		queue.admit()
+		lm.dropQueue(resource)
+	}
+	return ctx.Err()
+}
+
+//leaveTurn lets the next local waiters of the resource proceed. Must be called with lm.mutex held.
+func (lm *LockManager) leaveTurn(resource string, mode LockMode) {
+	queue := lm.queues[resource]
+	if mode == LockExclusive {
+		queue.writer = false
+	} else {
+		queue.readers--
+	}
+	queue.admit()
+	lm.dropQueue(resource)
+}
+
+//dropQueue forgets local queue nobody uses. Must be called with lm.mutex held.
+func (lm *LockManager) dropQueue(resource string) {
+	queue := lm.queues[resource]
+	if queue.readers == 0 && !queue.writer && len(queue.waiters) == 0 {
+		delete(lm.queues, resource)
+	}
 }
 
-func (lm *LockManager) UnlockResource(resource string) {
+func (lm *LockManager) finishTurn(resource string, mode LockMode) {
 	lm.mutex.Lock()
 	defer lm.mutex.Unlock()
+	lm.leaveTurn(resource, mode)
+}
 
-	msg := comm.Message{Type: comm.MessageTypeGrantLockPermission}
-	grantMsg := comm.MessageGrantLockPermission{
-		Resource: resource,
+//LockResource acquires lease of the resource on the whole cluster.
+//Shared leases are held together by any number of readers, exclusive lease is held by a single writer.
+//Local callers wait for each other in order, then the current holders are waited for
+//until they release the resource or their leases expire.
+//Writers waiting for the resource keep new readers out.
+//ErrorResourceIsLocked is returned if other holders keep the resource until ctx or lock timeout expire.
+func (lm *LockManager) LockResource(ctx context.Context, resource string, mode LockMode) (*Lease, error) {
+	callerCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, lm.config.Timeouts.Lock.Or(defaultLockTimeout))
+	defer cancel()
+
+	lm.mutex.Lock()
+	lm.counter++
+	owner := fmt.Sprintf("%s/%d/%d", lm.nodeManager.This.Name, time.Now().UnixNano(), lm.counter)
+	lm.mutex.Unlock()
+
+	err := lm.waitTurn(ctx, resource, owner, mode)
+	if err != nil && mode == LockExclusive {
+		lm.release(callerCtx, resource, owner)
+	}
+	if err == context.DeadlineExceeded {
+		return nil, ErrorResourceIsLocked
+	}
+	if err != nil {
+		return nil, err
 	}
-	msg.EncodeData(grantMsg)
 
-	for _, node := range lm.lockMap[resource].GrantOnRelease {
-		lm.msgHub.Send(msg, node)
+	for {
+		token, err := lm.propose(ctx, lockCommand{
+			Op:       opAcquire,
+			Resource: resource,
+			Owner:    owner,
+			Node:     lm.nodeManager.This.Name,
+			Mode:     mode,
+			Time:     time.Now(),
+			TTL:      lm.leaseTTL(),
+		})
+		if err == nil && decodeToken(token) != 0 {
+			lease := &Lease{
+				Resource: resource,
+				Mode:     mode,
+				Token:    decodeToken(token),
+				owner:    owner,
+				lost:     make(chan struct{}),
+				done:     make(chan struct{}),
+			}
+			go lm.renew(lease)
+			return lease, nil
+		}
+		if err == nil {
+			changed, expiresIn := lm.waitChange(resource)
+			select {
+			case <-changed:
+				continue
+			case <-time.After(expiresIn):
+				continue
+			case <-ctx.Done():
+				err = ctx.Err()
+				if err == context.DeadlineExceeded {
+					err = ErrorResourceIsLocked
+				}
+			}
+		}
+		//The caller waited long enough, so the place in the queue is given up only while the caller still waits
+		lm.release(callerCtx, resource, owner)
+		lm.finishTurn(resource, mode)
+		return nil, err
 	}
-	delete(lm.lockMap, resource)
 }
 
-func (lm *LockManager) shouldGrantPermission(request comm.MessageRequestLock, nodeName string) bool {
-	lockInfo, exists := lm.lockMap[request.Resource]
+//renew extends the lease until it is released. If renewal fails until the lease
+//expires, the lease is lost: other node may already hold the resource.
+func (lm *LockManager) renew(lease *Lease) {
+	ttl := lm.leaseTTL()
+	expires := time.Now().Add(ttl)
+	for {
+		select {
+		case <-lease.done:
+			return
+		case <-time.After(ttl / 3):
+		}
 
-	if !exists {
-		return true
+		ctx, cancel := context.WithDeadline(context.Background(), expires)
+		now := time.Now()
+		token, err := lm.propose(ctx, lockCommand{
+			Op:       opRenew,
+			Resource: lease.Resource,
+			Owner:    lease.owner,
+			Time:     now,
+			TTL:      ttl,
+		})
+		cancel()
+		if err == nil && decodeToken(token) == lease.Token {
+			expires = now.Add(ttl)
+			continue
+		}
+		select {
+		case <-lease.done:
+			return
+		default:
+		}
+		if err == nil || time.Now().After(expires) {
+			log.Printf("Lease of %s with token %d is lost\n", lease.Resource, lease.Token)
+			close(lease.lost)
+			return
+		}
 	}
+}
+
+//release drops the owner from holders and queued writers of the resource within ctx and lock timeout.
+//If it fails, the lease or the place in the queue expires on its own.
+func (lm *LockManager) release(ctx context.Context, resource, owner string) {
+	ctx, cancel := context.WithTimeout(ctx, lm.config.Timeouts.Lock.Or(defaultLockTimeout))
+	defer cancel()
+	lm.propose(ctx, lockCommand{
+		Op:       opRelease,
+		Resource: resource,
+		Owner:    owner,
+	})
+}
+
+//UnlockResource releases lease acquired by LockResource and lets the next local waiters proceed
+func (lm *LockManager) UnlockResource(lease *Lease) {
+	close(lease.done)
+	lm.release(context.Background(), lease.Resource, lease.owner)
+	lm.finishTurn(lease.Resource, lease.Mode)
+}
+
+//ForceUnlock drops every holder and queued writer of the resource.
+//Holders learn they lost their leases when they try to renew them.
+func (lm *LockManager) ForceUnlock(ctx context.Context, resource string) error {
+	ctx, cancel := context.WithTimeout(ctx, lm.config.Timeouts.Lock.Or(defaultLockTimeout))
+	defer cancel()
+	_, err := lm.propose(ctx, lockCommand{
+		Op:       opForceRelease,
+		Resource: resource,
+		Time:     time.Now(),
+	})
+	return err
+}
 
-	if lockInfo.GrantedCount == 0 {
-		return false
+func lockStatus(lockInfo LockInfo, now time.Time) LockStatus {
+	return LockStatus{
+		LockInfo: lockInfo,
+		Age:      c.Duration{Duration: now.Sub(lockInfo.Since)},
+		Expired:  !now.Before(lockInfo.Expires),
 	}
+}
 
-	if lockInfo.Timestamp > request.Timestamp {
-		return false
-	} else if lockInfo.Timestamp < request.Timestamp {
-		return true
-	} else {
-		return strings.Compare(lm.nodeManager.This.Name, nodeName) < 0
+//Locks returns the cluster-wide lock table sorted by resource, expired leases included.
+//Resources only waited for by local callers are listed too.
+func (lm *LockManager) Locks() []ResourceLock {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	now := time.Now()
+	locks := make([]ResourceLock, 0, len(lm.table.Resources))
+	for resource, state := range lm.table.Resources {
+		resourceLock := ResourceLock{
+			Resource: resource,
+			Mode:     state.mode(),
+			Holders:  make([]LockStatus, 0, len(state.Holders)),
+			Waiting:  make([]LockStatus, 0, len(state.Queue)),
+		}
+		for _, holder := range state.Holders {
+			resourceLock.Holders = append(resourceLock.Holders, lockStatus(holder, now))
+		}
+		sort.Slice(resourceLock.Holders, func(i, j int) bool {
+			return resourceLock.Holders[i].Token < resourceLock.Holders[j].Token
+		})
+		for _, waiter := range state.Queue {
+			resourceLock.Waiting = append(resourceLock.Waiting, lockStatus(waiter, now))
+		}
+		if queue, exists := lm.queues[resource]; exists {
+			resourceLock.LocalWaiters = len(queue.waiters)
+		}
+		locks = append(locks, resourceLock)
+	}
+	for resource, queue := range lm.queues {
+		if _, exists := lm.table.Resources[resource]; !exists && len(queue.waiters) > 0 {
+			locks = append(locks, ResourceLock{
+				Resource:     resource,
+				Holders:      make([]LockStatus, 0),
+				Waiting:      make([]LockStatus, 0),
+				LocalWaiters: len(queue.waiters),
+			})
+		}
 	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Resource < locks[j].Resource
+	})
+	return locks
 }
@@ -0,0 +1,308 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const testResource = "bucket/file"
+
+func newTestLockManager() *LockManager {
+	return &LockManager{
+		table:   lockTable{Resources: make(map[string]*resourceState, 0)},
+		queues:  make(map[string]*localQueue, 0),
+		changed: make(map[string]chan struct{}, 0),
+	}
+}
+
+//apply executes the command and returns the fencing token it granted, 0 if the lock is not granted
+func apply(t *testing.T, lm *LockManager, command lockCommand) uint64 {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(command); err != nil {
+		t.Fatal(err)
+	}
+	return decodeToken(lm.Apply(buf.Bytes()))
+}
+
+//step is a command of the owner at the time after the start, token is what it must be granted.
+//Owner is on the node of its own name unless node is given.
+type step struct {
+	op    string
+	owner string
+	node  string
+	mode  LockMode
+	after time.Duration
+	token uint64
+}
+
+func TestApply(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Minute
+	x, s := LockExclusive, LockShared
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "exclusive conflicts with exclusive", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "b", mode: x, token: 0},
+			{op: opRelease, owner: "a"},
+			{op: opAcquire, owner: "b", mode: x, token: 2},
+		}},
+		{name: "exclusive conflicts with shared", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "b", mode: s, token: 0},
+			{op: opRelease, owner: "a"},
+			{op: opAcquire, owner: "b", mode: s, token: 2},
+		}},
+		{name: "shared holders", steps: []step{
+			{op: opAcquire, owner: "a", mode: s, token: 1},
+			{op: opAcquire, owner: "b", mode: s, token: 2},
+			{op: opAcquire, owner: "c", mode: x, token: 0},
+			{op: opRelease, owner: "a"},
+			{op: opAcquire, owner: "c", mode: x, token: 0},
+			{op: opRelease, owner: "b"},
+			{op: opAcquire, owner: "c", mode: x, token: 3},
+		}},
+		{name: "queued writer keeps new readers out", steps: []step{
+			{op: opAcquire, owner: "a", mode: s, token: 1},
+			{op: opAcquire, owner: "w", mode: x, token: 0},
+			{op: opAcquire, owner: "b", mode: s, token: 0},
+			{op: opRelease, owner: "a"},
+			{op: opAcquire, owner: "w", mode: x, token: 2},
+			{op: opRelease, owner: "w"},
+			{op: opAcquire, owner: "b", mode: s, token: 3},
+		}},
+		{name: "writers are let in order they asked", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "b", mode: x, token: 0},
+			{op: opAcquire, owner: "c", mode: x, token: 0},
+			{op: opRelease, owner: "a"},
+			{op: opAcquire, owner: "c", mode: x, token: 0},
+			{op: opAcquire, owner: "b", mode: x, token: 2},
+			{op: opRelease, owner: "b"},
+			{op: opAcquire, owner: "c", mode: x, token: 3},
+		}},
+		{name: "holder acquiring again keeps its token", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "a", mode: x, after: 30 * time.Second, token: 1},
+			{op: opAcquire, owner: "b", mode: x, after: 80 * time.Second, token: 0},
+		}},
+		{name: "renew extends the lease", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opRenew, owner: "a", after: 50 * time.Second, token: 1},
+			{op: opAcquire, owner: "b", mode: x, after: 100 * time.Second, token: 0},
+			{op: opRenew, owner: "a", after: 100 * time.Second, token: 1},
+		}},
+		{name: "expired lease is not renewed", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opRenew, owner: "a", after: 2 * time.Minute, token: 0},
+			{op: opRenew, owner: "b", token: 0},
+		}},
+		{name: "expired holder gives way to greater token", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "b", mode: x, after: 2 * time.Minute, token: 2},
+			{op: opRenew, owner: "a", after: 2 * time.Minute, token: 0},
+		}},
+		{name: "expired writer leaves the queue", steps: []step{
+			{op: opAcquire, owner: "a", mode: s, token: 1},
+			{op: opAcquire, owner: "w", mode: x, token: 0},
+			{op: opRenew, owner: "a", after: 50 * time.Second, token: 1},
+			{op: opAcquire, owner: "b", mode: s, after: 90 * time.Second, token: 2},
+		}},
+		{name: "writer waiting for local readers keeps other readers out", steps: []step{
+			{op: opAcquire, owner: "a", node: "one", mode: s, token: 1},
+			{op: opEnqueue, owner: "w", node: "one", mode: x},
+			{op: opAcquire, owner: "b", node: "two", mode: s, token: 0},
+			{op: opAcquire, owner: "c", node: "one", mode: s, token: 2},
+			{op: opRelease, owner: "a"},
+			{op: opRelease, owner: "c"},
+			{op: opAcquire, owner: "b", node: "two", mode: s, token: 0},
+			{op: opAcquire, owner: "w", node: "one", mode: x, token: 3},
+		}},
+		{name: "enqueued writer is not granted", steps: []step{
+			{op: opEnqueue, owner: "w", node: "one", mode: x},
+			{op: opAcquire, owner: "b", node: "two", mode: s, token: 0},
+			{op: opRelease, owner: "w"},
+			{op: opAcquire, owner: "b", node: "two", mode: s, token: 1},
+		}},
+		{name: "local writer ahead of enqueued one is let in", steps: []step{
+			{op: opEnqueue, owner: "w2", node: "one", mode: x},
+			{op: opAcquire, owner: "w1", node: "one", mode: x, token: 1},
+		}},
+		{name: "writers of other nodes queued first are waited for", steps: []step{
+			{op: opAcquire, owner: "a", node: "one", mode: s, token: 1},
+			{op: opAcquire, owner: "v", node: "two", mode: x, token: 0},
+			{op: opEnqueue, owner: "w", node: "one", mode: x},
+			{op: opAcquire, owner: "c", node: "one", mode: s, token: 0},
+		}},
+		{name: "force release drops holders and queue", steps: []step{
+			{op: opAcquire, owner: "a", mode: x, token: 1},
+			{op: opAcquire, owner: "w", mode: x, token: 0},
+			{op: opForceRelease},
+			{op: opRenew, owner: "a", token: 0},
+			{op: opAcquire, owner: "b", mode: s, token: 2},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lm := newTestLockManager()
+			for i, step := range test.steps {
+				node := step.node
+				if node == "" {
+					node = step.owner
+				}
+				token := apply(t, lm, lockCommand{
+					Op:       step.op,
+					Resource: testResource,
+					Owner:    step.owner,
+					Node:     node,
+					Mode:     step.mode,
+					Time:     start.Add(step.after),
+					TTL:      ttl,
+				})
+				if token != step.token {
+					t.Fatalf("step %d: %s of %s got token %d, want %d", i, step.op, step.owner, token, step.token)
+				}
+			}
+		})
+	}
+}
+
+//TestFencingOrder checks that tokens only grow, across resources and after the state is restored from a snapshot
+func TestFencingOrder(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lm := newTestLockManager()
+	var last uint64
+	acquire := func(lm *LockManager, resource, owner string) {
+		t.Helper()
+		token := apply(t, lm, lockCommand{Op: opAcquire, Resource: resource, Owner: owner, Mode: LockExclusive, Time: start, TTL: time.Minute})
+		if token <= last {
+			t.Fatalf("%s of %s got token %d, not greater than %d", resource, owner, token, last)
+		}
+		last = token
+		apply(t, lm, lockCommand{Op: opRelease, Resource: resource, Owner: owner, Time: start})
+	}
+
+	for i := 0; i < 3; i++ {
+		acquire(lm, "bucket/one", "a")
+		acquire(lm, "bucket/two", "a")
+	}
+	if len(lm.table.Resources) != 0 {
+		t.Fatalf("released resources are kept: %v", lm.table.Resources)
+	}
+
+	snapshot, err := lm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestLockManager()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	acquire(restored, "bucket/one", "b")
+}
+
+func TestRestoreKeepsHolders(t *testing.T) {
+	start := time.Now()
+	lm := newTestLockManager()
+	apply(t, lm, lockCommand{Op: opAcquire, Resource: testResource, Owner: "a", Mode: LockExclusive, Time: start, TTL: time.Minute})
+	apply(t, lm, lockCommand{Op: opAcquire, Resource: testResource, Owner: "w", Mode: LockExclusive, Time: start, TTL: time.Minute})
+
+	snapshot, err := lm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestLockManager()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	locks := restored.Locks()
+	if len(locks) != 1 || len(locks[0].Holders) != 1 || locks[0].Holders[0].Owner != "a" ||
+		len(locks[0].Waiting) != 1 || locks[0].Waiting[0].Owner != "w" || locks[0].Mode != LockExclusive {
+		t.Fatalf("got locks %+v after restore", locks)
+	}
+	if token := apply(t, restored, lockCommand{Op: opAcquire, Resource: testResource, Owner: "b", Mode: LockShared, Time: start, TTL: time.Minute}); token != 0 {
+		t.Fatalf("reader got token %d of resource held exclusively", token)
+	}
+}
+
+func TestLostLease(t *testing.T) {
+	lease := &Lease{Resource: testResource, Mode: LockExclusive, Token: 1, lost: make(chan struct{})}
+	ctx, cancel := lease.Context(context.Background())
+	defer cancel()
+	reader := lease.Guard(bytes.NewReader([]byte("data")))
+
+	buf := make([]byte, 2)
+	if _, err := reader.Read(buf); err != nil {
+		t.Fatalf("got error %v of held lease", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("context of held lease is done: %v", ctx.Err())
+	}
+
+	close(lease.lost)
+	if _, err := ioutil.ReadAll(reader); err != ErrorLeaseExpired {
+		t.Fatalf("got error %v of lost lease, want %v", err, ErrorLeaseExpired)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context of lost lease is not done")
+	}
+}
+
+//TestApplyAtLeaderTime checks that leases are timed by the leader's clock, not by the clock of the proposer
+func TestApplyAtLeaderTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lm := newTestLockManager()
+	applyAt := func(command lockCommand, appended time.Time) uint64 {
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(command); err != nil {
+			t.Fatal(err)
+		}
+		return decodeToken(lm.ApplyAt(buf.Bytes(), appended))
+	}
+
+	//Proposer's clock is an hour ahead, so its lease would look expired to everyone else
+	if token := applyAt(lockCommand{Op: opAcquire, Resource: testResource, Owner: "a", Mode: LockExclusive, Time: start.Add(time.Hour), TTL: time.Minute}, start); token != 1 {
+		t.Fatalf("got token %d, want 1", token)
+	}
+	//Proposer's clock is an hour behind, its lease would never expire
+	if token := applyAt(lockCommand{Op: opAcquire, Resource: testResource, Owner: "b", Mode: LockExclusive, Time: start.Add(-time.Hour), TTL: time.Minute}, start.Add(30*time.Second)); token != 0 {
+		t.Fatalf("got token %d of locked resource, want 0", token)
+	}
+	if token := applyAt(lockCommand{Op: opAcquire, Resource: testResource, Owner: "b", Mode: LockExclusive, Time: start.Add(-time.Hour), TTL: time.Minute}, start.Add(2*time.Minute)); token != 2 {
+		t.Fatalf("got token %d after the lease expired, want 2", token)
+	}
+}
+
+//TestForceReleaseFencesOutHolder checks that the evicted holder can neither keep its lease
+//nor write under its token, since every later holder gets a greater one
+func TestForceReleaseFencesOutHolder(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lm := newTestLockManager()
+	command := func(op, owner string) lockCommand {
+		return lockCommand{Op: op, Resource: testResource, Owner: owner, Node: owner, Mode: LockExclusive, Time: start, TTL: time.Minute}
+	}
+
+	evicted := apply(t, lm, command(opAcquire, "a"))
+	apply(t, lm, command(opForceRelease, ""))
+	if token := apply(t, lm, command(opRenew, "a")); token != 0 {
+		t.Fatalf("evicted holder renewed its lease with token %d", token)
+	}
+	next := apply(t, lm, command(opAcquire, "b"))
+	if next <= evicted {
+		t.Fatalf("got token %d of the next holder, want greater than %d of the evicted one", next, evicted)
+	}
+	apply(t, lm, command(opRelease, "b"))
+	if token := apply(t, lm, command(opAcquire, "a")); token <= next {
+		t.Fatalf("evicted holder got token %d back, want greater than %d", token, next)
+	}
+}
@@ -0,0 +1,354 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	c "dfs/config"
+	"dfs/server/raft"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTombstoneTTL = 7 * 24 * time.Hour
+	stateMachineName    = "catalog"
+)
+
+var (
+	ErrorStaleFencingToken   = errors.New("Fencing token is stale.")
+	ErrorBucketAlreadyExists = errors.New("Bucket already exists.")
+	ErrorBucketDoesNotExist  = errors.New("Bucket does not exist.")
+	ErrorBucketIsNotEmpty    = errors.New("Bucket is not empty.")
+)
+
+const (
+	opPut          = "put"
+	opDelete       = "delete"
+	opExpire       = "expire"
+	opCreateBucket = "create-bucket"
+	opDeleteBucket = "delete-bucket"
+)
+
+//ObjectMeta is the catalog record of a file. Deleted records are kept until TombstoneTTL passes
+//so that lagging nodes can not bring deleted files back.
+//Fence is the fencing token of the path lock the record was written under.
+//Checksum is SHA-256 of the file, MD5 is kept for the clients that identify files by it.
+//Files assembled from parts have CompositeMD5, the MD5 of MD5s of the parts followed by their number like S3 ETags.
+type ObjectMeta struct {
+	Path         string
+	Size         int64
+	Checksum     string
+	MD5          string `json:",omitempty"`
+	CompositeMD5 string `json:",omitempty"`
+	ContentType  string
+	Created      time.Time
+	Modified     time.Time
+	Replicas     []string
+	Version      uint64
+	Deleted      bool
+	Fence        uint64
+}
+
+//BucketMeta is the record of the bucket created explicitly.
+//Buckets holding files exist without records as well.
+type BucketMeta struct {
+	Name    string
+	Created time.Time
+}
+
+type catalogCommand struct {
+	Op     string
+	Object ObjectMeta
+	Bucket string
+	Time   time.Time
+	TTL    time.Duration
+}
+
+type catalogResult struct {
+	Object ObjectMeta
+	Exists bool
+	//Stale is set when the command was rejected for the lock holder who wrote the record later
+	Stale bool
+	//NotEmpty is set when the bucket was not deleted because it holds files
+	NotEmpty bool
+}
+
+//catalogSnapshot is what the catalog is restored from
+type catalogSnapshot struct {
+	Objects map[string]ObjectMeta
+	Buckets map[string]BucketMeta
+}
+
+//CatalogWatcher is called for every record that changed the catalog
+type CatalogWatcher func(object ObjectMeta)
+
+//Catalog keeps metadata of every file in the cluster.
+//It is a state machine of the raft log, so every node keeps the same records
+//and changes are made only when the majority of nodes stores them.
+type Catalog struct {
+	mutex    sync.Mutex
+	objects  map[string]ObjectMeta
+	buckets  map[string]BucketMeta
+	watchers []CatalogWatcher
+	config   *c.Config
+	raft     *raft.Raft
+}
+
+func (catalog *Catalog) UseConfig(config *c.Config) {
+	catalog.config = config
+}
+
+//Listen registers catalog in the raft log, it must be called before raft starts
+func (catalog *Catalog) Listen(r *raft.Raft) {
+	catalog.objects = make(map[string]ObjectMeta, 0)
+	catalog.buckets = make(map[string]BucketMeta, 0)
+	catalog.raft = r
+	r.Register(stateMachineName, catalog)
+
+	go func() {
+		ticker := time.Tick(time.Hour)
+		for {
+			<-ticker
+			if r.IsLeader() {
+				catalog.propose(context.Background(), catalogCommand{
+					Op:   opExpire,
+					Time: time.Now(),
+					TTL:  catalog.config.TombstoneTTL.Or(defaultTombstoneTTL),
+				})
+			}
+		}
+	}()
+}
+
+//Watch subscribes watcher to catalog changes
+func (catalog *Catalog) Watch(watcher CatalogWatcher) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	catalog.watchers = append(catalog.watchers, watcher)
+}
+
+//notify runs watchers on the changed records apart from the raft apply loop, so slow watchers do not hold back the log.
+//Watchers may see changes of the file out of order and must compare the records themselves.
+func (catalog *Catalog) notify(objects []ObjectMeta) {
+	if len(objects) == 0 {
+		return
+	}
+	catalog.mutex.Lock()
+	watchers := catalog.watchers
+	catalog.mutex.Unlock()
+	go func() {
+		for _, object := range objects {
+			for _, watcher := range watchers {
+				watcher(object)
+			}
+		}
+	}()
+}
+
+func (catalog *Catalog) propose(ctx context.Context, command catalogCommand) (catalogResult, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(command)
+	if err != nil {
+		return catalogResult{}, err
+	}
+	data, err := catalog.raft.Propose(ctx, stateMachineName, buf.Bytes())
+	if err != nil {
+		return catalogResult{}, err
+	}
+	var result catalogResult
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&result)
+	if err == nil && result.Stale {
+		err = ErrorStaleFencingToken
+	}
+	if err == nil && result.NotEmpty {
+		err = ErrorBucketIsNotEmpty
+	}
+	return result, err
+}
+
+//Apply executes committed catalog command
+func (catalog *Catalog) Apply(data []byte) []byte {
+	var command catalogCommand
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&command) != nil {
+		return nil
+	}
+
+	var result catalogResult
+	changed := make([]ObjectMeta, 0)
+
+	catalog.mutex.Lock()
+	current, exists := catalog.objects[command.Object.Path]
+	switch {
+	case command.Op == opCreateBucket:
+		_, result.Exists = catalog.buckets[command.Bucket]
+		if !result.Exists {
+			catalog.buckets[command.Bucket] = BucketMeta{Name: command.Bucket, Created: command.Time}
+		}
+
+	case command.Op == opDeleteBucket:
+		_, result.Exists = catalog.buckets[command.Bucket]
+		for path, object := range catalog.objects {
+			bucketName, _ := splitPath(path)
+			if bucketName == command.Bucket && !object.Deleted {
+				result.Exists = true
+				result.NotEmpty = true
+				break
+			}
+		}
+		if !result.NotEmpty {
+			delete(catalog.buckets, command.Bucket)
+		}
+
+	case exists && command.Object.Fence < current.Fence:
+		result.Stale = true
+
+	case command.Op == opPut:
+		object := command.Object
+		object.Version = current.Version + 1
+		object.Created = command.Time
+		if exists && !current.Deleted {
+			object.Created = current.Created
+		}
+		object.Modified = command.Time
+		object.Deleted = false
+		catalog.objects[object.Path] = object
+		result = catalogResult{Object: object, Exists: true}
+		changed = append(changed, object)
+
+	case command.Op == opDelete:
+		if !exists || current.Deleted {
+			break
+		}
+		current.Version++
+		current.Modified = command.Time
+		current.Deleted = true
+		current.Fence = command.Object.Fence
+		catalog.objects[current.Path] = current
+		result = catalogResult{Object: current, Exists: true}
+		changed = append(changed, current)
+
+	case command.Op == opExpire:
+		for path, object := range catalog.objects {
+			if object.Deleted && command.Time.Sub(object.Modified) > command.TTL {
+				delete(catalog.objects, path)
+			}
+		}
+	}
+	catalog.mutex.Unlock()
+
+	catalog.notify(changed)
+
+	buf := &bytes.Buffer{}
+	gob.NewEncoder(buf).Encode(result)
+	return buf.Bytes()
+}
+
+func (catalog *Catalog) Snapshot() ([]byte, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	return json.Marshal(catalogSnapshot{Objects: catalog.objects, Buckets: catalog.buckets})
+}
+
+//Restore replaces the catalog with snapshot, watchers learn about the files deleted meanwhile
+func (catalog *Catalog) Restore(data []byte) error {
+	var snapshot catalogSnapshot
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return err
+	}
+	if snapshot.Objects == nil {
+		snapshot.Objects = make(map[string]ObjectMeta, 0)
+	}
+	if snapshot.Buckets == nil {
+		snapshot.Buckets = make(map[string]BucketMeta, 0)
+	}
+	catalog.mutex.Lock()
+	catalog.objects = snapshot.Objects
+	catalog.buckets = snapshot.Buckets
+	catalog.mutex.Unlock()
+
+	catalog.notify(catalog.DeletedObjects())
+	return nil
+}
+
+//Get returns record of the file unless the file does not exist or was deleted
+func (catalog *Catalog) Get(path string) (object ObjectMeta, exists bool) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	object, exists = catalog.objects[path]
+	if !exists || object.Deleted {
+		return ObjectMeta{}, false
+	}
+	return object, true
+}
+
+//Put records new version of the file.
+//ErrorStaleFencingToken is returned if the record was written under a newer lock than object.Fence.
+func (catalog *Catalog) Put(ctx context.Context, object ObjectMeta) (ObjectMeta, error) {
+	result, err := catalog.propose(ctx, catalogCommand{
+		Op:     opPut,
+		Object: object,
+		Time:   time.Now(),
+	})
+	return result.Object, err
+}
+
+//Delete marks the file as deleted under the lock with the fencing token and returns the deletion record
+func (catalog *Catalog) Delete(ctx context.Context, path string, fence uint64) (object ObjectMeta, exists bool, err error) {
+	result, err := catalog.propose(ctx, catalogCommand{
+		Op:     opDelete,
+		Object: ObjectMeta{Path: path, Fence: fence},
+		Time:   time.Now(),
+	})
+	return result.Object, result.Exists, err
+}
+
+//CreateBucket records the bucket, ErrorBucketAlreadyExists is returned if it is recorded already
+func (catalog *Catalog) CreateBucket(ctx context.Context, bucketName string) error {
+	result, err := catalog.propose(ctx, catalogCommand{
+		Op:     opCreateBucket,
+		Bucket: bucketName,
+		Time:   time.Now(),
+	})
+	if err == nil && result.Exists {
+		err = ErrorBucketAlreadyExists
+	}
+	return err
+}
+
+//DeleteBucket removes record of the bucket unless it holds files
+func (catalog *Catalog) DeleteBucket(ctx context.Context, bucketName string) error {
+	result, err := catalog.propose(ctx, catalogCommand{
+		Op:     opDeleteBucket,
+		Bucket: bucketName,
+		Time:   time.Now(),
+	})
+	if err == nil && !result.Exists {
+		err = ErrorBucketDoesNotExist
+	}
+	return err
+}
+
+//IsDeleted reports whether file was deleted after the given time
+func (catalog *Catalog) IsDeleted(path string, since time.Time) bool {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	object, exists := catalog.objects[path]
+	return exists && object.Deleted && !object.Modified.Before(since)
+}
+
+//DeletedObjects returns records of deleted files that are still remembered
+func (catalog *Catalog) DeletedObjects() []ObjectMeta {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	objects := make([]ObjectMeta, 0)
+	for _, object := range catalog.objects {
+		if object.Deleted {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
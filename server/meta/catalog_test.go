@@ -0,0 +1,179 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFence(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    string
+		fence uint64
+		stale bool
+		//size is the size of the file afterwards, 0 if it is deleted
+		size int64
+	}{
+		{name: "put under newer lock", op: opPut, fence: 3, size: 2},
+		{name: "put under the same lock", op: opPut, fence: 2, size: 2},
+		{name: "put under older lock", op: opPut, fence: 1, stale: true, size: 1},
+		{name: "delete under older lock", op: opDelete, fence: 1, stale: true, size: 1},
+		{name: "delete under newer lock", op: opDelete, fence: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			catalog := newTestCatalog()
+			apply(t, catalog, catalogCommand{Op: opPut, Object: ObjectMeta{Path: "bucket/file", Size: 1, Fence: 2}, Time: time.Now()})
+
+			result := apply(t, catalog, catalogCommand{Op: test.op, Object: ObjectMeta{Path: "bucket/file", Size: 2, Fence: test.fence}, Time: time.Now()})
+			if result.Stale != test.stale {
+				t.Fatalf("got stale %v, want %v", result.Stale, test.stale)
+			}
+			object, exists := catalog.Get("bucket/file")
+			if exists != (test.size > 0) || object.Size != test.size {
+				t.Fatalf("got record %+v, exists %v, want size %d", object, exists, test.size)
+			}
+		})
+	}
+}
+
+func TestTombstoneExpiry(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+	catalog := newTestCatalog()
+	apply(t, catalog, catalogCommand{Op: opPut, Object: ObjectMeta{Path: "bucket/old"}, Time: start})
+	apply(t, catalog, catalogCommand{Op: opPut, Object: ObjectMeta{Path: "bucket/new"}, Time: start})
+	apply(t, catalog, catalogCommand{Op: opPut, Object: ObjectMeta{Path: "bucket/kept"}, Time: start})
+	apply(t, catalog, catalogCommand{Op: opDelete, Object: ObjectMeta{Path: "bucket/old"}, Time: start})
+	apply(t, catalog, catalogCommand{Op: opDelete, Object: ObjectMeta{Path: "bucket/new"}, Time: start.Add(ttl)})
+
+	apply(t, catalog, catalogCommand{Op: opExpire, Time: start.Add(ttl + time.Minute), TTL: ttl})
+	tests := []struct {
+		path    string
+		deleted bool
+		exists  bool
+	}{
+		{path: "bucket/old", exists: false},
+		{path: "bucket/new", deleted: true, exists: true},
+		{path: "bucket/kept", exists: true},
+	}
+	for _, test := range tests {
+		catalog.mutex.Lock()
+		object, exists := catalog.objects[test.path]
+		catalog.mutex.Unlock()
+		if exists != test.exists || object.Deleted != test.deleted {
+			t.Fatalf("%s: got record %+v, exists %v, want exists %v, deleted %v", test.path, object, exists, test.exists, test.deleted)
+		}
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		deleted  []string
+		exists   bool
+		notEmpty bool
+	}{
+		{name: "empty bucket", exists: true},
+		{name: "bucket with files", paths: []string{"bucket/file"}, exists: true, notEmpty: true},
+		{name: "bucket with deleted files", paths: []string{"bucket/file"}, deleted: []string{"bucket/file"}, exists: true},
+		{name: "files of other bucket", paths: []string{"other/file"}, exists: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			catalog := newTestCatalog()
+			apply(t, catalog, catalogCommand{Op: opCreateBucket, Bucket: "bucket", Time: time.Now()})
+			put(t, catalog, test.paths...)
+			for _, path := range test.deleted {
+				apply(t, catalog, catalogCommand{Op: opDelete, Object: ObjectMeta{Path: path}, Time: time.Now()})
+			}
+
+			result := apply(t, catalog, catalogCommand{Op: opDeleteBucket, Bucket: "bucket", Time: time.Now()})
+			if result.Exists != test.exists || result.NotEmpty != test.notEmpty {
+				t.Fatalf("got exists %v, not empty %v, want %v, %v", result.Exists, result.NotEmpty, test.exists, test.notEmpty)
+			}
+			catalog.mutex.Lock()
+			_, kept := catalog.buckets["bucket"]
+			catalog.mutex.Unlock()
+			if kept != test.notEmpty {
+				t.Fatalf("got bucket kept %v, want %v", kept, test.notEmpty)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	catalog := newTestCatalog()
+	put(t, catalog, "bucket/file")
+	apply(t, catalog, catalogCommand{Op: opCreateBucket, Bucket: "bucket", Time: time.Now()})
+	data, err := catalog.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestCatalog()
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := restored.Get("bucket/file"); !exists {
+		t.Fatal("restored catalog lost the file")
+	}
+	if _, exists := restored.buckets["bucket"]; !exists {
+		t.Fatal("restored catalog lost the bucket")
+	}
+
+	//Snapshot without buckets is restored with no buckets
+	data, err = json.Marshal(catalogSnapshot{Objects: map[string]ObjectMeta{"bucket/file": {Path: "bucket/file"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.buckets == nil || len(restored.buckets) != 0 {
+		t.Fatalf("got buckets %v, want none", restored.buckets)
+	}
+}
+
+func TestWatchersRunApart(t *testing.T) {
+	catalog := newTestCatalog()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	notified := make(chan ObjectMeta, 2)
+	catalog.Watch(func(object ObjectMeta) {
+		notified <- object
+		<-blocked
+	})
+
+	commands := make([][]byte, 0)
+	for _, path := range []string{"bucket/file", "bucket/other"} {
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(catalogCommand{Op: opPut, Object: ObjectMeta{Path: path}, Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, buf.Bytes())
+	}
+	applied := make(chan struct{})
+	go func() {
+		for _, command := range commands {
+			catalog.Apply(command)
+		}
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked watcher holds back the catalog")
+	}
+	paths := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		paths[(<-notified).Path] = true
+	}
+	if !paths["bucket/file"] || !paths["bucket/other"] {
+		t.Fatalf("got notifications of %v, want both files", paths)
+	}
+}
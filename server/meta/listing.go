@@ -0,0 +1,173 @@
+package meta
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultMaxKeys = 1000
+)
+
+var (
+	ErrorBadContinuationToken = errors.New("Bad continuation token.")
+)
+
+type ObjectListing struct {
+	Bucket                string
+	Prefix                string
+	MaxKeys               int
+	Objects               []ObjectMeta
+	IsTruncated           bool
+	NextContinuationToken string `json:",omitempty"`
+}
+
+func splitPath(path string) (bucketName, fileName string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+//ContinuationToken returns token that continues listing after the file name
+func ContinuationToken(startAfter string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(startAfter))
+}
+
+//ParseContinuationToken returns the file name listing continues after
+func ParseContinuationToken(continuationToken string) (startAfter string, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(continuationToken)
+	if err != nil {
+		return "", ErrorBadContinuationToken
+	}
+	return string(decoded), nil
+}
+
+//Buckets returns names of the buckets that were created or hold at least one file
+func (catalog *Catalog) Buckets(prefix string) []string {
+	records := catalog.BucketRecords(prefix)
+	buckets := make([]string, 0, len(records))
+	for _, record := range records {
+		buckets = append(buckets, record.Name)
+	}
+	return buckets
+}
+
+//BucketRecords returns records of the buckets that were created or hold at least one file in name order.
+//Buckets that were not created explicitly are as old as their oldest file.
+func (catalog *Catalog) BucketRecords(prefix string) []BucketMeta {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	records := make(map[string]BucketMeta, len(catalog.buckets))
+	for bucketName, record := range catalog.buckets {
+		if strings.HasPrefix(bucketName, prefix) {
+			records[bucketName] = record
+		}
+	}
+	for path, object := range catalog.objects {
+		bucketName, _ := splitPath(path)
+		if object.Deleted || !strings.HasPrefix(bucketName, prefix) || catalog.isCreated(bucketName) {
+			continue
+		}
+		if record, exists := records[bucketName]; !exists || object.Created.Before(record.Created) {
+			records[bucketName] = BucketMeta{Name: bucketName, Created: object.Created}
+		}
+	}
+	buckets := make([]BucketMeta, 0, len(records))
+	for _, record := range records {
+		buckets = append(buckets, record)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return buckets
+}
+
+//isCreated reports whether bucket was created explicitly. Must be called with catalog.mutex held.
+func (catalog *Catalog) isCreated(bucketName string) bool {
+	_, exists := catalog.buckets[bucketName]
+	return exists
+}
+
+//BucketExists reports whether bucket was created or holds at least one file
+func (catalog *Catalog) BucketExists(bucketName string) bool {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if catalog.isCreated(bucketName) {
+		return true
+	}
+	for path, object := range catalog.objects {
+		objectBucket, _ := splitPath(path)
+		if objectBucket == bucketName && !object.Deleted {
+			return true
+		}
+	}
+	return false
+}
+
+//List returns a page of at most maxKeys files of the bucket in name order.
+//Next page is requested with NextContinuationToken of the previous one.
+//This node catches up with the leader first, so files written through other nodes before the call are listed.
+func (catalog *Catalog) List(ctx context.Context, bucketName, prefix, continuationToken string, maxKeys int) (ObjectListing, error) {
+	err := catalog.raft.ReadIndex(ctx)
+	if err != nil {
+		return ObjectListing{}, err
+	}
+	return catalog.list(bucketName, prefix, continuationToken, maxKeys)
+}
+
+//list returns the page of files as they are recorded on this node
+func (catalog *Catalog) list(bucketName, prefix, continuationToken string, maxKeys int) (ObjectListing, error) {
+	if maxKeys <= 0 || maxKeys > DefaultMaxKeys {
+		maxKeys = DefaultMaxKeys
+	}
+	listing := ObjectListing{
+		Bucket:  bucketName,
+		Prefix:  prefix,
+		MaxKeys: maxKeys,
+		Objects: make([]ObjectMeta, 0),
+	}
+
+	startAfter, err := ParseContinuationToken(continuationToken)
+	if err != nil {
+		return listing, err
+	}
+
+	catalog.mutex.Lock()
+	names := make([]string, 0)
+	for path, object := range catalog.objects {
+		objectBucket, name := splitPath(path)
+		if !object.Deleted && objectBucket == bucketName && strings.HasPrefix(name, prefix) && name > startAfter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxKeys {
+		names = names[:maxKeys]
+		listing.IsTruncated = true
+		listing.NextContinuationToken = ContinuationToken(names[maxKeys-1])
+	}
+	for _, name := range names {
+		listing.Objects = append(listing.Objects, catalog.objects[bucketName+"/"+name])
+	}
+	catalog.mutex.Unlock()
+
+	return listing, nil
+}
+
+//IsNested reports whether a file is kept under the path as under a directory or the path is under a file.
+//Files are stored at their paths, so the file at such path can not be stored.
+func (catalog *Catalog) IsNested(path string) bool {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for objectPath, object := range catalog.objects {
+		if !object.Deleted && (strings.HasPrefix(objectPath, path+"/") || strings.HasPrefix(path, objectPath+"/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCatalog() *Catalog {
+	return &Catalog{
+		objects: make(map[string]ObjectMeta, 0),
+		buckets: make(map[string]BucketMeta, 0),
+	}
+}
+
+//apply executes the command and returns its result
+func apply(t *testing.T, catalog *Catalog, command catalogCommand) catalogResult {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(command); err != nil {
+		t.Fatal(err)
+	}
+	var result catalogResult
+	if err := gob.NewDecoder(bytes.NewReader(catalog.Apply(buf.Bytes()))).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func put(t *testing.T, catalog *Catalog, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		apply(t, catalog, catalogCommand{Op: opPut, Object: ObjectMeta{Path: path}, Time: time.Now()})
+	}
+}
+
+func TestIsNested(t *testing.T) {
+	catalog := newTestCatalog()
+	put(t, catalog, "bucket/a", "bucket/dir/file", "bucket/deleted/file")
+	apply(t, catalog, catalogCommand{Op: opDelete, Object: ObjectMeta{Path: "bucket/deleted/file"}, Time: time.Now()})
+
+	tests := []struct {
+		path   string
+		nested bool
+	}{
+		{path: "bucket/a/b", nested: true},
+		{path: "bucket/dir", nested: true},
+		{path: "bucket/a", nested: false},
+		{path: "bucket/ab", nested: false},
+		{path: "bucket/di", nested: false},
+		{path: "other/a/b", nested: false},
+		{path: "bucket/deleted", nested: false},
+	}
+	for _, test := range tests {
+		if nested := catalog.IsNested(test.path); nested != test.nested {
+			t.Fatalf("%s: got nested %v, want %v", test.path, nested, test.nested)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	catalog := newTestCatalog()
+	put(t, catalog, "bucket/a", "bucket/b/1", "bucket/b/2", "bucket/c", "bucket/deleted", "other/a")
+	apply(t, catalog, catalogCommand{Op: opDelete, Object: ObjectMeta{Path: "bucket/deleted"}, Time: time.Now()})
+
+	tests := []struct {
+		name   string
+		prefix string
+		//pages are the names listed on every page of maxKeys files
+		maxKeys int
+		pages   [][]string
+	}{
+		{name: "whole bucket", pages: [][]string{{"a", "b/1", "b/2", "c"}}},
+		{name: "prefix", prefix: "b/", pages: [][]string{{"b/1", "b/2"}}},
+		{name: "prefix of no file", prefix: "d", pages: [][]string{{}}},
+		{name: "pages", maxKeys: 3, pages: [][]string{{"a", "b/1", "b/2"}, {"c"}}},
+		{name: "pages ending with the last file", maxKeys: 2, pages: [][]string{{"a", "b/1"}, {"b/2", "c"}}},
+		{name: "pages of prefix", prefix: "b", maxKeys: 1, pages: [][]string{{"b/1"}, {"b/2"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			continuationToken := ""
+			for i, page := range test.pages {
+				listing, err := catalog.list("bucket", test.prefix, continuationToken, test.maxKeys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				names := make([]string, 0)
+				for _, object := range listing.Objects {
+					names = append(names, object.Path[len("bucket/"):])
+				}
+				if strings.Join(names, ",") != strings.Join(page, ",") {
+					t.Fatalf("page %d: got %v, want %v", i, names, page)
+				}
+				last := i == len(test.pages)-1
+				if listing.IsTruncated == last || (listing.NextContinuationToken == "") != last {
+					t.Fatalf("page %d of %d: got truncated %v, token %q", i, len(test.pages), listing.IsTruncated, listing.NextContinuationToken)
+				}
+				continuationToken = listing.NextContinuationToken
+			}
+		})
+	}
+
+	if _, err := catalog.list("bucket", "", "not base64!", 0); err != ErrorBadContinuationToken {
+		t.Fatalf("got error %v, want %v", err, ErrorBadContinuationToken)
+	}
+}
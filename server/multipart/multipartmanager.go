@@ -0,0 +1,636 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	sp "dfs/server/path"
+	"dfs/server/raft"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	p "path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stateMachineName          = "multipart"
+	defaultMultipartUploadTTL = 24 * time.Hour
+	defaultReaperInterval     = time.Minute
+	defaultChunkSize          = 1 << 20
+	defaultProposeTimeout     = 10 * time.Second
+	//partsDir is the directory of the staging dir that keeps parts received by this node
+	partsDir = "multipart"
+	//staleDirAge is how long parts of unknown uploads are kept, the node may learn about the upload after it receives a part
+	staleDirAge = time.Hour
+)
+
+//MaxPartNumber is the highest number of the part like in S3
+const MaxPartNumber = 10000
+
+const (
+	opInitiate = "initiate"
+	opPart     = "part"
+	opFinish   = "finish"
+	opExpire   = "expire"
+)
+
+var (
+	ErrorUploadDoesNotExist   = errors.New("Multipart upload does not exist.")
+	ErrorInvalidPartNumber    = errors.New("Part number must be between 1 and 10000.")
+	ErrorInvalidPart          = errors.New("Part was not uploaded or its ETag does not match.")
+	ErrorInvalidPartOrder     = errors.New("Parts must be listed in ascending order.")
+	ErrorNoPartsListed        = errors.New("Parts to complete the upload with must be listed.")
+	ErrorUploadIsCompleting   = errors.New("Multipart upload is being completed.")
+	ErrorUploadOnAnotherNode  = errors.New("Multipart upload is completed by another node.")
+	ErrorPartChecksumMismatch = errors.New("Checksum of the part does not match.")
+	ErrorPartIsTooLarge       = errors.New("Part is too large.")
+)
+
+//Part is the record of the part received by Node. Part uploaded again replaces the previous one.
+type Part struct {
+	Number   int
+	Node     string
+	Size     int64
+	Checksum string
+	MD5      string
+	Uploaded time.Time
+}
+
+//Upload is the multipart upload of the file reserved by an upload token.
+//Parts are uploaded to any nodes, Node assembles them once the upload is completed.
+//Upload expires if it receives no part for MultipartUploadTTL.
+type Upload struct {
+	ID          string
+	Path        string
+	Fence       uint64
+	Node        string
+	Replicas    []string
+	ContentType string
+	MaxSize     int64
+	Initiated   time.Time
+	Updated     time.Time
+	Parts       map[int]Part
+}
+
+//SortedParts returns parts of the upload ordered by number
+func (upload Upload) SortedParts() []Part {
+	parts := make([]Part, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts
+}
+
+//CompletedPart is the part listed by the client to complete the upload with
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+type multipartCommand struct {
+	Op     string
+	Upload Upload
+	Part   Part
+	ID     string
+	Time   time.Time
+	TTL    time.Duration
+}
+
+type multipartResult struct {
+	Exists  bool
+	Expired []Upload
+}
+
+//MultipartManager keeps multipart uploads in the raft log, so parts may be uploaded to any node.
+//Data of the parts stays on the nodes that received them until the upload is finished.
+type MultipartManager struct {
+	mutex       sync.Mutex
+	config      *c.Config
+	nodeManager *node.NodeManager
+	pathManager *sp.PathManager
+	raft        *raft.Raft
+	msgHub      *comm.MessageHub
+
+	uploads map[string]*Upload
+	//completing holds uploads this node is assembling
+	completing map[string]bool
+}
+
+func (mm *MultipartManager) UseConfig(config *c.Config) {
+	mm.config = config
+}
+
+//Listen registers uploads in the raft log, it must be called before raft starts
+func (mm *MultipartManager) Listen(
+	nodeManager *node.NodeManager,
+	pathManager *sp.PathManager,
+	r *raft.Raft,
+	msgHub *comm.MessageHub) {
+
+	mm.nodeManager = nodeManager
+	mm.pathManager = pathManager
+	mm.raft = r
+	mm.msgHub = msgHub
+	mm.uploads = make(map[string]*Upload, 0)
+	mm.completing = make(map[string]bool, 0)
+	r.Register(stateMachineName, mm)
+	msgHub.Subscribe(mm, comm.MessageTypeRemoveParts)
+	msgHub.SubscribeStream(mm, comm.MessageTypeReadPart)
+
+	go func() {
+		ticker := time.Tick(mm.config.TokenReaperInterval.Or(defaultReaperInterval))
+		for {
+			<-ticker
+			if r.IsLeader() {
+				mm.abortExpired()
+			}
+			mm.removeStaleParts()
+		}
+	}()
+}
+
+func (mm *MultipartManager) dir() string {
+	return p.Join(mm.config.StagingPath(), partsDir)
+}
+
+//partPath returns where this node keeps the part, versions of the part are told apart by checksum
+func (mm *MultipartManager) partPath(id string, number int, checksum string) string {
+	return p.Join(mm.dir(), id, fmt.Sprintf("%d-%s.part", number, checksum))
+}
+
+func (mm *MultipartManager) chunkSize() int {
+	chunkSize := mm.config.ReplicationChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if chunkSize > comm.MaxPayloadLength/2 {
+		chunkSize = comm.MaxPayloadLength / 2
+	}
+	return chunkSize
+}
+
+func (mm *MultipartManager) propose(ctx context.Context, command multipartCommand) (multipartResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, mm.config.Timeouts.Consensus.Or(defaultProposeTimeout))
+	defer cancel()
+
+	command.Time = time.Now()
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(command)
+	if err != nil {
+		return multipartResult{}, err
+	}
+	data, err := mm.raft.Propose(ctx, stateMachineName, buf.Bytes())
+	if err != nil {
+		return multipartResult{}, err
+	}
+	var result multipartResult
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&result)
+	return result, err
+}
+
+//Apply executes committed multipart command. Part and finish report whether the upload existed,
+//expire returns the uploads it removed.
+func (mm *MultipartManager) Apply(data []byte) []byte {
+	var command multipartCommand
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&command) != nil {
+		return nil
+	}
+
+	var result multipartResult
+	mm.mutex.Lock()
+	switch command.Op {
+	case opInitiate:
+		upload := command.Upload
+		upload.Initiated = command.Time
+		upload.Updated = command.Time
+		upload.Parts = make(map[int]Part, 0)
+		mm.uploads[upload.ID] = &upload
+		result.Exists = true
+
+	case opPart:
+		upload, exists := mm.uploads[command.ID]
+		if exists {
+			part := command.Part
+			part.Uploaded = command.Time
+			upload.Parts[part.Number] = part
+			upload.Updated = command.Time
+		}
+		result.Exists = exists
+
+	case opFinish:
+		_, result.Exists = mm.uploads[command.ID]
+		delete(mm.uploads, command.ID)
+
+	case opExpire:
+		ids := make([]string, 0)
+		for id, upload := range mm.uploads {
+			if command.Time.Sub(upload.Updated) > command.TTL {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			result.Expired = append(result.Expired, *mm.uploads[id])
+			delete(mm.uploads, id)
+		}
+	}
+	mm.mutex.Unlock()
+
+	buf := &bytes.Buffer{}
+	gob.NewEncoder(buf).Encode(result)
+	return buf.Bytes()
+}
+
+func (mm *MultipartManager) Snapshot() ([]byte, error) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	return json.Marshal(mm.uploads)
+}
+
+func (mm *MultipartManager) Restore(data []byte) error {
+	uploads := make(map[string]*Upload, 0)
+	err := json.Unmarshal(data, &uploads)
+	if err != nil {
+		return err
+	}
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	mm.uploads = uploads
+	return nil
+}
+
+//Initiate records new upload assembled by this node and returns it with the ID assigned
+func (mm *MultipartManager) Initiate(ctx context.Context, upload Upload) (Upload, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.ID = hex.EncodeToString(id)
+	upload.Node = mm.nodeManager.This.Name
+
+	_, err = mm.propose(ctx, multipartCommand{Op: opInitiate, Upload: upload})
+	if err != nil {
+		return Upload{}, err
+	}
+	return mm.Get(upload.ID)
+}
+
+//Get returns copy of the upload
+func (mm *MultipartManager) Get(id string) (Upload, error) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	upload, exists := mm.uploads[id]
+	if !exists {
+		return Upload{}, ErrorUploadDoesNotExist
+	}
+	copied := *upload
+	copied.Parts = make(map[int]Part, len(upload.Parts))
+	for number, part := range upload.Parts {
+		copied.Parts[number] = part
+	}
+	return copied, nil
+}
+
+//Expires returns when the upload expires unless it receives another part
+func (mm *MultipartManager) Expires(upload Upload) time.Time {
+	return upload.Updated.Add(mm.config.MultipartUploadTTL.Or(defaultMultipartUploadTTL))
+}
+
+//Lookup returns copy of the upload like Get. Upload missing here may be initiated through another node
+//a moment ago, so this node catches up with the leader before the upload is reported missing.
+func (mm *MultipartManager) Lookup(ctx context.Context, id string) (Upload, error) {
+	upload, err := mm.Get(id)
+	if err != ErrorUploadDoesNotExist {
+		return upload, err
+	}
+	err = mm.raft.ReadIndex(ctx)
+	if err != nil {
+		return Upload{}, err
+	}
+	return mm.Get(id)
+}
+
+//WritePart stores the part on this node and records it in the upload
+func (mm *MultipartManager) WritePart(ctx context.Context, id string, number int, data io.Reader) (Part, error) {
+	if number < 1 || number > MaxPartNumber {
+		return Part{}, ErrorInvalidPartNumber
+	}
+	upload, err := mm.Lookup(ctx, id)
+	if err != nil {
+		return Part{}, err
+	}
+
+	err = os.MkdirAll(p.Join(mm.dir(), id), 0755)
+	if err != nil {
+		return Part{}, err
+	}
+	//Same part may be uploaded concurrently, so every upload is written aside until its checksum is known
+	tempFile, err := ioutil.TempFile(p.Join(mm.dir(), id), fmt.Sprintf("%d-*.tmp", number))
+	if err != nil {
+		return Part{}, err
+	}
+	tempPath := tempFile.Name()
+
+	var reader io.Reader = data
+	if upload.MaxSize > 0 {
+		reader = io.LimitReader(data, upload.MaxSize+1)
+	}
+	hash := sha256.New()
+	md5Hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hash, md5Hash), reader)
+	if err == nil && upload.MaxSize > 0 && size > upload.MaxSize {
+		err = ErrorPartIsTooLarge
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	part := Part{
+		Number:   number,
+		Node:     mm.nodeManager.This.Name,
+		Size:     size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		MD5:      hex.EncodeToString(md5Hash.Sum(nil)),
+	}
+	partPath := mm.partPath(id, number, part.Checksum)
+	if err == nil {
+		err = os.Rename(tempPath, partPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return Part{}, err
+	}
+
+	result, err := mm.propose(ctx, multipartCommand{Op: opPart, ID: id, Part: part})
+	if err == nil && !result.Exists {
+		err = ErrorUploadDoesNotExist
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return Part{}, err
+	}
+	return part, nil
+}
+
+//Acquire reserves the upload for assembling by this node.
+//Parts recorded through other nodes are applied here before the upload is read.
+func (mm *MultipartManager) Acquire(ctx context.Context, id string) (Upload, error) {
+	err := mm.raft.ReadIndex(ctx)
+	if err != nil {
+		return Upload{}, err
+	}
+	upload, err := mm.Get(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if upload.Node != mm.nodeManager.This.Name {
+		return Upload{}, ErrorUploadOnAnotherNode
+	}
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	if mm.completing[id] {
+		return Upload{}, ErrorUploadIsCompleting
+	}
+	mm.completing[id] = true
+	return upload, nil
+}
+
+func (mm *MultipartManager) Release(id string) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+	delete(mm.completing, id)
+}
+
+//Select returns the parts to assemble the upload of. Like in S3 the parts must be listed,
+//listed parts must be uploaded and ascend, ETags are the MD5 of the parts.
+func Select(upload Upload, completed []CompletedPart) ([]Part, error) {
+	if len(completed) == 0 {
+		return nil, ErrorNoPartsListed
+	}
+	parts := make([]Part, 0, len(completed))
+	for i, listed := range completed {
+		if i > 0 && listed.Number <= completed[i-1].Number {
+			return nil, ErrorInvalidPartOrder
+		}
+		part, exists := upload.Parts[listed.Number]
+		etag := listed.ETag
+		if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+			etag = etag[1 : len(etag)-1]
+		}
+		if !exists || (etag != "" && etag != part.MD5) {
+			return nil, ErrorInvalidPart
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+//Assemble writes the parts one after another, parts kept by other nodes are streamed from them.
+//Every part is verified against its checksum.
+func (mm *MultipartManager) Assemble(ctx context.Context, id string, parts []Part, w io.Writer) error {
+	for _, part := range parts {
+		hash := sha256.New()
+		var err error
+		if part.Node == mm.nodeManager.This.Name {
+			err = mm.copyLocalPart(io.MultiWriter(w, hash), id, part)
+		} else {
+			err = mm.copyRemotePart(ctx, io.MultiWriter(w, hash), id, part)
+		}
+		if err != nil {
+			return fmt.Errorf("part %d: %v", part.Number, err)
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != part.Checksum {
+			return ErrorPartChecksumMismatch
+		}
+	}
+	return nil
+}
+
+func (mm *MultipartManager) copyLocalPart(w io.Writer, id string, part Part) error {
+	file, err := os.Open(mm.partPath(id, part.Number, part.Checksum))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func (mm *MultipartManager) copyRemotePart(ctx context.Context, w io.Writer, id string, part Part) error {
+	stream, err := mm.msgHub.OpenStream(part.Node)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for offset := int64(0); offset < part.Size; {
+		msg := comm.Message{Type: comm.MessageTypeReadPart}
+		msg.EncodeData(comm.MessageReadPart{
+			UploadID: id,
+			Number:   part.Number,
+			Checksum: part.Checksum,
+			Offset:   offset,
+			Length:   mm.chunkSize(),
+		})
+		reply, err := stream.Request(ctx, msg)
+		if err != nil {
+			return err
+		}
+		var data comm.MessagePartData
+		err = reply.DecodeData(&data)
+		if err != nil {
+			return err
+		}
+		if data.Error != "" {
+			return errors.New(data.Error)
+		}
+		if len(data.Data) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		_, err = w.Write(data.Data)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data.Data))
+	}
+	return nil
+}
+
+//HandleStreamMessage sends chunks of the parts this node received to the node assembling the upload
+func (mm *MultipartManager) HandleStreamMessage(msg *comm.Message) comm.Message {
+	var request comm.MessageReadPart
+	msg.DecodeData(&request)
+	var response comm.MessagePartData
+
+	err := func() error {
+		file, err := os.Open(mm.partPath(request.UploadID, request.Number, request.Checksum))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		buf := make([]byte, request.Length)
+		n, err := file.ReadAt(buf, request.Offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		response.Data = buf[:n]
+		return nil
+	}()
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	responseMsg := comm.Message{Type: comm.MessageTypePartData}
+	responseMsg.EncodeData(response)
+	return responseMsg
+}
+
+//Finish forgets the upload and removes its parts from every node holding them
+func (mm *MultipartManager) Finish(ctx context.Context, id string) error {
+	upload, err := mm.Get(id)
+	if err != nil {
+		return err
+	}
+	result, err := mm.propose(ctx, multipartCommand{Op: opFinish, ID: id})
+	if err == nil && !result.Exists {
+		err = ErrorUploadDoesNotExist
+	}
+	if err == nil {
+		mm.removeParts(upload)
+	}
+	return err
+}
+
+//removeParts removes the parts of the upload here and asks other nodes holding them to do the same.
+//Parts of the node which is not reached are removed by it once they are stale.
+func (mm *MultipartManager) removeParts(upload Upload) {
+	os.RemoveAll(p.Join(mm.dir(), upload.ID))
+
+	msg := comm.Message{Type: comm.MessageTypeRemoveParts}
+	msg.EncodeData(comm.MessageRemoveParts{UploadID: upload.ID})
+	sent := map[string]bool{mm.nodeManager.This.Name: true}
+	for _, part := range upload.Parts {
+		if sent[part.Node] {
+			continue
+		}
+		sent[part.Node] = true
+		err := mm.msgHub.Send(msg, part.Node)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (mm *MultipartManager) HandleMessage(msg *comm.Message) {
+	switch msg.Type {
+	case comm.MessageTypeRemoveParts:
+		var request comm.MessageRemoveParts
+		msg.DecodeData(&request)
+		if request.UploadID != "" && p.Base(request.UploadID) == request.UploadID {
+			os.RemoveAll(p.Join(mm.dir(), request.UploadID))
+		}
+	}
+}
+
+//Abort forgets the upload and releases the path it was uploading for the reason
+func (mm *MultipartManager) Abort(ctx context.Context, id, reason string) error {
+	upload, err := mm.Get(id)
+	if err != nil {
+		return err
+	}
+	err = mm.Finish(ctx, id)
+	if err != nil {
+		return err
+	}
+	return mm.pathManager.AbortUpload(upload.Path, upload.Fence, reason)
+}
+
+func (mm *MultipartManager) abortExpired() {
+	result, err := mm.propose(context.Background(), multipartCommand{
+		Op:  opExpire,
+		TTL: mm.config.MultipartUploadTTL.Or(defaultMultipartUploadTTL),
+	})
+	if err != nil {
+		return
+	}
+	for _, upload := range result.Expired {
+		mm.removeParts(upload)
+		err := mm.pathManager.AbortUpload(upload.Path, upload.Fence, "multipart upload expired")
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//removeStaleParts removes parts of the uploads that were finished or expired
+func (mm *MultipartManager) removeStaleParts() {
+	dirs, err := ioutil.ReadDir(mm.dir())
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		mm.mutex.Lock()
+		_, exists := mm.uploads[dir.Name()]
+		mm.mutex.Unlock()
+		if !exists && time.Since(dir.ModTime()) > staleDirAge {
+			os.RemoveAll(p.Join(mm.dir(), dir.Name()))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	p "path"
+	"testing"
+	"time"
+)
+
+const testUploadID = "upload"
+
+func newTestMultipartManager(t *testing.T) *MultipartManager {
+	t.Helper()
+	config := &c.Config{StagingDir: t.TempDir()}
+	config.This.Name = "one"
+	nodeManager := &node.NodeManager{}
+	nodeManager.UseConfig(config)
+	mm := &MultipartManager{
+		nodeManager: nodeManager,
+		uploads:     make(map[string]*Upload, 0),
+		completing:  make(map[string]bool, 0),
+	}
+	mm.UseConfig(config)
+	return mm
+}
+
+//apply executes the command and returns its result
+func apply(t *testing.T, mm *MultipartManager, command multipartCommand) multipartResult {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(command); err != nil {
+		t.Fatal(err)
+	}
+	var result multipartResult
+	if err := gob.NewDecoder(bytes.NewReader(mm.Apply(buf.Bytes()))).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+//storePart keeps the part on this node like WritePart does and returns its record
+func storePart(t *testing.T, mm *MultipartManager, number int, data string) Part {
+	t.Helper()
+	checksum := sha256.Sum256([]byte(data))
+	sum := md5.Sum([]byte(data))
+	part := Part{
+		Number:   number,
+		Node:     mm.nodeManager.This.Name,
+		Size:     int64(len(data)),
+		Checksum: hex.EncodeToString(checksum[:]),
+		MD5:      hex.EncodeToString(sum[:]),
+	}
+	path := mm.partPath(testUploadID, number, part.Checksum)
+	if err := os.MkdirAll(p.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return part
+}
+
+func TestSelect(t *testing.T) {
+	upload := Upload{Parts: map[int]Part{
+		1: {Number: 1, MD5: "aa"},
+		2: {Number: 2, MD5: "bb"},
+		4: {Number: 4, MD5: "dd"},
+	}}
+	tests := []struct {
+		name      string
+		completed []CompletedPart
+		numbers   []int
+		err       error
+	}{
+		{name: "all parts", completed: []CompletedPart{{1, "aa"}, {2, "bb"}, {4, "dd"}}, numbers: []int{1, 2, 4}},
+		{name: "some parts", completed: []CompletedPart{{1, "aa"}, {4, "dd"}}, numbers: []int{1, 4}},
+		{name: "quoted ETags", completed: []CompletedPart{{1, `"aa"`}, {2, `"bb"`}}, numbers: []int{1, 2}},
+		{name: "no ETags", completed: []CompletedPart{{2, ""}}, numbers: []int{2}},
+		{name: "no parts", err: ErrorNoPartsListed},
+		{name: "descending parts", completed: []CompletedPart{{2, "bb"}, {1, "aa"}}, err: ErrorInvalidPartOrder},
+		{name: "repeated part", completed: []CompletedPart{{1, "aa"}, {1, "aa"}}, err: ErrorInvalidPartOrder},
+		{name: "missing part", completed: []CompletedPart{{3, ""}}, err: ErrorInvalidPart},
+		{name: "other ETag", completed: []CompletedPart{{1, "bb"}}, err: ErrorInvalidPart},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts, err := Select(upload, test.completed)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if len(parts) != len(test.numbers) {
+				t.Fatalf("got parts %v, want numbers %v", parts, test.numbers)
+			}
+			for i, part := range parts {
+				if part.Number != test.numbers[i] {
+					t.Fatalf("got parts %v, want numbers %v", parts, test.numbers)
+				}
+			}
+		})
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	mm := newTestMultipartManager(t)
+	first := storePart(t, mm, 1, "hello ")
+	second := storePart(t, mm, 2, "world")
+	corrupted := storePart(t, mm, 3, "!")
+	corrupted.Checksum = second.Checksum
+	if err := ioutil.WriteFile(mm.partPath(testUploadID, 3, corrupted.Checksum), []byte("?"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		parts []Part
+		data  string
+		err   error
+	}{
+		{name: "parts in order", parts: []Part{first, second}, data: "hello world"},
+		{name: "single part", parts: []Part{second}, data: "world"},
+		{name: "corrupted part", parts: []Part{first, corrupted}, err: ErrorPartChecksumMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := mm.Assemble(context.Background(), testUploadID, test.parts, buf)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && buf.String() != test.data {
+				t.Fatalf("got %q, want %q", buf.String(), test.data)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+	mm := newTestMultipartManager(t)
+
+	apply(t, mm, multipartCommand{Op: opInitiate, Upload: Upload{ID: "idle", Path: "bucket/idle"}, Time: start})
+	apply(t, mm, multipartCommand{Op: opInitiate, Upload: Upload{ID: testUploadID, Path: "bucket/file"}, Time: start})
+	apply(t, mm, multipartCommand{Op: opPart, ID: testUploadID, Part: Part{Number: 1, MD5: "aa"}, Time: start.Add(ttl)})
+	//Part uploaded again replaces the previous one
+	apply(t, mm, multipartCommand{Op: opPart, ID: testUploadID, Part: Part{Number: 1, MD5: "bb"}, Time: start.Add(ttl)})
+	if result := apply(t, mm, multipartCommand{Op: opPart, ID: "unknown", Part: Part{Number: 1}, Time: start}); result.Exists {
+		t.Fatal("part of unknown upload was recorded")
+	}
+
+	result := apply(t, mm, multipartCommand{Op: opExpire, Time: start.Add(ttl + time.Minute), TTL: ttl})
+	if len(result.Expired) != 1 || result.Expired[0].ID != "idle" {
+		t.Fatalf("got expired uploads %+v, want idle", result.Expired)
+	}
+	upload, err := mm.Get(testUploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upload.Parts) != 1 || upload.Parts[1].MD5 != "bb" {
+		t.Fatalf("got parts %+v, want part 1 uploaded again", upload.Parts)
+	}
+
+	if result := apply(t, mm, multipartCommand{Op: opFinish, ID: testUploadID, Time: start}); !result.Exists {
+		t.Fatal("finished upload did not exist")
+	}
+	if _, err := mm.Get(testUploadID); err != ErrorUploadDoesNotExist {
+		t.Fatalf("got error %v of finished upload, want %v", err, ErrorUploadDoesNotExist)
+	}
+}
+
+//TestRemoveParts checks that other nodes remove the parts of aborted uploads, but only in the parts dir
+func TestRemoveParts(t *testing.T) {
+	mm := newTestMultipartManager(t)
+	part := storePart(t, mm, 1, "data")
+	outside := p.Join(mm.config.StagingPath(), "kept")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"../kept", "", testUploadID} {
+		msg := comm.Message{Type: comm.MessageTypeRemoveParts}
+		if err := msg.EncodeData(comm.MessageRemoveParts{UploadID: id}); err != nil {
+			t.Fatal(err)
+		}
+		mm.HandleMessage(&msg)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("dir outside of the parts dir is removed: %v", err)
+	}
+	if _, err := os.Stat(mm.partPath(testUploadID, 1, part.Checksum)); !os.IsNotExist(err) {
+		t.Fatalf("part is kept after abort: %v", err)
+	}
+}
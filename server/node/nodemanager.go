@@ -3,36 +3,66 @@ package node
 import (
 	c "dfs/config"
 	"errors"
+	"sync"
+	"time"
 )
 
 var (
 	ErrorNodeAlreadyExists = errors.New("Node with this name already exists.")
 )
 
+const (
+	defaultSuspectTimeout = 25 * time.Second
+	defaultDeadTimeout    = 60 * time.Second
+)
+
+type NodeState string
+
+const (
+	NodeStateAlive   NodeState = "alive"
+	NodeStateSuspect NodeState = "suspect"
+	NodeStateDead    NodeState = "dead"
+)
+
 type NodeInfo struct {
 	Name           string
 	PublicAddress  string
 	PrivateAddress string
+	Weight         float64
 }
 
+type NodeLiveness struct {
+	State    NodeState
+	LastSeen time.Time
+}
+
+//NodeStateWatcher is called every time a node changes its state
+type NodeStateWatcher func(nodeName string, state NodeState)
+
 type NodeManager struct {
 	This      NodeInfo
 	nodes     map[string]NodeInfo
 	nodeNames []string
+
+	mutex          sync.Mutex
+	liveness       map[string]*NodeLiveness
+	watchers       []NodeStateWatcher
+	suspectTimeout time.Duration
+	deadTimeout    time.Duration
 }
 
-func (nm NodeManager) Node(nodeName string) NodeInfo {
+func (nm *NodeManager) Node(nodeName string) NodeInfo {
 	if nodeName == nm.This.Name {
 		return nm.This
 	}
 	return nm.nodes[nodeName]
 }
 
-func (nm NodeManager) Nodes() map[string]NodeInfo {
+func (nm *NodeManager) Nodes() map[string]NodeInfo {
 	return nm.nodes
 }
 
-func (nm NodeManager) NodeNames() []string {
+func (nm *NodeManager) NodeNames() []string {
 	return nm.nodeNames
 }
 
@@ -52,13 +82,130 @@ func (nm *NodeManager) UseConfig(config *c.Config) {
 	nm.This.Name = config.This.Name
 	nm.This.PublicAddress = config.This.PublicAddress
 	nm.This.PrivateAddress = config.This.PrivateAddress
+	nm.This.Weight = config.This.Weight
 
 	for _, nodeInfo := range config.Nodes {
 		node := NodeInfo{
 			Name:           nodeInfo.Name,
 			PublicAddress:  nodeInfo.PublicAddress,
 			PrivateAddress: nodeInfo.PrivateAddress,
+			Weight:         nodeInfo.Weight,
 		}
 		nm.AddNode(node)
 	}
+
+	nm.suspectTimeout = config.FailureDetector.SuspectTimeout.Or(defaultSuspectTimeout)
+	nm.deadTimeout = config.FailureDetector.DeadTimeout.Or(defaultDeadTimeout)
+}
+
+//StartFailureDetector starts tracking liveness of the other nodes.
+//Node becomes suspect if no heartbeat came during SuspectTimeout and dead after DeadTimeout.
+func (nm *NodeManager) StartFailureDetector() {
+	nm.mutex.Lock()
+	nm.liveness = make(map[string]*NodeLiveness, 0)
+	now := time.Now()
+	for _, nodeName := range nm.nodeNames {
+		nm.liveness[nodeName] = &NodeLiveness{State: NodeStateAlive, LastSeen: now}
+	}
+	nm.mutex.Unlock()
+
+	go func() {
+		ticker := time.Tick(time.Second)
+		for {
+			<-ticker
+			nm.checkLiveness()
+		}
+	}()
+}
+
+func (nm *NodeManager) checkLiveness() {
+	nm.mutex.Lock()
+	changed := make(map[string]NodeState, 0)
+	now := time.Now()
+	for nodeName, liveness := range nm.liveness {
+		state := NodeStateAlive
+		silence := now.Sub(liveness.LastSeen)
+		if silence > nm.deadTimeout {
+			state = NodeStateDead
+		} else if silence > nm.suspectTimeout {
+			state = NodeStateSuspect
+		}
+		if state != liveness.State {
+			liveness.State = state
+			changed[nodeName] = state
+		}
+	}
+	nm.mutex.Unlock()
+
+	nm.notify(changed)
+}
+
+//Heartbeat marks node as alive
+func (nm *NodeManager) Heartbeat(nodeName string) {
+	nm.mutex.Lock()
+	liveness, exists := nm.liveness[nodeName]
+	if !exists {
+		nm.mutex.Unlock()
+		return
+	}
+	liveness.LastSeen = time.Now()
+	changed := make(map[string]NodeState, 0)
+	if liveness.State != NodeStateAlive {
+		liveness.State = NodeStateAlive
+		changed[nodeName] = NodeStateAlive
+	}
+	nm.mutex.Unlock()
+
+	nm.notify(changed)
+}
+
+func (nm *NodeManager) notify(changed map[string]NodeState) {
+	nm.mutex.Lock()
+	watchers := nm.watchers
+	nm.mutex.Unlock()
+	for nodeName, state := range changed {
+		for _, watcher := range watchers {
+			watcher(nodeName, state)
+		}
+	}
+}
+
+//Watch subscribes watcher to node state changes
+func (nm *NodeManager) Watch(watcher NodeStateWatcher) {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	nm.watchers = append(nm.watchers, watcher)
+}
+
+func (nm *NodeManager) NodeState(nodeName string) NodeState {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	if liveness, exists := nm.liveness[nodeName]; exists {
+		return liveness.State
+	}
+	return NodeStateAlive
+}
+
+//LiveNodeNames returns names of the other nodes that are not considered dead
+func (nm *NodeManager) LiveNodeNames() []string {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	nodeNames := make([]string, 0, len(nm.nodeNames))
+	for _, nodeName := range nm.nodeNames {
+		if liveness, exists := nm.liveness[nodeName]; exists && liveness.State == NodeStateDead {
+			continue
+		}
+		nodeNames = append(nodeNames, nodeName)
+	}
+	return nodeNames
+}
+
+func (nm *NodeManager) Liveness() map[string]NodeLiveness {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	result := make(map[string]NodeLiveness, len(nm.liveness))
+	for nodeName, liveness := range nm.liveness {
+		result[nodeName] = *liveness
+	}
+	return result
 }
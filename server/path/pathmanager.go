@@ -1,122 +1,464 @@
 package path
 
 import (
-	"dfs/comm"
+	"bytes"
+	"context"
 	c "dfs/config"
 	"dfs/server/node"
-	"dfs/server/status"
+	"dfs/server/raft"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	defaultPathLockTimeout = 10 * time.Second
+	stateMachineName       = "paths"
+	//finishedUploadsKept is the number of committed and aborted uploads remembered for the status
+	finishedUploadsKept = 100
+	//defaultExpireInterval is how often the leader aborts reservations whose tokens expired
+	//and uploads whose leases lapsed or whose nodes died
+	defaultExpireInterval = 30 * time.Second
+	defaultUploadLeaseTTL = time.Minute
+)
+
+const (
+	opReserve = "reserve"
+	opStart   = "start"
+	opCommit  = "commit"
+	opAbort   = "abort"
+	opExpire  = "expire"
+	opRenew   = "renew"
+)
+
+//UploadState is the stage of the upload lifecycle.
+//Path is locked while the upload is reserved or in progress, commit and abort release it.
+type UploadState string
+
+const (
+	UploadReserved   UploadState = "reserved"
+	UploadInProgress UploadState = "in progress"
+	UploadCommitted  UploadState = "committed"
+	UploadAborted    UploadState = "aborted"
 )
 
 var (
-	ErrorPathIsLocked = errors.New("Path is locked.")
+	ErrorPathIsLocked    = errors.New("Path is locked.")
+	ErrorUploadIsUnknown = errors.New("Upload is unknown or already finished.")
 )
 
-type lockInfo struct {
-	WaitChan chan bool
-	Counter  int
+//Upload is the record of an upload of the path.
+//Fence is the fencing token of the lock the upload was requested under, it tells uploads of the same path apart.
+//Reservation is aborted once Expires passes and the upload has not started. Upload in progress is aborted
+//once Expires passes without the lease being renewed or Node dies, zero Expires means it has no lease.
+type Upload struct {
+	Path     string
+	Fence    uint64
+	State    UploadState
+	Owner    string
+	Node     string
+	Reason   string
+	Reserved time.Time
+	Updated  time.Time
+	Expires  time.Time
+}
+
+//PathLock describes a path reserved for upload.
+//Lock is stale if the node handling the upload is dead or the reservation or the lease outlived its expiration.
+type PathLock struct {
+	Upload
+	Age   c.Duration
+	Stale bool
+}
+
+//pathCommand changes the path table. Expire command lists the Nodes the leader sees dead.
+type pathCommand struct {
+	Op      string
+	Path    string
+	Fence   uint64
+	Node    string
+	Nodes   []string
+	Reason  string
+	Time    time.Time
+	Expires time.Time
+}
+
+//pathTable is the replicated state of the path manager
+type pathTable struct {
+	Uploads  map[string]*Upload
+	Finished []Upload
 }
 
+//PathManager keeps the paths being uploaded in the raft log, so every node refuses to reuse them
 type PathManager struct {
-	mutex         sync.Mutex
-	config        *c.Config
-	nodeManager   *node.NodeManager
-	statusManager *status.StatusManager
-	msgHub        *comm.MessageHub
+	mutex       sync.Mutex
+	config      *c.Config
+	nodeManager *node.NodeManager
+	raft        *raft.Raft
 
-	lockedPaths map[string]*lockInfo
+	table pathTable
 }
 
 func (pm *PathManager) UseConfig(config *c.Config) {
 	pm.config = config
 }
 
-func (pm *PathManager) Listen(
-	nodeManager *node.NodeManager,
-	msgHub *comm.MessageHub) {
-	pm.lockedPaths = make(map[string]*lockInfo, 0)
+func (pm *PathManager) expireInterval() time.Duration {
+	return pm.config.TokenReaperInterval.Or(defaultExpireInterval)
+}
+
+func (pm *PathManager) uploadLeaseTTL() time.Duration {
+	return pm.config.UploadLeaseTTL.Or(defaultUploadLeaseTTL)
+}
+
+//deadNodes returns names of the nodes the failure detector of this node considers dead
+func (pm *PathManager) deadNodes() []string {
+	nodes := make([]string, 0)
+	for _, nodeName := range pm.nodeManager.NodeNames() {
+		if pm.nodeManager.NodeState(nodeName) == node.NodeStateDead {
+			nodes = append(nodes, nodeName)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+//Listen registers path table in the raft log, it must be called before raft starts
+func (pm *PathManager) Listen(nodeManager *node.NodeManager, r *raft.Raft) {
+	pm.table = pathTable{Uploads: make(map[string]*Upload, 0)}
 	pm.nodeManager = nodeManager
-	pm.msgHub = msgHub
-	pm.msgHub.Subscribe(pm,
-		comm.MessageTypeLockPath,
-		comm.MessageTypeUnlockPath,
-		comm.MessageTypePathLocked)
+	pm.raft = r
+	r.Register(stateMachineName, pm)
+
+	go func() {
+		ticker := time.Tick(pm.expireInterval())
+		for {
+			<-ticker
+			if r.IsLeader() {
+				pm.propose(context.Background(), pathCommand{Op: opExpire, Nodes: pm.deadNodes()})
+			}
+		}
+	}()
 }
 
-func (pm *PathManager) IsLocked(path string) bool {
-	pm.mutex.Lock()
-	defer pm.mutex.Unlock()
-	_, exists := pm.lockedPaths[path]
-	return exists
+//finish moves the upload to the finished ones. Must be called with pm.mutex held.
+func (pm *PathManager) finish(upload *Upload, state UploadState, reason string, now time.Time) {
+	upload.State = state
+	upload.Reason = reason
+	upload.Updated = now
+	delete(pm.table.Uploads, upload.Path)
+	pm.table.Finished = append(pm.table.Finished, *upload)
+	if len(pm.table.Finished) > finishedUploadsKept {
+		pm.table.Finished = pm.table.Finished[len(pm.table.Finished)-finishedUploadsKept:]
+	}
 }
 
-func (pm *PathManager) LockPath(path string) error {
-	if _, exists := pm.lockedPaths[path]; exists {
-		return ErrorPathIsLocked
+//expired tells why the upload must be aborted by the expire command or returns empty string if it may go on
+func expired(upload *Upload, command pathCommand) string {
+	switch upload.State {
+	case UploadReserved:
+		if command.Time.After(upload.Expires) {
+			return "upload token expired"
+		}
+	case UploadInProgress:
+		for _, nodeName := range command.Nodes {
+			if nodeName == upload.Node {
+				return "node handling the upload is dead"
+			}
+		}
+		if !upload.Expires.IsZero() && command.Time.After(upload.Expires) {
+			return "upload lease expired"
+		}
+	}
+	return ""
+}
+
+//Apply executes committed path command. Reserve returns whether the path was free,
+//other commands return whether they moved the upload with the given fence.
+func (pm *PathManager) Apply(data []byte) []byte {
+	var command pathCommand
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&command) != nil {
+		return nil
 	}
 
 	pm.mutex.Lock()
-	waitChan := make(chan bool, 1)
-	pm.lockedPaths[path] = &lockInfo{
-		WaitChan: waitChan,
-		Counter:  len(pm.nodeManager.NodeNames()),
+	defer pm.mutex.Unlock()
+
+	if command.Op == opExpire {
+		paths := make([]string, 0)
+		for path, upload := range pm.table.Uploads {
+			if expired(upload, command) != "" {
+				paths = append(paths, path)
+			}
+		}
+		//Finished uploads are kept in order, so every node must finish them in the same order
+		sort.Strings(paths)
+		for _, path := range paths {
+			upload := pm.table.Uploads[path]
+			pm.finish(upload, UploadAborted, expired(upload, command), command.Time)
+		}
+		return nil
+	}
+
+	upload, exists := pm.table.Uploads[command.Path]
+	if command.Op == opReserve {
+		if exists {
+			return []byte{0}
+		}
+		pm.table.Uploads[command.Path] = &Upload{
+			Path:     command.Path,
+			Fence:    command.Fence,
+			State:    UploadReserved,
+			Owner:    command.Node,
+			Reserved: command.Time,
+			Updated:  command.Time,
+			Expires:  command.Expires,
+		}
+		return []byte{1}
 	}
-	pm.mutex.Unlock()
 
-	msg := comm.Message{Type: comm.MessageTypeLockPath}
-	messageFile := comm.MessageLockPath{
-		Path: path,
+	//Fence 0 matches any upload, so admin can release the path without knowing it
+	if !exists || (command.Fence != 0 && upload.Fence != command.Fence) {
+		return []byte{0}
 	}
-	msg.EncodeData(messageFile)
+	switch command.Op {
+	case opStart:
+		if upload.State != UploadReserved {
+			return []byte{0}
+		}
+		upload.State = UploadInProgress
+		upload.Node = command.Node
+		upload.Updated = command.Time
+		upload.Expires = command.Expires
 
-	pm.msgHub.Broadcast(msg)
+	case opRenew:
+		if upload.State != UploadInProgress {
+			return []byte{0}
+		}
+		upload.Expires = command.Expires
 
-	<-waitChan
-	return nil
+	case opCommit:
+		pm.finish(upload, UploadCommitted, "", command.Time)
+
+	case opAbort:
+		pm.finish(upload, UploadAborted, command.Reason, command.Time)
+	}
+	return []byte{1}
+}
+
+func (pm *PathManager) Snapshot() ([]byte, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	return json.Marshal(pm.table)
 }
 
-func (pm *PathManager) UnlockPath(path string) {
+func (pm *PathManager) Restore(data []byte) error {
+	table := pathTable{Uploads: make(map[string]*Upload, 0)}
+	err := json.Unmarshal(data, &table)
+	if err != nil {
+		return err
+	}
 	pm.mutex.Lock()
-	delete(pm.lockedPaths, path)
-	pm.mutex.Unlock()
+	defer pm.mutex.Unlock()
+	pm.table = table
+	return nil
+}
 
-	msg := comm.Message{Type: comm.MessageTypeUnlockPath}
-	messageUnlock := comm.MessageUnlockPath{
-		Path: path,
+func (pm *PathManager) propose(ctx context.Context, command pathCommand) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pm.config.Timeouts.PathLock.Or(defaultPathLockTimeout))
+	defer cancel()
+
+	command.Time = time.Now()
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(command)
+	if err != nil {
+		return false, err
+	}
+	done, err := pm.raft.Propose(ctx, stateMachineName, buf.Bytes())
+	if err != nil {
+		return false, err
 	}
-	msg.EncodeData(messageUnlock)
-	pm.msgHub.Broadcast(msg)
+	return len(done) == 1 && done[0] == 1, nil
 }
 
-func (pm *PathManager) HandleMessage(msg *comm.Message) {
+func (pm *PathManager) IsLocked(path string) bool {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
+	_, exists := pm.table.Uploads[path]
+	return exists
+}
 
-	switch msg.Type {
-	case comm.MessageTypeLockPath:
-		var lockPathMessage comm.MessageLockPath
-		msg.DecodeData(&lockPathMessage)
+//LockPath reserves path for the upload on the whole cluster, it fails if the path is already reserved.
+//Reservation is aborted if the upload does not start until expires.
+func (pm *PathManager) LockPath(ctx context.Context, path string, fence uint64, expires time.Time) error {
+	reserved, err := pm.propose(ctx, pathCommand{
+		Op:      opReserve,
+		Path:    path,
+		Fence:   fence,
+		Node:    pm.nodeManager.This.Name,
+		Expires: expires,
+	})
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return ErrorPathIsLocked
+	}
+	return nil
+}
+
+func (pm *PathManager) transition(ctx context.Context, command pathCommand) error {
+	done, err := pm.propose(ctx, command)
+	if err != nil {
+		return err
+	}
+	if !done {
+		return ErrorUploadIsUnknown
+	}
+	return nil
+}
 
-		pm.lockedPaths[lockPathMessage.Path] = nil
+//StartUpload marks the reserved upload as receiving data on this node. The upload holds the path by the lease
+//renewed until stop is called, the leader aborts the upload once the lease lapses or the node dies.
+//Lost is closed once the upload is aborted or the lease lapses, the upload must not be installed then.
+func (pm *PathManager) StartUpload(ctx context.Context, path string, fence uint64) (lost <-chan struct{}, stop func(), err error) {
+	ttl := pm.uploadLeaseTTL()
+	expires := time.Now().Add(ttl)
+	err = pm.transition(ctx, pathCommand{
+		Op:      opStart,
+		Path:    path,
+		Fence:   fence,
+		Node:    pm.nodeManager.This.Name,
+		Expires: expires,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-		responseMsg := comm.Message{Type: comm.MessageTypePathLocked}
-		pathLocked := comm.MessagePathLocked{
-			Path: lockPathMessage.Path,
+	done := make(chan struct{})
+	lostLease := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(ttl / 3):
+			}
+			renewed := time.Now().Add(ttl)
+			err := pm.transition(context.Background(), pathCommand{
+				Op:      opRenew,
+				Path:    path,
+				Fence:   fence,
+				Expires: renewed,
+			})
+			if err == nil {
+				expires = renewed
+			}
+			if err == ErrorUploadIsUnknown || (err != nil && time.Now().After(expires)) {
+				close(lostLease)
+				return
+			}
 		}
-		responseMsg.EncodeData(pathLocked)
-		pm.msgHub.Send(responseMsg, msg.SourceNode)
-
-	case comm.MessageTypePathLocked:
-		var pathLocked comm.MessagePathLocked
-		msg.DecodeData(&pathLocked)
-		pm.lockedPaths[pathLocked.Path].Counter--
-		if pm.lockedPaths[pathLocked.Path].Counter == 0 {
-			pm.lockedPaths[pathLocked.Path].WaitChan <- true
+	}()
+	return lostLease, func() { close(done) }, nil
+}
+
+//StartSession marks the reserved upload as receiving data on this node in requests of a session,
+//like resumable and multipart uploads are. The session holds the path until it is finished,
+//it expires on its own, so the leader aborts the upload only if the node dies.
+func (pm *PathManager) StartSession(ctx context.Context, path string, fence uint64) error {
+	return pm.transition(ctx, pathCommand{
+		Op:    opStart,
+		Path:  path,
+		Fence: fence,
+		Node:  pm.nodeManager.This.Name,
+	})
+}
+
+//CheckUpload tells whether the upload is still in progress under the fence. This node catches up with the leader first,
+//so the upload aborted or replaced through another node is seen.
+func (pm *PathManager) CheckUpload(ctx context.Context, path string, fence uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, pm.config.Timeouts.PathLock.Or(defaultPathLockTimeout))
+	defer cancel()
+	err := pm.raft.ReadIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	upload, exists := pm.table.Uploads[path]
+	if !exists || upload.Fence != fence || upload.State != UploadInProgress {
+		return ErrorUploadIsUnknown
+	}
+	return nil
+}
+
+//CommitUpload finishes the upload and releases its path
+func (pm *PathManager) CommitUpload(path string, fence uint64) error {
+	return pm.transition(context.Background(), pathCommand{
+		Op:    opCommit,
+		Path:  path,
+		Fence: fence,
+	})
+}
+
+//AbortUpload cancels the upload for the reason and releases its path
+func (pm *PathManager) AbortUpload(path string, fence uint64, reason string) error {
+	return pm.transition(context.Background(), pathCommand{
+		Op:     opAbort,
+		Path:   path,
+		Fence:  fence,
+		Reason: reason,
+	})
+}
+
+//UnlockPath aborts whatever upload holds the path
+func (pm *PathManager) UnlockPath(path string) error {
+	return pm.AbortUpload(path, 0, "path was force-released")
+}
+
+//Uploads returns uploads in progress sorted by path, followed by the recently finished ones
+func (pm *PathManager) Uploads() []Upload {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	uploads := make([]Upload, 0, len(pm.table.Uploads)+len(pm.table.Finished))
+	for _, upload := range pm.table.Uploads {
+		uploads = append(uploads, *upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Path < uploads[j].Path
+	})
+	for i := len(pm.table.Finished) - 1; i >= 0; i-- {
+		uploads = append(uploads, pm.table.Finished[i])
+	}
+	return uploads
+}
+
+//Locks returns locked paths sorted by path
+func (pm *PathManager) Locks() []PathLock {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	now := time.Now()
+	locks := make([]PathLock, 0, len(pm.table.Uploads))
+	for _, upload := range pm.table.Uploads {
+		age := now.Sub(upload.Reserved)
+		handler := upload.Owner
+		if upload.State == UploadInProgress {
+			handler = upload.Node
 		}
-	case comm.MessageTypeUnlockPath:
-		var unlockPath comm.MessageUnlockPath
-		msg.DecodeData(&unlockPath)
-		delete(pm.lockedPaths, unlockPath.Path)
+		locks = append(locks, PathLock{
+			Upload: *upload,
+			Age:    c.Duration{Duration: age},
+			Stale: (!upload.Expires.IsZero() && now.After(upload.Expires.Add(pm.expireInterval()))) ||
+				pm.nodeManager.NodeState(handler) == node.NodeStateDead,
+		})
 	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Path < locks[j].Path
+	})
+	return locks
 }
@@ -0,0 +1,123 @@
+package path
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func newTestPathManager() *PathManager {
+	return &PathManager{table: pathTable{Uploads: make(map[string]*Upload, 0)}}
+}
+
+func apply(t *testing.T, pm *PathManager, command pathCommand) bool {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(command); err != nil {
+		t.Fatal(err)
+	}
+	done := pm.Apply(buf.Bytes())
+	return len(done) == 1 && done[0] == 1
+}
+
+func TestExpire(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lease := time.Minute
+
+	tests := []struct {
+		name string
+		//start moves the upload in progress, zero lease starts a session without lease
+		start bool
+		lease time.Duration
+		renew time.Duration
+		after time.Duration
+		dead  []string
+		//reason is why the upload is aborted, empty if it is kept
+		reason string
+	}{
+		{name: "reservation before token expires", after: 30 * time.Second},
+		{name: "reservation after token expires", after: 2 * time.Minute, reason: "upload token expired"},
+		{name: "reservation of dead node before token expires", after: 30 * time.Second, dead: []string{"one"}},
+		{name: "upload with lease", start: true, lease: lease, after: 30 * time.Second},
+		{name: "upload after lease lapsed", start: true, lease: lease, after: 2 * time.Minute, reason: "upload lease expired"},
+		{name: "upload with renewed lease", start: true, lease: lease, renew: 90 * time.Second, after: 2 * time.Minute},
+		{name: "upload of dead node", start: true, lease: lease, after: time.Second, dead: []string{"two", "one"}, reason: "node handling the upload is dead"},
+		{name: "upload of other dead node", start: true, lease: lease, after: time.Second, dead: []string{"two"}},
+		{name: "session without lease", start: true, after: 24 * time.Hour},
+		{name: "session of dead node", start: true, after: time.Second, dead: []string{"one"}, reason: "node handling the upload is dead"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := newTestPathManager()
+			if !apply(t, pm, pathCommand{Op: opReserve, Path: "b/f", Fence: 7, Node: "one", Time: start, Expires: start.Add(time.Minute)}) {
+				t.Fatal("path was not reserved")
+			}
+			if test.start {
+				expires := time.Time{}
+				if test.lease > 0 {
+					expires = start.Add(test.lease)
+				}
+				if !apply(t, pm, pathCommand{Op: opStart, Path: "b/f", Fence: 7, Node: "one", Time: start, Expires: expires}) {
+					t.Fatal("upload was not started")
+				}
+			}
+			if test.renew > 0 {
+				if !apply(t, pm, pathCommand{Op: opRenew, Path: "b/f", Fence: 7, Time: start.Add(test.renew), Expires: start.Add(test.renew + test.lease)}) {
+					t.Fatal("lease was not renewed")
+				}
+			}
+
+			apply(t, pm, pathCommand{Op: opExpire, Nodes: test.dead, Time: start.Add(test.after)})
+
+			uploads := pm.Uploads()
+			if len(uploads) != 1 {
+				t.Fatalf("got %d uploads, want 1", len(uploads))
+			}
+			upload := uploads[0]
+			if test.reason == "" {
+				if upload.State == UploadAborted {
+					t.Fatalf("upload was aborted: %s", upload.Reason)
+				}
+				if !pm.IsLocked("b/f") {
+					t.Fatal("path is not locked")
+				}
+				return
+			}
+			if upload.State != UploadAborted || upload.Reason != test.reason {
+				t.Fatalf("got %s upload (%s), want aborted (%s)", upload.State, upload.Reason, test.reason)
+			}
+			if pm.IsLocked("b/f") {
+				t.Fatal("path is still locked")
+			}
+		})
+	}
+}
+
+func TestTransitionsCheckFence(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pm := newTestPathManager()
+	apply(t, pm, pathCommand{Op: opReserve, Path: "b/f", Fence: 7, Node: "one", Time: now})
+
+	if apply(t, pm, pathCommand{Op: opReserve, Path: "b/f", Fence: 8, Node: "two", Time: now}) {
+		t.Fatal("reserved path was reserved again")
+	}
+	if apply(t, pm, pathCommand{Op: opRenew, Path: "b/f", Fence: 7, Time: now}) {
+		t.Fatal("lease of the upload which has not started was renewed")
+	}
+	if apply(t, pm, pathCommand{Op: opStart, Path: "b/f", Fence: 6, Node: "one", Time: now}) {
+		t.Fatal("upload was started with stale fence")
+	}
+	if !apply(t, pm, pathCommand{Op: opStart, Path: "b/f", Fence: 7, Node: "one", Time: now}) {
+		t.Fatal("upload was not started")
+	}
+	if apply(t, pm, pathCommand{Op: opCommit, Path: "b/f", Fence: 6, Time: now}) {
+		t.Fatal("upload was committed with stale fence")
+	}
+	if !apply(t, pm, pathCommand{Op: opCommit, Path: "b/f", Fence: 7, Time: now}) {
+		t.Fatal("upload was not committed")
+	}
+	if pm.IsLocked("b/f") {
+		t.Fatal("committed upload keeps the path")
+	}
+}
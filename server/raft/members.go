@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+type membersChange struct {
+	Add    string
+	Remove string
+}
+
+func decodeMembers(data []byte) []string {
+	var members []string
+	json.Unmarshal(data, &members)
+	return members
+}
+
+//changeMembers turns requested change into the new member list.
+//Changes go one node at a time, so the old and new majorities always overlap.
+//Must be called with r.mutex held.
+func (r *Raft) changeMembers(data []byte) ([]byte, error) {
+	if r.membersIndex > r.commitIndex {
+		return nil, ErrorMembershipChangeInProgress
+	}
+	var change membersChange
+	err := json.Unmarshal(data, &change)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(r.members)+1)
+	for _, member := range r.members {
+		if member != change.Add && member != change.Remove {
+			members = append(members, member)
+		}
+	}
+	if change.Add != "" {
+		members = append(members, change.Add)
+	}
+	sort.Strings(members)
+	return json.Marshal(members)
+}
+
+func (r *Raft) isKnownNode(nodeName string) bool {
+	if nodeName == r.nodeManager.This.Name {
+		return true
+	}
+	_, exists := r.nodeManager.Nodes()[nodeName]
+	return exists
+}
+
+//AddMember makes configured node a voting member of the cluster
+func (r *Raft) AddMember(ctx context.Context, nodeName string) error {
+	if !r.isKnownNode(nodeName) {
+		return ErrorUnknownNode
+	}
+	data, _ := json.Marshal(membersChange{Add: nodeName})
+	_, _, err := r.propose(ctx, EntryMembers, "", data)
+	return err
+}
+
+//RemoveMember stops node from voting and receiving the log
+func (r *Raft) RemoveMember(ctx context.Context, nodeName string) error {
+	if !r.isKnownNode(nodeName) {
+		return ErrorUnknownNode
+	}
+	data, _ := json.Marshal(membersChange{Remove: nodeName})
+	_, _, err := r.propose(ctx, EntryMembers, "", data)
+	return err
+}
@@ -0,0 +1,916 @@
+package raft
+
+import (
+	"context"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	"errors"
+	"log"
+	"math/rand"
+	p "path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 150 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 1024
+	defaultConsensusTimeout  = 10 * time.Second
+	maxEntriesPerRequest     = 256
+	//replicationQueueLength is the number of replication requests waiting to be handled by the follower
+	replicationQueueLength = 64
+)
+
+type State string
+
+const (
+	StateFollower  State = "follower"
+	StateCandidate State = "candidate"
+	StateLeader    State = "leader"
+)
+
+var (
+	ErrorNoLeader                   = errors.New("Cluster has no leader.")
+	ErrorLeadershipLost             = errors.New("Leadership was lost before the command was committed.")
+	ErrorUnknownStateMachine        = errors.New("Unknown state machine.")
+	ErrorUnknownNode                = errors.New("Node is not configured.")
+	ErrorMembershipChangeInProgress = errors.New("Another membership change is in progress.")
+	ErrorNoQuorum                   = errors.New("Command was not committed in time, cluster may have lost quorum.")
+)
+
+type EntryType uint8
+
+const (
+	EntryCommand EntryType = iota
+	EntryNoop
+	EntryMembers
+)
+
+//Entry is a record of the log. Time is the leader's clock at the moment the entry was appended.
+type Entry struct {
+	Index  uint64
+	Term   uint64
+	Type   EntryType
+	Target string
+	Data   []byte
+	Time   time.Time
+}
+
+//StateMachine is a piece of state replicated by the log.
+//Apply must be deterministic, as every node applies the same commands in the same order.
+type StateMachine interface {
+	Apply(data []byte) []byte
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+//TimedStateMachine is a StateMachine whose commands depend on time. ApplyAt is given Time of the entry
+//instead of Apply, so the outcome does not depend on the clock of the node that proposed the command.
+//Entries written before the time was recorded have zero Time.
+type TimedStateMachine interface {
+	StateMachine
+	ApplyAt(data []byte, appended time.Time) []byte
+}
+
+//Snapshot holds the state of every machine after the entry Index was applied
+type Snapshot struct {
+	Index    uint64
+	Term     uint64
+	Members  []string
+	Machines map[string][]byte
+}
+
+type Status struct {
+	State         State
+	Term          uint64
+	Leader        string
+	Members       []string
+	LastIndex     uint64
+	CommitIndex   uint64
+	LastApplied   uint64
+	SnapshotIndex uint64
+}
+
+type result struct {
+	data  []byte
+	index uint64
+	err   error
+}
+
+type waiter struct {
+	term   uint64
+	result chan result
+}
+
+//transport carries messages of raft between the nodes, it is the comm.MessageHub except in tests
+type transport interface {
+	Subscribe(msgHandler comm.MessageHandler, msgTypes ...comm.MessageType)
+	RequestContext(ctx context.Context, msg comm.Message, nodeName string) (*comm.Message, error)
+	Reply(request *comm.Message, reply comm.Message) error
+}
+
+//Raft keeps the replicated log of commands and applies committed commands to the registered state machines.
+//Commands can be proposed on any node, followers forward them to the leader.
+type Raft struct {
+	mutex      sync.Mutex
+	applyMutex sync.Mutex
+	applyCond  *sync.Cond
+	//applied is closed and replaced every time entries are applied
+	applied chan struct{}
+	//acked is closed and replaced every time a follower answers the leader
+	acked chan struct{}
+	//replication queues requests of the leader to be handled in order
+	replication chan *comm.Message
+
+	config      *c.Config
+	nodeManager *node.NodeManager
+	msgHub      transport
+	storage     storage
+	machines    map[string]StateMachine
+
+	state        State
+	currentTerm  uint64
+	votedFor     string
+	leader       string
+	log          []Entry
+	snapshot     Snapshot
+	members      []string
+	membersIndex uint64
+	commitIndex  uint64
+	lastApplied  uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	//lastAck holds the time the last request answered by the follower was sent
+	lastAck  map[string]time.Time
+	triggers map[string]chan struct{}
+	waiters  map[uint64]*waiter
+
+	lastContact       time.Time
+	leaderContact     time.Time
+	electing          bool
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+}
+
+func (r *Raft) UseConfig(config *c.Config) {
+	r.config = config
+}
+
+//Register adds state machine driven by the commands proposed to target.
+//Machines must be registered before Listen.
+func (r *Raft) Register(target string, machine StateMachine) {
+	if r.machines == nil {
+		r.machines = make(map[string]StateMachine, 0)
+	}
+	r.machines[target] = machine
+}
+
+func (r *Raft) dir() string {
+	if r.config.Raft.Dir != "" {
+		return r.config.Raft.Dir
+	}
+	return p.Clean(r.config.UploadDir) + ".raft"
+}
+
+func (r *Raft) Listen(nodeManager *node.NodeManager, msgHub *comm.MessageHub) error {
+	return r.listen(nodeManager, msgHub)
+}
+
+func (r *Raft) listen(nodeManager *node.NodeManager, msgHub transport) error {
+	r.nodeManager = nodeManager
+	r.msgHub = msgHub
+	r.applyCond = sync.NewCond(&r.mutex)
+	r.applied = make(chan struct{})
+	r.acked = make(chan struct{})
+	r.replication = make(chan *comm.Message, replicationQueueLength)
+	r.heartbeatInterval = r.config.Raft.HeartbeatInterval.Or(defaultHeartbeatInterval)
+	r.nextIndex = make(map[string]uint64, 0)
+	r.matchIndex = make(map[string]uint64, 0)
+	r.lastAck = make(map[string]time.Time, 0)
+	r.triggers = make(map[string]chan struct{}, 0)
+	r.waiters = make(map[uint64]*waiter, 0)
+	r.state = StateFollower
+
+	err := r.restore()
+	if err != nil {
+		return err
+	}
+
+	msgHub.Subscribe(r,
+		comm.MessageTypeRequestVote,
+		comm.MessageTypeAppendEntries,
+		comm.MessageTypeInstallSnapshot,
+		comm.MessageTypePropose,
+		comm.MessageTypeReadIndex)
+
+	r.mutex.Lock()
+	r.resetElectionTimer()
+	for _, nodeName := range nodeManager.NodeNames() {
+		r.triggers[nodeName] = make(chan struct{}, 1)
+		go r.replicate(nodeName, r.triggers[nodeName])
+	}
+	r.mutex.Unlock()
+
+	go r.run()
+	go r.applyCommitted()
+	go r.serveReplication()
+	return nil
+}
+
+//restore loads persisted state and brings state machines up to the last snapshot
+func (r *Raft) restore() error {
+	r.storage.dir = r.dir()
+	err := r.storage.open()
+	if err != nil {
+		return err
+	}
+
+	r.currentTerm, r.votedFor, err = r.storage.loadState()
+	if err != nil {
+		return err
+	}
+
+	r.snapshot, err = r.storage.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if r.snapshot.Members == nil {
+		r.snapshot.Members = append([]string{r.nodeManager.This.Name}, r.nodeManager.NodeNames()...)
+		sort.Strings(r.snapshot.Members)
+	}
+	for target, data := range r.snapshot.Machines {
+		if machine, exists := r.machines[target]; exists {
+			if err := machine.Restore(data); err != nil {
+				return err
+			}
+		}
+	}
+	r.commitIndex = r.snapshot.Index
+	r.lastApplied = r.snapshot.Index
+
+	entries, err := r.storage.loadLog()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Index == r.lastIndex()+1 {
+			r.log = append(r.log, entry)
+		}
+	}
+	r.updateMembers()
+	return nil
+}
+
+func (r *Raft) run() {
+	ticker := time.Tick(r.heartbeatInterval / 2)
+	for {
+		<-ticker
+		r.mutex.Lock()
+		switch {
+		case r.state == StateLeader && !r.hasQuorumContact():
+			log.Println("Leader lost contact with the majority, stepping down")
+			r.becomeFollower(r.currentTerm)
+		case r.state != StateLeader && !r.electing && time.Since(r.lastContact) > r.electionTimeout && r.isMember(r.nodeManager.This.Name):
+			r.resetElectionTimer()
+			r.electing = true
+			go r.startElection()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+//resetElectionTimer must be called with r.mutex held
+func (r *Raft) resetElectionTimer() {
+	base := r.config.Raft.ElectionTimeout.Or(defaultElectionTimeout)
+	r.lastContact = time.Now()
+	r.electionTimeout = base + time.Duration(rand.Int63n(int64(base)))
+}
+
+//hasQuorumContact reports whether the leader heard from the majority recently
+func (r *Raft) hasQuorumContact() bool {
+	timeout := r.config.Raft.ElectionTimeout.Or(defaultElectionTimeout) * 2
+	contacted := 0
+	for _, member := range r.members {
+		if member == r.nodeManager.This.Name || time.Since(r.lastAck[member]) < timeout {
+			contacted++
+		}
+	}
+	return contacted > len(r.members)/2
+}
+
+func (r *Raft) isMember(nodeName string) bool {
+	for _, member := range r.members {
+		if member == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) lastIndex() uint64 {
+	if len(r.log) == 0 {
+		return r.snapshot.Index
+	}
+	return r.log[len(r.log)-1].Index
+}
+
+//term returns term of the entry at index or 0 if the log does not have it
+func (r *Raft) term(index uint64) uint64 {
+	if index == r.snapshot.Index {
+		return r.snapshot.Term
+	}
+	if index < r.snapshot.Index || index > r.lastIndex() {
+		return 0
+	}
+	return r.log[index-r.snapshot.Index-1].Term
+}
+
+//entries returns copy of the entries starting at index
+func (r *Raft) entries(from uint64, limit int) []Entry {
+	if from <= r.snapshot.Index || from > r.lastIndex() {
+		return nil
+	}
+	entries := r.log[from-r.snapshot.Index-1:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+//updateMembers sets members from the latest membership entry of the log
+func (r *Raft) updateMembers() {
+	r.members = r.snapshot.Members
+	r.membersIndex = r.snapshot.Index
+	for _, entry := range r.log {
+		if entry.Type == EntryMembers {
+			r.members = decodeMembers(entry.Data)
+			r.membersIndex = entry.Index
+		}
+	}
+}
+
+//membersAt returns members as of the entry at index
+func (r *Raft) membersAt(index uint64) []string {
+	members := r.snapshot.Members
+	for _, entry := range r.log {
+		if entry.Index > index {
+			break
+		}
+		if entry.Type == EntryMembers {
+			members = decodeMembers(entry.Data)
+		}
+	}
+	return members
+}
+
+func (r *Raft) persistState() {
+	err := r.storage.saveState(r.currentTerm, r.votedFor)
+	if err != nil {
+		log.Println("Failed to save raft state:", err)
+	}
+}
+
+//becomeFollower must be called with r.mutex held
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.leader = ""
+		r.persistState()
+	}
+	if r.state == StateLeader {
+		r.leader = ""
+	}
+	r.state = StateFollower
+}
+
+//startElection asks for pre-votes first, so a node which can not win does not disturb the cluster by raising the term
+func (r *Raft) startElection() {
+	defer func() {
+		r.mutex.Lock()
+		r.electing = false
+		r.mutex.Unlock()
+	}()
+	if !r.requestVotes(true) {
+		return
+	}
+
+	r.mutex.Lock()
+	if r.state == StateLeader {
+		r.mutex.Unlock()
+		return
+	}
+	r.state = StateCandidate
+	r.currentTerm++
+	r.votedFor = r.nodeManager.This.Name
+	r.leader = ""
+	r.persistState()
+	term := r.currentTerm
+	r.mutex.Unlock()
+
+	if r.requestVotes(false) {
+		r.mutex.Lock()
+		if r.state == StateCandidate && r.currentTerm == term {
+			r.becomeLeader()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+//requestVotes reports whether the majority of members voted for this node.
+//Pre-vote asks for the next term without changing the term of anyone.
+func (r *Raft) requestVotes(preVote bool) bool {
+	r.mutex.Lock()
+	if r.state == StateLeader {
+		r.mutex.Unlock()
+		return false
+	}
+	term := r.currentTerm
+	if preVote {
+		term++
+	}
+	members := r.members
+	msg := comm.Message{Type: comm.MessageTypeRequestVote}
+	msg.EncodeData(comm.MessageRequestVote{
+		Term:         term,
+		Candidate:    r.nodeManager.This.Name,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.term(r.lastIndex()),
+		PreVote:      preVote,
+	})
+	timeout := r.electionTimeout
+	r.mutex.Unlock()
+
+	voters := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != r.nodeManager.This.Name {
+			voters = append(voters, member)
+		}
+	}
+
+	//Votes are counted as they come, so a dead member does not delay the election
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	replies := make(chan *comm.Message, len(voters))
+	for _, voter := range voters {
+		go func(voter string) {
+			reply, err := r.msgHub.RequestContext(ctx, msg, voter)
+			if err != nil {
+				reply = nil
+			}
+			replies <- reply
+		}(voter)
+	}
+
+	votes := 1
+	for range voters {
+		if votes > len(members)/2 {
+			break
+		}
+		reply := <-replies
+		if reply == nil {
+			continue
+		}
+		var vote comm.MessageVote
+		if reply.DecodeData(&vote) != nil {
+			continue
+		}
+		r.mutex.Lock()
+		if vote.Term > term || (preVote && vote.Term > r.currentTerm && !vote.Granted) {
+			r.becomeFollower(vote.Term)
+			r.mutex.Unlock()
+			return false
+		}
+		r.mutex.Unlock()
+		if vote.Granted && vote.Term == term {
+			votes++
+		}
+	}
+	return votes > len(members)/2
+}
+
+//becomeLeader must be called with r.mutex held
+func (r *Raft) becomeLeader() {
+	log.Printf("Became raft leader of term %d\n", r.currentTerm)
+	r.state = StateLeader
+	r.leader = r.nodeManager.This.Name
+	for _, nodeName := range r.nodeManager.NodeNames() {
+		r.nextIndex[nodeName] = r.lastIndex() + 1
+		r.matchIndex[nodeName] = 0
+		r.lastAck[nodeName] = time.Now()
+	}
+	//Entries of the previous terms are committed together with the first entry of the new term
+	r.append(EntryNoop, "", nil)
+}
+
+//append adds entry to the leader's log and starts replicating it. Must be called with r.mutex held.
+func (r *Raft) append(entryType EntryType, target string, data []byte) *waiter {
+	entry := Entry{
+		Index:  r.lastIndex() + 1,
+		Term:   r.currentTerm,
+		Type:   entryType,
+		Target: target,
+		Data:   data,
+		Time:   time.Now(),
+	}
+	r.log = append(r.log, entry)
+	err := r.storage.appendLog([]Entry{entry})
+	if err != nil {
+		log.Println("Failed to append raft log:", err)
+	}
+	if entryType == EntryMembers {
+		r.members = decodeMembers(data)
+		r.membersIndex = entry.Index
+	}
+
+	w := &waiter{term: entry.Term, result: make(chan result, 1)}
+	r.waiters[entry.Index] = w
+
+	r.triggerReplication()
+	r.advanceCommitIndex()
+	return w
+}
+
+//triggerReplication makes the leader send entries or heartbeats to every follower now. Must be called with r.mutex held.
+func (r *Raft) triggerReplication() {
+	for _, trigger := range r.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//advanceCommitIndex commits entries of the current term stored by the majority. Must be called with r.mutex held.
+func (r *Raft) advanceCommitIndex() {
+	for index := r.lastIndex(); index > r.commitIndex && r.term(index) == r.currentTerm; index-- {
+		stored := 0
+		for _, member := range r.members {
+			if member == r.nodeManager.This.Name || r.matchIndex[member] >= index {
+				stored++
+			}
+		}
+		if stored > len(r.members)/2 {
+			r.commitIndex = index
+			r.applyCond.Broadcast()
+			break
+		}
+	}
+	//Leader removed from the cluster steps down once the change is committed
+	if r.state == StateLeader && !r.isMember(r.nodeManager.This.Name) && r.commitIndex >= r.membersIndex {
+		r.becomeFollower(r.currentTerm)
+	}
+}
+
+//applyCommitted applies committed entries to the state machines and takes snapshots
+func (r *Raft) applyCommitted() {
+	r.mutex.Lock()
+	for {
+		for r.lastApplied >= r.commitIndex {
+			r.applyCond.Wait()
+		}
+		entries := r.entries(r.lastApplied+1, int(r.commitIndex-r.lastApplied))
+		r.mutex.Unlock()
+
+		r.applyMutex.Lock()
+		for _, entry := range entries {
+			r.mutex.Lock()
+			skip := entry.Index != r.lastApplied+1
+			r.mutex.Unlock()
+			if skip {
+				continue
+			}
+
+			res := result{index: entry.Index}
+			if entry.Type == EntryCommand {
+				if machine, exists := r.machines[entry.Target]; exists {
+					if timed, ok := machine.(TimedStateMachine); ok {
+						res.data = timed.ApplyAt(entry.Data, entry.Time)
+					} else {
+						res.data = machine.Apply(entry.Data)
+					}
+				} else {
+					res.err = ErrorUnknownStateMachine
+				}
+			}
+
+			r.mutex.Lock()
+			r.lastApplied = entry.Index
+			if w, exists := r.waiters[entry.Index]; exists {
+				delete(r.waiters, entry.Index)
+				if w.term != entry.Term {
+					res = result{err: ErrorLeadershipLost}
+				}
+				w.result <- res
+			}
+			r.mutex.Unlock()
+		}
+		r.mutex.Lock()
+		r.notifyApplied()
+		r.mutex.Unlock()
+		r.takeSnapshot()
+		r.applyMutex.Unlock()
+
+		r.mutex.Lock()
+	}
+}
+
+//takeSnapshot compacts the log once enough entries are applied. Must be called with r.applyMutex held.
+func (r *Raft) takeSnapshot() {
+	threshold := r.config.Raft.SnapshotThreshold
+	if threshold <= 0 {
+		threshold = defaultSnapshotThreshold
+	}
+
+	r.mutex.Lock()
+	if r.lastApplied-r.snapshot.Index < uint64(threshold) {
+		r.mutex.Unlock()
+		return
+	}
+	snapshot := Snapshot{
+		Index:    r.lastApplied,
+		Term:     r.term(r.lastApplied),
+		Members:  r.membersAt(r.lastApplied),
+		Machines: make(map[string][]byte, len(r.machines)),
+	}
+	r.mutex.Unlock()
+
+	for target, machine := range r.machines {
+		data, err := machine.Snapshot()
+		if err != nil {
+			log.Println("Failed to take snapshot:", err)
+			return
+		}
+		snapshot.Machines[target] = data
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.installSnapshot(snapshot)
+}
+
+//installSnapshot replaces the log up to the snapshot. Must be called with r.mutex held.
+func (r *Raft) installSnapshot(snapshot Snapshot) {
+	if r.term(snapshot.Index) == snapshot.Term && snapshot.Index <= r.lastIndex() {
+		r.log = r.log[snapshot.Index-r.snapshot.Index:]
+	} else {
+		r.log = nil
+	}
+	r.snapshot = snapshot
+
+	err := r.storage.saveSnapshot(snapshot)
+	if err == nil {
+		err = r.storage.rewriteLog(r.log)
+	}
+	if err != nil {
+		log.Println("Failed to save raft snapshot:", err)
+	}
+	r.updateMembers()
+}
+
+//Propose appends command for the target state machine to the log and waits until it is applied.
+//It returns what the state machine returned, or nothing if this node got the applied command in a snapshot.
+func (r *Raft) Propose(ctx context.Context, target string, data []byte) ([]byte, error) {
+	data, _, err := r.propose(ctx, EntryCommand, target, data)
+	return data, err
+}
+
+//notifyApplied wakes callers waiting for entries to be applied. Must be called with r.mutex held.
+func (r *Raft) notifyApplied() {
+	close(r.applied)
+	r.applied = make(chan struct{})
+}
+
+//waitApplied waits until this node applies the entry, so the caller reads what it has just written
+func (r *Raft) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		r.mutex.Lock()
+		if r.lastApplied >= index {
+			r.mutex.Unlock()
+			return nil
+		}
+		applied := r.applied
+		r.mutex.Unlock()
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//propose returns result of the command and index of its entry
+func (r *Raft) propose(ctx context.Context, entryType EntryType, target string, data []byte) ([]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeouts.Consensus.Or(defaultConsensusTimeout))
+	defer cancel()
+
+	for {
+		r.mutex.Lock()
+		if r.state == StateLeader {
+			if entryType == EntryMembers {
+				var err error
+				data, err = r.changeMembers(data)
+				if err != nil {
+					r.mutex.Unlock()
+					return nil, 0, err
+				}
+			}
+			w := r.append(entryType, target, data)
+			r.mutex.Unlock()
+
+			select {
+			case res := <-w.result:
+				return res.data, res.index, res.err
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, 0, ErrorNoQuorum
+				}
+				return nil, 0, ctx.Err()
+			}
+		}
+		leader := r.leader
+		r.mutex.Unlock()
+
+		if leader != "" {
+			data, index, err := r.forward(ctx, leader, entryType, target, data)
+			if err == nil {
+				err = r.waitApplied(ctx, index)
+			}
+			if err != ErrorNoLeader {
+				return data, index, err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ErrorNoLeader
+		case <-time.After(r.heartbeatInterval):
+		}
+	}
+}
+
+//ReadIndex waits until this node applies every entry committed before the call, so state machines read afterwards
+//reflect every write completed before. Unlike a proposal it writes nothing to the log:
+//the leader confirms it still leads by a round of heartbeats and tells the index to wait for.
+func (r *Raft) ReadIndex(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeouts.Consensus.Or(defaultConsensusTimeout))
+	defer cancel()
+
+	for {
+		r.mutex.Lock()
+		isLeader := r.state == StateLeader
+		leader := r.leader
+		r.mutex.Unlock()
+
+		err := ErrorNoLeader
+		var index uint64
+		if isLeader {
+			index, err = r.readIndex(ctx)
+		} else if leader != "" {
+			index, err = r.forwardReadIndex(ctx, leader)
+		}
+		if err == nil {
+			return r.waitApplied(ctx, index)
+		}
+		if err != ErrorNoLeader {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ErrorNoLeader
+		case <-time.After(r.heartbeatInterval):
+		}
+	}
+}
+
+//readIndex returns the commit index of the leader once the majority confirmed it still leads
+func (r *Raft) readIndex(ctx context.Context) (uint64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	term := r.currentTerm
+
+	//Commit index is known to be up to date once the leader committed an entry of its own term
+	for r.term(r.commitIndex) != term {
+		if r.state != StateLeader || r.currentTerm != term {
+			return 0, ErrorNoLeader
+		}
+		applied := r.applied
+		r.mutex.Unlock()
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			r.mutex.Lock()
+			return 0, ErrorNoQuorum
+		}
+		r.mutex.Lock()
+	}
+
+	index := r.commitIndex
+	start := time.Now()
+	r.triggerReplication()
+	for {
+		if r.state != StateLeader || r.currentTerm != term {
+			return 0, ErrorNoLeader
+		}
+		confirmed := 0
+		for _, member := range r.members {
+			if member == r.nodeManager.This.Name || !r.lastAck[member].Before(start) {
+				confirmed++
+			}
+		}
+		if confirmed > len(r.members)/2 {
+			return index, nil
+		}
+		acked := r.acked
+		r.mutex.Unlock()
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			r.mutex.Lock()
+			return 0, ErrorNoQuorum
+		}
+		r.mutex.Lock()
+	}
+}
+
+func (r *Raft) forwardReadIndex(ctx context.Context, leader string) (uint64, error) {
+	reply, err := r.msgHub.RequestContext(ctx, comm.Message{Type: comm.MessageTypeReadIndex}, leader)
+	if err != nil {
+		return 0, err
+	}
+	var readIndexResult comm.MessageReadIndexResult
+	err = reply.DecodeData(&readIndexResult)
+	if err != nil {
+		return 0, err
+	}
+	if readIndexResult.Error != "" {
+		return 0, leaderError(readIndexResult.Error)
+	}
+	return readIndexResult.Index, nil
+}
+
+func (r *Raft) forward(ctx context.Context, leader string, entryType EntryType, target string, data []byte) ([]byte, uint64, error) {
+	msg := comm.Message{Type: comm.MessageTypePropose}
+	msg.EncodeData(comm.MessagePropose{
+		Type:   uint8(entryType),
+		Target: target,
+		Data:   data,
+	})
+	reply, err := r.msgHub.RequestContext(ctx, msg, leader)
+	if err != nil {
+		return nil, 0, err
+	}
+	var proposeResult comm.MessageProposeResult
+	err = reply.DecodeData(&proposeResult)
+	if err != nil {
+		return nil, 0, err
+	}
+	if proposeResult.Error != "" {
+		return nil, 0, leaderError(proposeResult.Error)
+	}
+	return proposeResult.Result, proposeResult.Index, nil
+}
+
+//leaderError restores error the leader failed the forwarded command with,
+//so callers can tell errors of raft by their values
+func leaderError(message string) error {
+	for _, err := range []error{
+		ErrorNoLeader,
+		ErrorLeadershipLost,
+		ErrorUnknownStateMachine,
+		ErrorUnknownNode,
+		ErrorMembershipChangeInProgress,
+		ErrorNoQuorum,
+	} {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+//IsLeader reports whether this node leads the cluster
+func (r *Raft) IsLeader() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.state == StateLeader
+}
+
+func (r *Raft) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return Status{
+		State:         r.state,
+		Term:          r.currentTerm,
+		Leader:        r.leader,
+		Members:       r.members,
+		LastIndex:     r.lastIndex(),
+		CommitIndex:   r.commitIndex,
+		LastApplied:   r.lastApplied,
+		SnapshotIndex: r.snapshot.Index,
+	}
+}
@@ -0,0 +1,484 @@
+package raft
+
+import (
+	"context"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testHeartbeatInterval = 20 * time.Millisecond
+	testElectionTimeout   = 100 * time.Millisecond
+	testWaitTimeout       = 5 * time.Second
+	testMachineName       = "test"
+)
+
+var errorUnreachable = errors.New("Node is unreachable.")
+
+//memNetwork delivers messages between raft nodes of one process. Isolated nodes neither send nor receive.
+type memNetwork struct {
+	mutex    sync.Mutex
+	nodes    map[string]*memTransport
+	isolated map[string]bool
+	lastID   uint64
+}
+
+func (network *memNetwork) connected(a, b string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return !network.isolated[a] && !network.isolated[b]
+}
+
+func (network *memNetwork) isolate(nodeName string, isolated bool) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.isolated[nodeName] = isolated
+}
+
+func (network *memNetwork) isIsolated(nodeName string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.isolated[nodeName]
+}
+
+func (network *memNetwork) transport(nodeName string) *memTransport {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.nodes[nodeName]
+}
+
+//memTransport is the transport of a single node of memNetwork
+type memTransport struct {
+	network  *memNetwork
+	name     string
+	mutex    sync.Mutex
+	handlers map[comm.MessageType][]comm.MessageHandler
+	pending  map[uint64]chan *comm.Message
+}
+
+func (t *memTransport) Subscribe(msgHandler comm.MessageHandler, msgTypes ...comm.MessageType) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, msgType := range msgTypes {
+		t.handlers[msgType] = append(t.handlers[msgType], msgHandler)
+	}
+}
+
+func (t *memTransport) RequestContext(ctx context.Context, msg comm.Message, nodeName string) (*comm.Message, error) {
+	target := t.network.transport(nodeName)
+	if target == nil || !t.network.connected(t.name, nodeName) {
+		return nil, errorUnreachable
+	}
+	msg.SourceNode = t.name
+	msg.ID = atomic.AddUint64(&t.network.lastID, 1)
+	replyChan := make(chan *comm.Message, 1)
+	t.mutex.Lock()
+	t.pending[msg.ID] = replyChan
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.pending, msg.ID)
+		t.mutex.Unlock()
+	}()
+
+	target.mutex.Lock()
+	handlers := target.handlers[msg.Type]
+	target.mutex.Unlock()
+	go func() {
+		for _, msgHandler := range handlers {
+			msgHandler.HandleMessage(&msg)
+		}
+	}()
+
+	select {
+	case reply := <-replyChan:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *memTransport) Reply(request *comm.Message, reply comm.Message) error {
+	source := t.network.transport(request.SourceNode)
+	if source == nil || !t.network.connected(t.name, request.SourceNode) {
+		return errorUnreachable
+	}
+	reply.SourceNode = t.name
+	reply.InReplyTo = request.ID
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if replyChan, exists := source.pending[request.ID]; exists {
+		select {
+		case replyChan <- &reply:
+		default:
+		}
+	}
+	return nil
+}
+
+//testMachine records the commands in order they are applied
+type testMachine struct {
+	mutex    sync.Mutex
+	commands []string
+}
+
+func (m *testMachine) Apply(data []byte) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.commands = append(m.commands, string(data))
+	return data
+}
+
+func (m *testMachine) Snapshot() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.Marshal(m.commands)
+}
+
+func (m *testMachine) Restore(data []byte) error {
+	var commands []string
+	err := json.Unmarshal(data, &commands)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.commands = commands
+	return nil
+}
+
+func (m *testMachine) applied() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+type testCluster struct {
+	network  *memNetwork
+	names    []string
+	rafts    map[string]*Raft
+	machines map[string]*testMachine
+}
+
+func newTestCluster(t *testing.T, size int, snapshotThreshold int) *testCluster {
+	t.Helper()
+	dir := t.TempDir()
+	cluster := &testCluster{
+		network:  &memNetwork{nodes: make(map[string]*memTransport, 0), isolated: make(map[string]bool, 0)},
+		rafts:    make(map[string]*Raft, 0),
+		machines: make(map[string]*testMachine, 0),
+	}
+	//Raft can not be stopped, so nodes are cut off once the test ends and settle before their directories are removed
+	t.Cleanup(func() {
+		for _, name := range cluster.names {
+			cluster.network.isolate(name, true)
+		}
+		time.Sleep(2 * testElectionTimeout)
+	})
+	nodes := make([]c.NodeInfo, 0, size)
+	for i := 1; i <= size; i++ {
+		name := "node" + strconv.Itoa(i)
+		cluster.names = append(cluster.names, name)
+		nodes = append(nodes, c.NodeInfo{Name: name, PrivateAddress: name})
+		cluster.network.nodes[name] = &memTransport{
+			network:  cluster.network,
+			name:     name,
+			handlers: make(map[comm.MessageType][]comm.MessageHandler, 0),
+			pending:  make(map[uint64]chan *comm.Message, 0),
+		}
+	}
+
+	for i, name := range cluster.names {
+		config := &c.Config{
+			This:  nodes[i],
+			Nodes: append(append([]c.NodeInfo(nil), nodes[:i]...), nodes[i+1:]...),
+			Raft: c.RaftConfig{
+				Dir:               filepath.Join(dir, name),
+				HeartbeatInterval: c.Duration{Duration: testHeartbeatInterval},
+				ElectionTimeout:   c.Duration{Duration: testElectionTimeout},
+				SnapshotThreshold: snapshotThreshold,
+			},
+		}
+		nodeManager := &node.NodeManager{}
+		nodeManager.UseConfig(config)
+
+		r := &Raft{}
+		r.UseConfig(config)
+		machine := &testMachine{}
+		r.Register(testMachineName, machine)
+		if err := r.listen(nodeManager, cluster.network.nodes[name]); err != nil {
+			t.Fatal(err)
+		}
+		cluster.rafts[name] = r
+		cluster.machines[name] = machine
+	}
+	return cluster
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWaitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//waitLeader waits until the connected nodes agree on the single leader and returns it
+func (cluster *testCluster) waitLeader(t *testing.T) string {
+	t.Helper()
+	var leader string
+	waitFor(t, "leader", func() bool {
+		leader = ""
+		var term uint64
+		for _, name := range cluster.names {
+			if cluster.network.isIsolated(name) {
+				continue
+			}
+			status := cluster.rafts[name].Status()
+			if status.Leader == "" || (leader != "" && (status.Leader != leader || status.Term != term)) {
+				return false
+			}
+			leader, term = status.Leader, status.Term
+		}
+		return leader != "" && !cluster.network.isIsolated(leader) && cluster.rafts[leader].IsLeader()
+	})
+	return leader
+}
+
+//follower returns a connected node other than the leader
+func (cluster *testCluster) follower(leader string, except ...string) string {
+	for _, name := range cluster.names {
+		skip := name == leader || cluster.network.isIsolated(name)
+		for _, other := range except {
+			skip = skip || name == other
+		}
+		if !skip {
+			return name
+		}
+	}
+	return ""
+}
+
+func (cluster *testCluster) propose(t *testing.T, nodeName string, command string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testWaitTimeout)
+	defer cancel()
+	result, err := cluster.rafts[nodeName].Propose(ctx, testMachineName, []byte(command))
+	if err != nil {
+		t.Fatalf("proposal %s on %s failed: %v", command, nodeName, err)
+	}
+	if string(result) != command {
+		t.Fatalf("proposal %s on %s returned %q", command, nodeName, result)
+	}
+}
+
+func TestElection(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "single node", size: 1},
+		{name: "three nodes", size: 3},
+		{name: "five nodes", size: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := newTestCluster(t, test.size, 0)
+			leader := cluster.waitLeader(t)
+			leaders := 0
+			for _, name := range cluster.names {
+				if cluster.rafts[name].IsLeader() {
+					leaders++
+				}
+			}
+			if leaders != 1 {
+				t.Fatalf("got %d leaders", leaders)
+			}
+			if members := cluster.rafts[leader].Status().Members; len(members) != test.size {
+				t.Fatalf("got members %v, want %d nodes", members, test.size)
+			}
+		})
+	}
+}
+
+func TestReelection(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	leader := cluster.waitLeader(t)
+	term := cluster.rafts[leader].Status().Term
+
+	cluster.network.isolate(leader, true)
+	newLeader := cluster.waitLeader(t)
+	if newLeader == leader {
+		t.Fatalf("isolated node %s is still the leader", leader)
+	}
+	if newTerm := cluster.rafts[newLeader].Status().Term; newTerm <= term {
+		t.Fatalf("new leader got term %d, not greater than %d", newTerm, term)
+	}
+	waitFor(t, "isolated leader to step down", func() bool {
+		return !cluster.rafts[leader].IsLeader()
+	})
+
+	//Isolated node can not win pre-vote, so it does not disturb the cluster once it is back
+	cluster.network.isolate(leader, false)
+	if got := cluster.waitLeader(t); got != newLeader {
+		t.Fatalf("got leader %s after the old leader is back, want %s", got, newLeader)
+	}
+}
+
+func TestNoCommitWithoutQuorum(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0)
+	leader := cluster.waitLeader(t)
+	cluster.propose(t, leader, "before")
+	for _, name := range cluster.names {
+		if name != leader {
+			cluster.network.isolate(name, true)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*testElectionTimeout)
+	defer cancel()
+	if _, err := cluster.rafts[leader].Propose(ctx, testMachineName, []byte("lost")); err == nil {
+		t.Fatal("proposal is committed without quorum")
+	}
+	for _, name := range cluster.names {
+		for _, command := range cluster.machines[name].applied() {
+			if command == "lost" {
+				t.Fatalf("%s applied command proposed without quorum", name)
+			}
+		}
+	}
+}
+
+func TestLogCatchUp(t *testing.T) {
+	tests := []struct {
+		name              string
+		snapshotThreshold int
+	}{
+		{name: "append entries", snapshotThreshold: 0},
+		{name: "install snapshot", snapshotThreshold: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := newTestCluster(t, 3, test.snapshotThreshold)
+			leader := cluster.waitLeader(t)
+			lagging := cluster.follower(leader)
+			other := cluster.follower(leader, lagging)
+
+			expected := make([]string, 0)
+			for i := 0; i < 3; i++ {
+				command := "before" + strconv.Itoa(i)
+				cluster.propose(t, leader, command)
+				expected = append(expected, command)
+			}
+
+			cluster.network.isolate(lagging, true)
+			for i := 0; i < 20; i++ {
+				//Proposals of the follower are forwarded to the leader
+				proposer := leader
+				if i%2 == 1 {
+					proposer = other
+				}
+				command := "during" + strconv.Itoa(i)
+				cluster.propose(t, proposer, command)
+				expected = append(expected, command)
+			}
+			if applied := cluster.machines[lagging].applied(); len(applied) >= len(expected) {
+				t.Fatalf("isolated node applied %d commands", len(applied))
+			}
+			if test.snapshotThreshold > 0 {
+				if status := cluster.rafts[leader].Status(); status.SnapshotIndex == 0 {
+					t.Fatalf("leader took no snapshot: %+v", status)
+				}
+			}
+
+			cluster.network.isolate(lagging, false)
+			//Followers learn the last commit index with the next heartbeat
+			waitFor(t, "nodes to catch up", func() bool {
+				for _, name := range cluster.names {
+					if len(cluster.machines[name].applied()) != len(expected) {
+						return false
+					}
+				}
+				return true
+			})
+			for _, name := range cluster.names {
+				applied := cluster.machines[name].applied()
+				if len(applied) != len(expected) {
+					t.Fatalf("%s applied %d commands, want %d", name, len(applied), len(expected))
+				}
+				for i := range expected {
+					if applied[i] != expected[i] {
+						t.Fatalf("%s applied %v, want %v", name, applied, expected)
+					}
+				}
+			}
+			if status, leaderStatus := cluster.rafts[lagging].Status(), cluster.rafts[leader].Status(); status.LastIndex != leaderStatus.LastIndex {
+				t.Fatalf("lagging node has last index %d, leader %d", status.LastIndex, leaderStatus.LastIndex)
+			}
+		})
+	}
+}
+
+//TestInstallSnapshotResolvesWaiters checks that proposals covered by the snapshot are reported applied
+//only if the log of the node matches the snapshot and still holds the proposed entries
+func TestInstallSnapshotResolvesWaiters(t *testing.T) {
+	tests := []struct {
+		name string
+		//logMatches tells whether the snapshot ends with the last entry of the node
+		logMatches bool
+	}{
+		{name: "matching log", logMatches: true},
+		{name: "diverged log", logMatches: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := newTestCluster(t, 3, 0)
+			leader := cluster.waitLeader(t)
+			lagging := cluster.follower(leader)
+			cluster.network.isolate(lagging, true)
+			r := cluster.rafts[lagging]
+
+			//Node appended the entries while it led, the second one was replaced by another leader since
+			r.mutex.Lock()
+			kept := r.append(EntryCommand, testMachineName, []byte("kept"))
+			replaced := r.append(EntryCommand, testMachineName, []byte("replaced"))
+			replaced.term++
+			request := comm.MessageInstallSnapshot{
+				Term:     r.currentTerm,
+				Leader:   leader,
+				Index:    r.lastIndex(),
+				LogTerm:  r.term(r.lastIndex()),
+				Members:  append([]string(nil), r.members...),
+				Machines: map[string][]byte{testMachineName: []byte(`["kept","other"]`)},
+			}
+			r.mutex.Unlock()
+			if !test.logMatches {
+				request.LogTerm++
+			}
+
+			if installed := r.handleInstallSnapshot(request); installed.Refused || installed.MatchIndex != request.Index {
+				t.Fatalf("snapshot was not installed: %+v", installed)
+			}
+			if res := <-kept.result; test.logMatches && (res.err != nil || res.index != request.Index-1) {
+				t.Fatalf("got result %+v of the kept entry, want it applied at %d", res, request.Index-1)
+			} else if !test.logMatches && res.err != ErrorLeadershipLost {
+				t.Fatalf("got result %+v of the entry in diverged log, want %v", res, ErrorLeadershipLost)
+			}
+			if res := <-replaced.result; res.err != ErrorLeadershipLost {
+				t.Fatalf("got result %+v of the replaced entry, want %v", res, ErrorLeadershipLost)
+			}
+		})
+	}
+}
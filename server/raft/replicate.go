@@ -0,0 +1,459 @@
+package raft
+
+import (
+	"context"
+	"dfs/comm"
+	"log"
+	"time"
+)
+
+func toMessages(entries []Entry) []comm.MessageRaftEntry {
+	messages := make([]comm.MessageRaftEntry, 0, len(entries))
+	for _, entry := range entries {
+		messages = append(messages, comm.MessageRaftEntry{
+			Index:  entry.Index,
+			Term:   entry.Term,
+			Type:   uint8(entry.Type),
+			Target: entry.Target,
+			Data:   entry.Data,
+			Time:   entry.Time,
+		})
+	}
+	return messages
+}
+
+func fromMessages(messages []comm.MessageRaftEntry) []Entry {
+	entries := make([]Entry, 0, len(messages))
+	for _, msg := range messages {
+		entries = append(entries, Entry{
+			Index:  msg.Index,
+			Term:   msg.Term,
+			Type:   EntryType(msg.Type),
+			Target: msg.Target,
+			Data:   msg.Data,
+			Time:   msg.Time,
+		})
+	}
+	return entries
+}
+
+//replicate sends new entries or heartbeats to the follower while this node is the leader
+func (r *Raft) replicate(nodeName string, trigger chan struct{}) {
+	for {
+		select {
+		case <-trigger:
+		case <-time.After(r.heartbeatInterval):
+		}
+
+		r.mutex.Lock()
+		if r.state != StateLeader || !r.isMember(nodeName) {
+			r.mutex.Unlock()
+			continue
+		}
+		term := r.currentTerm
+		var msg comm.Message
+		if r.nextIndex[nodeName] <= r.snapshot.Index {
+			msg.Type = comm.MessageTypeInstallSnapshot
+			msg.EncodeData(comm.MessageInstallSnapshot{
+				Term:     term,
+				Leader:   r.nodeManager.This.Name,
+				Index:    r.snapshot.Index,
+				LogTerm:  r.snapshot.Term,
+				Members:  r.snapshot.Members,
+				Machines: r.snapshot.Machines,
+			})
+		} else {
+			prevLogIndex := r.nextIndex[nodeName] - 1
+			msg.Type = comm.MessageTypeAppendEntries
+			msg.EncodeData(comm.MessageAppendEntries{
+				Term:         term,
+				Leader:       r.nodeManager.This.Name,
+				PrevLogIndex: prevLogIndex,
+				PrevLogTerm:  r.term(prevLogIndex),
+				Entries:      toMessages(r.entries(prevLogIndex+1, maxEntriesPerRequest)),
+				LeaderCommit: r.commitIndex,
+			})
+		}
+		timeout := r.electionTimeout
+		r.mutex.Unlock()
+
+		sent := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		reply, err := r.msgHub.RequestContext(ctx, msg, nodeName)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		r.mutex.Lock()
+		more := r.handleReplicationReply(nodeName, term, sent, reply)
+		r.mutex.Unlock()
+		if more {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+//handleReplicationReply updates follower progress and reports whether it still lags behind.
+//Sent is the time the request was sent at, the follower acknowledged the leader no earlier.
+//Must be called with r.mutex held.
+func (r *Raft) handleReplicationReply(nodeName string, term uint64, sent time.Time, reply *comm.Message) (more bool) {
+	var replyTerm, matchIndex uint64
+	success := true
+	refused := false
+	switch reply.Type {
+	case comm.MessageTypeAppendEntriesResult:
+		var result comm.MessageAppendEntriesResult
+		if reply.DecodeData(&result) != nil {
+			return false
+		}
+		replyTerm, matchIndex, success = result.Term, result.MatchIndex, result.Success
+		if !success {
+			if result.ConflictIndex > 0 && result.ConflictIndex < r.nextIndex[nodeName] {
+				r.nextIndex[nodeName] = result.ConflictIndex
+			} else if r.nextIndex[nodeName] > 1 {
+				r.nextIndex[nodeName]--
+			}
+		}
+	case comm.MessageTypeSnapshotInstalled:
+		var result comm.MessageSnapshotInstalled
+		if reply.DecodeData(&result) != nil {
+			return false
+		}
+		replyTerm, matchIndex, refused = result.Term, result.MatchIndex, result.Refused
+	default:
+		return false
+	}
+
+	if replyTerm > r.currentTerm {
+		r.becomeFollower(replyTerm)
+		return false
+	}
+	if r.state != StateLeader || r.currentTerm != term {
+		return false
+	}
+	r.lastAck[nodeName] = sent
+	close(r.acked)
+	r.acked = make(chan struct{})
+	if refused {
+		//Snapshot is sent again with the next heartbeat
+		return false
+	}
+	if success {
+		if matchIndex > r.matchIndex[nodeName] {
+			r.matchIndex[nodeName] = matchIndex
+		}
+		r.nextIndex[nodeName] = r.matchIndex[nodeName] + 1
+		r.advanceCommitIndex()
+	}
+	return !success || r.nextIndex[nodeName] <= r.lastIndex()
+}
+
+func (r *Raft) HandleMessage(msg *comm.Message) {
+	switch msg.Type {
+	case comm.MessageTypeRequestVote:
+		//Votes must not wait for replication requests, elections would stall behind slow disk
+		go r.handleVoteMessage(msg)
+
+	case comm.MessageTypeAppendEntries, comm.MessageTypeInstallSnapshot:
+		//Replication requests are handled in order off the connection.
+		//Request is dropped if too many are waiting, the leader sends it again.
+		select {
+		case r.replication <- msg:
+		default:
+		}
+
+	case comm.MessageTypePropose:
+		//Proposals wait for the commit, so they must not hold up other messages
+		go r.handlePropose(msg)
+
+	case comm.MessageTypeReadIndex:
+		go r.handleReadIndex(msg)
+	}
+}
+
+func (r *Raft) handleVoteMessage(msg *comm.Message) {
+	var request comm.MessageRequestVote
+	if msg.DecodeData(&request) != nil {
+		return
+	}
+	responseMsg := comm.Message{Type: comm.MessageTypeVote}
+	responseMsg.EncodeData(r.handleRequestVote(request))
+	r.msgHub.Reply(msg, responseMsg)
+}
+
+//serveReplication handles queued AppendEntries and InstallSnapshot requests one by one
+func (r *Raft) serveReplication() {
+	for msg := range r.replication {
+		switch msg.Type {
+		case comm.MessageTypeAppendEntries:
+			var request comm.MessageAppendEntries
+			if msg.DecodeData(&request) != nil {
+				continue
+			}
+			responseMsg := comm.Message{Type: comm.MessageTypeAppendEntriesResult}
+			responseMsg.EncodeData(r.handleAppendEntries(request))
+			r.msgHub.Reply(msg, responseMsg)
+
+		case comm.MessageTypeInstallSnapshot:
+			var request comm.MessageInstallSnapshot
+			if msg.DecodeData(&request) != nil {
+				continue
+			}
+			responseMsg := comm.Message{Type: comm.MessageTypeSnapshotInstalled}
+			responseMsg.EncodeData(r.handleInstallSnapshot(request))
+			r.msgHub.Reply(msg, responseMsg)
+		}
+	}
+}
+
+func (r *Raft) handleRequestVote(request comm.MessageRequestVote) comm.MessageVote {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if request.PreVote {
+		return r.handlePreVote(request)
+	}
+	if request.Term > r.currentTerm {
+		r.becomeFollower(request.Term)
+	}
+	vote := comm.MessageVote{Term: r.currentTerm}
+	if request.Term < r.currentTerm {
+		return vote
+	}
+
+	if (r.votedFor == "" || r.votedFor == request.Candidate) && r.isUpToDate(request) {
+		r.votedFor = request.Candidate
+		r.persistState()
+		r.resetElectionTimer()
+		vote.Granted = true
+	}
+	return vote
+}
+
+//handlePreVote grants pre-vote to the candidate which could win the election.
+//Nodes which hear from the leader refuse, so a rejoining node can not depose it.
+//Must be called with r.mutex held.
+func (r *Raft) handlePreVote(request comm.MessageRequestVote) comm.MessageVote {
+	vote := comm.MessageVote{Term: r.currentTerm, PreVote: true}
+	if request.Term < r.currentTerm {
+		return vote
+	}
+	heardFromLeader := r.state == StateLeader ||
+		(r.leader != "" && time.Since(r.leaderContact) < r.config.Raft.ElectionTimeout.Or(defaultElectionTimeout))
+	if !heardFromLeader && r.isUpToDate(request) {
+		vote.Term = request.Term
+		vote.Granted = true
+	}
+	return vote
+}
+
+//isUpToDate reports whether the candidate's log has all entries of this node's log.
+//Must be called with r.mutex held.
+func (r *Raft) isUpToDate(request comm.MessageRequestVote) bool {
+	lastIndex := r.lastIndex()
+	lastTerm := r.term(lastIndex)
+	return request.LastLogTerm > lastTerm ||
+		(request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex)
+}
+
+//acceptLeader must be called with r.mutex held
+func (r *Raft) acceptLeader(term uint64, leader string) {
+	if term > r.currentTerm || r.state != StateFollower {
+		r.becomeFollower(term)
+	}
+	r.leader = leader
+	r.leaderContact = time.Now()
+	r.resetElectionTimer()
+}
+
+func (r *Raft) handleAppendEntries(request comm.MessageAppendEntries) comm.MessageAppendEntriesResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := comm.MessageAppendEntriesResult{Term: r.currentTerm}
+	if request.Term < r.currentTerm {
+		return result
+	}
+	r.acceptLeader(request.Term, request.Leader)
+	result.Term = r.currentTerm
+
+	entries := fromMessages(request.Entries)
+	prevLogIndex, prevLogTerm := request.PrevLogIndex, request.PrevLogTerm
+	if prevLogIndex < r.snapshot.Index {
+		//Entries covered by the snapshot are committed and must match
+		for len(entries) > 0 && entries[0].Index <= r.snapshot.Index {
+			entries = entries[1:]
+		}
+		prevLogIndex, prevLogTerm = r.snapshot.Index, r.snapshot.Term
+	}
+
+	lastIndex := r.lastIndex()
+	if prevLogIndex > lastIndex {
+		result.ConflictIndex = lastIndex + 1
+		return result
+	}
+	if term := r.term(prevLogIndex); term != prevLogTerm {
+		conflictIndex := prevLogIndex
+		for conflictIndex-1 > r.snapshot.Index && r.term(conflictIndex-1) == term {
+			conflictIndex--
+		}
+		result.ConflictIndex = conflictIndex
+		return result
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= r.lastIndex() {
+			if r.term(entry.Index) == entry.Term {
+				continue
+			}
+			r.log = r.log[:entry.Index-r.snapshot.Index-1]
+			if err := r.storage.rewriteLog(r.log); err != nil {
+				return result
+			}
+			r.updateMembers()
+		}
+		newEntries := entries[i:]
+		r.log = append(r.log, newEntries...)
+		if err := r.storage.appendLog(newEntries); err != nil {
+			return result
+		}
+		r.updateMembers()
+		break
+	}
+
+	matchIndex := prevLogIndex + uint64(len(entries))
+	if request.LeaderCommit > r.commitIndex {
+		r.commitIndex = request.LeaderCommit
+		if r.commitIndex > matchIndex {
+			r.commitIndex = matchIndex
+		}
+		r.applyCond.Broadcast()
+	}
+	result.Success = true
+	result.MatchIndex = matchIndex
+	return result
+}
+
+func (r *Raft) handleInstallSnapshot(request comm.MessageInstallSnapshot) comm.MessageSnapshotInstalled {
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	installed := comm.MessageSnapshotInstalled{Term: r.currentTerm}
+	if request.Term < r.currentTerm {
+		return installed
+	}
+	r.acceptLeader(request.Term, request.Leader)
+	installed.Term = r.currentTerm
+	installed.MatchIndex = request.Index
+	if request.Index <= r.commitIndex {
+		return installed
+	}
+
+	//Snapshot which does not restore is refused, machines restored before the failure are rolled back,
+	//so the node keeps the state of its previous index like it does when it fails to restore at startup
+	restored := make(map[string][]byte, 0)
+	for target, data := range request.Machines {
+		machine, exists := r.machines[target]
+		if !exists {
+			continue
+		}
+		previous, err := machine.Snapshot()
+		if err == nil {
+			err = machine.Restore(data)
+		}
+		if err != nil {
+			log.Printf("Failed to restore %s from snapshot at index %d: %v\n", target, request.Index, err)
+			for target, previous := range restored {
+				r.machines[target].Restore(previous)
+			}
+			installed.MatchIndex = r.commitIndex
+			installed.Refused = true
+			return installed
+		}
+		restored[target] = previous
+	}
+	//Entries this node appended as leader are the committed ones if its log matches the snapshot,
+	//they are applied then, though what the state machines returned is not kept in the snapshot
+	applied := make(map[uint64]bool, 0)
+	if r.term(request.Index) == request.LogTerm {
+		for index, w := range r.waiters {
+			if index <= request.Index && r.term(index) == w.term {
+				applied[index] = true
+			}
+		}
+	}
+	r.installSnapshot(Snapshot{
+		Index:    request.Index,
+		Term:     request.LogTerm,
+		Members:  request.Members,
+		Machines: request.Machines,
+	})
+	r.commitIndex = request.Index
+	r.lastApplied = request.Index
+	r.notifyApplied()
+	for index, w := range r.waiters {
+		if index > request.Index {
+			continue
+		}
+		delete(r.waiters, index)
+		if applied[index] {
+			w.result <- result{index: index}
+		} else {
+			w.result <- result{err: ErrorLeadershipLost}
+		}
+	}
+	return installed
+}
+
+func (r *Raft) handlePropose(msg *comm.Message) {
+	var request comm.MessagePropose
+	if msg.DecodeData(&request) != nil {
+		return
+	}
+	response := comm.MessageProposeResult{}
+	r.mutex.Lock()
+	isLeader := r.state == StateLeader
+	r.mutex.Unlock()
+	if !isLeader {
+		//Follower does not pass the proposal on, so stale leaders can not bounce it around,
+		//the proposer retries once it learns the new leader
+		response.Error = ErrorNoLeader.Error()
+	} else {
+		data, index, err := r.propose(context.Background(), EntryType(request.Type), request.Target, request.Data)
+		response.Result = data
+		response.Index = index
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+	responseMsg := comm.Message{Type: comm.MessageTypeProposeResult}
+	responseMsg.EncodeData(response)
+	r.msgHub.Reply(msg, responseMsg)
+}
+
+func (r *Raft) handleReadIndex(msg *comm.Message) {
+	response := comm.MessageReadIndexResult{}
+	r.mutex.Lock()
+	isLeader := r.state == StateLeader
+	r.mutex.Unlock()
+	if !isLeader {
+		response.Error = ErrorNoLeader.Error()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeouts.Consensus.Or(defaultConsensusTimeout))
+		index, err := r.readIndex(ctx)
+		cancel()
+		response.Index = index
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+	responseMsg := comm.Message{Type: comm.MessageTypeReadIndexResult}
+	responseMsg.EncodeData(response)
+	r.msgHub.Reply(msg, responseMsg)
+}
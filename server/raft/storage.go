@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	p "path"
+)
+
+//storage persists term, vote, log and the last snapshot in the raft directory.
+//Log is appended as one JSON entry per line and rewritten when truncated or compacted.
+type storage struct {
+	dir string
+}
+
+type persistentState struct {
+	Term     uint64
+	VotedFor string
+}
+
+func (s *storage) open() error {
+	return os.MkdirAll(s.dir, 0755)
+}
+
+func (s *storage) statePath() string {
+	return p.Join(s.dir, "state.json")
+}
+
+func (s *storage) logPath() string {
+	return p.Join(s.dir, "log.jsonl")
+}
+
+func (s *storage) snapshotPath() string {
+	return p.Join(s.dir, "snapshot.json")
+}
+
+//writeFile atomically replaces file with data written by write
+func writeFile(fileName string, write func(file *os.File) error) error {
+	tmpName := fileName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+func readJSON(fileName string, output interface{}) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(output)
+}
+
+func (s *storage) loadState() (term uint64, votedFor string, err error) {
+	var state persistentState
+	err = readJSON(s.statePath(), &state)
+	return state.Term, state.VotedFor, err
+}
+
+func (s *storage) saveState(term uint64, votedFor string) error {
+	return writeFile(s.statePath(), func(file *os.File) error {
+		return json.NewEncoder(file).Encode(persistentState{term, votedFor})
+	})
+}
+
+func (s *storage) loadSnapshot() (snapshot Snapshot, err error) {
+	err = readJSON(s.snapshotPath(), &snapshot)
+	return snapshot, err
+}
+
+func (s *storage) saveSnapshot(snapshot Snapshot) error {
+	return writeFile(s.snapshotPath(), func(file *os.File) error {
+		return json.NewEncoder(file).Encode(snapshot)
+	})
+}
+
+//loadLog reads entries of the log, a partially written last entry is dropped
+func (s *storage) loadLog() ([]Entry, error) {
+	file, err := os.Open(s.logPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]Entry, 0)
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for dec.More() {
+		var entry Entry
+		if dec.Decode(&entry) != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *storage) appendLog(entries []Entry) error {
+	file, err := os.OpenFile(s.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	enc := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+func (s *storage) rewriteLog(entries []Entry) error {
+	return writeFile(s.logPath(), func(file *os.File) error {
+		enc := json.NewEncoder(file)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
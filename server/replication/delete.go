@@ -0,0 +1,100 @@
+package replication
+
+import (
+	"context"
+	"dfs/comm"
+	"fmt"
+	"os"
+	p "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//DeleteError reports nodes that failed to delete the file
+type DeleteError struct {
+	Path   string
+	Failed map[string]string
+}
+
+func (err *DeleteError) Error() string {
+	nodeNames := make([]string, 0, len(err.Failed))
+	for nodeName := range err.Failed {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	return fmt.Sprintf("Failed to delete %s on %s.", err.Path, strings.Join(nodeNames, ", "))
+}
+
+//deleteLocalFile removes local replica of the file deleted at the given time.
+//Replica written after the deletion belongs to a new upload and is kept.
+func (rm *ReplicationManager) deleteLocalFile(path string, deletedAt time.Time) error {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	filePath := p.Join(rm.config.UploadDir, path)
+	if stat, err := os.Stat(filePath); err != nil || stat.ModTime().After(deletedAt) {
+		return nil
+	}
+	err := os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//DeleteFile removes replicas of the file deleted from the catalog at deletedAt from this node and every live node.
+//It returns nodes where the file is gone and *DeleteError if some nodes failed.
+func (rm *ReplicationManager) DeleteFile(ctx context.Context, path string, deletedAt time.Time) (deleted []string, err error) {
+	failed := make(map[string]string, 0)
+
+	if err := rm.deleteLocalFile(path, deletedAt); err != nil {
+		failed[rm.nodeManager.This.Name] = err.Error()
+	} else {
+		deleted = append(deleted, rm.nodeManager.This.Name)
+	}
+
+	msg := comm.Message{Type: comm.MessageTypeDeleteFile}
+	msg.EncodeData(comm.MessageDeleteFile{
+		Path:      path,
+		DeletedAt: deletedAt,
+	})
+	responses := rm.msgHub.RequestMulticast(ctx, msg, rm.nodeManager.LiveNodeNames())
+	for nodeName, response := range responses {
+		if response.Err == comm.ErrorNodeIsDead {
+			continue
+		}
+		if response.Err != nil {
+			failed[nodeName] = response.Err.Error()
+			continue
+		}
+		var fileDeleted comm.MessageFileDeleted
+		if err := response.Msg.DecodeData(&fileDeleted); err != nil {
+			failed[nodeName] = err.Error()
+		} else if fileDeleted.Error != "" {
+			failed[nodeName] = fileDeleted.Error
+		} else {
+			deleted = append(deleted, nodeName)
+		}
+	}
+
+	sort.Strings(deleted)
+	if len(failed) > 0 {
+		return deleted, &DeleteError{Path: path, Failed: failed}
+	}
+	return deleted, nil
+}
+
+func (rm *ReplicationManager) handleDeleteFile(msg *comm.Message) {
+	var request comm.MessageDeleteFile
+	if msg.DecodeData(&request) != nil {
+		return
+	}
+	response := comm.MessageFileDeleted{Path: request.Path}
+	if err := rm.deleteLocalFile(request.Path, request.DeletedAt); err != nil {
+		response.Error = err.Error()
+	}
+	responseMsg := comm.Message{Type: comm.MessageTypeFileDeleted}
+	responseMsg.EncodeData(response)
+	rm.msgHub.Reply(msg, responseMsg)
+}
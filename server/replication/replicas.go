@@ -0,0 +1,20 @@
+package replication
+
+import (
+	"dfs/comm"
+)
+
+//ReplicationFactor returns how many nodes must keep files of the bucket, 0 means all nodes
+func (rm *ReplicationManager) ReplicationFactor(bucketName string) int {
+	if factor, exists := rm.config.BucketReplicationFactors[bucketName]; exists {
+		return factor
+	}
+	return rm.config.ReplicationFactor
+}
+
+func (rm *ReplicationManager) HandleMessage(msg *comm.Message) {
+	switch msg.Type {
+	case comm.MessageTypeDeleteFile:
+		rm.handleDeleteFile(msg)
+	}
+}
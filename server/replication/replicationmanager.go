@@ -1,28 +1,44 @@
 package replication
 
 import (
+	"context"
+	"crypto/sha256"
 	"dfs/comm"
 	c "dfs/config"
+	"dfs/server/meta"
 	"dfs/server/node"
 	"dfs/server/status"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	p "path"
 	"sync"
+	"time"
 )
 
-type replicationInfo struct {
-	WaitChan        chan bool
-	ReplicatedCount int
-}
+const (
+	defaultReplicationTimeout = 5 * time.Minute
+	defaultChunkSize          = 1 << 20
+	maxSendAttempts           = 5
+	minRetryDelay             = 100 * time.Millisecond
+	stagedFileTTL             = time.Hour
+)
+
+var (
+	ErrorChecksumMismatch = errors.New("Checksum of replicated file does not match.")
+	ErrorFileIsDeleted    = errors.New("File was deleted.")
+)
 
 type ReplicationManager struct {
-	mutex          sync.Mutex
-	config         *c.Config
-	nodeManager    *node.NodeManager
-	statusManager  *status.StatusManager
-	msgHub         *comm.MessageHub
-	replicationMap map[string]*replicationInfo
+	mutex         sync.Mutex
+	config        *c.Config
+	nodeManager   *node.NodeManager
+	statusManager *status.StatusManager
+	catalog       *meta.Catalog
+	msgHub        *comm.MessageHub
 }
 
 func (rm *ReplicationManager) UseConfig(config *c.Config) {
@@ -32,89 +48,358 @@ func (rm *ReplicationManager) UseConfig(config *c.Config) {
 func (rm *ReplicationManager) Listen(
 	nodeManager *node.NodeManager,
 	statusManager *status.StatusManager,
+	catalog *meta.Catalog,
 	msgHub *comm.MessageHub) {
 
-	rm.replicationMap = make(map[string]*replicationInfo, 0)
-
 	rm.nodeManager = nodeManager
 	rm.statusManager = statusManager
+	rm.catalog = catalog
 	rm.msgHub = msgHub
-	rm.msgHub.Subscribe(rm, comm.MessageTypeFile, comm.MessageTypeFileReceived)
+	rm.msgHub.Subscribe(rm, comm.MessageTypeDeleteFile)
+	rm.msgHub.SubscribeStream(rm,
+		comm.MessageTypeRequestFileOffset,
+		comm.MessageTypeFileChunk,
+		comm.MessageTypeCommitFile)
+
+	//Replicas of deleted files and of files overwritten on other nodes are removed
+	catalog.Watch(func(object meta.ObjectMeta) {
+		if object.Deleted || !rm.keeps(object) {
+			rm.deleteLocalFile(object.Path, object.Modified)
+		}
+	})
+
+	go func() {
+		ticker := time.Tick(stagedFileTTL)
+		for {
+			<-ticker
+			rm.removeStaleStagedFiles()
+		}
+	}()
 }
 
-func (rm *ReplicationManager) ReplicateFile(path string) {
-	filePath := p.Join(rm.config.UploadDir, path)
+//keeps reports whether this node is one of the replicas of the file
+func (rm *ReplicationManager) keeps(object meta.ObjectMeta) bool {
+	for _, nodeName := range object.Replicas {
+		if nodeName == rm.nodeManager.This.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (rm *ReplicationManager) stagingDir() string {
+	return rm.config.StagingPath()
+}
+
+func (rm *ReplicationManager) chunkSize() int {
+	chunkSize := rm.config.ReplicationChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if chunkSize > comm.MaxPayloadLength/2 {
+		chunkSize = comm.MaxPayloadLength / 2
+	}
+	return chunkSize
+}
+
+//stagedPath returns where partially received file is kept until it is complete
+func (rm *ReplicationManager) stagedPath(path, checksum string) string {
+	pathHash := sha256.Sum256([]byte(path))
+	return p.Join(rm.stagingDir(), hex.EncodeToString(pathHash[:16])+"-"+checksum+".part")
+}
+
+func fileInfo(filePath, path string) (info comm.MessageFileInfo, err error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return info, err
+	}
+	size, checksum, err := fileChecksum(filePath)
+	if err != nil {
+		return info, err
+	}
+	return comm.MessageFileInfo{
+		Path:     path,
+		Size:     size,
+		Checksum: checksum,
+		ModTime:  stat.ModTime(),
+	}, nil
+}
+
+func fileChecksum(filePath string) (size int64, checksum string, err error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return
+		return 0, "", err
 	}
 	defer file.Close()
 
-	fileData, err := ioutil.ReadAll(file)
+	hash := sha256.New()
+	size, err = io.Copy(hash, file)
 	if err != nil {
-		return
+		return 0, "", err
 	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	rm.mutex.Lock()
-	waitChan := make(chan bool, 1)
-	rm.replicationMap[path] = &replicationInfo{
-		WaitChan:        waitChan,
-		ReplicatedCount: len(rm.nodeManager.NodeNames()),
+//ReplicateFile streams file to the listed nodes in chunks and waits until they store it.
+//It returns nodes that received the file.
+func (rm *ReplicationManager) ReplicateFile(ctx context.Context, path string, nodeNames []string) (replicated []string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, rm.config.Timeouts.Replication.Or(defaultReplicationTimeout))
+	defer cancel()
+
+	filePath := p.Join(rm.config.UploadDir, path)
+	info, err := fileInfo(filePath, path)
+	if err != nil {
+		return nil, err
 	}
-	rm.mutex.Unlock()
 
-	msg := comm.Message{Type: comm.MessageTypeFile}
-	messageFile := comm.MessageFile{
-		Path:     path,
-		FileData: fileData,
+	type result struct {
+		nodeName string
+		err      error
+	}
+	results := make(chan result, len(nodeNames))
+	for _, nodeName := range nodeNames {
+		go func(nodeName string) {
+			results <- result{nodeName, rm.replicateTo(ctx, info, filePath, nodeName)}
+		}(nodeName)
 	}
-	msg.EncodeData(messageFile)
 
-	rm.msgHub.Broadcast(msg)
+	for range nodeNames {
+		result := <-results
+		if result.err == nil {
+			replicated = append(replicated, result.nodeName)
+		} else if err == nil {
+			err = fmt.Errorf("replication of %s to %s failed: %w", path, result.nodeName, result.err)
+		}
+	}
+	return replicated, err
+}
 
-	<-waitChan
+//replicateTo sends file to a single node, resuming after failures from the last acknowledged offset
+func (rm *ReplicationManager) replicateTo(ctx context.Context, info comm.MessageFileInfo, filePath, nodeName string) error {
+	delay := minRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := rm.sendFile(ctx, info, filePath, nodeName)
+		if err == nil {
+			return nil
+		}
+		if rm.nodeManager.NodeState(nodeName) == node.NodeStateDead {
+			return comm.ErrorNodeIsDead
+		}
+		if attempt == maxSendAttempts || err == ErrorChecksumMismatch || err == ErrorFileIsDeleted {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
 
-func (rm *ReplicationManager) HandleMessage(msg *comm.Message) {
-	rm.mutex.Lock()
-	defer rm.mutex.Unlock()
+func (rm *ReplicationManager) sendFile(ctx context.Context, info comm.MessageFileInfo, filePath, nodeName string) error {
+	rm.statusManager.TransferStarted()
+	defer rm.statusManager.TransferFinished()
+
+	stream, err := rm.msgHub.OpenStream(nodeName)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	msg := comm.Message{Type: comm.MessageTypeRequestFileOffset}
+	msg.EncodeData(info)
+	reply, err := stream.Request(ctx, msg)
+	if err != nil {
+		return err
+	}
+	var fileOffset comm.MessageFileOffset
+	err = reply.DecodeData(&fileOffset)
+	if err != nil {
+		return err
+	}
+
+	offset := fileOffset.Offset
+	buf := make([]byte, rm.chunkSize())
+	for offset < info.Size {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		msg := comm.Message{Type: comm.MessageTypeFileChunk}
+		msg.EncodeData(comm.MessageFileChunk{
+			Path:     info.Path,
+			Checksum: info.Checksum,
+			Offset:   offset,
+			Data:     buf[:n],
+		})
+		reply, err := stream.Request(ctx, msg)
+		if err != nil {
+			return err
+		}
+		var ack comm.MessageFileChunkAck
+		err = reply.DecodeData(&ack)
+		if err != nil {
+			return err
+		}
+		if ack.Error != "" {
+			return errors.New(ack.Error)
+		}
+		offset = ack.Offset
+	}
+
+	msg = comm.Message{Type: comm.MessageTypeCommitFile}
+	msg.EncodeData(info)
+	reply, err = stream.Request(ctx, msg)
+	if err != nil {
+		return err
+	}
+	var committed comm.MessageFileCommitted
+	err = reply.DecodeData(&committed)
+	if err != nil {
+		return err
+	}
+	switch committed.Error {
+	case ErrorChecksumMismatch.Error():
+		return ErrorChecksumMismatch
+	case ErrorFileIsDeleted.Error():
+		return ErrorFileIsDeleted
+	}
+	if committed.Error != "" {
+		return errors.New(committed.Error)
+	}
+	return nil
+}
 
+func (rm *ReplicationManager) HandleStreamMessage(msg *comm.Message) comm.Message {
 	switch msg.Type {
-	case comm.MessageTypeFile:
-		var fileMessage comm.MessageFile
-		msg.DecodeData(&fileMessage)
+	case comm.MessageTypeRequestFileOffset:
+		var info comm.MessageFileInfo
+		msg.DecodeData(&info)
+		response := comm.MessageFileOffset{Path: info.Path}
+
+		stagedPath := rm.stagedPath(info.Path, info.Checksum)
+		if stat, err := os.Stat(stagedPath); err == nil {
+			if stat.Size() <= info.Size {
+				response.Offset = stat.Size()
+			} else {
+				os.Remove(stagedPath)
+			}
+		}
 
-		uploadPath := p.Join(rm.config.UploadDir, fileMessage.Path)
+		responseMsg := comm.Message{Type: comm.MessageTypeFileOffset}
+		responseMsg.EncodeData(response)
+		return responseMsg
 
-		err := os.MkdirAll(p.Dir(uploadPath), 0755)
+	case comm.MessageTypeFileChunk:
+		var chunk comm.MessageFileChunk
+		msg.DecodeData(&chunk)
+		offset, err := rm.writeChunk(chunk)
+		response := comm.MessageFileChunkAck{
+			Path:   chunk.Path,
+			Offset: offset,
+		}
 		if err != nil {
-			return
+			response.Error = err.Error()
 		}
 
-		resultFile, err := os.Create(uploadPath)
+		responseMsg := comm.Message{Type: comm.MessageTypeFileChunkAck}
+		responseMsg.EncodeData(response)
+		return responseMsg
+
+	case comm.MessageTypeCommitFile:
+		var info comm.MessageFileInfo
+		msg.DecodeData(&info)
+		response := comm.MessageFileCommitted{Path: info.Path}
+		err := rm.commitFile(info)
 		if err != nil {
-			return
+			response.Error = err.Error()
 		}
 
-		resultFile.Write(fileMessage.FileData)
+		responseMsg := comm.Message{Type: comm.MessageTypeFileCommitted}
+		responseMsg.EncodeData(response)
+		return responseMsg
+	}
+	return comm.Message{}
+}
+
+//writeChunk appends chunk to the staged file and returns offset of the next expected chunk.
+//Chunks that do not continue the staged file are not written, the sender resumes from returned offset.
+func (rm *ReplicationManager) writeChunk(chunk comm.MessageFileChunk) (offset int64, err error) {
+	stagedPath := rm.stagedPath(chunk.Path, chunk.Checksum)
+	err = os.MkdirAll(p.Dir(stagedPath), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(stagedPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() != chunk.Offset {
+		return stat.Size(), nil
+	}
+
+	n, err := file.WriteAt(chunk.Data, chunk.Offset)
+	return chunk.Offset + int64(n), err
+}
+
+//commitFile verifies the staged file and atomically moves it into UploadDir.
+//Files that were deleted after they had been uploaded are refused.
+func (rm *ReplicationManager) commitFile(info comm.MessageFileInfo) error {
+	stagedPath := rm.stagedPath(info.Path, info.Checksum)
+	if rm.catalog.IsDeleted(info.Path, info.ModTime) {
+		os.Remove(stagedPath)
+		return ErrorFileIsDeleted
+	}
+	if info.Size == 0 {
+		//Empty files have no chunks
+		_, err := rm.writeChunk(comm.MessageFileChunk{Path: info.Path, Checksum: info.Checksum})
 		if err != nil {
-			resultFile.Close()
-			os.Remove(uploadPath)
-		}
-		responseMsg := comm.Message{Type: comm.MessageTypeFileReceived}
-		fileReceived := comm.MessageFileReceived{
-			Path: fileMessage.Path,
-		}
-		responseMsg.EncodeData(fileReceived)
-		rm.msgHub.Send(responseMsg, msg.SourceNode)
-
-	case comm.MessageTypeFileReceived:
-		var fileReceived comm.MessageFileReceived
-		msg.DecodeData(&fileReceived)
-		rm.replicationMap[fileReceived.Path].ReplicatedCount--
-		if rm.replicationMap[fileReceived.Path].ReplicatedCount == 0 {
-			rm.replicationMap[fileReceived.Path].WaitChan <- true
-			delete(rm.replicationMap, fileReceived.Path)
+			return err
+		}
+	}
+	size, checksum, err := fileChecksum(stagedPath)
+	if err != nil {
+		return err
+	}
+	if size != info.Size || checksum != info.Checksum {
+		os.Remove(stagedPath)
+		return ErrorChecksumMismatch
+	}
+
+	os.Chtimes(stagedPath, info.ModTime, info.ModTime)
+
+	uploadPath := p.Join(rm.config.UploadDir, info.Path)
+	err = os.MkdirAll(p.Dir(uploadPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(stagedPath, uploadPath)
+}
+
+func (rm *ReplicationManager) removeStaleStagedFiles() {
+	files, err := ioutil.ReadDir(rm.stagingDir())
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		//Directories belong to other kinds of staged uploads that expire on their own
+		if !file.IsDir() && time.Since(file.ModTime()) > stagedFileTTL {
+			os.Remove(p.Join(rm.stagingDir(), file.Name()))
 		}
 	}
 }
@@ -0,0 +1,167 @@
+package replication
+
+import (
+	"crypto/sha256"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/meta"
+	"dfs/server/node"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPath = "bucket/file"
+
+//newTestReplicationManager returns the receiving side of replication, catalog holds the given records
+func newTestReplicationManager(t *testing.T, objects ...meta.ObjectMeta) *ReplicationManager {
+	t.Helper()
+	config := &c.Config{UploadDir: filepath.Join(t.TempDir(), "upload")}
+	config.This.Name = "one"
+	nodeManager := &node.NodeManager{}
+	nodeManager.UseConfig(config)
+
+	snapshot := struct{ Objects map[string]meta.ObjectMeta }{make(map[string]meta.ObjectMeta, 0)}
+	for _, object := range objects {
+		snapshot.Objects[object.Path] = object
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := &meta.Catalog{}
+	if err := catalog.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+
+	rm := &ReplicationManager{nodeManager: nodeManager, catalog: catalog}
+	rm.UseConfig(config)
+	return rm
+}
+
+//request handles the stream message carrying data and decodes the response into reply
+func request(t *testing.T, rm *ReplicationManager, msgType comm.MessageType, data, reply interface{}) {
+	t.Helper()
+	msg := comm.Message{Type: msgType}
+	if err := msg.EncodeData(data); err != nil {
+		t.Fatal(err)
+	}
+	response := rm.HandleStreamMessage(&msg)
+	if err := response.DecodeData(reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFileInfo(data []byte, modTime time.Time) comm.MessageFileInfo {
+	checksum := sha256.Sum256(data)
+	return comm.MessageFileInfo{Path: testPath, Size: int64(len(data)), Checksum: hex.EncodeToString(checksum[:]), ModTime: modTime}
+}
+
+func sendChunk(t *testing.T, rm *ReplicationManager, info comm.MessageFileInfo, offset int64, data []byte) int64 {
+	t.Helper()
+	var ack comm.MessageFileChunkAck
+	request(t, rm, comm.MessageTypeFileChunk, comm.MessageFileChunk{Path: info.Path, Checksum: info.Checksum, Offset: offset, Data: data}, &ack)
+	if ack.Error != "" {
+		t.Fatalf("chunk at %d: got error %s", offset, ack.Error)
+	}
+	return ack.Offset
+}
+
+func TestChunkResume(t *testing.T) {
+	data := []byte("0123456789")
+	rm := newTestReplicationManager(t)
+	info := newTestFileInfo(data, time.Now())
+
+	steps := []struct {
+		name   string
+		offset int64
+		end    int64
+		//ack is the offset the receiver expects next
+		ack int64
+	}{
+		{name: "first chunk", offset: 0, end: 4, ack: 4},
+		{name: "chunk sent again", offset: 0, end: 4, ack: 4},
+		{name: "chunk past the end", offset: 6, end: 10, ack: 4},
+		{name: "next chunk", offset: 4, end: 8, ack: 8},
+	}
+	for _, step := range steps {
+		if ack := sendChunk(t, rm, info, step.offset, data[step.offset:step.end]); ack != step.ack {
+			t.Fatalf("%s: got offset %d, want %d", step.name, ack, step.ack)
+		}
+	}
+
+	//Sender which lost the connection asks where to resume from
+	var fileOffset comm.MessageFileOffset
+	request(t, rm, comm.MessageTypeRequestFileOffset, info, &fileOffset)
+	if fileOffset.Offset != 8 {
+		t.Fatalf("got resume offset %d, want 8", fileOffset.Offset)
+	}
+	sendChunk(t, rm, info, 8, data[8:])
+
+	var committed comm.MessageFileCommitted
+	request(t, rm, comm.MessageTypeCommitFile, info, &committed)
+	if committed.Error != "" {
+		t.Fatalf("got commit error %s", committed.Error)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(rm.config.UploadDir, testPath))
+	if err != nil || string(stored) != string(data) {
+		t.Fatalf("got stored file %q, %v, want %q", stored, err, data)
+	}
+}
+
+func TestCommitFile(t *testing.T) {
+	data := []byte("0123456789")
+	uploaded := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name string
+		//sent is what the receiver got in chunks
+		sent    []byte
+		info    comm.MessageFileInfo
+		objects []meta.ObjectMeta
+		err     error
+	}{
+		{name: "complete file", sent: data, info: newTestFileInfo(data, uploaded)},
+		{name: "empty file", info: newTestFileInfo(nil, uploaded)},
+		{name: "corrupted chunk", sent: []byte("0123x56789"), info: newTestFileInfo(data, uploaded), err: ErrorChecksumMismatch},
+		{name: "missing chunk", sent: data[:4], info: newTestFileInfo(data, uploaded), err: ErrorChecksumMismatch},
+		{
+			name:    "deleted after upload",
+			sent:    data,
+			info:    newTestFileInfo(data, uploaded),
+			objects: []meta.ObjectMeta{{Path: testPath, Deleted: true, Modified: uploaded.Add(time.Second)}},
+			err:     ErrorFileIsDeleted,
+		},
+		{
+			name:    "uploaded again after delete",
+			sent:    data,
+			info:    newTestFileInfo(data, uploaded),
+			objects: []meta.ObjectMeta{{Path: testPath, Deleted: true, Modified: uploaded.Add(-time.Second)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rm := newTestReplicationManager(t, test.objects...)
+			if len(test.sent) > 0 {
+				sendChunk(t, rm, test.info, 0, test.sent)
+			}
+
+			err := rm.commitFile(test.info)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			_, statErr := os.Stat(filepath.Join(rm.config.UploadDir, testPath))
+			if stored := statErr == nil; stored != (test.err == nil) {
+				t.Fatalf("got file stored %v after commit error %v", stored, err)
+			}
+			//Refused file is not resumed from the staged data
+			if _, statErr := os.Stat(rm.stagedPath(test.info.Path, test.info.Checksum)); !os.IsNotExist(statErr) {
+				t.Fatalf("staged file is kept after commit: %v", statErr)
+			}
+		})
+	}
+}
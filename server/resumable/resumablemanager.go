@@ -0,0 +1,295 @@
+package resumable
+
+import (
+	"crypto/rand"
+	c "dfs/config"
+	sp "dfs/server/path"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	p "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResumableUploadTTL = 24 * time.Hour
+	defaultReaperInterval     = time.Minute
+	//sessionsDir is the directory of the staging dir that keeps resumable uploads
+	sessionsDir = "resumable"
+	infoSuffix  = ".info"
+	dataSuffix  = ".data"
+)
+
+var (
+	ErrorUploadDoesNotExist   = errors.New("Resumable upload does not exist.")
+	ErrorUploadIsBusy         = errors.New("Resumable upload is receiving another chunk.")
+	ErrorOffsetMismatch       = errors.New("Chunk offset does not match offset of the upload.")
+	ErrorUploadLengthExceeded = errors.New("Chunk exceeds length of the upload.")
+)
+
+//Session is the resumable upload of the file reserved by an upload token.
+//Data received so far is staged outside of the upload dir, Offset is its size.
+type Session struct {
+	ID          string
+	Path        string
+	Fence       uint64
+	Replicas    []string
+	Length      int64
+	ContentType string
+	//Metadata is the metadata the client created the upload with, it is returned to the client as is
+	Metadata string
+	Created  time.Time
+
+	Offset  int64     `json:"-"`
+	Updated time.Time `json:"-"`
+	Expires time.Time `json:"-"`
+}
+
+//entry is the session with the flag telling whether a chunk is being written to it
+type entry struct {
+	Session
+	busy bool
+}
+
+//ResumableManager keeps resumable uploads of this node. Sessions are stored in the staging dir,
+//so uploads survive restarts, and expire if they receive no chunk for ResumableUploadTTL.
+type ResumableManager struct {
+	mutex       sync.Mutex
+	config      *c.Config
+	pathManager *sp.PathManager
+	sessions    map[string]*entry
+}
+
+func (rm *ResumableManager) UseConfig(config *c.Config) {
+	rm.config = config
+}
+
+//Listen loads sessions left from the previous run and starts aborting expired ones
+func (rm *ResumableManager) Listen(pathManager *sp.PathManager) {
+	rm.pathManager = pathManager
+	rm.sessions = make(map[string]*entry, 0)
+	rm.load()
+
+	go func() {
+		ticker := time.Tick(rm.config.TokenReaperInterval.Or(defaultReaperInterval))
+		for {
+			<-ticker
+			rm.abortExpired()
+		}
+	}()
+}
+
+func (rm *ResumableManager) ttl() time.Duration {
+	return rm.config.ResumableUploadTTL.Or(defaultResumableUploadTTL)
+}
+
+func (rm *ResumableManager) dir() string {
+	return p.Join(rm.config.StagingPath(), sessionsDir)
+}
+
+func (rm *ResumableManager) infoPath(id string) string {
+	return p.Join(rm.dir(), id+infoSuffix)
+}
+
+//DataPath returns where the data of the session is staged
+func (rm *ResumableManager) DataPath(id string) string {
+	return p.Join(rm.dir(), id+dataSuffix)
+}
+
+func (rm *ResumableManager) load() {
+	files, err := ioutil.ReadDir(rm.dir())
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), infoSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), infoSuffix)
+		data, err := ioutil.ReadFile(rm.infoPath(id))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		var loaded entry
+		err = json.Unmarshal(data, &loaded.Session)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		stat, err := os.Stat(rm.DataPath(id))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		loaded.Offset = stat.Size()
+		loaded.Updated = stat.ModTime()
+		rm.sessions[id] = &loaded
+	}
+}
+
+//snapshot returns copy of the session with its expiration time. Must be called with rm.mutex held.
+func (rm *ResumableManager) snapshot(s *entry) Session {
+	session := s.Session
+	session.Expires = s.Updated.Add(rm.ttl())
+	return session
+}
+
+//Create stores new session with empty data and returns it with the ID assigned
+func (rm *ResumableManager) Create(session Session) (Session, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Session{}, err
+	}
+	session.ID = hex.EncodeToString(id)
+	session.Created = time.Now()
+	session.Updated = session.Created
+	session.Offset = 0
+
+	err = os.MkdirAll(rm.dir(), 0755)
+	if err != nil {
+		return Session{}, err
+	}
+	info, err := json.Marshal(session)
+	if err != nil {
+		return Session{}, err
+	}
+	err = ioutil.WriteFile(rm.infoPath(session.ID), info, 0644)
+	if err != nil {
+		return Session{}, err
+	}
+	data, err := os.Create(rm.DataPath(session.ID))
+	if err != nil {
+		os.Remove(rm.infoPath(session.ID))
+		return Session{}, err
+	}
+	data.Close()
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.sessions[session.ID] = &entry{Session: session}
+	return rm.snapshot(rm.sessions[session.ID]), nil
+}
+
+//Get returns the session without acquiring it
+func (rm *ResumableManager) Get(id string) (Session, error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	s, exists := rm.sessions[id]
+	if !exists {
+		return Session{}, ErrorUploadDoesNotExist
+	}
+	return rm.snapshot(s), nil
+}
+
+//Acquire reserves the session for a single writer, it must be released once the chunk is written
+func (rm *ResumableManager) Acquire(id string) (Session, error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	s, exists := rm.sessions[id]
+	if !exists {
+		return Session{}, ErrorUploadDoesNotExist
+	}
+	if s.busy {
+		return Session{}, ErrorUploadIsBusy
+	}
+	s.busy = true
+	return rm.snapshot(s), nil
+}
+
+func (rm *ResumableManager) Release(id string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if s, exists := rm.sessions[id]; exists {
+		s.busy = false
+	}
+}
+
+//Append writes the chunk at offset of the acquired session. Data received before the chunk breaks is kept,
+//so the client resumes from the returned offset. Chunk going over the length is rejected as a whole.
+func (rm *ResumableManager) Append(id string, offset int64, chunk io.Reader) (Session, error) {
+	rm.mutex.Lock()
+	s, exists := rm.sessions[id]
+	rm.mutex.Unlock()
+	if !exists {
+		return Session{}, ErrorUploadDoesNotExist
+	}
+	if offset != s.Offset {
+		return Session{}, ErrorOffsetMismatch
+	}
+
+	data, err := os.OpenFile(rm.DataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return Session{}, err
+	}
+	_, err = data.Seek(offset, io.SeekStart)
+	if err != nil {
+		data.Close()
+		return Session{}, err
+	}
+	remaining := s.Length - offset
+	written, err := io.Copy(data, io.LimitReader(chunk, remaining+1))
+	if err == nil && written > remaining {
+		err = data.Truncate(offset)
+		written = 0
+		if err == nil {
+			err = ErrorUploadLengthExceeded
+		}
+	}
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	s.Offset += written
+	s.Updated = time.Now()
+	return rm.snapshot(s), err
+}
+
+//Remove forgets the session and deletes its staged data
+func (rm *ResumableManager) Remove(id string) {
+	rm.mutex.Lock()
+	delete(rm.sessions, id)
+	rm.mutex.Unlock()
+	os.Remove(rm.DataPath(id))
+	os.Remove(rm.infoPath(id))
+}
+
+//Abort removes the session and releases the path it was uploading for the reason
+func (rm *ResumableManager) Abort(id, reason string) error {
+	session, err := rm.Get(id)
+	if err != nil {
+		return err
+	}
+	rm.Remove(id)
+	return rm.pathManager.AbortUpload(session.Path, session.Fence, reason)
+}
+
+func (rm *ResumableManager) abortExpired() {
+	now := time.Now()
+	expired := make([]string, 0)
+	rm.mutex.Lock()
+	for id, s := range rm.sessions {
+		if !s.busy && now.After(rm.snapshot(s).Expires) {
+			//Expired session is kept busy until it is removed, so no chunk is written to it meanwhile
+			s.busy = true
+			expired = append(expired, id)
+		}
+	}
+	rm.mutex.Unlock()
+
+	for _, id := range expired {
+		err := rm.Abort(id, "resumable upload expired")
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
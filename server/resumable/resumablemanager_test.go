@@ -0,0 +1,135 @@
+package resumable
+
+import (
+	"bytes"
+	c "dfs/config"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestResumableManager(t *testing.T) *ResumableManager {
+	t.Helper()
+	rm := &ResumableManager{sessions: make(map[string]*entry, 0)}
+	rm.UseConfig(&c.Config{StagingDir: t.TempDir()})
+	return rm
+}
+
+//brokenReader returns the data and then fails like a connection that dropped
+type brokenReader struct {
+	io.Reader
+}
+
+func (r brokenReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestAppend(t *testing.T) {
+	rm := newTestResumableManager(t)
+	session, err := rm.Create(Session{Path: "bucket/file", Length: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		offset int64
+		chunk  io.Reader
+		err    error
+		//result is the offset of the upload after the chunk
+		result int64
+	}{
+		{name: "first chunk", offset: 0, chunk: strings.NewReader("0123"), result: 4},
+		{name: "chunk sent again", offset: 0, chunk: strings.NewReader("0123"), err: ErrorOffsetMismatch, result: 4},
+		{name: "chunk past the offset", offset: 6, chunk: strings.NewReader("6789"), err: ErrorOffsetMismatch, result: 4},
+		{name: "broken chunk keeps received data", offset: 4, chunk: brokenReader{strings.NewReader("45")}, err: errors.New("connection reset"), result: 6},
+		{name: "chunk over the length", offset: 6, chunk: strings.NewReader("6789x"), err: ErrorUploadLengthExceeded, result: 6},
+		{name: "last chunk", offset: 6, chunk: strings.NewReader("6789"), result: 10},
+	}
+	for _, step := range steps {
+		if _, err := rm.Acquire(session.ID); err != nil {
+			t.Fatalf("%s: got error %v of acquire", step.name, err)
+		}
+		result, err := rm.Append(session.ID, step.offset, step.chunk)
+		rm.Release(session.ID)
+		if (err == nil) != (step.err == nil) || (err != nil && err.Error() != step.err.Error()) {
+			t.Fatalf("%s: got error %v, want %v", step.name, err, step.err)
+		}
+		if current, _ := rm.Get(session.ID); current.Offset != step.result || (err == nil && result.Offset != step.result) {
+			t.Fatalf("%s: got offset %d, want %d", step.name, current.Offset, step.result)
+		}
+	}
+	data, err := ioutil.ReadFile(rm.DataPath(session.ID))
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("got staged data %q, %v", data, err)
+	}
+}
+
+func TestAcquireBusy(t *testing.T) {
+	rm := newTestResumableManager(t)
+	session, err := rm.Create(Session{Path: "bucket/file", Length: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.Acquire(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.Acquire(session.ID); err != ErrorUploadIsBusy {
+		t.Fatalf("got error %v of second writer, want %v", err, ErrorUploadIsBusy)
+	}
+	rm.Release(session.ID)
+	if _, err := rm.Acquire(session.ID); err != nil {
+		t.Fatalf("got error %v after release", err)
+	}
+	if _, err := rm.Acquire("unknown"); err != ErrorUploadDoesNotExist {
+		t.Fatalf("got error %v of unknown upload, want %v", err, ErrorUploadDoesNotExist)
+	}
+}
+
+//TestLoad checks that uploads are resumed after restart from the offset of the staged data
+func TestLoad(t *testing.T) {
+	rm := newTestResumableManager(t)
+	session, err := rm.Create(Session{Path: "bucket/file", Length: 10, Metadata: "filename ZmlsZQ=="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.Append(session.ID, 0, bytes.NewReader([]byte("0123"))); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &ResumableManager{sessions: make(map[string]*entry, 0)}
+	restarted.UseConfig(rm.config)
+	restarted.load()
+	loaded, err := restarted.Get(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Offset != 4 || loaded.Length != 10 || loaded.Path != session.Path || loaded.Metadata != session.Metadata {
+		t.Fatalf("got session %+v after restart, want %+v at offset 4", loaded, session)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	rm := newTestResumableManager(t)
+	session, err := rm.Create(Session{Path: "bucket/file", Length: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.Remove(session.ID)
+
+	if _, err := rm.Get(session.ID); err != ErrorUploadDoesNotExist {
+		t.Fatalf("got error %v of terminated upload, want %v", err, ErrorUploadDoesNotExist)
+	}
+	for _, path := range []string{rm.DataPath(session.ID), rm.infoPath(session.ID)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s is kept after termination: %v", path, err)
+		}
+	}
+}
@@ -1,38 +1,68 @@
 package server
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
 	"dfs/comm"
 	c "dfs/config"
 	"dfs/server/lock"
+	"dfs/server/meta"
+	mp "dfs/server/multipart"
 	"dfs/server/node"
 	sp "dfs/server/path"
+	"dfs/server/raft"
 	"dfs/server/replication"
+	rs "dfs/server/resumable"
 	"dfs/server/status"
-	"dfs/server/token"
+	st "dfs/server/token"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"mime/multipart"
+	"log"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	ErrorFileAlreadyExists    = errors.New("File already exists.")
+	ErrorPathConflict         = errors.New("Path is a directory of another file or lies under another file.")
 	ErrorPathIsLocked         = errors.New("Upload path is locked.")
+	ErrorPathIsNotLocked      = errors.New("Upload path is not locked.")
 	ErrorFileDoesNotExist     = errors.New("File does not exist.")
 	ErrorFailedToRequestToken = errors.New("Failed to request token.")
+	ErrorNoNodeAvailable      = errors.New("No node is available.")
+	ErrorFileTooLarge         = errors.New("File is too large.")
+	ErrorReservedFileName     = errors.New("File name must not contain \"" + tempSeparator + "\".")
 )
 
+const (
+	commitAttempts      = 10
+	commitRetryInterval = 3 * time.Second
+)
+
+//tempSeparator joins path of the file and fencing token of the upload in the name the file is written aside under,
+//file names are refused if they contain it, so the file written aside never takes place of another file
+const tempSeparator = "~"
+
 type Server struct {
 	sync.Mutex
 	config             c.Config
 	statusManager      status.StatusManager
 	nodeManager        node.NodeManager
-	tokenManager       token.TokenManager
+	tokenManager       st.TokenManager
 	lockManager        lock.LockManager
 	replicationManager replication.ReplicationManager
+	catalog            meta.Catalog
+	raft               raft.Raft
 	pathManager        sp.PathManager
+	resumableManager   rs.ResumableManager
+	multipartManager   mp.MultipartManager
 	msgHub             comm.MessageHub
 }
 
@@ -40,117 +70,803 @@ func (server *Server) Start(config c.Config) {
 	server.config = config
 
 	server.nodeManager.UseConfig(&server.config)
+	server.nodeManager.StartFailureDetector()
 
-	server.pathManager.UseConfig(&server.config)
-	server.pathManager.Listen(&server.nodeManager, &server.msgHub)
+	server.msgHub.UseConfig(&server.config)
 
 	server.statusManager.UseConfig(&server.config)
 	server.statusManager.Listen(&server.nodeManager, &server.msgHub)
 
 	server.tokenManager.UseConfig(&server.config)
-	server.tokenManager.Listen(
+	err := server.tokenManager.Listen(&server.nodeManager, &server.statusManager)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server.raft.UseConfig(&server.config)
+
+	server.pathManager.UseConfig(&server.config)
+	server.pathManager.Listen(&server.nodeManager, &server.raft)
+
+	server.resumableManager.UseConfig(&server.config)
+	server.resumableManager.Listen(&server.pathManager)
+
+	server.multipartManager.UseConfig(&server.config)
+	server.multipartManager.Listen(
 		&server.nodeManager,
-		&server.statusManager,
 		&server.pathManager,
+		&server.raft,
 		&server.msgHub)
 
 	server.lockManager.UseConfig(&server.config)
-	server.lockManager.Listen(&server.nodeManager, &server.msgHub)
+	server.lockManager.Listen(&server.nodeManager, &server.raft)
+
+	server.catalog.UseConfig(&server.config)
+	server.catalog.Listen(&server.raft)
 
 	server.replicationManager.UseConfig(&server.config)
-	server.replicationManager.Listen(&server.nodeManager, &server.statusManager, &server.msgHub)
+	server.replicationManager.Listen(
+		&server.nodeManager,
+		&server.statusManager,
+		&server.catalog,
+		&server.msgHub)
 
-	server.msgHub.Listen(&server.nodeManager, config.This.PrivateAddress)
+	err = server.raft.Listen(&server.nodeManager, &server.msgHub)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = server.msgHub.Listen(&server.nodeManager, config.This.PrivateAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (server *Server) RequestUpload(bucketName, fileName string) (address, token string, err error) {
+//RequestUpload reserves the path and issues upload token for it.
+//Options narrow lifetime and scope of the token, clientIP is the address the token is bound to if it asks so.
+func (server *Server) RequestUpload(ctx context.Context, bucketName, fileName string, options st.TokenOptions, clientIP string) (address, token string, err error) {
 	server.statusManager.CountRequest()
 
+	options, err = server.tokenManager.Options(bucketName, "upload", options)
+	if err != nil {
+		return "", "", err
+	}
+
 	uploadPath := path.Join(bucketName, fileName)
+	if strings.Contains(uploadPath, tempSeparator) {
+		return "", "", ErrorReservedFileName
+	}
 
-	err = server.lockManager.LockResource("path:" + uploadPath)
+	lease, err := server.lockManager.LockResource(ctx, "path:"+uploadPath, lock.LockExclusive)
 	if err != nil {
 		return "", "", err
 	}
-	defer server.lockManager.UnlockResource("path:" + uploadPath)
+	defer server.lockManager.UnlockResource(lease)
 
 	if server.pathManager.IsLocked(uploadPath) {
 		return "", "", ErrorPathIsLocked
 	}
 
-	server.pathManager.LockPath(uploadPath)
+	if _, exists := server.catalog.Get(uploadPath); exists && !options.Overwrite {
+		return "", "", ErrorFileAlreadyExists
+	}
+	if server.catalog.IsNested(uploadPath) {
+		return "", "", ErrorPathConflict
+	}
 
-	nodeName := server.statusManager.ChooseNodeForUpload()
-	token = server.tokenManager.RequestToken(uploadPath, nodeName, "upload")
+	expires := time.Now().Add(options.TTL)
+	err = server.pathManager.LockPath(ctx, uploadPath, lease.Token, expires)
+	if err != nil {
+		return "", "", err
+	}
 
-	if token == "" {
+	replicationFactor := server.replicationManager.ReplicationFactor(bucketName)
+	replicas := server.statusManager.ChooseNodesForUpload(uploadPath, replicationFactor)
+	if len(replicas) == 0 {
+		server.pathManager.AbortUpload(uploadPath, lease.Token, ErrorNoNodeAvailable.Error())
+		return "", "", ErrorNoNodeAvailable
+	}
+	nodeName := replicas[0]
+	token, err = server.tokenManager.IssueToken(st.TokenInfo{
+		Type:        "upload",
+		Path:        uploadPath,
+		Node:        nodeName,
+		Replicas:    replicas,
+		Fence:       lease.Token,
+		MaxSize:     options.MaxSize,
+		ExpireTime:  expires,
+		MaxUses:     options.MaxUses,
+		ClientIP:    boundIP(options, clientIP),
+		Methods:     options.Methods,
+		ContentType: options.ContentType,
+	})
+	if err != nil {
+		server.pathManager.AbortUpload(uploadPath, lease.Token, ErrorFailedToRequestToken.Error())
 		return "", "", ErrorFailedToRequestToken
 	}
 
 	return server.nodeManager.Node(nodeName).PublicAddress, token, nil
 }
 
-func (server *Server) Upload(token string, file multipart.File, fileHeader *multipart.FileHeader) (err error) {
+//Upload stores the file the token was issued for and replicates it.
+//The upload is committed once the file is in the catalog, otherwise it is aborted, either way its path is released.
+//Content type of the file is taken from access and defaults to application/octet-stream.
+func (server *Server) Upload(ctx context.Context, token string, access st.Access, file io.Reader) (object meta.ObjectMeta, err error) {
 	server.statusManager.CountRequest()
+	server.statusManager.TransferStarted()
+	defer server.statusManager.TransferFinished()
 
-	uploadPath, err := server.tokenManager.GetPathByToken(token, "upload")
+	tokenInfo, err := server.tokenManager.GetTokenInfo(token, "upload", access)
 	if err != nil {
-		return err
+		return meta.ObjectMeta{}, err
+	}
+	uploadPath := tokenInfo.Path
+	contentType := access.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	leaseLost, stopLease, err := server.pathManager.StartUpload(ctx, uploadPath, tokenInfo.Fence)
+	if err != nil {
+		return meta.ObjectMeta{}, err
 	}
+	defer stopLease()
+	defer func() {
+		if err != nil {
+			server.pathManager.AbortUpload(uploadPath, tokenInfo.Fence, err.Error())
+		} else {
+			server.commitUpload(uploadPath, tokenInfo.Fence)
+		}
+	}()
 
 	newPath := path.Join(server.config.UploadDir, uploadPath)
 
 	err = os.MkdirAll(path.Dir(newPath), 0755)
 	if err != nil {
-		return err
+		return meta.ObjectMeta{}, err
 	}
 
-	resultFile, err := os.Create(newPath)
+	//File is written aside and renamed into place, so downloads of the file it replaces are not disturbed
+	tempPath := writeAsidePath(newPath, tokenInfo.Fence)
+	resultFile, err := os.Create(tempPath)
 	if err != nil {
-		return err
+		return meta.ObjectMeta{}, err
 	}
 
-	_, err = io.Copy(resultFile, file)
+	//One byte over the limit is read to tell files of exactly allowed size from larger ones
+	var reader io.Reader = &leasedReader{Reader: file, lost: leaseLost}
+	if tokenInfo.MaxSize > 0 {
+		reader = io.LimitReader(reader, tokenInfo.MaxSize+1)
+	}
+	hash := sha256.New()
+	md5Hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(resultFile, hash, md5Hash), reader)
+	if err == nil && tokenInfo.MaxSize > 0 && size > tokenInfo.MaxSize {
+		err = ErrorFileTooLarge
+	}
+	if closeErr := resultFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		object, err = server.install(ctx, tempPath, meta.ObjectMeta{
+			Path:        uploadPath,
+			Size:        size,
+			Checksum:    hex.EncodeToString(hash.Sum(nil)),
+			MD5:         hex.EncodeToString(md5Hash.Sum(nil)),
+			ContentType: contentType,
+			Fence:       tokenInfo.Fence,
+		}, tokenInfo.Replicas)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return meta.ObjectMeta{}, err
+	}
+	return object, nil
+}
+
+//commitUpload releases path of the upload whose file is in the catalog. The file is published already,
+//so failure to commit is not reported to the client, committing is retried in background instead.
+func (server *Server) commitUpload(uploadPath string, fence uint64) {
+	err := server.pathManager.CommitUpload(uploadPath, fence)
+	if err == nil || err == sp.ErrorUploadIsUnknown {
+		return
+	}
+	log.Printf("Failed to commit upload of %s, retrying: %v\n", uploadPath, err)
+	go func() {
+		for attempt := 1; attempt < commitAttempts; attempt++ {
+			time.Sleep(commitRetryInterval)
+			err = server.pathManager.CommitUpload(uploadPath, fence)
+			if err == nil || err == sp.ErrorUploadIsUnknown {
+				return
+			}
+		}
+		log.Printf("Failed to commit upload of %s: %v\n", uploadPath, err)
+	}()
+}
+
+func writeAsidePath(filePath string, fence uint64) string {
+	return fmt.Sprintf("%s%s%d", filePath, tempSeparator, fence)
+}
+
+//leasedReader stops receiving the upload once its lease is lost
+type leasedReader struct {
+	io.Reader
+	lost <-chan struct{}
+}
+
+func (r *leasedReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.lost:
+		return 0, sp.ErrorUploadIsUnknown
+	default:
+	}
+	return r.Reader.Read(p)
+}
+
+//install moves the file written aside into place and publishes it. The exclusive lock of the path is held meanwhile,
+//so downloads holding the shared lock neither see the file change under them nor get the old record with the new content.
+//Publishing is cancelled if the lock is lost.
+func (server *Server) install(ctx context.Context, tempPath string, object meta.ObjectMeta, replicas []string) (meta.ObjectMeta, error) {
+	lease, err := server.lockManager.LockResource(ctx, "path:"+object.Path, lock.LockExclusive)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	defer server.lockManager.UnlockResource(lease)
+	ctx, cancel := lease.Context(ctx)
+	defer cancel()
+
+	//Upload aborted meanwhile, by admin or for its lease, may have its path reserved again,
+	//so its file must not replace the file of the newer upload
+	err = server.pathManager.CheckUpload(ctx, object.Path, object.Fence)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	select {
+	case <-lease.Lost():
+		return meta.ObjectMeta{}, lock.ErrorLeaseExpired
+	default:
+	}
+	err = os.Rename(tempPath, path.Join(server.config.UploadDir, object.Path))
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	return server.publish(ctx, object, replicas)
+}
+
+//publish replicates the file written to the upload dir to the other replicas and records it in the catalog
+func (server *Server) publish(ctx context.Context, object meta.ObjectMeta, replicas []string) (meta.ObjectMeta, error) {
+	thisName := server.nodeManager.This.Name
+	targets := make([]string, 0, len(replicas))
+	for _, nodeName := range replicas {
+		if nodeName != thisName {
+			targets = append(targets, nodeName)
+		}
+	}
+
+	replicated, err := server.replicationManager.ReplicateFile(ctx, object.Path, targets)
+	if err != nil {
+		log.Println(err)
+	}
+
+	object.Replicas = append(replicated, thisName)
+	return server.catalog.Put(ctx, object)
+}
+
+//CreateResumableUpload starts resumable upload of length bytes to the path reserved by the upload token.
+//Metadata is kept for the client as is, the file gets the content type of the access.
+func (server *Server) CreateResumableUpload(ctx context.Context, token string, access st.Access, length int64, metadata string) (rs.Session, error) {
+	server.statusManager.CountRequest()
+
+	tokenInfo, err := server.tokenManager.GetTokenInfo(token, "upload", access)
+	if err != nil {
+		return rs.Session{}, err
+	}
+	if tokenInfo.MaxSize > 0 && length > tokenInfo.MaxSize {
+		server.pathManager.AbortUpload(tokenInfo.Path, tokenInfo.Fence, ErrorFileTooLarge.Error())
+		return rs.Session{}, ErrorFileTooLarge
+	}
+	contentType := access.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	//Upload in progress is not aborted when the token expires, the session expires instead
+	err = server.pathManager.StartSession(ctx, tokenInfo.Path, tokenInfo.Fence)
+	if err != nil {
+		return rs.Session{}, err
+	}
+	session, err := server.resumableManager.Create(rs.Session{
+		Path:        tokenInfo.Path,
+		Fence:       tokenInfo.Fence,
+		Replicas:    tokenInfo.Replicas,
+		Length:      length,
+		ContentType: contentType,
+		Metadata:    metadata,
+	})
+	if err != nil {
+		server.pathManager.AbortUpload(tokenInfo.Path, tokenInfo.Fence, err.Error())
+		return rs.Session{}, err
+	}
+	return session, nil
+}
+
+func (server *Server) ResumableUpload(id string) (rs.Session, error) {
+	return server.resumableManager.Get(id)
+}
+
+//WriteResumableUpload appends the chunk to the upload at offset. Once all the data is received
+//the file is moved into the upload dir and published, the object is zero until then.
+func (server *Server) WriteResumableUpload(ctx context.Context, id string, offset int64, chunk io.Reader) (session rs.Session, object meta.ObjectMeta, err error) {
+	server.statusManager.CountRequest()
+	server.statusManager.TransferStarted()
+	defer server.statusManager.TransferFinished()
+
+	session, err = server.resumableManager.Acquire(id)
+	if err != nil {
+		return rs.Session{}, meta.ObjectMeta{}, err
+	}
+	defer server.resumableManager.Release(id)
+
+	session, err = server.resumableManager.Append(id, offset, chunk)
+	if err != nil || session.Offset < session.Length {
+		return session, meta.ObjectMeta{}, err
+	}
+
+	object, err = server.completeResumableUpload(ctx, session)
+	if err != nil {
+		server.resumableManager.Abort(id, err.Error())
+		return session, meta.ObjectMeta{}, err
+	}
+	server.resumableManager.Remove(id)
+	server.commitUpload(session.Path, session.Fence)
+	return session, object, nil
+}
+
+//completeResumableUpload moves the staged data into place at once and publishes it
+func (server *Server) completeResumableUpload(ctx context.Context, session rs.Session) (meta.ObjectMeta, error) {
+	stagedPath := server.resumableManager.DataPath(session.ID)
+	stagedFile, err := os.Open(stagedPath)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	hash := sha256.New()
+	md5Hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(hash, md5Hash), stagedFile)
+	stagedFile.Close()
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+
+	newPath := path.Join(server.config.UploadDir, session.Path)
+	err = os.MkdirAll(path.Dir(newPath), 0755)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	return server.install(ctx, stagedPath, meta.ObjectMeta{
+		Path:        session.Path,
+		Size:        size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		MD5:         hex.EncodeToString(md5Hash.Sum(nil)),
+		ContentType: session.ContentType,
+		Fence:       session.Fence,
+	}, session.Replicas)
+}
+
+//TerminateResumableUpload discards the upload and releases its path
+func (server *Server) TerminateResumableUpload(id string) error {
+	server.statusManager.CountRequest()
+
+	_, err := server.resumableManager.Acquire(id)
 	if err != nil {
-		resultFile.Close()
-		os.Remove(newPath)
 		return err
 	}
+	return server.resumableManager.Abort(id, "resumable upload was terminated")
+}
+
+//InitiateMultipartUpload starts multipart upload of the path reserved by the upload token, this node assembles it.
+//The file gets the content type of the access.
+func (server *Server) InitiateMultipartUpload(ctx context.Context, token string, access st.Access) (mp.Upload, error) {
+	server.statusManager.CountRequest()
+
+	tokenInfo, err := server.tokenManager.GetTokenInfo(token, "upload", access)
+	if err != nil {
+		return mp.Upload{}, err
+	}
+	contentType := access.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	//Upload in progress is not aborted when the token expires, the multipart upload expires instead
+	err = server.pathManager.StartSession(ctx, tokenInfo.Path, tokenInfo.Fence)
+	if err != nil {
+		return mp.Upload{}, err
+	}
+	upload, err := server.multipartManager.Initiate(ctx, mp.Upload{
+		Path:        tokenInfo.Path,
+		Fence:       tokenInfo.Fence,
+		Replicas:    tokenInfo.Replicas,
+		ContentType: contentType,
+		MaxSize:     tokenInfo.MaxSize,
+	})
+	if err != nil {
+		server.pathManager.AbortUpload(tokenInfo.Path, tokenInfo.Fence, err.Error())
+		return mp.Upload{}, err
+	}
+	return upload, nil
+}
+
+func (server *Server) MultipartUpload(ctx context.Context, id string) (mp.Upload, error) {
+	return server.multipartManager.Lookup(ctx, id)
+}
 
-	resultFile.Close()
+func (server *Server) MultipartUploadExpires(upload mp.Upload) time.Time {
+	return server.multipartManager.Expires(upload)
+}
 
-	server.replicationManager.ReplicateFile(uploadPath)
+//UploadPart stores the part of the multipart upload on this node, parts are accepted by every node
+func (server *Server) UploadPart(ctx context.Context, id string, number int, data io.Reader) (mp.Part, error) {
+	server.statusManager.CountRequest()
+	server.statusManager.TransferStarted()
+	defer server.statusManager.TransferFinished()
 
-	return nil
+	return server.multipartManager.WritePart(ctx, id, number, data)
 }
 
-func (server *Server) RequestDownload(bucketName, fileName string) (address, token string, err error) {
+//CompleteMultipartUpload assembles the listed parts into the file and publishes it.
+//Only the node the upload was initiated on completes it. Upload is kept for another attempt if its parts can not be read.
+func (server *Server) CompleteMultipartUpload(ctx context.Context, id string, completed []mp.CompletedPart) (meta.ObjectMeta, error) {
 	server.statusManager.CountRequest()
+	server.statusManager.TransferStarted()
+	defer server.statusManager.TransferFinished()
+
+	upload, err := server.multipartManager.Acquire(ctx, id)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	defer server.multipartManager.Release(id)
+
+	parts, err := mp.Select(upload, completed)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	size := int64(0)
+	for _, part := range parts {
+		size += part.Size
+	}
+	if upload.MaxSize > 0 && size > upload.MaxSize {
+		return meta.ObjectMeta{}, ErrorFileTooLarge
+	}
+
+	newPath := path.Join(server.config.UploadDir, upload.Path)
+	err = os.MkdirAll(path.Dir(newPath), 0755)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	tempPath := writeAsidePath(newPath, upload.Fence)
+	resultFile, err := os.Create(tempPath)
+	if err != nil {
+		return meta.ObjectMeta{}, err
+	}
+	hash := sha256.New()
+	md5Hash := md5.New()
+	err = server.multipartManager.Assemble(ctx, id, parts, io.MultiWriter(resultFile, hash, md5Hash))
+	if closeErr := resultFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return meta.ObjectMeta{}, err
+	}
+
+	composite := md5.New()
+	for _, part := range parts {
+		partMD5, _ := hex.DecodeString(part.MD5)
+		composite.Write(partMD5)
+	}
+	object, err := server.install(ctx, tempPath, meta.ObjectMeta{
+		Path:         upload.Path,
+		Size:         size,
+		Checksum:     hex.EncodeToString(hash.Sum(nil)),
+		MD5:          hex.EncodeToString(md5Hash.Sum(nil)),
+		CompositeMD5: fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(parts)),
+		ContentType:  upload.ContentType,
+		Fence:        upload.Fence,
+	}, upload.Replicas)
+	if err != nil {
+		os.Remove(tempPath)
+		server.multipartManager.Abort(ctx, id, err.Error())
+		return meta.ObjectMeta{}, err
+	}
+	err = server.multipartManager.Finish(ctx, id)
+	if err != nil {
+		log.Println(err)
+	}
+	server.commitUpload(upload.Path, upload.Fence)
+	return object, nil
+}
+
+//AbortMultipartUpload discards the upload with its parts and releases its path
+func (server *Server) AbortMultipartUpload(ctx context.Context, id string) error {
+	server.statusManager.CountRequest()
+	return server.multipartManager.Abort(ctx, id, "multipart upload was aborted")
+}
+
+//PartAddresses returns public addresses of live nodes to spread parts of the upload among
+func (server *Server) PartAddresses(upload mp.Upload) []string {
+	addresses := make([]string, 0)
+	for _, nodeName := range server.statusManager.Owners(upload.ID, 0) {
+		addresses = append(addresses, server.NodeAddress(nodeName))
+	}
+	return addresses
+}
+
+func (server *Server) NodeAddress(nodeName string) string {
+	return server.nodeManager.Node(nodeName).PublicAddress
+}
+
+//RequestDownload issues download token for the file on one of the nodes keeping it.
+//Options narrow lifetime and scope of the token, clientIP is the address the token is bound to if it asks so.
+func (server *Server) RequestDownload(ctx context.Context, bucketName, fileName string, options st.TokenOptions, clientIP string) (address, token string, err error) {
+	server.statusManager.CountRequest()
+
+	options, err = server.tokenManager.Options(bucketName, "download", options)
+	if err != nil {
+		return "", "", err
+	}
 
 	downloadPath := path.Join(bucketName, fileName)
 
-	nodeName := server.statusManager.ChooseNodeForDownload()
-	token = server.tokenManager.RequestToken(downloadPath, nodeName, "download")
-	if token == "" {
+	object, exists := server.catalog.Get(downloadPath)
+	if !exists {
+		return "", "", ErrorFileDoesNotExist
+	}
+	nodeName := server.statusManager.ChooseNodeForDownload(object.Replicas)
+	if nodeName == "" {
+		return "", "", ErrorFileDoesNotExist
+	}
+
+	token, err = server.tokenManager.IssueToken(st.TokenInfo{
+		Type:       "download",
+		Path:       downloadPath,
+		Node:       nodeName,
+		MaxSize:    object.Size,
+		ExpireTime: time.Now().Add(options.TTL),
+		MaxUses:    options.MaxUses,
+		ClientIP:   boundIP(options, clientIP),
+		Methods:    options.Methods,
+	})
+	if err != nil {
 		return "", "", ErrorFailedToRequestToken
 	}
 
 	return server.nodeManager.Node(nodeName).PublicAddress, token, nil
 }
 
-func (server *Server) Download(token string) (downloadPath string, err error) {
+//RequestDelete issues the token letting the client delete the file, the delete must be sent to this node
+func (server *Server) RequestDelete(bucketName, fileName string, options st.TokenOptions, clientIP string) (address, token string, err error) {
+	server.statusManager.CountRequest()
+
+	options, err = server.tokenManager.Options(bucketName, "delete", options)
+	if err != nil {
+		return "", "", err
+	}
+
+	deletePath := path.Join(bucketName, fileName)
+	if _, exists := server.catalog.Get(deletePath); !exists {
+		return "", "", ErrorFileDoesNotExist
+	}
+
+	token, err = server.tokenManager.IssueToken(st.TokenInfo{
+		Type:       "delete",
+		Path:       deletePath,
+		Node:       server.nodeManager.This.Name,
+		ExpireTime: time.Now().Add(options.TTL),
+		MaxUses:    options.MaxUses,
+		ClientIP:   boundIP(options, clientIP),
+		Methods:    options.Methods,
+	})
+	if err != nil {
+		return "", "", ErrorFailedToRequestToken
+	}
+
+	return server.nodeManager.This.PublicAddress, token, nil
+}
+
+//CheckDeleteToken verifies that the token lets the request delete the file
+func (server *Server) CheckDeleteToken(token, bucketName, fileName string, access st.Access) error {
+	tokenInfo, err := server.tokenManager.GetTokenInfo(token, "delete", access)
+	if err != nil {
+		return err
+	}
+	if tokenInfo.Path != path.Join(bucketName, fileName) {
+		return st.ErrorTokenForAnotherPath
+	}
+	return nil
+}
+
+//Delete removes the file from every node keeping it.
+//It returns nodes the file was deleted on, *replication.DeleteError is returned if some of them failed.
+func (server *Server) Delete(ctx context.Context, bucketName, fileName string) (deleted []string, err error) {
+	server.statusManager.CountRequest()
+
+	deletePath := path.Join(bucketName, fileName)
+
+	lease, err := server.lockManager.LockResource(ctx, "path:"+deletePath, lock.LockExclusive)
+	if err != nil {
+		return nil, err
+	}
+	defer server.lockManager.UnlockResource(lease)
+
+	if server.pathManager.IsLocked(deletePath) {
+		return nil, ErrorPathIsLocked
+	}
+
+	object, exists, err := server.catalog.Delete(ctx, deletePath, lease.Token)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrorFileDoesNotExist
+	}
+
+	return server.replicationManager.DeleteFile(ctx, deletePath, object.Modified)
+}
+
+//CreateBucket records the bucket so that it exists while it holds no files
+func (server *Server) CreateBucket(ctx context.Context, bucketName string) error {
+	server.statusManager.CountRequest()
+	return server.catalog.CreateBucket(ctx, bucketName)
+}
+
+//DeleteBucket removes record of the bucket, meta.ErrorBucketIsNotEmpty is returned while it holds files
+func (server *Server) DeleteBucket(ctx context.Context, bucketName string) error {
+	server.statusManager.CountRequest()
+	return server.catalog.DeleteBucket(ctx, bucketName)
+}
+
+//Buckets returns records of the buckets in name order
+func (server *Server) Buckets() []meta.BucketMeta {
+	server.statusManager.CountRequest()
+	return server.catalog.BucketRecords("")
+}
+
+//BucketExists reports whether bucket was created or holds files
+func (server *Server) BucketExists(bucketName string) bool {
+	return server.catalog.BucketExists(bucketName)
+}
+
+//Object returns catalog record of the file
+func (server *Server) Object(bucketName, fileName string) (meta.ObjectMeta, error) {
+	server.statusManager.CountRequest()
+	object, exists := server.catalog.Get(path.Join(bucketName, fileName))
+	if !exists {
+		return meta.ObjectMeta{}, ErrorFileDoesNotExist
+	}
+	return object, nil
+}
+
+//ListBuckets returns names of all buckets in the cluster starting with prefix
+func (server *Server) ListBuckets(prefix string) []string {
+	server.statusManager.CountRequest()
+	return server.catalog.Buckets(prefix)
+}
+
+//ListObjects returns a page of files of the bucket starting with prefix.
+//Next page is requested with NextContinuationToken of the previous one.
+func (server *Server) ListObjects(ctx context.Context, bucketName, prefix, continuationToken string, maxKeys int) (meta.ObjectListing, error) {
+	server.statusManager.CountRequest()
+	return server.catalog.List(ctx, bucketName, prefix, continuationToken, maxKeys)
+}
+
+//Download returns path and catalog record of the file the token grants access to.
+//The file is kept from being deleted or overwritten by the shared lock until DownloadFinished is called.
+func (server *Server) Download(ctx context.Context, token string, access st.Access) (downloadPath string, object meta.ObjectMeta, lease *lock.Lease, err error) {
 	server.statusManager.CountRequest()
 
-	downloadPath, err = server.tokenManager.GetPathByToken(token, "download")
+	tokenInfo, err := server.tokenManager.GetTokenInfo(token, "download", access)
 	if err != nil {
-		return "", err
+		return "", meta.ObjectMeta{}, nil, err
 	}
 
-	downloadPath = path.Join(server.config.UploadDir, downloadPath)
+	lease, err = server.lockManager.LockResource(ctx, "path:"+tokenInfo.Path, lock.LockShared)
+	if err != nil {
+		return "", meta.ObjectMeta{}, nil, err
+	}
+	downloadPath = path.Join(server.config.UploadDir, tokenInfo.Path)
+	//Catalog tells the file exists, this node still must keep its replica
+	object, exists := server.catalog.Get(tokenInfo.Path)
+	if _, err := os.Stat(downloadPath); !exists || err != nil {
+		server.lockManager.UnlockResource(lease)
+		return "", meta.ObjectMeta{}, nil, ErrorFileDoesNotExist
+	}
+
+	server.statusManager.TransferStarted()
+
+	return downloadPath, object, lease, nil
+}
+
+//MeterDownload charges bytes read from the file of the download to its token
+func (server *Server) MeterDownload(token string, file io.ReadSeeker) io.ReadSeeker {
+	return server.tokenManager.Meter(token, file)
+}
+
+//InspectToken returns what the token issued by the cluster grants access to
+func (server *Server) InspectToken(token string) (st.TokenInfo, error) {
+	return server.tokenManager.Inspect(token)
+}
+
+//boundIP returns the address token must be bound to, empty unless options ask for binding
+func boundIP(options st.TokenOptions, clientIP string) string {
+	if !options.BindIP {
+		return ""
+	}
+	return clientIP
+}
+
+func (server *Server) DownloadFinished(lease *lock.Lease) {
+	server.lockManager.UnlockResource(lease)
+	server.statusManager.TransferFinished()
+}
+
+//LocksStatus lists locks of the cluster as seen by this node
+type LocksStatus struct {
+	Resources []lock.ResourceLock
+	Paths     []sp.PathLock
+}
+
+//Locks returns lock table and paths reserved for uploads
+func (server *Server) Locks() LocksStatus {
+	return LocksStatus{
+		Resources: server.lockManager.Locks(),
+		Paths:     server.pathManager.Locks(),
+	}
+}
+
+//ForceUnlock drops every holder of the lock resource
+func (server *Server) ForceUnlock(ctx context.Context, resource string) error {
+	return server.lockManager.ForceUnlock(ctx, resource)
+}
+
+//ForceUnlockPath releases path reserved for upload
+func (server *Server) ForceUnlockPath(uploadPath string) error {
+	if !server.pathManager.IsLocked(uploadPath) {
+		return ErrorPathIsNotLocked
+	}
+	return server.pathManager.UnlockPath(uploadPath)
+}
+
+//IsAdminToken reports whether token authorizes admin requests
+func (server *Server) IsAdminToken(token string) bool {
+	adminToken := server.config.AdminToken
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+type ClusterStatus struct {
+	Nodes    map[string]status.NodeStatus
+	Liveness map[string]node.NodeLiveness
+	Peers    map[string]comm.PeerState
+	Raft     raft.Status
+	//Uploads lists uploads in progress followed by the recently finished ones
+	Uploads []sp.Upload
+}
+
+func (server *Server) Status() ClusterStatus {
+	return ClusterStatus{
+		Nodes:    server.statusManager.Status(),
+		Liveness: server.nodeManager.Liveness(),
+		Peers:    server.msgHub.PeerStates(),
+		Raft:     server.raft.Status(),
+		Uploads:  server.pathManager.Uploads(),
+	}
+}
 
-	return downloadPath, nil
+//AddRaftMember makes configured node a voting member of the consensus group
+func (server *Server) AddRaftMember(ctx context.Context, nodeName string) error {
+	return server.raft.AddMember(ctx, nodeName)
 }
 
-func (server *Server) Status() map[string]status.NodeStatus {
-	return server.statusManager.Status()
+//RemoveRaftMember removes node from the consensus group
+func (server *Server) RemoveRaftMember(ctx context.Context, nodeName string) error {
+	return server.raft.RemoveMember(ctx, nodeName)
 }
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package status
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+//freeDiskSpace returns number of bytes available to unprivileged users on filesystem holding dir.
+//If dir does not exist yet, its closest existing parent is measured.
+func freeDiskSpace(dir string) (free uint64, known bool) {
+	dir, _ = filepath.Abs(dir)
+	var stat syscall.Statfs_t
+	for syscall.Statfs(dir, &stat) != nil {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true
+}
@@ -0,0 +1,35 @@
+package status
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+//freeDiskSpace returns number of bytes available to the user running the node on the volume holding dir.
+//If dir does not exist yet, its closest existing parent is measured.
+func freeDiskSpace(dir string) (free uint64, known bool) {
+	dir, _ = filepath.Abs(dir)
+	for {
+		path, err := syscall.UTF16PtrFromString(dir)
+		if err != nil {
+			return 0, false
+		}
+		var available, total, totalFree uint64
+		ok, _, _ := procGetDiskFreeSpaceEx.Call(
+			uintptr(unsafe.Pointer(path)),
+			uintptr(unsafe.Pointer(&available)),
+			uintptr(unsafe.Pointer(&total)),
+			uintptr(unsafe.Pointer(&totalFree)))
+		if ok != 0 {
+			return available, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,90 @@
+package status
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultVirtualNodes = 128
+)
+
+type ringPoint struct {
+	hash     uint64
+	nodeName string
+}
+
+//Ring is a consistent hashing ring. Every node is placed on the ring as a number of
+//virtual nodes proportional to its weight, so adding or removing a node only moves
+//keys that belong to that node.
+type Ring struct {
+	points []ringPoint
+	nodes  int
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+//NewRing builds ring from node weights. Nodes with non-positive weight get weight 1.
+func NewRing(weights map[string]float64, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	ring := &Ring{nodes: len(weights)}
+	for nodeName, weight := range weights {
+		if weight <= 0 {
+			weight = 1
+		}
+		count := int(weight * float64(virtualNodes))
+		if count < 1 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:     ringHash(nodeName + "#" + strconv.Itoa(i)),
+				nodeName: nodeName,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash == ring.points[j].hash {
+			return ring.points[i].nodeName < ring.points[j].nodeName
+		}
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+//Owners returns up to n distinct nodes responsible for the key, in order of preference.
+//Nodes for which skip returns true are passed over. Not positive n means all nodes.
+func (ring *Ring) Owners(key string, n int, skip func(nodeName string) bool) []string {
+	if n <= 0 || n > ring.nodes {
+		n = ring.nodes
+	}
+	owners := make([]string, 0, n)
+	if len(ring.points) == 0 {
+		return owners
+	}
+
+	seen := make(map[string]bool, ring.nodes)
+	hash := ringHash(key)
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+	for i := 0; i < len(ring.points) && len(owners) < n; i++ {
+		point := ring.points[(start+i)%len(ring.points)]
+		if seen[point.nodeName] {
+			continue
+		}
+		seen[point.nodeName] = true
+		if skip != nil && skip(point.nodeName) {
+			continue
+		}
+		owners = append(owners, point.nodeName)
+	}
+	return owners
+}
@@ -0,0 +1,119 @@
+package status
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestOwners(t *testing.T) {
+	weights := map[string]float64{"one": 1, "two": 1, "three": 1}
+
+	tests := []struct {
+		name  string
+		n     int
+		skip  func(nodeName string) bool
+		count int
+	}{
+		{name: "single owner", n: 1, count: 1},
+		{name: "two owners", n: 2, count: 2},
+		{name: "all nodes", n: 0, count: 3},
+		{name: "more than nodes", n: 5, count: 3},
+		{name: "skipped node", n: 3, skip: func(nodeName string) bool { return nodeName == "two" }, count: 2},
+		{name: "every node skipped", n: 2, skip: func(string) bool { return true }, count: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring := NewRing(weights, 0)
+			for i := 0; i < 100; i++ {
+				key := "bucket/file" + strconv.Itoa(i)
+				owners := ring.Owners(key, test.n, test.skip)
+				if len(owners) != test.count {
+					t.Fatalf("%s: got %d owners %v, want %d", key, len(owners), owners, test.count)
+				}
+				seen := make(map[string]bool, 0)
+				for _, owner := range owners {
+					if seen[owner] {
+						t.Fatalf("%s: owner %s is repeated in %v", key, owner, owners)
+					}
+					if test.skip != nil && test.skip(owner) {
+						t.Fatalf("%s: skipped node %s is an owner", key, owner)
+					}
+					seen[owner] = true
+				}
+			}
+		})
+	}
+}
+
+func TestOwnersOfEmptyRing(t *testing.T) {
+	owners := NewRing(map[string]float64{}, 0).Owners("bucket/file", 2, nil)
+	if len(owners) != 0 {
+		t.Fatalf("got owners %v of empty ring", owners)
+	}
+}
+
+func TestRingIsDeterministic(t *testing.T) {
+	weights := map[string]float64{"one": 1, "two": 2, "three": 0.5}
+	first := NewRing(weights, 16)
+	for i := 0; i < 10; i++ {
+		ring := NewRing(weights, 16)
+		for j := 0; j < 100; j++ {
+			key := strconv.Itoa(j)
+			want, got := first.Owners(key, 0, nil), ring.Owners(key, 0, nil)
+			for k := range want {
+				if got[k] != want[k] {
+					t.Fatalf("%s: got owners %v, want %v", key, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRemovedNodeMovesOnlyItsKeys(t *testing.T) {
+	before := NewRing(map[string]float64{"one": 1, "two": 1, "three": 1}, 0)
+	after := NewRing(map[string]float64{"one": 1, "two": 1}, 0)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := "bucket/file" + strconv.Itoa(i)
+		owner := before.Owners(key, 1, nil)[0]
+		newOwner := after.Owners(key, 1, nil)[0]
+		if owner != "three" && newOwner != owner {
+			t.Fatalf("%s moved from %s to %s", key, owner, newOwner)
+		}
+		if owner == "three" {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("removed node owned no keys")
+	}
+}
+
+func TestWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		//share is the expected share of keys owned by node "one"
+		share float64
+	}{
+		{name: "equal weights", weights: map[string]float64{"one": 1, "two": 1}, share: 0.5},
+		{name: "double weight", weights: map[string]float64{"one": 2, "two": 1}, share: 2.0 / 3},
+		{name: "non-positive weight counts as 1", weights: map[string]float64{"one": 0, "two": 1}, share: 0.5},
+	}
+	const keys = 20000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring := NewRing(test.weights, 0)
+			owned := 0
+			for i := 0; i < keys; i++ {
+				if ring.Owners(strconv.Itoa(i), 1, nil)[0] == "one" {
+					owned++
+				}
+			}
+			share := float64(owned) / keys
+			if share < test.share-0.08 || share > test.share+0.08 {
+				t.Fatalf("node owns %.2f of keys, want about %.2f", share, test.share)
+			}
+		})
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"dfs/comm"
 	c "dfs/config"
 	"dfs/server/node"
-	//"fmt"
-	"math/rand"
 	"sync"
 	"time"
 )
@@ -14,7 +12,15 @@ import (
 type NodeStatus struct {
 	RequestsPerMinute int
 	RequestCounter    int
+	//TokenCount is the number of unexpired tokens the cluster issued for transfers on the node,
+	//tokens of other nodes are counted as of their last status
 	TokenCount        int
+	FreeDisk          uint64
+	InFlightTransfers int
+	//FreeDiskUnknown tells free disk space could not be measured, such node is not excluded from placement
+	FreeDiskUnknown bool
+	//Latency is the round-trip time of requests from this node to the node
+	Latency time.Duration
 }
 
 type StatusManager struct {
@@ -24,6 +30,12 @@ type StatusManager struct {
 	this         NodeStatus
 	nodeStatuses map[string]NodeStatus
 	config       *c.Config
+	ring         *Ring
+	strategy     Strategy
+	//issued keeps expiry times of the tokens issued for every node
+	issued map[string][]time.Time
+	//reported keeps the token counts other nodes issued for every node, by the reporting node
+	reported map[string]map[string]int
 }
 
 func (sm *StatusManager) UseConfig(config *c.Config) {
@@ -33,6 +45,16 @@ func (sm *StatusManager) UseConfig(config *c.Config) {
 func (sm *StatusManager) Listen(nodeManager *node.NodeManager, msgHub *comm.MessageHub) {
 	sm.nodeManager = nodeManager
 	sm.nodeStatuses = make(map[string]NodeStatus, 0)
+	sm.issued = make(map[string][]time.Time, 0)
+	sm.reported = make(map[string]map[string]int, 0)
+
+	weights := map[string]float64{nodeManager.This.Name: nodeManager.This.Weight}
+	for nodeName, nodeInfo := range nodeManager.Nodes() {
+		weights[nodeName] = nodeInfo.Weight
+	}
+	sm.ring = NewRing(weights, sm.config.VirtualNodes)
+	sm.strategy = NewStrategy(sm.config.PlacementStrategy)
+
 	sm.msgHub = msgHub
 	sm.msgHub.Subscribe(sm, comm.MessageTypeStatus)
 	go func() {
@@ -44,12 +66,20 @@ func (sm *StatusManager) Listen(nodeManager *node.NodeManager, msgHub *comm.Mess
 
 			sm.this.RequestsPerMinute = sm.this.RequestCounter * 6
 			sm.this.RequestCounter = 0
+			free, known := freeDiskSpace(sm.config.UploadDir)
+			sm.this.FreeDisk, sm.this.FreeDiskUnknown = free, !known
 			sm.nodeStatuses[sm.nodeManager.This.Name] = sm.this
 
 			status := comm.MessageNodeStatus{
-				sm.this.RequestsPerMinute,
-				sm.this.TokenCount,
-				sm.this.RequestCounter,
+				RequestsPerMinute: sm.this.RequestsPerMinute,
+				RequestCounter:    sm.this.RequestCounter,
+				FreeDisk:          sm.this.FreeDisk,
+				FreeDiskUnknown:   sm.this.FreeDiskUnknown,
+				InFlightTransfers: sm.this.InFlightTransfers,
+				IssuedTokens:      make(map[string]int, len(sm.issued)),
+			}
+			for nodeName := range sm.issued {
+				status.IssuedTokens[nodeName] = sm.tokenCount(nodeName)
 			}
 
 			sm.mutex.Unlock()
@@ -70,12 +100,18 @@ func (sm *StatusManager) HandleMessage(msg *comm.Message) {
 			return
 		}
 
-		//fmt.Printf("Got message from %s\n%s\n", msg.SourceNode, status.String())
+		sm.nodeManager.Heartbeat(msg.SourceNode)
+
+		sm.mutex.Lock()
+		defer sm.mutex.Unlock()
 		sm.nodeStatuses[msg.SourceNode] = NodeStatus{
-			status.RequestsPerMinute,
-			status.RequestCounter,
-			status.TokenCount,
+			RequestsPerMinute: status.RequestsPerMinute,
+			RequestCounter:    status.RequestCounter,
+			FreeDisk:          status.FreeDisk,
+			FreeDiskUnknown:   status.FreeDiskUnknown,
+			InFlightTransfers: status.InFlightTransfers,
 		}
+		sm.reported[msg.SourceNode] = status.IssuedTokens
 	}
 }
 
@@ -85,38 +121,116 @@ func (sm *StatusManager) CountRequest() {
 	sm.this.RequestCounter += 1
 }
 
-func (sm *StatusManager) TokenAdded() {
+//TokenIssued counts token for transfer on the node until the token expires
+func (sm *StatusManager) TokenIssued(nodeName string, expires time.Time) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.issued[nodeName] = append(sm.issued[nodeName], expires)
+}
+
+//tokenCount returns the number of unexpired tokens this node issued for the node. Must be called with sm.mutex held.
+func (sm *StatusManager) tokenCount(nodeName string) int {
+	now := time.Now()
+	issued := sm.issued[nodeName][:0]
+	for _, expires := range sm.issued[nodeName] {
+		if now.Before(expires) {
+			issued = append(issued, expires)
+		}
+	}
+	sm.issued[nodeName] = issued
+	return len(issued)
+}
+
+func (sm *StatusManager) TransferStarted() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.this.InFlightTransfers += 1
+}
+
+func (sm *StatusManager) TransferFinished() {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	sm.this.TokenCount += 1
+	sm.this.InFlightTransfers -= 1
 }
 
-func (sm *StatusManager) TokenDeleted() {
+func (sm *StatusManager) Status() map[string]NodeStatus {
+	peers := sm.msgHub.PeerStates()
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	sm.this.TokenCount -= 1
+	statuses := make(map[string]NodeStatus, len(sm.nodeStatuses))
+	for nodeName, nodeStatus := range sm.nodeStatuses {
+		nodeStatus.Latency = peers[nodeName].Latency
+		nodeStatus.TokenCount = sm.clusterTokenCount(nodeName)
+		statuses[nodeName] = nodeStatus
+	}
+	this := sm.this
+	this.RequestsPerMinute = statuses[sm.nodeManager.This.Name].RequestsPerMinute
+	this.TokenCount = sm.clusterTokenCount(sm.nodeManager.This.Name)
+	statuses[sm.nodeManager.This.Name] = this
+	return statuses
+}
+
+//clusterTokenCount adds the tokens other nodes reported for the node to the ones issued here. Must be called with sm.mutex held.
+func (sm *StatusManager) clusterTokenCount(nodeName string) int {
+	count := sm.tokenCount(nodeName)
+	for reporter, issued := range sm.reported {
+		if reporter != sm.nodeManager.This.Name {
+			count += issued[nodeName]
+		}
+	}
+	return count
 }
 
-func (sm StatusManager) Status() map[string]NodeStatus {
+//hasFreeDisk reports whether node has enough disk space to accept new files.
+//Nodes that did not report their status yet or could not measure their disk are assumed to have it.
+func (sm *StatusManager) hasFreeDisk(nodeName string) bool {
+	if sm.config.MinFreeDisk == 0 {
+		return true
+	}
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	return sm.nodeStatuses
+	nodeStatus, exists := sm.nodeStatuses[nodeName]
+	return !exists || nodeStatus.FreeDiskUnknown || nodeStatus.FreeDisk >= sm.config.MinFreeDisk
+}
+
+//Owners returns up to n live nodes that should keep the file according to the placement ring.
+//If n is not positive or exceeds the number of live nodes, all live nodes are returned.
+func (sm *StatusManager) Owners(path string, n int) []string {
+	return sm.ring.Owners(path, n, func(nodeName string) bool {
+		return sm.nodeManager.NodeState(nodeName) == node.NodeStateDead
+	})
 }
 
-func (sm StatusManager) ChooseNodeForUpload() (nodeName string) {
-	nodeNames := sm.nodeManager.NodeNames()
-	index := rand.Int() % (len(nodeNames) + 1)
-	if index == 0 {
-		return sm.nodeManager.This.Name
+//ChooseNodesForUpload returns n distinct nodes that should keep a new file, first of them receives the upload.
+//Replica set follows the placement ring skipping nodes that are out of disk space,
+//the receiving node is picked among them by the placement strategy.
+func (sm *StatusManager) ChooseNodesForUpload(path string, n int) (nodeNames []string) {
+	nodeNames = sm.ring.Owners(path, n, func(nodeName string) bool {
+		return sm.nodeManager.NodeState(nodeName) == node.NodeStateDead || !sm.hasFreeDisk(nodeName)
+	})
+	if len(nodeNames) == 0 {
+		return nodeNames
 	}
-	return nodeNames[index-1]
+	chosen := sm.strategy.Choose(nodeNames, sm.Status())
+	for i, nodeName := range nodeNames {
+		if nodeName == chosen {
+			nodeNames[0], nodeNames[i] = nodeNames[i], nodeNames[0]
+		}
+	}
+	return nodeNames
 }
 
-func (sm StatusManager) ChooseNodeForDownload() (nodeName string) {
-	nodeNames := sm.nodeManager.NodeNames()
-	index := rand.Int() % (len(nodeNames) + 1)
-	if index == 0 {
-		return sm.nodeManager.This.Name
+//ChooseNodeForDownload picks one of the live nodes among the ones holding the file
+func (sm *StatusManager) ChooseNodeForDownload(holders []string) (nodeName string) {
+	candidates := make([]string, 0, len(holders))
+	for _, holder := range holders {
+		if holder == sm.nodeManager.This.Name || sm.nodeManager.NodeState(holder) != node.NodeStateDead {
+			candidates = append(candidates, holder)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
 	}
-	return nodeNames[index-1]
+	return sm.strategy.Choose(candidates, sm.Status())
 }
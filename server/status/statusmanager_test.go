@@ -0,0 +1,124 @@
+package status
+
+import (
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	"testing"
+	"time"
+)
+
+func newTestStatusManager(t *testing.T, config *c.Config) (*StatusManager, *node.NodeManager) {
+	t.Helper()
+	config.This.Name = "one"
+	config.Nodes = []c.NodeInfo{{Name: "two", Weight: 1}, {Name: "three", Weight: 1}}
+	config.ClusterSecret = "secret"
+	nodeManager := &node.NodeManager{}
+	nodeManager.UseConfig(config)
+	//Status asks the hub for peer latencies
+	msgHub := &comm.MessageHub{}
+	msgHub.UseConfig(config)
+	if err := msgHub.Listen(nodeManager, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	sm := &StatusManager{}
+	sm.UseConfig(config)
+	sm.Listen(nodeManager, msgHub)
+	return sm, nodeManager
+}
+
+func TestChooseNodeForDownload(t *testing.T) {
+	tests := []struct {
+		name    string
+		holders []string
+	}{
+		{name: "single replica", holders: []string{"two"}},
+		{name: "replica on this node", holders: []string{"one"}},
+		{name: "two replicas", holders: []string{"three", "two"}},
+		{name: "no replicas"},
+	}
+	for _, strategy := range []string{StrategyRandom, StrategyLeastRequests, StrategyLeastTokens, StrategyPowerOfTwo, StrategyFreeDisk} {
+		sm, _ := newTestStatusManager(t, &c.Config{PlacementStrategy: strategy})
+		for _, test := range tests {
+			t.Run(strategy+"/"+test.name, func(t *testing.T) {
+				for i := 0; i < 50; i++ {
+					nodeName := sm.ChooseNodeForDownload(test.holders)
+					if len(test.holders) == 0 {
+						if nodeName != "" {
+							t.Fatalf("got node %s of file without replicas", nodeName)
+						}
+						return
+					}
+					if !contains(test.holders, nodeName) {
+						t.Fatalf("got node %s, want one of %v", nodeName, test.holders)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChooseNodeForDownloadSkipsDead(t *testing.T) {
+	config := &c.Config{}
+	config.FailureDetector.SuspectTimeout.Duration = time.Millisecond
+	config.FailureDetector.DeadTimeout.Duration = time.Millisecond
+	sm, nodeManager := newTestStatusManager(t, config)
+	nodeManager.StartFailureDetector()
+	for deadline := time.Now().Add(5 * time.Second); nodeManager.NodeState("three") != node.NodeStateDead; {
+		if time.Now().After(deadline) {
+			t.Fatal("node three is not dead")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i := 0; i < 50; i++ {
+		if nodeName := sm.ChooseNodeForDownload([]string{"three", "one"}); nodeName != "one" {
+			t.Fatalf("got node %s, want one", nodeName)
+		}
+	}
+	if nodeName := sm.ChooseNodeForDownload([]string{"three"}); nodeName != "" {
+		t.Fatalf("got node %s of file kept by dead node only", nodeName)
+	}
+}
+
+func contains(nodeNames []string, nodeName string) bool {
+	for _, name := range nodeNames {
+		if name == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTokenCount(t *testing.T) {
+	sm, _ := newTestStatusManager(t, &c.Config{})
+	report := func(sourceNode string, issued map[string]int) {
+		msg := comm.Message{Type: comm.MessageTypeStatus, SourceNode: sourceNode}
+		if err := msg.EncodeData(comm.MessageNodeStatus{IssuedTokens: issued}); err != nil {
+			t.Fatal(err)
+		}
+		sm.HandleMessage(&msg)
+	}
+
+	sm.TokenIssued("two", time.Now().Add(time.Minute))
+	sm.TokenIssued("two", time.Now().Add(-time.Second))
+	report("two", map[string]int{"two": 2, "one": 1})
+	report("three", map[string]int{"two": 4})
+	//Later status replaces the earlier count of the node
+	report("three", map[string]int{"two": 3})
+
+	statuses := sm.Status()
+	tests := []struct {
+		nodeName string
+		count    int
+	}{
+		{nodeName: "one", count: 1},
+		{nodeName: "two", count: 6},
+		{nodeName: "three", count: 0},
+	}
+	for _, test := range tests {
+		if count := statuses[test.nodeName].TokenCount; count != test.count {
+			t.Fatalf("got %d tokens of %s, want %d", count, test.nodeName, test.count)
+		}
+	}
+}
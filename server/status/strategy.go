@@ -0,0 +1,104 @@
+package status
+
+import (
+	"math/rand"
+)
+
+const (
+	StrategyRandom        = "random"
+	StrategyLeastRequests = "least-requests"
+	StrategyLeastTokens   = "least-tokens"
+	StrategyPowerOfTwo    = "power-of-two-choices"
+	StrategyFreeDisk      = "free-disk-weighted"
+)
+
+//Strategy picks the node that serves a transfer among the candidates
+type Strategy interface {
+	Choose(candidates []string, statuses map[string]NodeStatus) string
+}
+
+//NewStrategy returns strategy by its config name. Unknown names fall back to random choice.
+func NewStrategy(name string) Strategy {
+	switch name {
+	case StrategyLeastRequests:
+		return leastStrategy(func(status NodeStatus) float64 {
+			return float64(status.RequestsPerMinute)
+		})
+	case StrategyLeastTokens:
+		return leastStrategy(func(status NodeStatus) float64 {
+			return float64(status.TokenCount)
+		})
+	case StrategyPowerOfTwo:
+		return powerOfTwoStrategy{}
+	case StrategyFreeDisk:
+		return freeDiskStrategy{}
+	}
+	return randomStrategy{}
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Choose(candidates []string, statuses map[string]NodeStatus) string {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+//leastStrategy chooses node with the lowest load, ties are broken at random
+type leastStrategy func(status NodeStatus) float64
+
+func (load leastStrategy) Choose(candidates []string, statuses map[string]NodeStatus) string {
+	best := make([]string, 0, len(candidates))
+	var bestLoad float64
+	for _, nodeName := range candidates {
+		nodeLoad := load(statuses[nodeName])
+		if len(best) == 0 || nodeLoad < bestLoad {
+			best = append(best[:0], nodeName)
+			bestLoad = nodeLoad
+		} else if nodeLoad == bestLoad {
+			best = append(best, nodeName)
+		}
+	}
+	return best[rand.Intn(len(best))]
+}
+
+//powerOfTwoStrategy samples two nodes and takes the less busy one
+type powerOfTwoStrategy struct{}
+
+func busyness(status NodeStatus) float64 {
+	return float64(status.RequestsPerMinute) + 10*float64(status.InFlightTransfers) + status.Latency.Seconds()*1000
+}
+
+func (powerOfTwoStrategy) Choose(candidates []string, statuses map[string]NodeStatus) string {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if busyness(statuses[candidates[j]]) < busyness(statuses[candidates[i]]) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+//freeDiskStrategy chooses node at random with probability proportional to its free disk space
+type freeDiskStrategy struct{}
+
+func (freeDiskStrategy) Choose(candidates []string, statuses map[string]NodeStatus) string {
+	var total float64
+	for _, nodeName := range candidates {
+		total += float64(statuses[nodeName].FreeDisk)
+	}
+	if total == 0 {
+		return randomStrategy{}.Choose(candidates, statuses)
+	}
+	point := rand.Float64() * total
+	for _, nodeName := range candidates {
+		point -= float64(statuses[nodeName].FreeDisk)
+		if point < 0 {
+			return nodeName
+		}
+	}
+	return candidates[len(candidates)-1]
+}
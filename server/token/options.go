@@ -0,0 +1,137 @@
+package token
+
+import (
+	c "dfs/config"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTokenTTL    = 2 * time.Minute
+	defaultTokenMaxTTL = 24 * time.Hour
+)
+
+var (
+	ErrorTTLTooLong         = errors.New("Requested token lifetime is too long.")
+	ErrorTooManyUses        = errors.New("Requested token uses exceed the limit.")
+	ErrorMethodIsNotAllowed = errors.New("Requested method is not allowed.")
+	ErrorMaxSizeTooLarge    = errors.New("Requested file size exceeds the limit.")
+)
+
+var (
+	defaultDownloadMethods = []string{http.MethodGet, http.MethodHead}
+	defaultUploadMethods   = []string{http.MethodPost, http.MethodPut}
+	defaultDeleteMethods   = []string{http.MethodDelete, http.MethodPost}
+)
+
+//TokenOptions is what a request asks of its token. Zero fields take the values configured for the bucket.
+//MaxSize and ContentType constrain the uploaded file and are ignored for downloads.
+//Overwrite lets the upload replace the existing file.
+type TokenOptions struct {
+	TTL         time.Duration
+	MaxUses     int
+	BindIP      bool
+	Methods     []string
+	MaxSize     int64
+	ContentType string
+	Overwrite   bool
+}
+
+//bucketConfig returns token config of the bucket, its empty fields are taken from the common one
+func (tm *TokenManager) bucketConfig(bucketName string) c.TokenConfig {
+	config := tm.config.Tokens
+	bucketConfig, exists := tm.config.BucketTokens[bucketName]
+	if !exists {
+		return config
+	}
+	if bucketConfig.TTL.Duration > 0 {
+		config.TTL = bucketConfig.TTL
+	}
+	if bucketConfig.MaxTTL.Duration > 0 {
+		config.MaxTTL = bucketConfig.MaxTTL
+	}
+	if bucketConfig.MaxUses > 0 {
+		config.MaxUses = bucketConfig.MaxUses
+	}
+	if bucketConfig.BindIP {
+		config.BindIP = true
+	}
+	if len(bucketConfig.DownloadMethods) > 0 {
+		config.DownloadMethods = bucketConfig.DownloadMethods
+	}
+	if len(bucketConfig.UploadMethods) > 0 {
+		config.UploadMethods = bucketConfig.UploadMethods
+	}
+	return config
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+//Options checks what the request asks of the token against the bucket config and fills in the defaults.
+//Requests may shorten lifetime up to MaxTTL, lower the number of uses, bind the token to IP and narrow the methods,
+//uploads may also lower the file size limit and fix the content type.
+func (tm *TokenManager) Options(bucketName string, tokenType string, requested TokenOptions) (TokenOptions, error) {
+	config := tm.bucketConfig(bucketName)
+	options := TokenOptions{
+		TTL:     config.TTL.Or(defaultTokenTTL),
+		MaxUses: config.MaxUses,
+		BindIP:  config.BindIP || requested.BindIP,
+		Methods: config.DownloadMethods,
+	}
+	if tokenType == "upload" {
+		options.Methods = config.UploadMethods
+		//Upload lifecycle lets the token be used once anyway
+		options.MaxUses = 1
+		options.MaxSize = tm.config.MaxUploadSize
+		options.ContentType = requested.ContentType
+		options.Overwrite = requested.Overwrite
+		if requested.MaxSize > 0 {
+			if options.MaxSize > 0 && requested.MaxSize > options.MaxSize {
+				return TokenOptions{}, ErrorMaxSizeTooLarge
+			}
+			options.MaxSize = requested.MaxSize
+		}
+	}
+	if tokenType == "delete" {
+		//Delete happens once, methods of the bucket config are those of transfers
+		options.Methods = defaultDeleteMethods
+		options.MaxUses = 1
+	}
+	if len(options.Methods) == 0 {
+		options.Methods = defaultDownloadMethods
+		if tokenType == "upload" {
+			options.Methods = defaultUploadMethods
+		}
+	}
+
+	if requested.TTL > 0 {
+		if requested.TTL > config.MaxTTL.Or(defaultTokenMaxTTL) {
+			return TokenOptions{}, ErrorTTLTooLong
+		}
+		options.TTL = requested.TTL
+	}
+	if requested.MaxUses > 0 {
+		if options.MaxUses > 0 && requested.MaxUses > options.MaxUses {
+			return TokenOptions{}, ErrorTooManyUses
+		}
+		options.MaxUses = requested.MaxUses
+	}
+	if len(requested.Methods) > 0 {
+		for _, method := range requested.Methods {
+			if !containsMethod(options.Methods, method) {
+				return TokenOptions{}, ErrorMethodIsNotAllowed
+			}
+		}
+		options.Methods = requested.Methods
+	}
+	return options, nil
+}
@@ -1,44 +1,97 @@
 package token
 
 import (
-	"dfs/comm"
+	"crypto/hmac"
+	"crypto/sha256"
 	c "dfs/config"
 	"dfs/server/node"
-	"dfs/server/path"
 	"dfs/server/status"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	p "path"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	defaultTokenReaperInterval = time.Minute
+	//usesSaveInterval is how often bytes charged to the download tokens are saved
+	usesSaveInterval = 5 * time.Second
+)
+
 var (
-	ErrorTokenDoesNotExist = errors.New("Token does not exist.")
-	ErrorFileAlreadyExists = errors.New("File already exists.")
-	ErrorFileDoesNotExist  = errors.New("File does not exist.")
+	ErrorNoTokenKey          = errors.New("No token key is configured.")
+	ErrorBadTokenKeyID       = errors.New("Token key ID must be non-empty and contain no dots.")
+	ErrorTokenIsMalformed    = errors.New("Token is malformed.")
+	ErrorTokenKeyIsUnknown   = errors.New("Token is signed with unknown key.")
+	ErrorTokenSignature      = errors.New("Token signature is invalid.")
+	ErrorTokenExpired        = errors.New("Token expired.")
+	ErrorTokenForAnotherNode = errors.New("Token is issued for another node.")
+	ErrorTokenType           = errors.New("Token is issued for another operation.")
+	ErrorTokenUsedUp         = errors.New("Token is used up.")
+	ErrorTokenForAnotherIP   = errors.New("Token is issued for another client address.")
+	ErrorTokenMethod         = errors.New("Token does not allow this method.")
+	ErrorTokenContentType    = errors.New("Token does not allow this content type.")
+	ErrorTokenForAnotherPath = errors.New("Token is issued for another file.")
 )
 
+//TokenInfo is what token grants access to.
+//Node is the node the transfer must go to, MaxSize limits size of the uploaded file, 0 means no limit.
+//Fence is the fencing token of the path lock the upload was requested under.
+//MaxUses, ClientIP and Methods restrict who and how many times may use the token, empty values restrict nothing.
+//Download token carries the size of the file in MaxSize, its MaxUses allow to read the file as many times over.
+//ContentType is the only content type the uploaded file may have if set.
 type TokenInfo struct {
-	ExpireTime time.Time
-	Path       string
+	Type        string
+	Path        string
+	Node        string
+	Replicas    []string
+	Fence       uint64
+	MaxSize     int64
+	ExpireTime  time.Time
+	MaxUses     int
+	ClientIP    string
+	Methods     []string
+	ContentType string
 }
 
-type TokenManager struct {
-	mutex sync.Mutex
+//Access describes the request presenting the token, ContentType is checked for uploads only
+type Access struct {
+	Method      string
+	ClientIP    string
+	ContentType string
+}
 
-	uploadTokenMap   map[string]TokenInfo
-	downloadTokenMap map[string]TokenInfo
+//tokenUses counts requests of the token, or bytes read for downloads of known size
+type tokenUses struct {
+	Count   int
+	Bytes   int64
+	Expires time.Time
+}
 
-	incomingUploadTokens   map[string]chan string
-	incomingDownloadTokens map[string]chan string
+//TokenManager issues and verifies stateless tokens.
+//Token carries its TokenInfo signed with a key shared by the cluster, so any node can verify it
+//without asking the node that issued it, and tokens survive restarts.
+//Token looks like "keyID.payload.signature", payload and signature are base64url encoded.
+//Uses of the tokens are counted by the node serving them until the tokens expire. Token is accepted
+//only by the node it is issued for, so the counts are kept in a file of that node rather than shared,
+//they survive restarts of the node.
+type TokenManager struct {
+	mutex sync.Mutex
+	//uses maps signatures of limited tokens to the number of times they were used
+	uses map[string]*tokenUses
+	//dirty tells bytes were charged since the uses were saved
+	dirty bool
 
 	nodeManager   *node.NodeManager
 	statusManager *status.StatusManager
-	pathManager   *path.PathManager
-	msgHub        *comm.MessageHub
 	config        *c.Config
 }
 
@@ -46,229 +99,270 @@ func (tm *TokenManager) UseConfig(config *c.Config) {
 	tm.config = config
 }
 
-func (tm *TokenManager) Listen(
-	nodeManager *node.NodeManager,
-	statusManager *status.StatusManager,
-	pathManager *path.PathManager,
-	msgHub *comm.MessageHub) {
-
-	tm.incomingUploadTokens = make(map[string]chan string, 0)
-	tm.incomingDownloadTokens = make(map[string]chan string, 0)
-	tm.uploadTokenMap = make(map[string]TokenInfo, 0)
-	tm.downloadTokenMap = make(map[string]TokenInfo, 0)
-
+func (tm *TokenManager) Listen(nodeManager *node.NodeManager, statusManager *status.StatusManager) error {
+	tm.uses = make(map[string]*tokenUses, 0)
 	tm.nodeManager = nodeManager
 	tm.statusManager = statusManager
-	tm.pathManager = pathManager
-	tm.msgHub = msgHub
-
-	msgHub.Subscribe(tm,
-		comm.MessageTypeUploadToken,
-		comm.MessageTypeDownloadToken,
-		comm.MessageTypeRequestUploadToken,
-		comm.MessageTypeRequestDownloadToken)
+	tm.loadUses()
 
 	go func() {
-		ticker := time.Tick(time.Minute * 1)
+		ticker := time.Tick(tm.config.TokenReaperInterval.Or(defaultTokenReaperInterval))
 		for {
 			<-ticker
 			tm.mutex.Lock()
 			now := time.Now()
-			for token, tokenInfo := range tm.uploadTokenMap {
-				if now.After(tokenInfo.ExpireTime) {
-					tm.pathManager.UnlockPath(tokenInfo.Path)
-					delete(tm.uploadTokenMap, token)
-					tm.statusManager.TokenDeleted()
+			expired := false
+			for signature, uses := range tm.uses {
+				if now.After(uses.Expires) {
+					delete(tm.uses, signature)
+					expired = true
 				}
 			}
-			for token, tokenInfo := range tm.downloadTokenMap {
-				if now.After(tokenInfo.ExpireTime) {
-					delete(tm.downloadTokenMap, token)
-					tm.statusManager.TokenDeleted()
-				}
+			if expired {
+				tm.saveUses()
 			}
 			tm.mutex.Unlock()
 		}
 	}()
-}
-
-func (tm *TokenManager) createLocalToken(path string, tokenType string) (token string, err error) {
-	token = uuid.New().String()
-	var tokenMap map[string]TokenInfo
-
-	checkPath := p.Join(tm.config.UploadDir, path)
-
-	switch tokenType {
-
-	case "upload":
-		if _, err := os.Stat(checkPath); !os.IsNotExist(err) {
-			return "", ErrorFileAlreadyExists
+	go func() {
+		ticker := time.Tick(usesSaveInterval)
+		for {
+			<-ticker
+			tm.mutex.Lock()
+			if tm.dirty {
+				tm.saveUses()
+			}
+			tm.mutex.Unlock()
 		}
-		tokenMap = tm.uploadTokenMap
+	}()
 
-	case "download":
-		if _, err := os.Stat(checkPath); os.IsNotExist(err) {
-			return "", ErrorFileDoesNotExist
-		}
-		tokenMap = tm.downloadTokenMap
-	default:
-		log.Fatal("Bad")
+	if len(tm.config.TokenKeys) == 0 {
+		return ErrorNoTokenKey
 	}
-
-	tokenMap[token] = TokenInfo{
-		Path:       path,
-		ExpireTime: time.Now().Add(time.Minute * 2),
+	for _, key := range tm.config.TokenKeys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return ErrorBadTokenKeyID
+		}
 	}
-
-	tm.statusManager.TokenAdded()
-	return token, nil
+	return nil
 }
 
-func (tm *TokenManager) GetPathByToken(token string, tokenType string) (path string, err error) {
-	tm.mutex.Lock()
-	defer tm.mutex.Unlock()
-
-	var tokenMap map[string]TokenInfo
+func (tm *TokenManager) usesPath() string {
+	return p.Clean(tm.config.UploadDir) + ".tokens"
+}
 
-	switch tokenType {
-	case "upload":
-		tokenMap = tm.uploadTokenMap
-	case "download":
-		tokenMap = tm.downloadTokenMap
-	default:
-		log.Fatal("Bad")
+//loadUses restores use counts saved before the node restarted
+func (tm *TokenManager) loadUses() {
+	data, err := ioutil.ReadFile(tm.usesPath())
+	if os.IsNotExist(err) {
+		return
 	}
-
-	tokenInfo, exists := tokenMap[token]
-	if !exists {
-		return "", ErrorTokenDoesNotExist
+	if err == nil {
+		err = json.Unmarshal(data, &tm.uses)
+	}
+	if err != nil {
+		log.Printf("Failed to load token uses: %v\n", err)
+		tm.uses = make(map[string]*tokenUses, 0)
 	}
-	delete(tokenMap, token)
-	tm.statusManager.TokenDeleted()
-	return tokenInfo.Path, nil
 }
 
-func (tm *TokenManager) RequestToken(path string, nodeName string, tokenType string) (token string) {
-
-	if nodeName == tm.nodeManager.This.Name {
-		tm.mutex.Lock()
-		defer tm.mutex.Unlock()
-		token, err := tm.createLocalToken(path, tokenType)
+//saveUses atomically replaces the file of use counts. Must be called with tm.mutex held.
+func (tm *TokenManager) saveUses() {
+	tm.dirty = false
+	err := func() error {
+		data, err := json.Marshal(tm.uses)
+		if err != nil {
+			return err
+		}
+		tmpPath := tm.usesPath() + ".tmp"
+		file, err := os.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
 		if err != nil {
-			return ""
+			os.Remove(tmpPath)
+			return err
 		}
-		return token
+		return os.Rename(tmpPath, tm.usesPath())
+	}()
+	if err != nil {
+		log.Printf("Failed to save token uses: %v\n", err)
 	}
+}
 
-	var requestMsg comm.Message
-
-	switch tokenType {
-	case "upload":
-		requestMsg.Type = comm.MessageTypeRequestUploadToken
-	case "download":
-		requestMsg.Type = comm.MessageTypeRequestDownloadToken
-	default:
-		log.Fatal("Bad")
-	}
+func sign(key c.TokenKey, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(key.ID + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
 
-	request := comm.MessageRequestToken{
-		Path: path,
+//IssueToken signs tokenInfo with the current key. Token expires after the default lifetime unless ExpireTime is set.
+func (tm *TokenManager) IssueToken(tokenInfo TokenInfo) (token string, err error) {
+	if tokenInfo.ExpireTime.IsZero() {
+		tokenInfo.ExpireTime = time.Now().Add(defaultTokenTTL)
 	}
-	requestMsg.EncodeData(request)
-
-	answerChan := make(chan string, 1)
-
-	tm.mutex.Lock()
-
-	switch tokenType {
-	case "upload":
-		tm.incomingUploadTokens[path] = answerChan
-	case "download":
-		tm.incomingDownloadTokens[path] = answerChan
-	default:
-		log.Fatal("Bad")
+	data, err := json.Marshal(tokenInfo)
+	if err != nil {
+		return "", err
 	}
-
-	tm.mutex.Unlock()
-
-	tm.msgHub.Send(requestMsg, nodeName)
-	token = <-answerChan
-
-	return token
+	key := tm.config.TokenKeys[0]
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	tm.statusManager.TokenIssued(tokenInfo.Node, tokenInfo.ExpireTime)
+	return key.ID + "." + payload + "." + sign(key, payload), nil
 }
 
-func (tm *TokenManager) HandleMessage(msg *comm.Message) {
-	tm.mutex.Lock()
-	defer tm.mutex.Unlock()
+//Inspect returns what token signed with one of the configured keys was issued for.
+//Unlike GetTokenInfo it does not check whether the token may be used and does not count the use.
+func (tm *TokenManager) Inspect(token string) (TokenInfo, error) {
+	tokenInfo, _, err := tm.decode(token)
+	return tokenInfo, err
+}
 
-	switch msg.Type {
+//GetTokenInfo verifies token presented by the request and returns what it was issued for.
+//Token must be signed with one of the configured keys, unexpired, issued for this node and operation
+//and allow the request. Every successful call counts as a use of the token, except HEAD requests.
+//Downloads of known size are charged by bytes read through Meter instead, so ranged and resumed downloads
+//cost only what they transfer, and the token is refused once the bytes of all its uses are read.
+func (tm *TokenManager) GetTokenInfo(token string, tokenType string, access Access) (tokenInfo TokenInfo, err error) {
+	tokenInfo, signature, err := tm.decode(token)
+	if err != nil {
+		return TokenInfo{}, err
+	}
 
-	case comm.MessageTypeRequestUploadToken:
-		var request comm.MessageRequestToken
+	switch {
+	case tokenInfo.Type != tokenType:
+		return TokenInfo{}, ErrorTokenType
+	case tokenInfo.Node != tm.nodeManager.This.Name:
+		return TokenInfo{}, ErrorTokenForAnotherNode
+	case time.Now().After(tokenInfo.ExpireTime):
+		return TokenInfo{}, ErrorTokenExpired
+	case tokenInfo.ClientIP != "" && tokenInfo.ClientIP != access.ClientIP:
+		return TokenInfo{}, ErrorTokenForAnotherIP
+	case len(tokenInfo.Methods) > 0 && !containsMethod(tokenInfo.Methods, access.Method):
+		return TokenInfo{}, ErrorTokenMethod
+	case tokenInfo.Type == "upload" && tokenInfo.ContentType != "" && tokenInfo.ContentType != access.ContentType:
+		return TokenInfo{}, ErrorTokenContentType
+	}
 
-		err := msg.DecodeData(&request)
-		if err != nil {
-			return
+	if tokenInfo.MaxUses > 0 {
+		tm.mutex.Lock()
+		defer tm.mutex.Unlock()
+		uses := tm.usesOf(signature, tokenInfo)
+		if budget := byteBudget(tokenInfo); budget > 0 {
+			if uses.Bytes >= budget {
+				return TokenInfo{}, ErrorTokenUsedUp
+			}
+			return tokenInfo, nil
 		}
-
-		token, err := tm.createLocalToken(request.Path, "upload")
-		if err != nil {
-			token = ""
+		if uses.Count >= tokenInfo.MaxUses {
+			return TokenInfo{}, ErrorTokenUsedUp
 		}
-
-		responseMsg := comm.Message{Type: comm.MessageTypeUploadToken}
-		tokenMessage := comm.MessageToken{
-			Path:  request.Path,
-			Token: token,
+		if access.Method == http.MethodHead {
+			return tokenInfo, nil
 		}
-		responseMsg.EncodeData(tokenMessage)
-		tm.msgHub.Send(responseMsg, msg.SourceNode)
-
-	case comm.MessageTypeUploadToken:
-		var response comm.MessageToken
+		uses.Count++
+		tm.saveUses()
+	}
+	return tokenInfo, nil
+}
 
-		err := msg.DecodeData(&response)
-		if err != nil {
-			return
-		}
+//usesOf returns uses of the token, must be called with tm.mutex held
+func (tm *TokenManager) usesOf(signature string, tokenInfo TokenInfo) *tokenUses {
+	uses, exists := tm.uses[signature]
+	if !exists {
+		uses = &tokenUses{Expires: tokenInfo.ExpireTime}
+		tm.uses[signature] = uses
+	}
+	return uses
+}
 
-		channel, exists := tm.incomingUploadTokens[response.Path]
-		if !exists {
-			return
-		}
+//byteBudget returns the number of bytes the limited download token may read, 0 if its uses are counted by requests
+func byteBudget(tokenInfo TokenInfo) int64 {
+	if tokenInfo.Type != "download" || tokenInfo.MaxSize <= 0 {
+		return 0
+	}
+	return int64(tokenInfo.MaxUses) * tokenInfo.MaxSize
+}
 
-		channel <- response.Token
+//Meter returns r which charges bytes read to the download token verified by GetTokenInfo.
+//Reading fails with ErrorTokenUsedUp once the token has read all the bytes it may.
+func (tm *TokenManager) Meter(token string, r io.ReadSeeker) io.ReadSeeker {
+	tokenInfo, signature, err := tm.decode(token)
+	if err != nil || tokenInfo.MaxUses <= 0 || byteBudget(tokenInfo) == 0 {
+		return r
+	}
+	return &meteredReader{ReadSeeker: r, tm: tm, signature: signature, tokenInfo: tokenInfo}
+}
 
-	case comm.MessageTypeRequestDownloadToken:
-		var request comm.MessageRequestToken
-		msg.DecodeData(&request)
+type meteredReader struct {
+	io.ReadSeeker
+	tm        *TokenManager
+	signature string
+	tokenInfo TokenInfo
+}
 
-		token, err := tm.createLocalToken(request.Path, "download")
-		if err != nil {
-			token = ""
-		}
+func (r *meteredReader) Read(p []byte) (int, error) {
+	granted := r.tm.charge(r.signature, r.tokenInfo, int64(len(p)))
+	if granted == 0 && len(p) > 0 {
+		return 0, ErrorTokenUsedUp
+	}
+	n, err := r.ReadSeeker.Read(p[:granted])
+	if int64(n) < granted {
+		r.tm.charge(r.signature, r.tokenInfo, int64(n)-granted)
+	}
+	return n, err
+}
 
-		responseMsg := comm.Message{Type: comm.MessageTypeDownloadToken}
-		tokenMessage := comm.MessageToken{
-			Path:  request.Path,
-			Token: token,
+//charge takes up to n bytes from the budget of the token and returns how many it took, negative n returns bytes
+func (tm *TokenManager) charge(signature string, tokenInfo TokenInfo, n int64) int64 {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	uses := tm.usesOf(signature, tokenInfo)
+	if remaining := byteBudget(tokenInfo) - uses.Bytes; n > 0 && n > remaining {
+		n = remaining
+		if n < 0 {
+			n = 0
 		}
-		responseMsg.EncodeData(tokenMessage)
-		tm.msgHub.Send(responseMsg, msg.SourceNode)
-
-	case comm.MessageTypeDownloadToken:
-		var response comm.MessageToken
+	}
+	uses.Bytes += n
+	tm.dirty = true
+	return n
+}
 
-		err := msg.DecodeData(&response)
-		if err != nil {
-			return
-		}
+//decode checks signature of the token and returns its payload
+func (tm *TokenManager) decode(token string) (tokenInfo TokenInfo, signature string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenInfo{}, "", ErrorTokenIsMalformed
+	}
+	keyID, payload, signature := parts[0], parts[1], parts[2]
 
-		channel, exists := tm.incomingDownloadTokens[response.Path]
-		if !exists {
-			return
+	var key *c.TokenKey
+	for i := range tm.config.TokenKeys {
+		if tm.config.TokenKeys[i].ID == keyID {
+			key = &tm.config.TokenKeys[i]
+			break
 		}
+	}
+	if key == nil {
+		return TokenInfo{}, "", ErrorTokenKeyIsUnknown
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(*key, payload))) {
+		return TokenInfo{}, "", ErrorTokenSignature
+	}
 
-		channel <- response.Token
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return TokenInfo{}, "", ErrorTokenIsMalformed
+	}
+	err = json.Unmarshal(data, &tokenInfo)
+	if err != nil {
+		return TokenInfo{}, "", ErrorTokenIsMalformed
 	}
+	return tokenInfo, signature, nil
 }
@@ -0,0 +1,311 @@
+package token
+
+import (
+	"bytes"
+	"dfs/comm"
+	c "dfs/config"
+	"dfs/server/node"
+	"dfs/server/status"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenManager(t *testing.T, uploadDir string, keys ...c.TokenKey) *TokenManager {
+	t.Helper()
+	config := &c.Config{UploadDir: uploadDir, TokenKeys: keys}
+	config.This.Name = "one"
+
+	nodeManager := &node.NodeManager{}
+	nodeManager.UseConfig(config)
+	statusManager := &status.StatusManager{}
+	statusManager.UseConfig(config)
+	statusManager.Listen(nodeManager, &comm.MessageHub{})
+
+	tm := &TokenManager{}
+	tm.UseConfig(config)
+	if err := tm.Listen(nodeManager, statusManager); err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func issue(t *testing.T, tm *TokenManager, tokenInfo TokenInfo) string {
+	t.Helper()
+	token, err := tm.IssueToken(tokenInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGetTokenInfo(t *testing.T) {
+	key := c.TokenKey{ID: "k1", Secret: "secret"}
+	valid := TokenInfo{
+		Type:        "upload",
+		Path:        "bucket/file",
+		Node:        "one",
+		ExpireTime:  time.Now().Add(time.Hour),
+		ClientIP:    "10.0.0.1",
+		Methods:     []string{"PUT"},
+		ContentType: "text/plain",
+	}
+	access := Access{Method: "PUT", ClientIP: "10.0.0.1", ContentType: "text/plain"}
+
+	tests := []struct {
+		name   string
+		modify func(tokenInfo *TokenInfo)
+		//tamper changes the issued token
+		tamper    func(token string) string
+		tokenType string
+		access    Access
+		err       error
+	}{
+		{name: "valid"},
+		{name: "another operation", tokenType: "download", err: ErrorTokenType},
+		{name: "another node", modify: func(ti *TokenInfo) { ti.Node = "two" }, err: ErrorTokenForAnotherNode},
+		{name: "expired", modify: func(ti *TokenInfo) { ti.ExpireTime = time.Now().Add(-time.Second) }, err: ErrorTokenExpired},
+		{name: "another client", access: Access{Method: "PUT", ClientIP: "10.0.0.2", ContentType: "text/plain"}, err: ErrorTokenForAnotherIP},
+		{name: "method not allowed", access: Access{Method: "POST", ClientIP: "10.0.0.1", ContentType: "text/plain"}, err: ErrorTokenMethod},
+		{name: "another content type", access: Access{Method: "PUT", ClientIP: "10.0.0.1", ContentType: "image/png"}, err: ErrorTokenContentType},
+		{name: "no restrictions", modify: func(ti *TokenInfo) { ti.ClientIP, ti.Methods, ti.ContentType = "", nil, "" }, access: Access{Method: "POST"}},
+		{name: "missing part", tamper: func(token string) string { return token[:strings.LastIndex(token, ".")] }, err: ErrorTokenIsMalformed},
+		{name: "unknown key", tamper: func(token string) string { return "k2" + strings.TrimPrefix(token, "k1") }, err: ErrorTokenKeyIsUnknown},
+		{name: "forged payload", tamper: forgePayload, err: ErrorTokenSignature},
+		{name: "forged signature", tamper: func(token string) string { return token[:len(token)-2] + "AA" }, err: ErrorTokenSignature},
+	}
+	tm := newTestTokenManager(t, filepath.Join(t.TempDir(), "upload"), key)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenInfo := valid
+			if test.modify != nil {
+				test.modify(&tokenInfo)
+			}
+			token := issue(t, tm, tokenInfo)
+			if test.tamper != nil {
+				token = test.tamper(token)
+			}
+			tokenType := test.tokenType
+			if tokenType == "" {
+				tokenType = "upload"
+			}
+			a := test.access
+			if a.Method == "" {
+				a = access
+			}
+
+			got, err := tm.GetTokenInfo(token, tokenType, a)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && (got.Path != tokenInfo.Path || !got.ExpireTime.Equal(tokenInfo.ExpireTime)) {
+				t.Fatalf("got token info %+v, want %+v", got, tokenInfo)
+			}
+		})
+	}
+}
+
+//forgePayload replaces the payload of the token with the one granting another path, keeping the signature
+func forgePayload(token string) string {
+	parts := strings.Split(token, ".")
+	data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var tokenInfo TokenInfo
+	json.Unmarshal(data, &tokenInfo)
+	tokenInfo.Path = "bucket/other"
+	data, _ = json.Marshal(tokenInfo)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(data) + "." + parts[2]
+}
+
+func TestDefaultExpiry(t *testing.T) {
+	tm := newTestTokenManager(t, filepath.Join(t.TempDir(), "upload"), c.TokenKey{ID: "k1", Secret: "secret"})
+	tokenInfo, err := tm.Inspect(issue(t, tm, TokenInfo{Type: "download", Node: "one"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(tokenInfo.ExpireTime); lifetime <= 0 || lifetime > defaultTokenTTL {
+		t.Fatalf("got token lifetime %v, want up to %v", lifetime, defaultTokenTTL)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := c.TokenKey{ID: "old", Secret: "old secret"}
+	newKey := c.TokenKey{ID: "new", Secret: "new secret"}
+	tokenInfo := TokenInfo{Type: "download", Node: "one", ExpireTime: time.Now().Add(time.Hour)}
+	access := Access{Method: "GET"}
+
+	tm := newTestTokenManager(t, filepath.Join(t.TempDir(), "upload"), oldKey)
+	oldToken := issue(t, tm, tokenInfo)
+
+	tests := []struct {
+		name string
+		keys []c.TokenKey
+		//signer is ID of the key new tokens are signed with
+		signer string
+		//err is what the token signed with the old key gets
+		err error
+	}{
+		{name: "before rotation", keys: []c.TokenKey{oldKey}, signer: "old"},
+		{name: "new key added", keys: []c.TokenKey{newKey, oldKey}, signer: "new"},
+		{name: "old key removed", keys: []c.TokenKey{newKey}, signer: "new", err: ErrorTokenKeyIsUnknown},
+		{name: "old secret changed", keys: []c.TokenKey{newKey, {ID: "old", Secret: "leaked"}}, signer: "new", err: ErrorTokenSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tm.config.TokenKeys = test.keys
+			if _, err := tm.GetTokenInfo(oldToken, "download", access); err != test.err {
+				t.Fatalf("got error %v of old token, want %v", err, test.err)
+			}
+			newToken := issue(t, tm, tokenInfo)
+			if !strings.HasPrefix(newToken, test.signer+".") {
+				t.Fatalf("got token %s, want token signed with key %s", newToken, test.signer)
+			}
+			if _, err := tm.GetTokenInfo(newToken, "download", access); err != nil {
+				t.Fatalf("got error %v of new token", err)
+			}
+		})
+	}
+}
+
+func TestListenChecksKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []c.TokenKey
+		err  error
+	}{
+		{name: "no keys", err: ErrorNoTokenKey},
+		{name: "empty ID", keys: []c.TokenKey{{ID: "", Secret: "secret"}}, err: ErrorBadTokenKeyID},
+		{name: "ID with dot", keys: []c.TokenKey{{ID: "k.1", Secret: "secret"}}, err: ErrorBadTokenKeyID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &c.Config{UploadDir: filepath.Join(t.TempDir(), "upload"), TokenKeys: test.keys}
+			tm := &TokenManager{}
+			tm.UseConfig(config)
+			if err := tm.Listen(&node.NodeManager{}, &status.StatusManager{}); err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMaxUses(t *testing.T) {
+	key := c.TokenKey{ID: "k1", Secret: "secret"}
+	uploadDir := filepath.Join(t.TempDir(), "upload")
+	tm := newTestTokenManager(t, uploadDir, key)
+	token := issue(t, tm, TokenInfo{Type: "upload", Node: "one", MaxUses: 2, ExpireTime: time.Now().Add(time.Hour)})
+
+	steps := []struct {
+		method string
+		err    error
+	}{
+		{method: "HEAD"},
+		{method: "PUT"},
+		{method: "HEAD"},
+		{method: "PUT"},
+		{method: "HEAD", err: ErrorTokenUsedUp},
+		{method: "PUT", err: ErrorTokenUsedUp},
+	}
+	for i, step := range steps {
+		if _, err := tm.GetTokenInfo(token, "upload", Access{Method: step.method}); err != step.err {
+			t.Fatalf("step %d: got error %v of %s, want %v", i, err, step.method, step.err)
+		}
+	}
+
+	//Uses are saved, so the node does not accept the token again after restart
+	restarted := newTestTokenManager(t, uploadDir, key)
+	if _, err := restarted.GetTokenInfo(token, "upload", Access{Method: "PUT"}); err != ErrorTokenUsedUp {
+		t.Fatalf("got error %v after restart, want %v", err, ErrorTokenUsedUp)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	file := []byte("0123456789")
+	tests := []struct {
+		name    string
+		maxUses int
+		//reads are offset and length of ranges read with the token, -1 length reads till the end
+		reads [][2]int64
+		//failed is the index of the read refused with ErrorTokenUsedUp, -1 if all succeed
+		failed int
+		usedUp bool
+	}{
+		{name: "single download", maxUses: 1, reads: [][2]int64{{0, -1}}, failed: -1, usedUp: true},
+		{name: "resumed download", maxUses: 1, reads: [][2]int64{{0, 4}, {4, -1}}, failed: -1, usedUp: true},
+		{name: "ranges within budget", maxUses: 1, reads: [][2]int64{{0, 3}, {5, 3}}, failed: -1},
+		{name: "second download over budget", maxUses: 1, reads: [][2]int64{{0, -1}, {0, -1}}, failed: 1, usedUp: true},
+		{name: "two downloads", maxUses: 2, reads: [][2]int64{{0, -1}, {0, -1}}, failed: -1, usedUp: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tm := newTestTokenManager(t, filepath.Join(t.TempDir(), "upload"), c.TokenKey{ID: "k1", Secret: "secret"})
+			token := issue(t, tm, TokenInfo{
+				Type:       "download",
+				Node:       "one",
+				MaxSize:    int64(len(file)),
+				MaxUses:    test.maxUses,
+				ExpireTime: time.Now().Add(time.Hour),
+			})
+			for i, read := range test.reads {
+				if _, err := tm.GetTokenInfo(token, "download", Access{Method: "GET"}); err != nil {
+					if i == test.failed && err == ErrorTokenUsedUp {
+						break
+					}
+					t.Fatalf("read %d: got error %v", i, err)
+				}
+				r := tm.Meter(token, bytes.NewReader(file))
+				r.Seek(read[0], 0)
+				length := read[1]
+				if length < 0 {
+					length = int64(len(file)) - read[0]
+				}
+				data, err := ioutil.ReadAll(io.LimitReader(r, length))
+				if i == test.failed {
+					if err != ErrorTokenUsedUp {
+						t.Fatalf("read %d: got error %v, want %v", i, err, ErrorTokenUsedUp)
+					}
+					break
+				}
+				if err != nil || !bytes.Equal(data, file[read[0]:read[0]+length]) {
+					t.Fatalf("read %d: got %q, %v", i, data, err)
+				}
+			}
+
+			_, err := tm.GetTokenInfo(token, "download", Access{Method: "HEAD"})
+			if usedUp := err == ErrorTokenUsedUp; usedUp != test.usedUp {
+				t.Fatalf("got error %v after reads, want used up %v", err, test.usedUp)
+			}
+		})
+	}
+}
+
+func TestDeleteOptions(t *testing.T) {
+	tm := newTestTokenManager(t, filepath.Join(t.TempDir(), "upload"), c.TokenKey{ID: "k1", Secret: "secret"})
+	tm.config.Tokens.DownloadMethods = []string{"GET"}
+	tests := []struct {
+		name      string
+		requested TokenOptions
+		methods   []string
+		err       error
+	}{
+		{name: "defaults", methods: []string{"DELETE", "POST"}},
+		{name: "narrowed methods", requested: TokenOptions{Methods: []string{"DELETE"}}, methods: []string{"DELETE"}},
+		{name: "transfer method", requested: TokenOptions{Methods: []string{"GET"}}, err: ErrorMethodIsNotAllowed},
+		{name: "several uses", requested: TokenOptions{MaxUses: 2}, err: ErrorTooManyUses},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := tm.Options("bucket", "delete", test.requested)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && (options.MaxUses != 1 || strings.Join(options.Methods, ",") != strings.Join(test.methods, ",")) {
+				t.Fatalf("got options %+v, want methods %v used once", options, test.methods)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	rs "dfs/server/resumable"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Resumable uploads follow the tus 1.0 protocol: POST to TusURL + upload token creates the upload,
+//HEAD on its location returns the offset, PATCH appends the chunk at the offset and DELETE terminates it.
+const (
+	TusURL         = "/tus/"
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+var (
+	ErrorTusVersion           = errors.New("Tus protocol version is not supported.")
+	ErrorTusContentType       = errors.New("Chunk must be sent as " + tusContentType + ".")
+	ErrorTusUploadLength      = errors.New("Upload-Length must be set to the size of the file.")
+	ErrorTusUploadOffset      = errors.New("Upload-Offset must be set to the offset of the chunk.")
+	ErrorTusMetadataMalformed = errors.New("Upload-Metadata is malformed.")
+)
+
+//tus serves resumable uploads. The upload is identified by the path after TusURL,
+//it is the upload token on creation and the ID of the created upload afterwards.
+func tus(response http.ResponseWriter, request *http.Request) {
+	header := response.Header()
+	header.Set("Tus-Resumable", tusVersion)
+	//Clients that can not send PATCH or DELETE override POST
+	if method := request.Header.Get("X-HTTP-Method-Override"); method != "" {
+		request.Method = method
+	}
+
+	if request.Method == http.MethodOptions {
+		header.Set("Tus-Version", tusVersion)
+		header.Set("Tus-Extension", tusExtensions)
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if request.Header.Get("Tus-Resumable") != tusVersion {
+		header.Set("Tus-Version", tusVersion)
+		writeError(response, request, ErrorTusVersion)
+		return
+	}
+
+	id := strings.TrimPrefix(request.URL.Path, TusURL)
+	switch request.Method {
+	case http.MethodPost:
+		tusCreate(response, request, id)
+	case http.MethodHead:
+		tusOffset(response, request, id)
+	case http.MethodPatch:
+		tusPatch(response, request, id)
+	case http.MethodDelete:
+		err := server.TerminateResumableUpload(id)
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		header.Set("Allow", "OPTIONS, POST, HEAD, PATCH, DELETE")
+		writeError(response, request, ErrorMethodNotAllowed)
+	}
+}
+
+//tusCreate starts the upload with the token, the first chunk may come in the body of the request
+func tusCreate(response http.ResponseWriter, request *http.Request, token string) {
+	length, err := strconv.ParseInt(request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(response, request, ErrorTusUploadLength)
+		return
+	}
+	metadata := request.Header.Get("Upload-Metadata")
+	fields, err := parseTusMetadata(metadata)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	access := tokenAccess(request)
+	access.ContentType = fields["filetype"]
+	session, err := server.CreateResumableUpload(request.Context(), token, access, length, metadata)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+
+	id := session.ID
+	header := response.Header()
+	header.Set("Location", "http://"+request.Host+TusURL+id)
+	if request.Header.Get("Content-Type") == tusContentType {
+		session, _, err = server.WriteResumableUpload(request.Context(), id, 0, request.Body)
+		if err != nil && err != rs.ErrorUploadLengthExceeded {
+			//Upload is created anyway if the body broke, the client resumes it from the offset
+			if current, currentErr := server.ResumableUpload(id); currentErr == nil {
+				session, err = current, nil
+			}
+		}
+		if err != nil {
+			writeError(response, request, err)
+			return
+		}
+		header.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	}
+	header.Set("Upload-Expires", session.Expires.UTC().Format(http.TimeFormat))
+	response.WriteHeader(http.StatusCreated)
+}
+
+//tusOffset tells the client where to resume the upload from
+func tusOffset(response http.ResponseWriter, request *http.Request, id string) {
+	session, err := server.ResumableUpload(id)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	header := response.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	header.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	header.Set("Upload-Expires", session.Expires.UTC().Format(http.TimeFormat))
+	if session.Metadata != "" {
+		header.Set("Upload-Metadata", session.Metadata)
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+//tusPatch appends the chunk, the file is published once the last chunk is received
+func tusPatch(response http.ResponseWriter, request *http.Request, id string) {
+	if request.Header.Get("Content-Type") != tusContentType {
+		writeError(response, request, ErrorTusContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(response, request, ErrorTusUploadOffset)
+		return
+	}
+
+	session, _, err := server.WriteResumableUpload(request.Context(), id, offset, request.Body)
+	if err != nil {
+		writeError(response, request, err)
+		return
+	}
+	header := response.Header()
+	header.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if session.Offset < session.Length {
+		header.Set("Upload-Expires", session.Expires.UTC().Format(http.TimeFormat))
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+//parseTusMetadata decodes comma separated pairs of keys and base64 values, values may be omitted
+func parseTusMetadata(metadata string) (map[string]string, error) {
+	fields := make(map[string]string, 0)
+	if strings.TrimSpace(metadata) == "" {
+		return fields, nil
+	}
+	for _, pair := range strings.Split(metadata, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, ErrorTusMetadataMalformed
+		}
+		value := []byte{}
+		if len(parts) == 2 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, ErrorTusMetadataMalformed
+			}
+		}
+		fields[parts[0]] = string(value)
+	}
+	return fields, nil
+}
+
+//tusLink returns the URL resumable upload with the token is created at
+func tusLink(address, token string) string {
+	return "http://" + address + TusURL + token
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		fields   map[string]string
+		err      error
+	}{
+		{name: "empty", metadata: "", fields: map[string]string{}},
+		{name: "pairs", metadata: "filename d29ybGQucG5n,filetype aW1hZ2UvcG5n", fields: map[string]string{"filename": "world.png", "filetype": "image/png"}},
+		{name: "key without value", metadata: "is_confidential,filename ZmlsZQ==", fields: map[string]string{"is_confidential": "", "filename": "file"}},
+		{name: "value is not base64", metadata: "filename file.txt", err: ErrorTusMetadataMalformed},
+		{name: "too many parts", metadata: "filename ZmlsZQ== ZmlsZQ==", err: ErrorTusMetadataMalformed},
+		{name: "empty pair", metadata: "filename ZmlsZQ==,,", err: ErrorTusMetadataMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, err := parseTusMetadata(test.metadata)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if len(fields) != len(test.fields) {
+				t.Fatalf("got fields %v, want %v", fields, test.fields)
+			}
+			for key, value := range test.fields {
+				if fields[key] != value {
+					t.Fatalf("got fields %v, want %v", fields, test.fields)
+				}
+			}
+		})
+	}
+}
+
+//TestTusProtocol checks the requests that are answered before the upload is looked up
+func TestTusProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		header  map[string]string
+		status  int
+		version string
+	}{
+		{name: "options", method: http.MethodOptions, status: http.StatusNoContent, version: tusVersion},
+		{name: "no version", method: http.MethodHead, status: http.StatusPreconditionFailed, version: tusVersion},
+		{name: "other version", method: http.MethodPatch, header: map[string]string{"Tus-Resumable": "0.2.2"}, status: http.StatusPreconditionFailed, version: tusVersion},
+		{name: "bad upload length", method: http.MethodPost, header: map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "-1"}, status: http.StatusBadRequest},
+		{name: "patch of other content type", method: http.MethodPatch, header: map[string]string{"Tus-Resumable": tusVersion, "Content-Type": "text/plain"}, status: http.StatusUnsupportedMediaType},
+		{name: "patch without offset", method: http.MethodPatch, header: map[string]string{"Tus-Resumable": tusVersion, "Content-Type": tusContentType}, status: http.StatusBadRequest},
+		{name: "overridden method", method: http.MethodPost, header: map[string]string{"Tus-Resumable": tusVersion, "X-HTTP-Method-Override": "GET"}, status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, TusURL+"upload", nil)
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+			response := httptest.NewRecorder()
+			tus(response, request)
+
+			if response.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", response.Code, test.status, response.Body.String())
+			}
+			if response.Header().Get("Tus-Resumable") != tusVersion {
+				t.Fatalf("got Tus-Resumable %q, want %s", response.Header().Get("Tus-Resumable"), tusVersion)
+			}
+			if version := response.Header().Get("Tus-Version"); version != test.version {
+				t.Fatalf("got Tus-Version %q, want %q", version, test.version)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -11,20 +12,50 @@ var (
 )
 
 func ExtractBucketNameFileName(request *http.Request) (bucketName string, fileName string, err error) {
-	parts := strings.Split(request.URL.Path[1:], "/")
-	if len(parts) != 3 {
+	parts := strings.SplitN(request.URL.Path[1:], "/", 2)
+	if len(parts) != 2 {
 		return "", "", ErrorBadQuery
 	}
+	return ParseBucketNameFileName(parts[1])
+}
 
-	if !IsValidName(parts[1]) {
+//ParseBucketNameFileName splits "{bucket}/{file}" into names of the bucket and the file
+func ParseBucketNameFileName(s string) (bucketName string, fileName string, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return "", "", ErrorBadQuery
+	}
+
+	if !IsValidName(parts[0]) {
 		return "", "", ErrorBadQuery
 	}
 
-	if !IsValidName(parts[2]) {
+	if !IsValidName(parts[1]) {
 		return "", "", ErrorBadQuery
 	}
 
-	return parts[1], parts[2], nil
+	return parts[0], parts[1], nil
+}
+
+//ExtractBucketName returns bucket name of /handler/{bucket}/ queries or empty string for /handler/
+func ExtractBucketName(request *http.Request) (bucketName string, err error) {
+	parts := strings.SplitN(request.URL.Path[1:], "/", 2)
+	if len(parts) == 1 {
+		return "", nil
+	}
+	return ParseBucketName(parts[1])
+}
+
+//ParseBucketName returns bucket name of "{bucket}/" or empty string for ""
+func ParseBucketName(s string) (bucketName string, err error) {
+	s = strings.TrimSuffix(s, "/")
+	if s == "" {
+		return "", nil
+	}
+	if strings.Contains(s, "/") || !IsValidName(s) {
+		return "", ErrorBadQuery
+	}
+	return s, nil
 }
 
 func ExtractToken(request *http.Request) (token string, err error) {
@@ -32,13 +63,47 @@ func ExtractToken(request *http.Request) (token string, err error) {
 	if len(parts) != 2 {
 		return "", ErrorBadQuery
 	}
-	if !IsValidName(parts[1]) {
+	if !IsValidToken(parts[1]) {
 		return "", ErrorBadQuery
 	}
 	return parts[1], nil
 }
 
+//ExtractBearerToken returns token of the "Authorization: Bearer" header or empty string
+func ExtractBearerToken(request *http.Request) string {
+	const prefix = "Bearer "
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len(prefix):])
+}
+
+//ClientIP returns address of the client the request came from
+func ClientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+//IsValidToken reports whether s consists of the characters of signed tokens: names and base64url
+func IsValidToken(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '.' && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+//IsValidName reports whether s may be a name of a bucket, a file or a node.
+//"." and ".." are not valid, so the name never refers to another directory.
 func IsValidName(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
 	for _, r := range s {
 		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '.' && r != '-' {
 			return false
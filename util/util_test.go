@@ -0,0 +1,53 @@
+package util
+
+import "testing"
+
+func TestParseBucketNameFileName(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		bucketName string
+		fileName   string
+		err        error
+	}{
+		{name: "valid", path: "bucket/file.txt", bucketName: "bucket", fileName: "file.txt"},
+		{name: "empty", path: "", err: ErrorBadQuery},
+		{name: "no file", path: "bucket/", err: ErrorBadQuery},
+		{name: "no bucket", path: "/file", err: ErrorBadQuery},
+		{name: "current directory as file", path: "bucket/.", err: ErrorBadQuery},
+		{name: "parent directory as file", path: "bucket/..", err: ErrorBadQuery},
+		{name: "parent directory as bucket", path: "../file", err: ErrorBadQuery},
+		{name: "nested file", path: "bucket/dir/file", err: ErrorBadQuery},
+		{name: "invalid character", path: "bucket/file name", err: ErrorBadQuery},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucketName, fileName, err := ParseBucketNameFileName(test.path)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if bucketName != test.bucketName || fileName != test.fileName {
+				t.Fatalf("got %q, %q, want %q, %q", bucketName, fileName, test.bucketName, test.fileName)
+			}
+		})
+	}
+}
+
+func TestParseBucketName(t *testing.T) {
+	tests := []struct {
+		path       string
+		bucketName string
+		err        error
+	}{
+		{path: "", bucketName: ""},
+		{path: "bucket/", bucketName: "bucket"},
+		{path: "./", err: ErrorBadQuery},
+		{path: "..", err: ErrorBadQuery},
+	}
+	for _, test := range tests {
+		bucketName, err := ParseBucketName(test.path)
+		if bucketName != test.bucketName || err != test.err {
+			t.Fatalf("%q: got %q, %v, want %q, %v", test.path, bucketName, err, test.bucketName, test.err)
+		}
+	}
+}